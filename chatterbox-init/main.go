@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/andres-erbsen/chatterbox/client/daemon"
 )
@@ -36,8 +37,11 @@ func main() {
 	flag.Var((*hex32Byte)(&serverTransportPubkey), "server-pubkey", "The TCP port which the server listens on. Note that people sending you mesages expct to be able to reach your home server at port 1984.")
 	serverAddress := flag.String("server-host", "chatterbox.xvm.mit.edu", "The IP address or hostname on which your (prospective) home server server can be reached")
 	serverPort := flag.Int("server-port", 1984, "The TCP port which the server listens on.")
+	serverOnion := flag.String("server-onion", "", "The .onion address of the Tor onion service of your home server, if it has one. It is used instead of server-host when connecting through Tor.")
+	serverReplicas := flag.String("server-replicas", "", "Comma-separated host:port addresses of replicas of your home server, which are tried in order if it can not be reached.")
 	dir := flag.String("account-directory", "", "Dedicated directory for the account.")
-	torAddress := flag.String("tor-address", "127.0.0.1:9050", "Address of the local TOR proxy.")
+	torAddress := flag.String("tor-address", "127.0.0.1:9050", "Address of the local TOR proxy. If empty, servers are contacted directly, which reveals your IP address to them.")
+	postQuantum := flag.Bool("post-quantum", false, "Also protect messages and connections against future quantum computers (uses more bandwidth).")
 	flag.Parse()
 
 	if *dename == "" || serverTransportPubkey == [32]byte{} || *serverAddress == "" {
@@ -48,7 +52,12 @@ func main() {
 		*dir = filepath.Join(os.Getenv("HOME"), ".chatterbox", *dename)
 	}
 
-	if err := daemon.Init(*dir, *dename, *serverAddress, *serverPort, &serverTransportPubkey, *torAddress); err != nil {
+	var replicas []string
+	if *serverReplicas != "" {
+		replicas = strings.Split(*serverReplicas, ",")
+	}
+
+	if err := daemon.Init(*dir, *dename, *serverAddress, *serverOnion, *serverPort, replicas, &serverTransportPubkey, *torAddress, *postQuantum); err != nil {
 		log.Fatal(err)
 	}
 	fmt.Printf("Account initialization done.\n"+
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+var root = flag.String("root", "", "chatterbox root directory")
+var conversation = flag.String("conversation", "", "name of the conversation directory")
+
+var actions = map[string]proto.MembershipChange_Action{
+	"add":    proto.MembershipChange_ADD,
+	"remove": proto.MembershipChange_REMOVE,
+	"leave":  proto.MembershipChange_LEAVE,
+}
+
+func main() {
+	flag.Parse()
+	p := &persistence.Paths{
+		RootDir:     *root,
+		Application: "chat-members",
+	}
+	if *root == "" || *conversation == "" {
+		flag.Usage()
+		log.Fatal("no root or conversation specified")
+	}
+	if flag.NArg() < 1 {
+		log.Fatal("usage: chatterbox-members -root=... -conversation=... add|remove|leave [names...]")
+	}
+	action, ok := actions[flag.Arg(0)]
+	if !ok {
+		log.Fatalf("unknown action %q", flag.Arg(0))
+	}
+
+	message := &proto.Message{
+		MembershipChange: &proto.MembershipChange{
+			Action:  action,
+			Members: flag.Args()[1:],
+		},
+	}
+	if err := p.ControlToOutbox(*conversation, message); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -12,7 +13,9 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/andres-erbsen/chatterbox/client"
 	"github.com/andres-erbsen/chatterbox/client/persistence"
 	"github.com/andres-erbsen/chatterbox/proto"
 	"github.com/russross/blackfriday"
@@ -137,6 +140,11 @@ func renderToHTML(msg *persistence.Message) string {
 	body = regexp.MustCompile("</p>\\s*<p>").ReplaceAllString(body, "<br><br>")
 	body = strings.Replace(body, "<p>", "", -1)
 	body = strings.Replace(body, "</p>", "", -1)
+	if msg.Sender == persistence.SystemSender {
+		// messages from the daemon are about the security of the
+		// conversation and must not be overlooked
+		return "<font color=\"red\"><b>" + body + "</b></font>"
+	}
 	return "<u>" + html.EscapeString(msg.Sender) + "</u>: " + body
 }
 
@@ -167,6 +175,21 @@ func (g *gui) openConversation(idx int) error {
 			log.Fatal(err)
 		}
 	})
+	window.On("showSafetyNumbers", func() {
+		account := new(proto.LocalAccount)
+		if err := persistence.UnmarshalFromFile(g.AccountPath(), account); err != nil {
+			log.Printf("error reading account: %s\n", err)
+			return
+		}
+		for _, name := range conv.Participants {
+			if name == account.Dename {
+				continue
+			}
+			if err := g.showSafetyNumber(name); err != nil {
+				log.Printf("error showing safety number with %s: %s\n", name, err)
+			}
+		}
+	})
 
 	//TODO: if an open conversation is selected again, focus that window
 
@@ -183,6 +206,49 @@ func (g *gui) openConversation(idx int) error {
 	return nil
 }
 
+// showSafetyNumber opens a window for comparing the safety number with
+// contact and marking the contact as verified.
+func (g *gui) showSafetyNumber(contact string) error {
+	safetyNumber, fingerprint, err := client.ContactSafetyNumber(&g.Paths, contact)
+	if err != nil {
+		return err
+	}
+	code, err := client.SafetyNumberQR(safetyNumber)
+	if err != nil {
+		return err
+	}
+
+	controls, err := g.engine.LoadFile("qrc:///qml/safety-number.qml")
+	if err != nil {
+		return err
+	}
+	window := controls.CreateWindow(nil)
+	window.Set("contact", contact)
+	window.Set("safetyNumber", safetyNumber)
+	window.Set("qrCode", "data:image/png;base64,"+base64.StdEncoding.EncodeToString(code.PNG()))
+	showStatus := func() {
+		verification, err := g.ContactVerification(contact)
+		if err != nil {
+			log.Printf("error reading verification of %s: %s\n", contact, err)
+		}
+		status := client.VerificationStatus(verification, fingerprint)
+		window.Set("status", status)
+		window.Set("warning", status == client.VerifiedKeysChanged)
+	}
+	showStatus()
+
+	window.ObjectByName("markVerified").On("triggered", func() {
+		if err := g.StoreContactVerification(contact, &proto.ContactVerification{
+			Fingerprint: (proto.Byte32)(*fingerprint),
+			Date:        time.Now().UnixNano(),
+		}); err != nil {
+			log.Printf("error storing verification of %s: %s\n", contact, err)
+		}
+		showStatus()
+	})
+	return nil
+}
+
 func (g *gui) run() error {
 	defer close(g.stop)
 	g.engine = qml.NewEngine()
@@ -19,6 +19,20 @@ ApplicationWindow {
 		}
 	}
 
+	signal showSafetyNumbers()
+	Action {
+		id: showSafetyNumbers
+		text: "Safety &Numbers"
+		shortcut: "Ctrl+Shift+N"
+		onTriggered: conversationWindow.showSafetyNumbers()
+	}
+
+	toolBar: ToolBar {
+		RowLayout {
+			ToolButton {action: showSafetyNumbers}
+		}
+	}
+
 	SplitView {
         id: mainLayout
 		anchors.fill: parent
@@ -0,0 +1,74 @@
+import QtQuick 2.2
+import QtQuick.Controls 1.1
+import QtQuick.Layouts 1.1
+
+
+ApplicationWindow {
+	id: safetyNumberWindow
+    visible: true
+    title: "Safety Number"
+    property int margin: 5
+    width: mainLayout.implicitWidth + 2 * margin
+    height: mainLayout.implicitHeight + 2 * margin
+
+	property string contact
+	property string safetyNumber
+	property string qrCode
+	property string status
+	property bool warning: false
+
+	Action {
+		id: markVerified
+		objectName: "markVerified"
+		text: "Mark as &Verified"
+	}
+
+	Action {
+		id: closeWindow
+		text: "&Close"
+		shortcut: "Escape"
+		onTriggered: safetyNumberWindow.close()
+	}
+
+    ColumnLayout {
+        id: mainLayout
+        anchors.fill: parent
+        anchors.margins: margin
+
+		Text {
+			text: "Compare this number with " + contact + " in person or over a channel you trust. " +
+				"If the numbers match, nobody is impersonating either of you."
+			wrapMode: Text.Wrap
+			Layout.maximumWidth: 400
+		}
+
+		TextEdit {
+			objectName: "safetyNumber"
+			text: safetyNumber
+			font.family: "monospace"
+			font.pointSize: 14
+			wrapMode: TextEdit.Wrap
+			readOnly: true
+			selectByMouse: true
+			Layout.maximumWidth: 400
+		}
+
+		Image {
+			source: qrCode
+			visible: qrCode != ""
+			smooth: false
+			Layout.alignment: Qt.AlignHCenter
+		}
+
+		Text {
+			text: contact + ": " + status
+			color: warning ? "red" : "black"
+			font.bold: warning
+		}
+
+		RowLayout {
+			Button {action: markVerified}
+			Button {action: closeWindow}
+		}
+    }
+}
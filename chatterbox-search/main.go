@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+)
+
+var root = flag.String("root", "", "chatterbox root directory")
+
+func main() {
+	flag.Parse()
+	p := &persistence.Paths{
+		RootDir:     *root,
+		Application: "chat-search",
+	}
+	if *root == "" || flag.NArg() == 0 {
+		flag.Usage()
+		log.Fatal("no root or query specified")
+	}
+
+	results, err := p.Search(strings.Join(flag.Args(), " "))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range results {
+		fmt.Printf("%s\t%s\t%s\t%s\n", r.Conversation, r.Sender, r.Date.Format(time.RFC3339), r.Path)
+	}
+}
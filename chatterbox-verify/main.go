@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	dename "github.com/andres-erbsen/dename/protocol"
+	"rsc.io/qr"
+)
+
+var root = flag.String("root", "", "chatterbox root directory")
+var showQR = flag.Bool("qr", false, "also print the safety number as a QR code")
+var verify = flag.Bool("verify", false, "mark the contact as verified after comparing safety numbers")
+var unverify = flag.Bool("unverify", false, "forget that the contact was verified")
+var showHistory = flag.Bool("history", false, "list all profiles of the contact that the daemon has used")
+
+// printQR draws a QR code on the terminal, two rows of the code per line of
+// text, with a margin of light modules around it.
+func printQR(code *qr.Code) {
+	const margin = 2
+	blocks := [2][2]string{{"█", "▀"}, {"▄", " "}}
+	for y := -margin; y < code.Size+margin; y += 2 {
+		line := ""
+		for x := -margin; x < code.Size+margin; x++ {
+			top, bottom := 0, 0
+			if code.Black(x, y) {
+				top = 1
+			}
+			if code.Black(x, y+1) {
+				bottom = 1
+			}
+			line += blocks[top][bottom]
+		}
+		fmt.Println(line)
+	}
+}
+
+// printHistory lists the profiles of contact that the daemon has used, one
+// per line: when the daemon first used it, its version, the fingerprint of
+// the keys in it and the server it points to.
+func printHistory(p *persistence.Paths, contact string) {
+	history, err := p.ProfileHistory(contact)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, entry := range history.Profiles {
+		profile := new(dename.Profile)
+		if err := profile.Unmarshal(entry.Profile); err != nil {
+			log.Fatal(err)
+		}
+		date := time.Unix(0, entry.Date).Format(time.RFC3339)
+		chatProfile, err := client.ChatProfile(profile)
+		if err != nil {
+			fmt.Printf("%s\t%d\t%s\n", date, entry.Version, err)
+			continue
+		}
+		fingerprint := client.ProfileFingerprint(contact, chatProfile)
+		fmt.Printf("%s\t%d\t%s\t%s:%d\n", date, entry.Version, hex.EncodeToString(fingerprint[:8]),
+			chatProfile.ServerAddressTCP, chatProfile.ServerPortTCP)
+	}
+}
+
+func main() {
+	flag.Parse()
+	p := &persistence.Paths{
+		RootDir:     *root,
+		Application: "chat-verify",
+	}
+	if *root == "" || flag.NArg() != 1 {
+		flag.Usage()
+		log.Fatal("usage: chatterbox-verify -root=... [-qr] [-verify|-unverify] contact")
+	}
+	if *verify && *unverify {
+		log.Fatal("-verify and -unverify are mutually exclusive")
+	}
+	contact := flag.Arg(0)
+
+	safetyNumber, fingerprint, err := client.ContactSafetyNumber(p, contact)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case *verify:
+		if err := p.StoreContactVerification(contact, &proto.ContactVerification{
+			Fingerprint: (proto.Byte32)(*fingerprint),
+			Date:        time.Now().UnixNano(),
+		}); err != nil {
+			log.Fatal(err)
+		}
+	case *unverify:
+		if err := p.StoreContactVerification(contact, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+	verification, err := p.ContactVerification(contact)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(safetyNumber)
+	fmt.Printf("%s: %s\n", contact, client.VerificationStatus(verification, fingerprint))
+	if *showQR {
+		code, err := client.SafetyNumberQR(safetyNumber)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printQR(code)
+	}
+	if *showHistory {
+		printHistory(p, contact)
+	}
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"bytes"
+	"crypto/mlkem"
+	"github.com/agl/ed25519"
 	"golang.org/x/crypto/nacl/box"
 	protobuf "golang.org/x/oprotobuf/proto"
 	"crypto/rand"
@@ -128,3 +130,148 @@ func createNewUser(name string, t *testing.T, config *client.Config) (*[32]byte,
 
 	return skAuth, newClient
 }
+
+func TestFirstMessagePrekeyID(t *testing.T) {
+	pkAuth, skAuth, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatProfile := &proto.Profile{MessageAuthKey: (proto.Byte32)(*pkAuth)}
+	chatProfileBytes, err := chatProfile.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, _, err := client.NewProfile(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetProfileField(profile, PROFILE_FIELD_ID, chatProfileBytes)
+	prt := func(string, *dename.ClientReply) (*dename.Profile, error) { return profile, nil }
+
+	var pkList, skList []*[32]byte
+	for i := 0; i < 3; i++ {
+		pk, sk, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkList, skList = append(pkList, pk), append(skList, sk)
+	}
+	msg, err := protobuf.Marshal(&proto.Message{Contents: []byte("Message"), Dename: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// older versions send the whole prekey
+	for _, shortID := range []bool{false, true} {
+		envelope, _, err := EncryptAuthFirst(msg, skAuth, pkList[2], nil, shortID, prt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(envelope) != proto.MAX_MESSAGE_SIZE {
+			t.Errorf("first message length %d, want %d", len(envelope), proto.MAX_MESSAGE_SIZE)
+		}
+		_, msg2, index, err := DecryptAuthFirst(envelope, pkList, skList, nil, skAuth, prt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != 2 || !bytes.Equal(msg, msg2) {
+			t.Errorf("decrypted %q with prekey %d", msg2, index)
+		}
+	}
+	envelope, _, err := EncryptAuthFirst(msg, skAuth, pkList[2], nil, true, prt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := DecryptAuthFirst(envelope, pkList[:2], skList[:2], nil, skAuth, prt); err == nil {
+		t.Error("decrypted a message to an unknown prekey")
+	}
+	garbage := make([]byte, len(envelope))
+	rand.Read(garbage)
+	if _, _, _, err := DecryptAuthFirst(garbage, pkList, skList, nil, skAuth, prt); err == nil {
+		t.Error("decrypted garbage")
+	}
+}
+
+func TestHybridFirstMessage(t *testing.T) {
+	pkAuth, skAuth, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatProfile := &proto.Profile{MessageAuthKey: (proto.Byte32)(*pkAuth)}
+	chatProfileBytes, err := chatProfile.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, _, err := client.NewProfile(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetProfileField(profile, PROFILE_FIELD_ID, chatProfileBytes)
+	prt := func(string, *dename.ClientReply) (*dename.Profile, error) { return profile, nil }
+
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkList, skList, kemList := []*[32]byte{pk}, []*[32]byte{sk}, [][]byte{dk.Bytes()}
+	kemKey := dk.EncapsulationKey().Bytes()
+
+	msg, err := protobuf.Marshal(&proto.Message{Contents: []byte("Message"), Dename: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybrid, _, err := EncryptAuthFirst(msg, skAuth, pk, kemKey, true, prt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classical, _, err := EncryptAuthFirst(msg, skAuth, pk, nil, true, prt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hybrid) != len(classical) {
+		t.Errorf("hybrid first message length %d, classical %d", len(hybrid), len(classical))
+	}
+	for _, envelope := range [][]byte{hybrid, classical} {
+		if _, msg2, _, err := DecryptAuthFirst(envelope, pkList, skList, kemList, skAuth, prt); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(msg, msg2) {
+			t.Errorf("decrypted %q", msg2)
+		}
+	}
+	if _, _, _, err := DecryptAuthFirst(hybrid, pkList, skList, nil, skAuth, prt); err == nil {
+		t.Error("decrypted a hybrid first message without the KEM key")
+	}
+}
+
+func TestSignHybridKeys(t *testing.T) {
+	pkSig, skSig, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kemKey := dk.EncapsulationKey().Bytes()
+	signed := SignHybridKeys([]*[32]byte{pk}, [][]byte{kemKey}, skSig)[0]
+	if len(signed) != 32+64+HYBRID_PREKEY_ADDED_LEN {
+		t.Fatalf("signed hybrid prekey length %d", len(signed))
+	}
+	// clients that do not know about hybrid prekeys read only the start
+	if !bytes.Equal(signed[:32+64], SignKeys([]*[32]byte{pk}, skSig)[0]) {
+		t.Error("the classical part of a hybrid prekey differs from SignKeys")
+	}
+	var sig [64]byte
+	copy(sig[:], signed[32+64+len(kemKey):])
+	if !ed25519.Verify(pkSig, append(append([]byte{}, pk[:]...), kemKey...), &sig) {
+		t.Error("the KEM key is not signed")
+	}
+}
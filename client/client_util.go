@@ -1,7 +1,9 @@
 package client
 
 import (
+	"bytes"
 	"crypto/hmac"
+	"crypto/mlkem"
 	"crypto/sha256"
 	"crypto/subtle"
 	"errors"
@@ -22,6 +24,19 @@ import (
 const PROFILE_FIELD_ID = 1984
 const ENCRYPT_ADDED_LEN = 168
 const ENCRYPT_FIRST_ADDED_LEN = 200
+const ENCRYPT_FIRST_HYBRID_ADDED_LEN = ratchet.OverheadFirstHybrid
+
+// HYBRID_PREKEY_ADDED_LEN is the length of the part of a signed hybrid prekey
+// that comes after the signed Curve25519 prekey: an ML-KEM-768 encapsulation
+// key and a signature of both keys.
+const HYBRID_PREKEY_ADDED_LEN = mlkem.EncapsulationKeySize768 + ed25519.SignatureSize
+
+// PREKEY_ID_LEN is the length of the prefix of the prekey a first message is
+// encrypted to that is sent in front of the message, so that the recipient can
+// pick the right prekey secret without trying all of them. Recipients whose
+// profiles do not set ShortPrekeyIDs get the whole prekey instead, as older
+// versions sent it.
+const PREKEY_ID_LEN = 8
 
 type ProfileRatchet func(string, *dename.ClientReply) (*dename.Profile, error)
 
@@ -81,16 +96,46 @@ func SignKeys(keys []*[32]byte, sk *[64]byte) [][]byte {
 	return pkList
 }
 
-func EncryptAuthFirst(message []byte, skAuth *[32]byte, userKey *[32]byte, prt ProfileRatchet) ([]byte, *ratchet.Ratchet, error) {
+// SignHybridKeys is like SignKeys, but appends the ML-KEM-768 encapsulation
+// key of each prekey and a signature of both keys. Clients that do not know
+// about hybrid prekeys only look at the part that SignKeys would produce.
+func SignHybridKeys(keys []*[32]byte, kemKeys [][]byte, sk *[64]byte) [][]byte {
+	pkList := SignKeys(keys, sk)
+	for i, key := range keys {
+		signature := ed25519.Sign(sk, append(append([]byte{}, key[:]...), kemKeys[i]...))
+		pkList[i] = append(append(pkList[i], kemKeys[i]...), signature[:]...)
+	}
+	return pkList
+}
+
+// EncryptAuthFirst encrypts the first message of a session to userKey. If
+// kemKey is not nil, the ML-KEM-768 key of the prekey is used as well. Both
+// kinds of first messages have the same length. The prekey is identified by
+// its first PREKEY_ID_LEN bytes if shortID is set, and in full otherwise.
+func EncryptAuthFirst(message []byte, skAuth *[32]byte, userKey *[32]byte, kemKey []byte, shortID bool, prt ProfileRatchet) ([]byte, *ratchet.Ratchet, error) {
 	ratch := &ratchet.Ratchet{
 		FillAuth:  FillAuthWith(skAuth),
 		CheckAuth: CheckAuthWith(prt),
 	}
 
-	out := append([]byte{}, (*userKey)[:]...)
-	paddedMsg := proto.Pad(message, proto.MAX_MESSAGE_SIZE-ENCRYPT_FIRST_ADDED_LEN-len(out))
-	out = ratch.EncryptFirst(out, paddedMsg, userKey)
+	out := append([]byte{}, userKey[:]...)
+	if shortID {
+		out = out[:PREKEY_ID_LEN]
+	}
+	if kemKey == nil {
+		paddedMsg := proto.Pad(message, proto.MAX_MESSAGE_SIZE-ENCRYPT_FIRST_ADDED_LEN-len(out))
+		out = ratch.EncryptFirst(out, paddedMsg, userKey)
+		return out, ratch, nil
+	}
 
+	paddedLen := proto.MAX_MESSAGE_SIZE - ENCRYPT_FIRST_HYBRID_ADDED_LEN - len(out)
+	if len(message) >= paddedLen {
+		return nil, nil, errors.New("message too long for a hybrid first message")
+	}
+	out, err := ratch.EncryptFirstHybrid(out, proto.Pad(message, paddedLen), userKey, kemKey)
+	if err != nil {
+		return nil, nil, err
+	}
 	return out, ratch, nil
 }
 
@@ -101,21 +146,39 @@ func EncryptAuth(message []byte, ratch *ratchet.Ratchet) ([]byte, *ratchet.Ratch
 	return out, ratch, nil
 }
 
-func DecryptAuthFirst(in []byte, pkList []*[32]byte, skList []*[32]byte, skAuth *[32]byte, prt ProfileRatchet) (*ratchet.Ratchet, []byte, int, error) {
+// DecryptAuthFirst decrypts a first message encrypted to one of the prekeys
+// in pkList. kemList, if not nil, contains the seeds of the ML-KEM-768
+// decapsulation keys of hybrid prekeys (and nil for the others).
+func DecryptAuthFirst(in []byte, pkList []*[32]byte, skList []*[32]byte, kemList [][]byte, skAuth *[32]byte, prt ProfileRatchet) (*ratchet.Ratchet, []byte, int, error) {
 	ratch := &ratchet.Ratchet{
 		FillAuth:  FillAuthWith(skAuth),
 		CheckAuth: CheckAuthWith(prt),
 	}
 
-	if len(in) < 32 {
+	if len(in) < PREKEY_ID_LEN+ratchet.OverheadFirst {
 		return nil, nil, -1, errors.New("Message length incorrect.")
 	}
-	var pkAuth [32]byte
-	copy(pkAuth[:], in[:32])
+	prekeyID := in[:PREKEY_ID_LEN]
 
-	envelope := in[32:]
+	// garbage and messages that are not first messages are rejected here,
+	// before any public-key operations are performed
 	for i, pk := range pkList {
-		if *pk == pkAuth {
+		if !bytes.Equal(pk[:PREKEY_ID_LEN], prekeyID) {
+			continue
+		}
+		// senders that do not know about short prekey IDs send the whole key
+		envelopes := [][]byte{in[PREKEY_ID_LEN:]}
+		if len(in) >= len(pk)+ratchet.OverheadFirst && bytes.Equal(in[:len(pk)], pk[:]) {
+			envelopes = [][]byte{in[len(pk):], in[PREKEY_ID_LEN:]}
+		}
+		for _, envelope := range envelopes {
+			if kemList != nil && len(kemList[i]) != 0 {
+				if msg, err := ratch.DecryptFirstHybrid(envelope, skList[i], kemList[i]); err == nil {
+					return ratch, proto.Unpad(msg), i, nil
+				}
+				// senders that do not know about hybrid prekeys use
+				// only the Curve25519 part of them
+			}
 			msg, err := ratch.DecryptFirst(envelope, skList[i])
 			if err == nil {
 				unpadMsg := proto.Unpad(msg)
@@ -146,42 +209,67 @@ func DeleteMessages(connToServer *ConnectionToServer, messageList []*[32]byte) e
 	return err
 }
 
+// UploadKeys uploads signed prekeys to our server, in as many messages as
+// needed to keep each of them under MAX_MESSAGE_SIZE.
 func UploadKeys(connToServer *ConnectionToServer, keyList [][]byte) error {
-	uploadKeys := &proto.ClientToServer{
-		UploadSignedKeys: keyList,
-	}
-	if err := WriteProtobuf(connToServer.Conn, uploadKeys); err != nil {
-		return err
+	for len(keyList) > 0 {
+		n, size := 0, 0
+		for n < len(keyList) && (n == 0 || size+len(keyList[n])+8 <= proto.MAX_MESSAGE_SIZE) {
+			size += len(keyList[n]) + 8 // tag and length
+			n++
+		}
+		uploadKeys := &proto.ClientToServer{
+			UploadSignedKeys: keyList[:n],
+		}
+		if err := WriteProtobuf(connToServer.Conn, uploadKeys); err != nil {
+			return err
+		}
+		if _, err := ReceiveReply(connToServer); err != nil {
+			return err
+		}
+		keyList = keyList[n:]
 	}
-
-	_, err := ReceiveReply(connToServer)
-	return err
+	return nil
 }
 
-func GetKey(conn *transport.Conn, inBuf []byte, pk *[32]byte, dename string, pkSig *[32]byte) (*[32]byte, error) {
+// GetKey fetches a prekey of the user pk from their server. If it is a hybrid
+// prekey, its ML-KEM-768 encapsulation key is returned as well.
+func GetKey(conn *transport.Conn, inBuf []byte, pk *[32]byte, dename string, pkSig *[32]byte) (*[32]byte, []byte, error) {
 	getKey := &proto.ClientToServer{
 		GetSignedKey: (*proto.Byte32)(pk),
 	}
 	if err := WriteProtobuf(conn, getKey); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	response, err := ReceiveProtobuf(conn, inBuf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	signedKey := response.SignedKey
+	if len(signedKey) != 32+64 && len(signedKey) != 32+64+HYBRID_PREKEY_ADDED_LEN {
+		return nil, nil, errors.New("Signed key has wrong length")
 	}
 
 	var userKey [32]byte
-	copy(userKey[:], response.SignedKey[:32])
+	copy(userKey[:], signedKey[:32])
 
 	var sig [64]byte
-	copy(sig[:], response.SignedKey[32:(32+64)])
+	copy(sig[:], signedKey[32:(32+64)])
 
 	if !ed25519.Verify(pkSig, userKey[:], &sig) {
-		return nil, errors.New("Improperly signed key returned")
+		return nil, nil, errors.New("Improperly signed key returned")
+	}
+	if len(signedKey) == 32+64 {
+		return &userKey, nil, nil
 	}
 
-	return &userKey, nil
+	kemKey := signedKey[32+64:][:mlkem.EncapsulationKeySize768]
+	copy(sig[:], signedKey[32+64+mlkem.EncapsulationKeySize768:])
+	if !ed25519.Verify(pkSig, append(append([]byte{}, userKey[:]...), kemKey...), &sig) {
+		return nil, nil, errors.New("Improperly signed KEM key returned")
+	}
+	return &userKey, append([]byte{}, kemKey...), nil
 }
 
 func GetNumKeys(connToServer *ConnectionToServer) (int64, error) {
@@ -233,12 +321,33 @@ func UploadMessageToUser(conn *transport.Conn, inBuf []byte, pk *[32]byte, envel
 	return nil
 }
 
+// RelayEnvelope asks our own server, which conn is authenticated to, to
+// deliver envelope to the user pk at the server at addr:port whose transport
+// key is serverPK and that has replicas at the host:port addresses replicas.
+func RelayEnvelope(conn *transport.Conn, inBuf []byte, pk *[32]byte, addr string, port int, replicas []string, serverPK *[32]byte, envelope []byte) error {
+	relayCommand := &proto.ClientToServer{
+		RelayEnvelope: &proto.ClientToServer_RelayEnvelope{
+			User:              (*proto.Byte32)(pk),
+			ServerAddress:     &addr,
+			ServerPort:        protobuf.Int32(int32(port)),
+			ServerTransportPK: (*proto.Byte32)(serverPK),
+			Envelope:          envelope,
+			ServerReplicas:    replicas,
+		},
+	}
+	if err := WriteProtobuf(conn, relayCommand); err != nil {
+		return err
+	}
+	_, err := ReceiveProtobuf(conn, inBuf)
+	return err
+}
+
 func WriteProtobuf(conn *transport.Conn, message *proto.ClientToServer) error {
 	unpadMsg, err := protobuf.Marshal(message)
 	if err != nil {
 		return err
 	}
-	_, err = conn.WriteFrame(proto.Pad(unpadMsg, proto.SERVER_MESSAGE_SIZE))
+	_, err = conn.WriteFrame(proto.Pad(unpadMsg, conn.MaxFrameSize()))
 	return err
 }
 
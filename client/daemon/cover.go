@@ -0,0 +1,151 @@
+// cover traffic and scheduled fetching
+
+package daemon
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// All envelopes are padded to the same size, but the times at which we send
+// and receive messages still tell the servers when we are talking. If
+// CoverTrafficInterval is set, the daemon sends exactly one message at random
+// intervals around it. Outgoing messages are not sent right away but queued in
+// queueDir, and each slot sends the oldest one. When the queue is empty, the
+// slot sends a dummy message to a random contact we have a session with
+// instead. Dummy messages are encrypted and uploaded exactly like other
+// messages in the session, and the recipient drops them after decrypting them.
+// Messages to contacts we have no session with are queued unencrypted and only
+// looked up and sent when their slot comes. Sending a message to a group of n
+// takes n slots. If FetchInterval is set, the daemon does not have our server
+// push messages as they arrive, but downloads them at random intervals around
+// FetchInterval.
+
+func (d *Daemon) coverTrafficInterval() time.Duration {
+	return time.Duration(d.CoverTrafficInterval) * time.Second
+}
+
+func (d *Daemon) fetchInterval() time.Duration {
+	return time.Duration(d.FetchInterval) * time.Second
+}
+
+// randomInterval returns a duration chosen uniformly between one half and
+// three halves of mean.
+func randomInterval(mean time.Duration) time.Duration {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(mean)))
+	if err != nil {
+		panic(err)
+	}
+	return mean/2 + time.Duration(n.Int64())
+}
+
+// scheduleAfter returns a channel that receives after a random interval
+// around mean, or nil if mean is 0.
+func scheduleAfter(mean time.Duration) <-chan time.Time {
+	if mean == 0 {
+		return nil
+	}
+	return time.After(randomInterval(mean))
+}
+
+// sendDummy sends a dummy message to a random contact we have a session with.
+func (d *Daemon) sendDummy() error {
+	contacts, err := d.contactsWithSession()
+	if err != nil || len(contacts) == 0 {
+		return err
+	}
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(contacts))))
+	if err != nil {
+		return err
+	}
+	name := contacts[i.Int64()]
+	d.ourDenameLookupMu.Lock()
+	message := &proto.Message{
+		Dename:       d.Dename,
+		DenameLookup: d.ourDenameLookup,
+		Dummy:        true,
+		Date:         d.Now().UnixNano(),
+	}
+	d.ourDenameLookupMu.Unlock()
+	msg, err := message.Marshal()
+	if err != nil {
+		return err
+	}
+	ratch, err := LoadRatchet(d, name, d.fillAuth, d.checkAuth)
+	if err != nil {
+		return err
+	}
+	envelope, err := d.encryptMessage(msg, name, ratch)
+	if err != nil {
+		return err
+	}
+	return d.deliverEnvelope(envelope, name)
+}
+
+// queueMessage puts an outgoing message at the end of the queue.
+func (d *Daemon) queueMessage(queued *proto.QueuedMessage) error {
+	files, err := ioutil.ReadDir(d.queueDir())
+	if err != nil {
+		return err
+	}
+	var next uint64
+	if len(files) != 0 {
+		last, err := strconv.ParseUint(files[len(files)-1].Name(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("queued message \"%s\": %s", files[len(files)-1].Name(), err)
+		}
+		next = last + 1
+	}
+	return d.MarshalToFile(filepath.Join(d.queueDir(), fmt.Sprintf("%020d", next)), queued)
+}
+
+// sendQueued sends the oldest queued message and returns true, or returns
+// false if there is none. A message that can not be sent goes to the end of
+// the queue so that it does not hold up the others.
+func (d *Daemon) sendQueued() (bool, error) {
+	files, err := ioutil.ReadDir(d.queueDir())
+	if err != nil || len(files) == 0 {
+		return false, err
+	}
+	path := filepath.Join(d.queueDir(), files[0].Name())
+	queued := new(proto.QueuedMessage)
+	if err := persistence.UnmarshalFromFile(path, queued); err != nil {
+		return true, shred.Remove(path)
+	}
+	if err = d.sendNow(queued); err != nil {
+		if err := d.queueMessage(queued); err != nil {
+			return true, err
+		}
+		err = fmt.Errorf("sending to %s: %s", queued.Dename, err)
+	}
+	if err := shred.Remove(path); err != nil {
+		return true, err
+	}
+	return true, err
+}
+
+// sendNow sends a queued message.
+func (d *Daemon) sendNow(queued *proto.QueuedMessage) error {
+	if queued.Message == nil {
+		return d.deliverEnvelope(queued.Envelope, queued.Dename)
+	}
+	// a session may have started since the message was queued
+	ratch, err := LoadRatchet(d, queued.Dename, d.fillAuth, d.checkAuth)
+	if err != nil {
+		return d.startSession(queued.Message, queued.Dename)
+	}
+	envelope, err := d.encryptMessage(queued.Message, queued.Dename, ratch)
+	if err != nil {
+		return err
+	}
+	return d.deliverEnvelope(envelope, queued.Dename)
+}
@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+func TestRandomInterval(t *testing.T) {
+	if scheduleAfter(0) != nil {
+		t.Error("scheduled with a zero interval")
+	}
+	mean := time.Minute
+	for i := 0; i < 100; i++ {
+		if interval := randomInterval(mean); interval < mean/2 || interval >= mean*3/2 {
+			t.Errorf("interval %s is too far from %s", interval, mean)
+		}
+	}
+}
+
+func TestDropDummy(t *testing.T) {
+	d := newTestDaemon(t)
+	defer os.RemoveAll(d.RootDir)
+	dummy := &proto.Message{Dename: "bob", Dummy: true, Date: time.Now().UnixNano()}
+	if err := d.saveMessage(dummy); err != nil {
+		t.Fatal(err)
+	}
+	if conversations, err := d.ListConversations(); err != nil || len(conversations) != 0 {
+		t.Errorf("dummy message was saved: %v, %v", conversations, err)
+	}
+}
+
+func TestQueueMessages(t *testing.T) {
+	d := newTestDaemon(t)
+	defer os.RemoveAll(d.RootDir)
+	d.CoverTrafficInterval = 60
+	queue := func() []*proto.QueuedMessage {
+		files, err := ioutil.ReadDir(d.queueDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []*proto.QueuedMessage
+		for _, file := range files {
+			queued := new(proto.QueuedMessage)
+			if err := persistence.UnmarshalFromFile(filepath.Join(d.queueDir(), file.Name()), queued); err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, queued)
+		}
+		return ret
+	}
+
+	if sent, err := d.sendQueued(); sent || err != nil {
+		t.Fatalf("sendQueued on an empty queue: %v, %v", sent, err)
+	}
+	// nothing is sent before its slot comes
+	if err := d.uploadEnvelope([]byte("first"), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.sendFirstMessage([]byte("hello"), "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.uploadEnvelope([]byte("second"), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	want := []*proto.QueuedMessage{
+		{Dename: "bob", Envelope: []byte("first")},
+		{Dename: "carol", Message: []byte("hello")},
+		{Dename: "bob", Envelope: []byte("second")},
+	}
+	if got := queue(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("queued %v, want %v", got, want)
+	}
+
+	// we have no profile of bob, so the first message can not be sent and
+	// goes to the end of the queue
+	if sent, err := d.sendQueued(); !sent || err == nil {
+		t.Fatalf("sendQueued: %v, %v", sent, err)
+	}
+	want = append(want[1:], want[0])
+	if got := queue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v after a failure, want %v", got, want)
+	}
+}
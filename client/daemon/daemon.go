@@ -22,7 +22,9 @@ import (
 	"github.com/andres-erbsen/chatterbox/client/profilesyncd"
 	"github.com/andres-erbsen/chatterbox/proto"
 	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/senderkey"
 	"github.com/andres-erbsen/chatterbox/shred"
+	"github.com/andres-erbsen/chatterbox/transport"
 	"github.com/andres-erbsen/dename/client"
 	dename "github.com/andres-erbsen/dename/protocol"
 )
@@ -56,15 +58,31 @@ type Daemon struct {
 
 	ourDenameLookup   *dename.ClientReply
 	ourDenameLookupMu sync.Mutex
+	// signals the main loop to push our new profile to contacts
+	ourProfileChanged chan struct{}
 
 	checkAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error
 	fillAuth  func(tag, data []byte, theirAuthPublic *[32]byte)
 
+	ratchets           ratchetIndex
+	senderKeys         senderKeyIndex
+	// the envelopes from each contact that we could not decrypt
+	decryptionFailures map[string]map[[32]byte]struct{}
+	// envelopes that have been requested from our server but not received
+	requested map[[32]byte]struct{}
+	// seeds of the ML-KEM keys of hybrid prekeys, by public prekey
+	prekeyKEMSecrets map[[32]byte][]byte
+
 	cc *util.ConnectionCache
 }
 
-// Init creates a new account locally and at the server
-func Init(rootDir, dename, serverAddr string, serverPort int, serverPK *[32]byte, torAddr string) error {
+// Init creates a new account locally and at the server. serverOnionAddr is
+// the .onion address of the server, or empty if it does not have one.
+// serverReplicas are the host:port addresses of replicas of the server. If
+// torAddr is empty, the daemon connects to servers directly instead of
+// through Tor. If postQuantum is true, the account uses hybrid prekeys and
+// transport handshakes.
+func Init(rootDir, dename, serverAddr, serverOnionAddr string, serverPort int, serverReplicas []string, serverPK *[32]byte, torAddr string, postQuantum bool) error {
 	d := &Daemon{
 		Paths: persistence.Paths{
 			RootDir:     rootDir,
@@ -74,29 +92,40 @@ func Init(rootDir, dename, serverAddr string, serverPort int, serverPK *[32]byte
 			Dename: dename,
 		},
 		LocalAccountConfig: proto.LocalAccountConfig{
-			ServerAddressTCP:  serverAddr,
-			ServerPortTCP:     int32(serverPort),
-			ServerTransportPK: (proto.Byte32)(*serverPK),
-			TorAddress:        torAddr,
+			ServerAddressTCP:   serverAddr,
+			ServerPortTCP:      int32(serverPort),
+			ServerTransportPK:  (proto.Byte32)(*serverPK),
+			TorAddress:         torAddr,
+			PostQuantum:        postQuantum,
+			ServerAddressOnion: serverOnionAddr,
+			DirectTCP:          torAddr == "",
+			ServerReplicasTCP:  serverReplicas,
 		},
 		Now: time.Now,
-		cc:  util.NewConnectionCache(util.NewAnonDialer(torAddr)),
 
 		inBuf:  make([]byte, proto.SERVER_MESSAGE_SIZE),
 		outBuf: make([]byte, proto.SERVER_MESSAGE_SIZE),
 	}
 
 	publicProfile := &proto.Profile{
-		ServerAddressTCP:  serverAddr,
-		ServerPortTCP:     int32(serverPort),
-		ServerTransportPK: (proto.Byte32)(*serverPK),
+		ServerAddressTCP:   serverAddr,
+		ServerPortTCP:      int32(serverPort),
+		ServerTransportPK:  (proto.Byte32)(*serverPK),
+		PostQuantumPrekeys: postQuantum,
+		ServerAddressOnion: serverOnionAddr,
+		ServerReplicasTCP:  serverReplicas,
+		ShortPrekeyIDs:     true,
+	}
+	d.cc = util.NewConnectionCache(util.NewDialer(&d.LocalAccountConfig))
+	if postQuantum {
+		d.cc.TransportConfig = &transport.HybridConfig
 	}
 
 	if err := util.GenerateLongTermKeys(&d.LocalAccountConfig, publicProfile, rand.Reader); err != nil {
 		panic(err)
 	}
 
-	conn, err := d.cc.DialServer(dename, serverAddr, serverPort, serverPK,
+	conn, err := d.cc.DialServerReplicas(dename, d.ourServerAddresses(), serverPK,
 		(*[32]byte)(&publicProfile.UserIDAtServer), (*[32]byte)(&d.TransportSecretKeyForServer))
 	if err != nil {
 		return err
@@ -171,7 +200,11 @@ func Load(rootDir string, denameConfig *client.Config) (*Daemon, error) {
 	if err := persistence.UnmarshalFromFile(d.configPath(), &d.LocalAccountConfig); err != nil {
 		return nil, err
 	}
-	d.cc = util.NewConnectionCache(util.NewAnonDialer(d.TorAddress))
+	dialer := util.NewDialer(&d.LocalAccountConfig)
+	d.cc = util.NewConnectionCache(dialer)
+	if d.PostQuantum {
+		d.cc.TransportConfig = &transport.HybridConfig
+	}
 
 	if err := persistence.UnmarshalFromFile(d.AccountPath(), &d.LocalAccount); err != nil {
 		return nil, err
@@ -190,11 +223,12 @@ func Load(rootDir string, denameConfig *client.Config) (*Daemon, error) {
 		return nil, err
 	}
 
-	ourDenameClient, err := client.NewClient(denameConfig, util.NewAnonDialer(d.TorAddress), nil)
+	denameDialer := util.IsolatedDialer(dialer, util.PurposeDename)
+	ourDenameClient, err := client.NewClient(denameConfig, denameDialer, nil)
 	if err != nil {
 		return nil, err
 	}
-	d.foreignDenameClient, err = client.NewClient(denameConfig, util.NewAnonDialer(d.TorAddress), nil)
+	d.foreignDenameClient, err = client.NewClient(denameConfig, denameDialer, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -203,11 +237,12 @@ func Load(rootDir string, denameConfig *client.Config) (*Daemon, error) {
 	}
 	timelessCfg := *denameConfig // TODO: make very sure this is a deep copy
 	timelessCfg.Freshness.Threshold = fmt.Sprintf("%dh", 100*365*24)
-	d.timelessDenameClient, err = client.NewClient(&timelessCfg, nil, nil)
+	d.timelessDenameClient, err = client.NewClient(&timelessCfg, denameDialer, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	d.ourProfileChanged = make(chan struct{}, 1)
 	d.psd, err = profilesyncd.New(ourDenameClient, 10*time.Minute, d.Dename, d.onOurDenameProfileDownload, nil)
 	if err != nil {
 		return nil, err
@@ -243,6 +278,18 @@ func (d *Daemon) Stop() {
 	d.wg.Wait()
 }
 
+// ourServerAddresses returns the addresses at which to try to reach the
+// replicas of our server.
+func (d *Daemon) ourServerAddresses() []string {
+	return d.cc.ServerAddresses(d.ServerAddressTCP, d.ServerAddressOnion, int(d.ServerPortTCP), d.ServerReplicasTCP)
+}
+
+// serverAddresses returns the addresses at which to try to reach the replicas
+// of the server of the user with the chatterbox profile profile.
+func (d *Daemon) serverAddresses(profile *proto.Profile) []string {
+	return d.cc.ServerAddresses(profile.ServerAddressTCP, profile.ServerAddressOnion, int(profile.ServerPortTCP), profile.ServerReplicasTCP)
+}
+
 // run executes the main loop of the chatterbox daemon
 func (d *Daemon) run() error {
 	profile := new(proto.Profile)
@@ -250,8 +297,7 @@ func (d *Daemon) run() error {
 		return err
 	}
 
-	ourConn, err := d.cc.DialServer(d.Dename, d.ServerAddressTCP, int(d.ServerPortTCP),
-		(*[32]byte)(&d.ServerTransportPK), (*[32]byte)(&profile.UserIDAtServer),
+	ourConn, err := d.cc.DialServerReplicas(d.Dename, d.ourServerAddresses(), (*[32]byte)(&d.ServerTransportPK), (*[32]byte)(&profile.UserIDAtServer),
 		(*[32]byte)(&d.TransportSecretKeyForServer))
 	if err != nil {
 		return err
@@ -293,16 +339,66 @@ func (d *Daemon) run() error {
 		return err
 	}
 
-	if err = util.EnablePush(connToServer); err != nil {
-		return err
+	if d.fetchInterval() == 0 {
+		if err = util.EnablePush(connToServer); err != nil {
+			return err
+		}
 	}
 
 	d.requestAllMessages(connToServer)
 
+	if err := d.sweepConversations(); err != nil {
+		log.Printf("sweep: %s", err)
+	}
+	if err := d.sweepSessions(); err != nil {
+		log.Printf("sweep sessions: %s", err)
+	}
+	if err := d.pushProfile(); err != nil {
+		log.Printf("sending our new profile: %s", err)
+	}
+	if prekeyPublics, prekeySecrets, err = d.releaseDeferred(prekeyPublics, prekeySecrets); err != nil {
+		return err
+	}
+	sweepTicker := time.NewTicker(sweepInterval)
+	defer sweepTicker.Stop()
+	coverTraffic := scheduleAfter(d.coverTrafficInterval())
+	fetch := scheduleAfter(d.fetchInterval())
+
 	for {
 		select {
 		case <-d.stop:
 			return nil
+		case <-sweepTicker.C:
+			if err := d.sweepConversations(); err != nil {
+				log.Printf("sweep: %s", err)
+			}
+			if err := d.sweepSessions(); err != nil {
+				log.Printf("sweep sessions: %s", err)
+			}
+			if err := d.pushProfile(); err != nil {
+				log.Printf("sending our new profile: %s", err)
+			}
+			if prekeyPublics, prekeySecrets, err = d.releaseDeferred(prekeyPublics, prekeySecrets); err != nil {
+				return err
+			}
+		case <-coverTraffic:
+			if sent, err := d.sendQueued(); err != nil {
+				log.Printf("cover traffic: %s", err)
+			} else if !sent {
+				if err := d.sendDummy(); err != nil {
+					log.Printf("cover traffic: %s", err)
+				}
+			}
+			coverTraffic = scheduleAfter(d.coverTrafficInterval())
+		case <-fetch:
+			if err := d.requestAllMessages(connToServer); err != nil {
+				return err
+			}
+			fetch = scheduleAfter(d.fetchInterval())
+		case <-d.ourProfileChanged:
+			if err := d.broadcastProfile(); err != nil {
+				log.Printf("sending our new profile: %s", err)
+			}
 		case ev := <-watcher.Event:
 			// event in the directory structure; watch any new directories
 			if _, err = os.Stat(ev.Name); err == nil {
@@ -315,43 +411,60 @@ func (d *Daemon) run() error {
 		case envelopewithid := <-connToServer.ReadEnvelope:
 			envelope := envelopewithid.Envelope
 			id := envelopewithid.Id
+			delete(d.requested, *id)
 			msgHash := sha256.Sum256(envelope)
+			// group messages name the sender key they were encrypted with
+			if message, key, err := d.decryptGroupMessage(envelope); err != errNoSenderKey {
+				if err == nil {
+					err = d.saveMessage(message)
+				}
+				if err == nil {
+					err = StoreSenderKey(d, d.senderKeyPath(key.ID()), key)
+				}
+				if err != nil {
+					log.Printf("failed to receive group message %x: %s", msgHash, err)
+				}
+				if err := util.DeleteMessages(connToServer, []*[32]byte{id}); err != nil {
+					return err
+				}
+				continue
+			}
 			// assume it's the first message we're receiving from the person; try to decrypt
 			message, ratch, index, err := d.decryptFirstMessage(envelope, prekeyPublics, prekeySecrets)
 			if err == nil {
 				// assumption was correct, found a prekey that matched
-				if err := StoreRatchet(d, message.Dename, ratch); err != nil {
+				if prekeyPublics, prekeySecrets, err = d.receiveFirstMessage(message, ratch, index, prekeyPublics, prekeySecrets); err != nil {
 					return err
 				}
-
-				newPrekeyPublics := append(prekeyPublics[:index], prekeyPublics[index+1:]...)
-				newPrekeySecrets := append(prekeySecrets[:index], prekeySecrets[index+1:]...)
-				if err = StorePrekeys(d, newPrekeyPublics, newPrekeySecrets); err != nil {
+				if err := util.DeleteMessages(connToServer, []*[32]byte{id}); err != nil {
 					return err
 				}
-				//TODO: Update prekeys by removing index, store // is this done? What does it mean?
-				if err := d.saveMessage(message); err != nil {
+			} else if deferred, ok := err.(*lookupDeferred); ok {
+				if held, err := d.deferFirstMessage(envelope, deferred.name); err != nil {
 					return err
+				} else if !held {
+					log.Printf("dropping first message %x from %s: too many messages are held", msgHash, deferred.name)
 				}
 				if err := util.DeleteMessages(connToServer, []*[32]byte{id}); err != nil {
 					return err
 				}
 			} else { // try decrypting with a ratchet
-				ratchets, err := AllRatchets(d, d.fillAuth, d.checkAuth)
-				if err != nil {
-					return err
+				var message *proto.Message
+				name, ratch, err := d.findRatchet(envelope)
+				if err == nil {
+					message, ratch, err = decryptMessage(envelope, []*ratchet.Ratchet{ratch})
 				}
 
 				// TODO: figure out what here should be atomic and comment
-				if message, ratch, err := decryptMessage(envelope, ratchets); err == nil {
-					if err := d.saveMessage(message); err != nil {
-						return err
-					}
-					if err := StoreRatchet(d, message.Dename, ratch); err != nil {
+				if err == nil {
+					if err := d.receiveMessage(message, ratch); err != nil {
 						return err
 					}
-				} else {
+				} else if deferred, deferErr := d.deferMessage(envelope, name); deferErr != nil {
+					return deferErr
+				} else if !deferred {
 					log.Printf("failed to decrypt %x: %s", msgHash, err)
+					d.decryptionFailed(name, envelope, err)
 				}
 				if err := util.DeleteMessages(connToServer, []*[32]byte{id}); err != nil {
 					return err
@@ -366,6 +479,45 @@ func (d *Daemon) run() error {
 
 }
 
+// receiveFirstMessage stores the session started by a first message that was
+// encrypted to the prekey at index and saves the message. It returns the
+// prekeys that are left.
+func (d *Daemon) receiveFirstMessage(message *proto.Message, ratch *ratchet.Ratchet, index int, prekeyPublics, prekeySecrets []*[32]byte) ([]*[32]byte, []*[32]byte, error) {
+	d.decryptionSucceeded(message.Dename)
+	sessions, err := d.liveSessions(message.Dename)
+	if err != nil {
+		return prekeyPublics, prekeySecrets, err
+	}
+	if err := d.storeIncomingSession(message, d.withSessionLimits(ratch), true); err != nil {
+		return prekeyPublics, prekeySecrets, err
+	}
+
+	prekeyPublics = append(prekeyPublics[:index], prekeyPublics[index+1:]...)
+	prekeySecrets = append(prekeySecrets[:index], prekeySecrets[index+1:]...)
+	if err = StorePrekeys(d, prekeyPublics, prekeySecrets); err != nil {
+		return prekeyPublics, prekeySecrets, err
+	}
+	if err := d.saveMessage(message); err != nil {
+		return prekeyPublics, prekeySecrets, err
+	}
+	if len(sessions) == 0 {
+		if err := d.noticeNewContact(message.Dename); err != nil {
+			log.Printf("sending our new profile to %s: %s", message.Dename, err)
+		}
+	}
+	return prekeyPublics, prekeySecrets, nil
+}
+
+// receiveMessage saves a message received in an existing session and stores
+// the session.
+func (d *Daemon) receiveMessage(message *proto.Message, ratch *ratchet.Ratchet) error {
+	d.decryptionSucceeded(message.Dename)
+	if err := d.saveMessage(message); err != nil {
+		return err
+	}
+	return d.storeIncomingSession(message, ratch, false)
+}
+
 func (d *Daemon) updatePrekeys(connToServer *util.ConnectionToServer) (prekeyPublics, prekeySecrets []*[32]byte, err error) {
 	// load prekeys and ensure that we have enough of them
 
@@ -380,6 +532,19 @@ func (d *Daemon) updatePrekeys(connToServer *util.ConnectionToServer) (prekeyPub
 
 	if numKeys < minPrekeys {
 		newPublicPrekeys, newSecretPrekeys, err := GeneratePrekeys(maxPrekeys - int(numKeys))
+		if err != nil {
+			return nil, nil, err
+		}
+		var kemPublics [][]byte
+		if d.PostQuantum {
+			var kemSecrets [][]byte
+			if kemPublics, kemSecrets, err = GenerateKEMKeys(len(newPublicPrekeys)); err != nil {
+				return nil, nil, err
+			}
+			for i, pk := range newPublicPrekeys {
+				d.prekeyKEMSecrets[*pk] = kemSecrets[i]
+			}
+		}
 		prekeySecrets = append(prekeySecrets, newSecretPrekeys...)
 		prekeyPublics = append(prekeyPublics, newPublicPrekeys...)
 		if err = StorePrekeys(d, prekeyPublics, prekeySecrets); err != nil {
@@ -387,7 +552,11 @@ func (d *Daemon) updatePrekeys(connToServer *util.ConnectionToServer) (prekeyPub
 		}
 		var signingKey [64]byte
 		copy(signingKey[:], d.KeySigningSecretKey[:64])
-		err = util.UploadKeys(connToServer, util.SignKeys(newPublicPrekeys, &signingKey))
+		signedKeys := util.SignKeys(newPublicPrekeys, &signingKey)
+		if d.PostQuantum {
+			signedKeys = util.SignHybridKeys(newPublicPrekeys, kemPublics, &signingKey)
+		}
+		err = util.UploadKeys(connToServer, signedKeys)
 		if err != nil {
 			return nil, nil, err // TODO handle this nicely
 		}
@@ -401,15 +570,40 @@ func (d *Daemon) requestAllMessages(conn *util.ConnectionToServer) error {
 	if err != nil {
 		return err
 	}
+	if d.requested == nil {
+		d.requested = make(map[[32]byte]struct{})
+	}
 	for _, msgHash := range msgs {
+		if _, ok := d.requested[*msgHash]; ok {
+			continue
+		}
 		if err := util.RequestMessage(conn, msgHash); err != nil {
 			return err
 		}
+		d.requested[*msgHash] = struct{}{}
 	}
 	return nil
 }
 
 func (d *Daemon) ProfileRatchet(name string, reply *dename.ClientReply) (*dename.Profile, error) {
+	profile, err := d.profileWithoutLookup(name, reply)
+	if err != errStaleLookup {
+		return profile, err
+	}
+	// case 3: look up the profile ourselves and remember it.  This should only
+	// happen if somebody sends us a message and we receive it when its bundled
+	// lookup is no longer fresh. Received first messages are deferred instead
+	// (see deferred.go).
+	profile, err = d.foreignDenameClient.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return d.LatestProfile(name, profile)
+}
+
+// profileWithoutLookup returns the profile of name from reply or from the
+// profiles we have stored, and errStaleLookup if neither has it.
+func (d *Daemon) profileWithoutLookup(name string, reply *dename.ClientReply) (*dename.Profile, error) {
 	if reply != nil {
 		if profile, err := d.foreignDenameClient.LookupFromReply(name, reply); err == nil {
 			// case 1: a fresh lookup is provided by the sender: remember and use it
@@ -430,15 +624,7 @@ func (d *Daemon) ProfileRatchet(name string, reply *dename.ClientReply) (*dename
 		}
 		return stored, nil
 	}
-
-	// case 3: look up the profile ourselves and remember it.  This should only
-	// happen if somebody sends us a message and we receive it when its bundled
-	// lookup is no longer fresh.
-	profile, err := d.foreignDenameClient.Lookup(name)
-	if err != nil {
-		return nil, err
-	}
-	return d.LatestProfile(name, profile)
+	return nil, errStaleLookup
 }
 
 func (d *Daemon) onOurDenameProfileDownload(p *dename.Profile, r *dename.ClientReply, e error) {
@@ -452,9 +638,28 @@ func (d *Daemon) onOurDenameProfileDownload(p *dename.Profile, r *dename.ClientR
 	if err := d.MarshalToFile(d.ourDenameLookupReplyPath(), r); err != nil {
 		log.Print(err)
 	}
+	if changed, err := d.checkOurProfile(p); err != nil {
+		log.Printf("our dename profile: %s", err)
+	} else if changed {
+		select {
+		case d.ourProfileChanged <- struct{}{}:
+		default:
+		}
+	}
 }
 
+// sendFirstMessage starts a new session with theirDename by sending msg, or
+// queues msg to be sent in the next cover traffic slot.
 func (d *Daemon) sendFirstMessage(msg []byte, theirDename string) error {
+	if d.coverTrafficInterval() != 0 {
+		return d.queueMessage(&proto.QueuedMessage{Dename: theirDename, Message: msg})
+	}
+	return d.startSession(msg, theirDename)
+}
+
+// startSession looks up theirDename, fetches a prekey from their server and
+// uploads msg as the first message of a new session.
+func (d *Daemon) startSession(msg []byte, theirDename string) error {
 	profile, err := d.foreignDenameClient.Lookup(theirDename)
 	if err != nil {
 		return err
@@ -462,7 +667,7 @@ func (d *Daemon) sendFirstMessage(msg []byte, theirDename string) error {
 	if profile == nil {
 		fmt.Errorf("unkown dename on to line: " + theirDename)
 	}
-	if err := d.MarshalToFile(d.profilePath(theirDename), profile); err != nil {
+	if _, err := d.LatestProfile(theirDename, profile); err != nil {
 		return err
 	}
 
@@ -476,32 +681,35 @@ func (d *Daemon) sendFirstMessage(msg []byte, theirDename string) error {
 		return err
 	}
 
-	addr := chatProfile.ServerAddressTCP
+	addrs := d.serverAddresses(chatProfile)
 	pkSig := (*[32]byte)(&chatProfile.KeySigningKey)
-	port := (int)(chatProfile.ServerPortTCP)
 	pkTransport := (*[32]byte)(&chatProfile.ServerTransportPK)
 	theirPk := (*[32]byte)(&chatProfile.UserIDAtServer)
 
 	ourSkAuth := (*[32]byte)(&d.MessageAuthSecretKey)
 
-	theirConn, err := d.cc.DialServer(theirDename, addr, port, pkTransport, nil, nil)
+	theirConn, err := d.cc.DialServerReplicas(theirDename, addrs, pkTransport, nil, nil)
 	if err != nil {
 		return err
 	}
 
 	theirInBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
-	theirKey, err := util.GetKey(theirConn, theirInBuf, theirPk, theirDename, pkSig)
+	theirKey, theirKEMKey, err := util.GetKey(theirConn, theirInBuf, theirPk, theirDename, pkSig)
+	if err == nil && theirKEMKey == nil && chatProfile.PostQuantumPrekeys {
+		err = fmt.Errorf("the server of %s returned a prekey without a KEM key", theirDename)
+	}
 	if err != nil {
 		theirConn.Close()
 		d.cc.PutClose(theirDename)
 		return err
 	}
-	encMsg, ratch, err := util.EncryptAuthFirst(msg, ourSkAuth, theirKey, d.ProfileRatchet)
+	encMsg, ratch, err := util.EncryptAuthFirst(msg, ourSkAuth, theirKey, theirKEMKey, chatProfile.ShortPrekeyIDs, d.ProfileRatchet)
 	if err != nil {
 		theirConn.Close()
 		d.cc.PutClose(theirDename)
 		return err
 	}
+	d.withSessionLimits(ratch)
 	if err := StoreRatchet(d, theirDename, ratch); err != nil {
 		theirConn.Close()
 		d.cc.PutClose(theirDename)
@@ -518,64 +726,51 @@ func (d *Daemon) sendFirstMessage(msg []byte, theirDename string) error {
 }
 
 func (d *Daemon) sendMessage(msg []byte, theirDename string, msgRatch *ratchet.Ratchet) error {
-	profile := new(dename.Profile)
-	err := persistence.UnmarshalFromFile(d.profilePath(theirDename), profile)
-	if err != nil {
-		return err
-	}
-
-	chatProfileBytes, err := client.GetProfileField(profile, util.PROFILE_FIELD_ID)
-	if err != nil {
-		return err
-	}
-
-	chatProfile := new(proto.Profile)
-	if err := chatProfile.Unmarshal(chatProfileBytes); err != nil {
-		return err
-	}
-
-	addr := chatProfile.ServerAddressTCP
-	port := (int)(chatProfile.ServerPortTCP)
-	pkTransport := (*[32]byte)(&chatProfile.ServerTransportPK)
-	theirPk := (*[32]byte)(&chatProfile.UserIDAtServer)
-
+	encMsg, err := d.encryptMessage(msg, theirDename, msgRatch)
 	if err != nil {
 		return err
 	}
+	return d.uploadEnvelope(encMsg, theirDename)
+}
 
-	theirInBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
-
+// encryptMessage encrypts msg in the session msgRatch with theirDename and
+// stores the advanced session.
+func (d *Daemon) encryptMessage(msg []byte, theirDename string, msgRatch *ratchet.Ratchet) ([]byte, error) {
 	encMsg, ratch, err := util.EncryptAuth(msg, msgRatch)
 	if err != nil {
-		return err
-	}
-
-	theirConn, err := d.cc.DialServer(theirDename, addr, port, pkTransport, nil, nil)
-	if err != nil {
-		return err
+		return nil, err
 	}
 	if err := StoreRatchet(d, theirDename, ratch); err != nil {
-		theirConn.Close()
-		d.cc.PutClose(theirDename)
-		return err
-	}
-	err = util.UploadMessageToUser(theirConn, theirInBuf, theirPk, encMsg)
-	if err != nil {
-		theirConn.Close()
-		d.cc.PutClose(theirDename)
-		return err
+		return nil, err
 	}
-	d.cc.Put(theirDename, theirConn)
-	return nil
+	return encMsg, nil
 }
 
+// decryptFirstMessage decrypts a message that starts a session. If the sender
+// can not be authenticated without looking them up, it returns a
+// *lookupDeferred error.
 func (d *Daemon) decryptFirstMessage(envelope []byte, pkList []*[32]byte, skList []*[32]byte) (*proto.Message, *ratchet.Ratchet, int, error) {
 	skAuth := (*[32]byte)(&d.MessageAuthSecretKey)
-	ratch, msg, index, err := util.DecryptAuthFirst(envelope, pkList, skList, skAuth, d.ProfileRatchet)
+	var deferred *lookupDeferred
+	profileRatchet := func(name string, reply *dename.ClientReply) (*dename.Profile, error) {
+		profile, err := d.profileWithoutLookup(name, reply)
+		if err == errStaleLookup {
+			deferred = &lookupDeferred{name}
+		}
+		return profile, err
+	}
+	kemList := make([][]byte, len(pkList))
+	for i, pk := range pkList {
+		kemList[i] = d.prekeyKEMSecrets[*pk]
+	}
+	ratch, msg, index, err := util.DecryptAuthFirst(envelope, pkList, skList, kemList, skAuth, profileRatchet)
 
-	if err != nil {
+	if err != nil && deferred != nil {
+		return nil, nil, -1, deferred
+	} else if err != nil {
 		return nil, nil, -1, err
 	}
+	ratch.CheckAuth = d.checkAuth
 	message := new(proto.Message)
 	if err := message.Unmarshal(msg); err != nil {
 		return nil, nil, -1, err
@@ -594,6 +789,9 @@ func decryptMessage(envelope []byte, ratchets []*ratchet.Ratchet) (*proto.Messag
 			break // found the right ratchet
 		}
 	}
+	if err == ratchet.ErrDuplicate {
+		return nil, nil, err
+	}
 	if msg == nil {
 		return nil, nil, fmt.Errorf("could not find suitable ratchet: %v", err)
 	}
@@ -624,82 +822,109 @@ func (d *Daemon) processOutboxDir(dirname string) error {
 		return nil // no metadata --> not an outgoing message
 	}
 
-	metadata := proto.ConversationMetadata{}
-	err := persistence.UnmarshalFromFile(metadataFile, &metadata)
+	metadata := new(proto.ConversationMetadata)
+	err := persistence.UnmarshalFromFile(metadataFile, metadata)
 	if err != nil {
 		return err
 	}
 
 	metadata.Participants = append(metadata.Participants, d.Dename)
-	undupStrings(metadata.Participants)
+	metadata.Participants = undupStrings(metadata.Participants)
 	sort.Strings(metadata.Participants)
-	convName := persistence.ConversationName(&metadata)
+	convName := persistence.ConversationName(metadata)
+
+	// the participants of a conversation we already know only change through
+	// membership changes, whatever the metadata in the outbox says
+	known := false
+	for _, name := range []string{filepath.Base(dirname), convName} {
+		existing, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), name))
+		if err == nil {
+			metadata, convName, known = existing, name, true
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if known && !contains(metadata.Participants, d.Dename) {
+		log.Printf("not sending to \"%s\": %s is no longer a member", convName, d.Dename)
+		return nil
+	}
 
 	// load messages
 	potentialMessages, err := ioutil.ReadDir(dirname)
 	if err != nil {
 		return err
 	}
-	messages := make([][]byte, 0, len(potentialMessages))
+	var controls, messages []os.FileInfo
 	for _, finfo := range potentialMessages {
-		if !finfo.IsDir() && finfo.Name() != persistence.MetadataFileName {
-			msg, err := ioutil.ReadFile(filepath.Join(dirname, finfo.Name()))
-			if err != nil {
-				return err
-			}
-
-			// make protobuf for message; append it
-			d.ourDenameLookupMu.Lock()
-			payload := proto.Message{
-				Dename:       d.Dename,
-				DenameLookup: d.ourDenameLookup,
-				Contents:     msg,
-				Subject:      metadata.Subject,
-				Participants: metadata.Participants,
-				Date:         finfo.ModTime().UnixNano(),
-			}
-			d.ourDenameLookupMu.Unlock()
-			payloadBytes, err := payload.Marshal()
-			if err != nil {
-				return err
-			}
-			messages = append(messages, payloadBytes)
+		if finfo.IsDir() || finfo.Name() == persistence.MetadataFileName {
+			continue
+		} else if strings.HasSuffix(finfo.Name(), persistence.ControlFileSuffix) {
+			controls = append(controls, finfo)
+		} else {
+			messages = append(messages, finfo)
 		}
 	}
-	if len(messages) == 0 {
+	if len(controls) == 0 && len(messages) == 0 {
 		return nil // no messages to send, just the metadata file
 	}
 
-	if err := d.conversationToConversations(&metadata); err != nil && !os.IsExist(err) && !strings.Contains(fmt.Sprint(err), "directory not empty") {
-		log.Fatal(err)
+	if metadata.Id == nil {
+		if metadata.Id, err = newConversationID(); err != nil {
+			return err
+		}
+		if known {
+			if err := d.storeConversationMetadata(convName, metadata); err != nil {
+				return err
+			}
+		}
+	}
+	if !known {
+		if err := d.conversationToConversations(metadata); err != nil && !os.IsExist(err) && !strings.Contains(fmt.Sprint(err), "directory not empty") {
+			log.Fatal(err)
+		}
 	}
 
-	for _, recipient := range metadata.Participants {
-		if recipient == d.Dename {
+	for _, finfo := range controls {
+		oldName := convName
+		if err := d.processControlFile(metadata, convName, filepath.Join(dirname, finfo.Name())); err != nil {
+			log.Printf("control message in \"%s\": %s", convName, err)
 			continue
 		}
-		for _, msg := range messages {
-			if err != nil {
-				return err
-			}
-			if msgRatch, err := LoadRatchet(d, recipient, d.fillAuth, d.checkAuth); err != nil { //First message to this recipien
-				if err := d.sendFirstMessage(msg, recipient); err != nil {
-					return err
-				}
-			} else {
-				if err := d.sendMessage(msg, recipient, msgRatch); err != nil {
-					return err
-				}
-			}
+		convName = persistence.ConversationName(metadata)
+		if dirname == filepath.Join(d.OutboxDir(), oldName) {
+			dirname = filepath.Join(d.OutboxDir(), convName)
 		}
 	}
+	if !contains(metadata.Participants, d.Dename) {
+		return nil // we left; anything else in the outbox stays unsent
+	}
 
-	// move the sent messages to the conversation folder
-	for _, finfo := range potentialMessages {
-		if !finfo.IsDir() && finfo.Name() != persistence.MetadataFileName {
-			if err = os.Rename(filepath.Join(dirname, finfo.Name()), filepath.Join(d.ConversationDir(), persistence.ConversationName(&metadata), persistence.MessageName(finfo.ModTime(), string(d.Dename)))); err != nil {
-				log.Fatal(err)
-			}
+	for _, finfo := range messages {
+		msg, err := ioutil.ReadFile(filepath.Join(dirname, finfo.Name()))
+		if err != nil {
+			return err
+		}
+
+		payload := d.newPayload(metadata, msg, finfo.ModTime())
+		d.sequenceOutgoing(metadata, payload)
+		messageName := persistence.MessageName(time.Unix(0, payload.Date), string(d.Dename))
+		if err := d.recordMessageFile(convName, messageName, payload); err != nil {
+			return err
+		}
+		if err := d.storeConversationMetadata(convName, metadata); err != nil {
+			return err
+		}
+		if err := d.sendToConversation(metadata, payload); err != nil {
+			return err
+		}
+
+		// move the sent message to the conversation folder
+		if err = os.Rename(filepath.Join(dirname, finfo.Name()), filepath.Join(d.ConversationDir(), convName, messageName)); err != nil {
+			log.Fatal(err)
+		}
+		if err := d.IndexMessage(convName, messageName, d.Dename, time.Unix(0, payload.Date), msg); err != nil {
+			log.Printf("search index: %s", err)
 		}
 	}
 
@@ -713,32 +938,143 @@ func (d *Daemon) processOutboxDir(dirname string) error {
 	return nil
 }
 
+// processControlFile sends a control message that a frontend has put into the
+// outbox of a conversation and applies it locally.
+func (d *Daemon) processControlFile(metadata *proto.ConversationMetadata, convName, path string) error {
+	defer shred.Remove(path)
+	template := new(proto.Message)
+	if err := persistence.UnmarshalFromFile(path, template); err != nil {
+		return err
+	}
+	switch {
+	case template.MembershipChange != nil:
+		return d.sendMembershipChange(metadata, convName, template.MembershipChange)
+	case template.Edit != nil:
+		return d.sendEdit(metadata, convName, template.Edit, template.Contents)
+	case template.Retention != nil:
+		return d.sendRetention(metadata, convName, template.Retention)
+	case template.History != nil:
+		return d.sendHistory(metadata, convName, template.History)
+	}
+	return fmt.Errorf("control file %s does not contain a known control message", path)
+}
+
+// newPayload returns a message from us in a conversation.
+func (d *Daemon) newPayload(metadata *proto.ConversationMetadata, contents []byte, date time.Time) *proto.Message {
+	d.ourDenameLookupMu.Lock()
+	defer d.ourDenameLookupMu.Unlock()
+	return &proto.Message{
+		Dename:         d.Dename,
+		DenameLookup:   d.ourDenameLookup,
+		Contents:       contents,
+		Subject:        metadata.Subject,
+		Participants:   metadata.Participants,
+		Date:           date.UnixNano(),
+		ConversationId: metadata.Id,
+	}
+}
+
 func (d *Daemon) saveMessage(message *proto.Message) error {
-	// generate metadata file
-	metadata := proto.ConversationMetadata{
-		Participants: message.Participants,
-		Subject:      message.Subject,
+	if message.SessionReset {
+		return d.receiveSessionReset(message)
+	}
+	if message.ProfileUpdate {
+		return nil // the dename lookup in it was stored when it was authenticated
+	}
+	if message.Dummy {
+		return nil
+	}
+	// a message dated in the future would sort after everything sent later and
+	// outlive the retention of its conversation
+	if now := d.Now().UnixNano(); message.Date > now {
+		message.Date = now
+	}
+	var metadata *proto.ConversationMetadata
+	date := time.Unix(0, message.Date)
+	if message.ConversationId == nil {
+		// sent by a client that does not know about conversation IDs: trust the
+		// participant list in the message.
+		metadata = &proto.ConversationMetadata{
+			Participants: message.Participants,
+			Subject:      message.Subject,
+		}
+		// create conversation directory if it doesn't already exist
+		_, err := os.Stat(filepath.Join(d.ConversationDir(), persistence.ConversationName(metadata)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		} else if err != nil && os.IsNotExist(err) {
+			// new message in existing conversation
+			if err := d.conversationToConversations(metadata); err != nil {
+				return err
+			}
+		}
+	} else {
+		var convName string
+		var err error
+		if metadata, convName, err = d.receivingConversation(message); err != nil {
+			return err
+		}
+		if message.SenderKey != nil {
+			key := senderkey.FromProto(message.SenderKey, message.Dename, (*[32]byte)(message.ConversationId))
+			// a key we already have may have been stepped since it was sent
+			if _, err := os.Stat(d.senderKeyPath(key.ID())); os.IsNotExist(err) {
+				if err := StoreSenderKey(d, d.senderKeyPath(key.ID()), key); err != nil {
+					return err
+				}
+			}
+		}
+		if message.MembershipChange != nil {
+			if err := d.receiveMembershipChange(metadata, convName, message); err != nil {
+				return err
+			}
+			convName = persistence.ConversationName(metadata)
+		}
+		if message.SequenceNumber != 0 {
+			date = d.sequenceIncoming(metadata, message)
+		}
+		if message.Edit != nil {
+			if err := d.applyEdit(metadata, convName, message.Dename, message.Edit, message.Contents); err != nil {
+				return err
+			}
+		} else if message.SequenceNumber != 0 && isContent(message) {
+			if err := d.recordMessageFile(convName, persistence.MessageName(date, string(message.Dename)), message); err != nil {
+				return err
+			}
+		}
+		if message.SequenceNumber != 0 || message.Edit != nil {
+			if err := d.storeConversationMetadata(convName, metadata); err != nil {
+				return err
+			}
+		}
+		if message.Retention != nil && applyRetention(metadata, message.Retention) {
+			if err := d.sweepConversation(metadata, convName); err != nil {
+				return err
+			}
+		}
+		if message.History != nil && applyHistory(metadata, message.History) {
+			if err := d.historyChanged(metadata, convName); err != nil {
+				return err
+			}
+		}
 	}
 	// generate conversation name
-	convName := persistence.ConversationName(&metadata)
-	messageName := persistence.MessageName(time.Unix(0, message.Date), string(message.Dename))
-
-	// create conversation directory if it doesn't already exist
+	convName := persistence.ConversationName(metadata)
 	convDir := filepath.Join(d.ConversationDir(), convName)
 	outboxDir := filepath.Join(d.OutboxDir(), convName)
-	_, err := os.Stat(convDir)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	} else if err != nil && os.IsNotExist(err) {
-		// new message in existing conversation
-		if err := d.conversationToConversations(&metadata); err != nil {
+
+	if isContent(message) {
+		messageName := persistence.MessageName(date, string(message.Dename))
+		if err := d.AtomicWriteFile(filepath.Join(convDir, messageName), message.Contents, 0600); err != nil {
 			return err
 		}
-	}
-
-	err = d.AtomicWriteFile(filepath.Join(convDir, messageName), message.Contents, 0600)
-	if err != nil {
-		return err
+		if err := d.IndexMessage(convName, messageName, message.Dename, date, message.Contents); err != nil {
+			log.Printf("search index: %s", err)
+		}
+		if message.SequenceNumber != 0 {
+			if err := d.applyHeldEdits(metadata, convName, &proto.MessageId{Dename: message.Dename, SequenceNumber: message.SequenceNumber}); err != nil {
+				return err
+			}
+		}
 	}
 
 	// to outbox
@@ -747,7 +1083,7 @@ func (d *Daemon) saveMessage(message *proto.Message) error {
 		return err
 	}
 	defer shred.RemoveAll(tdir)
-	err = d.MarshalToFile(filepath.Join(tdir, persistence.MetadataFileName), &metadata)
+	err = d.MarshalToFile(filepath.Join(tdir, persistence.MetadataFileName), metadata)
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package daemon
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
@@ -288,3 +289,227 @@ func TestEncryptFirstMessage(t *testing.T) {
 
 	//TODO: Confirm message is as expected within the test
 }
+
+// waitForFiles waits until a file matching pattern exists and returns the
+// matching files.
+func waitForFiles(t *testing.T, pattern string) []string {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			return files
+		}
+	}
+	t.Fatalf("timed out waiting for %s", pattern)
+	return nil
+}
+
+func TestSessionReset(t *testing.T) {
+	testSessionReset(t, false)
+}
+
+// bob loses the ratchet while his daemon is stopped, so the header keys that
+// attribute alice's messages to her are not in memory when it starts again
+func TestSessionResetAfterRestart(t *testing.T) {
+	testSessionReset(t, true)
+}
+
+func testSessionReset(t *testing.T, restart bool) {
+	alice := "alice"
+	bob := "bob"
+
+	denameConfig, denameTeardown := denameTestutil.SingleServer(t)
+	defer denameTeardown()
+
+	_, serverPubkey, serverAddr, serverTeardown := server.CreateTestServer(t)
+	defer serverTeardown()
+
+	aliceDir, err := ioutil.TempDir("", "daemon-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shred.RemoveAll(aliceDir)
+
+	bobDir, err := ioutil.TempDir("", "daemon-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shred.RemoveAll(bobDir)
+
+	aliceDaemon := PrepareTestAccountDaemon(alice, aliceDir, denameConfig, serverAddr, serverPubkey, t)
+	bobDaemon := PrepareTestAccountDaemon(bob, bobDir, denameConfig, serverAddr, serverPubkey, t)
+
+	aliceDaemon.Start()
+	bobDaemon.Start()
+	defer aliceDaemon.Stop()
+	defer func() { bobDaemon.Stop() }()
+
+	conv := &proto.ConversationMetadata{
+		Participants: []string{alice, bob},
+		Subject:      "testConversation",
+	}
+	convName := persistence.ConversationName(conv)
+	if err := aliceDaemon.ConversationToOutbox(conv); err != nil {
+		t.Fatal(err)
+	}
+	if err := aliceDaemon.MessageToOutbox(convName, "first"); err != nil {
+		t.Fatal(err)
+	}
+	waitForFiles(t, filepath.Join(bobDaemon.ConversationDir(), convName, "*alice"))
+
+	// bob loses his ratchet with alice and can't read anything she sends
+	if restart {
+		bobDaemon.Stop()
+	}
+	if err := shred.RemoveAll(bobDaemon.ratchetDir(alice)); err != nil {
+		t.Fatal(err)
+	}
+	if restart {
+		if bobDaemon, err = Load(bobDir, denameConfig); err != nil {
+			t.Fatal(err)
+		}
+		bobDaemon.Start()
+	}
+	for i := 0; i < maxDecryptionFailures; i++ {
+		if err := aliceDaemon.MessageToOutbox(convName, fmt.Sprintf("lost %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	system := "*" + persistence.SystemSender
+	waitForFiles(t, filepath.Join(bobDaemon.ConversationDir(), convName, system))
+	waitForFiles(t, filepath.Join(aliceDaemon.ConversationDir(), convName, system))
+
+	sentMessage := "Bob, can you hear me now?"
+	if err := aliceDaemon.MessageToOutbox(convName, sentMessage); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		files, err := filepath.Glob(filepath.Join(bobDaemon.ConversationDir(), convName, "*alice"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			if contents, err := ioutil.ReadFile(file); err == nil && string(contents) == sentMessage {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bob did not receive the message sent after the reset")
+		}
+	}
+}
+
+func TestHybridPrekeysStorage(t *testing.T) {
+	d := newTestDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+
+	publics, secrets, err := GeneratePrekeys(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, kemSecrets, err := GenerateKEMKeys(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadPrekeys(d); err != nil {
+		t.Fatal(err)
+	}
+	// the last prekey is not hybrid
+	for i, kemSecret := range kemSecrets {
+		d.prekeyKEMSecrets[*publics[i]] = kemSecret
+	}
+	// the first one has been used
+	if err := StorePrekeys(d, publics[1:], secrets[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadPrekeys(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.prekeyKEMSecrets) != 1 || !bytes.Equal(d.prekeyKEMSecrets[*publics[1]], kemSecrets[1]) {
+		t.Errorf("loaded KEM secrets %v", d.prekeyKEMSecrets)
+	}
+}
+
+func TestConcurrentMembershipChangesEndToEnd(t *testing.T) {
+	names := []string{"alice", "bob", "carol", "dave"}
+
+	denameConfig, denameTeardown := denameTestutil.SingleServer(t)
+	defer denameTeardown()
+
+	_, serverPubkey, serverAddr, serverTeardown := server.CreateTestServer(t)
+	defer serverTeardown()
+
+	id, err := newConversationID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv := &proto.ConversationMetadata{
+		Participants: names,
+		Subject:      "testConversation",
+		Id:           id,
+	}
+	daemons := make(map[string]*Daemon)
+	for _, name := range names {
+		dir, err := ioutil.TempDir("", "daemon-"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer shred.RemoveAll(dir)
+		d := PrepareTestAccountDaemon(name, dir, denameConfig, serverAddr, serverPubkey, t)
+		if err := d.conversationToConversations(conv); err != nil {
+			t.Fatal(err)
+		}
+		daemons[name] = d
+	}
+
+	// bob removes dave and carol removes alice before either hears of the
+	// other change
+	convName := persistence.ConversationName(conv)
+	for signer, change := range map[string]*proto.MembershipChange{
+		"bob":   {Action: proto.MembershipChange_REMOVE, Members: []string{"dave"}},
+		"carol": {Action: proto.MembershipChange_REMOVE, Members: []string{"alice"}},
+	} {
+		if err := daemons[signer].ConversationToOutbox(conv); err != nil {
+			t.Fatal(err)
+		}
+		if err := daemons[signer].ControlToOutbox(convName, &proto.Message{MembershipChange: change}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range daemons {
+		d.Start()
+		defer d.Stop()
+	}
+
+	// everybody ends up with the same participants, whichever change won
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		var seen []*proto.ConversationMetadata
+		for _, name := range names {
+			metadata, _, err := daemons[name].conversationByID(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen = append(seen, metadata)
+		}
+		agreed := true
+		for _, metadata := range seen {
+			if metadata == nil || metadata.MembershipChangeHash == nil || len(metadata.Participants) != 3 ||
+				seen[0].MembershipChangeHash == nil || *metadata.MembershipChangeHash != *seen[0].MembershipChangeHash {
+				agreed = false
+			}
+		}
+		if agreed {
+			return
+		}
+		if time.Now().After(deadline) {
+			for i, metadata := range seen {
+				if metadata != nil {
+					t.Errorf("%s: participants %v at version %d", names[i], metadata.Participants, metadata.MembershipVersion)
+				}
+			}
+			t.Fatal("the members did not agree on the membership")
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// deferred lookups of the senders of first messages
+
+package daemon
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// A first message from somebody whose profile we have not stored can only be
+// authenticated using the dename lookup bundled with it. If that lookup is no
+// longer fresh, we have to look the sender up ourselves, and doing it right
+// away would tell whoever watches the dename servers when we received a
+// message from whom. Instead, the message is held in deferredDir and the
+// sender is looked up after a random delay of up to maxLookupDelay. Messages
+// the sender sends in the new session in the meantime are held as well, and
+// they are decrypted once the first message has been received. Held messages
+// are received in the order they arrived in.
+const defaultMaxLookupDelay = 24 * time.Hour
+
+// Anybody can send us messages that look like they are in a session that a
+// held first message is going to start, so the number of held messages is
+// limited. Such messages can not be told apart before they are decrypted, so
+// the limit of maxDeferredPerSession applies to their total divided by the
+// number of held first messages.
+const (
+	maxDeferredMessages   = 1000
+	maxDeferredPerSession = 100
+)
+
+// errStaleLookup means that a profile can not be found without looking it up.
+var errStaleLookup = errors.New("no fresh dename lookup or stored profile")
+
+// lookupDeferred is returned by decryptFirstMessage when name has to be looked
+// up before the message can be authenticated.
+type lookupDeferred struct {
+	name string
+}
+
+func (e *lookupDeferred) Error() string {
+	return "the lookup of " + e.name + " has to be deferred"
+}
+
+func (d *Daemon) maxLookupDelay() time.Duration {
+	if d.MaxLookupDelay == 0 {
+		return defaultMaxLookupDelay
+	}
+	return time.Duration(d.MaxLookupDelay) * time.Second
+}
+
+func (d *Daemon) deferredPath(envelope []byte) string {
+	h := sha256.Sum256(envelope)
+	return filepath.Join(d.deferredDir(), hex.EncodeToString(h[:]))
+}
+
+// deferFirstMessage holds a first message from name until a random time
+// before maxLookupDelay has passed. It returns false if too many messages are
+// held already.
+func (d *Daemon) deferFirstMessage(envelope []byte, name string) (bool, error) {
+	deferred, _, err := d.loadDeferred()
+	if err != nil {
+		return false, err
+	}
+	if len(deferred) >= maxDeferredMessages {
+		return false, nil
+	}
+	delay, err := rand.Int(rand.Reader, big.NewInt(int64(d.maxLookupDelay())))
+	if err != nil {
+		return false, err
+	}
+	return true, d.storeDeferred(deferred, &proto.DeferredMessage{
+		Envelope: envelope,
+		Dename:   name,
+		Release:  d.Now().Add(time.Duration(delay.Int64())).UnixNano(),
+	})
+}
+
+// deferMessage holds a message that no session could decrypt if it may belong
+// to a session started by a held first message. name is the contact whose
+// session matched the message, if any. It returns true if the message was
+// held.
+func (d *Daemon) deferMessage(envelope []byte, name string) (bool, error) {
+	if name != "" {
+		return false, nil
+	}
+	deferred, _, err := d.loadDeferred()
+	if err != nil {
+		return false, err
+	}
+	sessions, held := 0, 0
+	for _, message := range deferred {
+		if message.Dename != "" {
+			sessions++
+		} else {
+			held++
+		}
+	}
+	if sessions == 0 || len(deferred) >= maxDeferredMessages || held >= sessions*maxDeferredPerSession {
+		return false, nil
+	}
+	return true, d.storeDeferred(deferred, &proto.DeferredMessage{Envelope: envelope})
+}
+
+// storeDeferred holds message after the messages in deferred. An envelope
+// that is held already keeps its place.
+func (d *Daemon) storeDeferred(deferred []*proto.DeferredMessage, message *proto.DeferredMessage) error {
+	path := d.deferredPath(message.Envelope)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if len(deferred) != 0 {
+		message.Arrival = deferred[len(deferred)-1].Arrival + 1
+	}
+	return d.MarshalToFile(path, message)
+}
+
+// loadDeferred returns the held messages in the order they arrived in and the
+// paths they are stored at.
+func (d *Daemon) loadDeferred() ([]*proto.DeferredMessage, []string, error) {
+	files, err := ioutil.ReadDir(d.deferredDir())
+	if err != nil {
+		return nil, nil, err
+	}
+	var messages []*proto.DeferredMessage
+	var paths []string
+	for _, file := range files {
+		path := filepath.Join(d.deferredDir(), file.Name())
+		message := new(proto.DeferredMessage)
+		if err := persistence.UnmarshalFromFile(path, message); err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, message)
+		paths = append(paths, path)
+	}
+	sort.Stable(byArrival{messages, paths})
+	return messages, paths, nil
+}
+
+type byArrival struct {
+	messages []*proto.DeferredMessage
+	paths    []string
+}
+
+func (s byArrival) Len() int           { return len(s.messages) }
+func (s byArrival) Less(i, j int) bool { return s.messages[i].Arrival < s.messages[j].Arrival }
+func (s byArrival) Swap(i, j int) {
+	s.messages[i], s.messages[j] = s.messages[j], s.messages[i]
+	s.paths[i], s.paths[j] = s.paths[j], s.paths[i]
+}
+
+// releaseDeferred looks up the senders of the held first messages whose time
+// has come and receives the messages if the senders' profiles authenticate
+// them. Messages in the sessions they start are received after them. It
+// returns the prekeys that are left.
+func (d *Daemon) releaseDeferred(prekeyPublics, prekeySecrets []*[32]byte) ([]*[32]byte, []*[32]byte, error) {
+	deferred, paths, err := d.loadDeferred()
+	if err != nil {
+		return prekeyPublics, prekeySecrets, err
+	}
+	released, pending := false, false
+	for i, held := range deferred {
+		if held.Dename == "" {
+			continue
+		}
+		if d.Now().Before(time.Unix(0, held.Release)) {
+			pending = true
+			continue
+		}
+		profile, err := d.foreignDenameClient.Lookup(held.Dename)
+		if err == nil {
+			_, err = d.LatestProfile(held.Dename, profile)
+		}
+		if err != nil {
+			log.Printf("deferred lookup of %s: %s", held.Dename, err)
+			pending = true // try again at the next sweep
+			continue
+		}
+		message, ratch, index, err := d.decryptFirstMessage(held.Envelope, prekeyPublics, prekeySecrets)
+		if err != nil {
+			log.Printf("rejecting deferred first message from %s: %s", held.Dename, err)
+		} else if prekeyPublics, prekeySecrets, err = d.receiveFirstMessage(message, ratch, index, prekeyPublics, prekeySecrets); err != nil {
+			return prekeyPublics, prekeySecrets, err
+		} else {
+			released = true
+		}
+		if err := shred.Remove(paths[i]); err != nil {
+			return prekeyPublics, prekeySecrets, err
+		}
+	}
+
+	for i, held := range deferred {
+		if held.Dename != "" {
+			continue
+		}
+		var name string
+		err := errors.New("no held first message started its session")
+		if released {
+			var ratch *ratchet.Ratchet
+			var message *proto.Message
+			if name, ratch, err = d.findRatchet(held.Envelope); err == nil {
+				message, ratch, err = decryptMessage(held.Envelope, []*ratchet.Ratchet{ratch})
+			}
+			if err == nil {
+				if err := d.receiveMessage(message, ratch); err != nil {
+					return prekeyPublics, prekeySecrets, err
+				}
+			}
+		}
+		if err != nil && pending {
+			continue // may belong to a session that has not started yet
+		} else if err != nil {
+			log.Printf("failed to decrypt deferred message: %s", err)
+			d.decryptionFailed(name, held.Envelope, err)
+		}
+		if err := shred.Remove(paths[i]); err != nil {
+			return prekeyPublics, prekeySecrets, err
+		}
+	}
+	return prekeyPublics, prekeySecrets, nil
+}
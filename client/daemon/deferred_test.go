@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeferredMessages(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	d := newTestDaemon(t)
+	defer os.RemoveAll(d.RootDir)
+	d.Now = func() time.Time { return now }
+	d.MaxLookupDelay = 3600
+
+	if _, err := d.profileWithoutLookup("bob", nil); err != errStaleLookup {
+		t.Fatalf("profile of an unknown contact without a lookup: %v", err)
+	}
+
+	// nothing is held for sessions that no first message is going to start
+	if deferred, err := d.deferMessage([]byte("orphan"), ""); err != nil || deferred {
+		t.Fatalf("deferMessage without a held first message: %v, %v", deferred, err)
+	}
+	if held, err := d.deferFirstMessage([]byte("first"), "bob"); err != nil || !held {
+		t.Fatalf("deferFirstMessage: %v, %v", held, err)
+	}
+	if deferred, err := d.deferMessage([]byte("in a known session"), "carol"); err != nil || deferred {
+		t.Fatalf("deferMessage in a session with carol: %v, %v", deferred, err)
+	}
+	if deferred, err := d.deferMessage([]byte("second"), ""); err != nil || !deferred {
+		t.Fatalf("deferMessage after a held first message: %v, %v", deferred, err)
+	}
+
+	held, paths, err := d.loadDeferred()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 2 {
+		t.Fatalf("%d messages held, want 2", len(held))
+	}
+	for _, message := range held {
+		if message.Dename != "bob" {
+			continue
+		}
+		release := time.Unix(0, message.Release)
+		if release.Before(now) || !release.Before(now.Add(time.Hour)) {
+			t.Errorf("release at %s, want within an hour of %s", release, now)
+		}
+	}
+
+	// before the release time, everything stays held
+	if _, _, err := d.releaseDeferred(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if held, paths, err = d.loadDeferred(); err != nil || len(held) != 2 {
+		t.Fatalf("%d messages held after an early release (%v), want 2", len(held), err)
+	}
+
+	// once no first message is held, the rest is dropped
+	for i, message := range held {
+		if message.Dename != "" {
+			if err := os.Remove(paths[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, _, err := d.releaseDeferred(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if held, _, err = d.loadDeferred(); err != nil || len(held) != 0 {
+		t.Fatalf("%d messages held without a first message (%v)", len(held), err)
+	}
+}
+
+func TestDeferredLimits(t *testing.T) {
+	d := newTestDaemon(t)
+	defer os.RemoveAll(d.RootDir)
+
+	var want []string
+	deferFirst := func(name string) {
+		if held, err := d.deferFirstMessage([]byte(name), name); err != nil || !held {
+			t.Fatalf("deferFirstMessage from %s: %v, %v", name, held, err)
+		}
+		want = append(want, name)
+	}
+	// each held first message makes room for maxDeferredPerSession more
+	deferFirst("bob")
+	for i := 0; ; i++ {
+		envelope := fmt.Sprintf("message %d", i)
+		held, err := d.deferMessage([]byte(envelope), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !held {
+			if i != maxDeferredPerSession {
+				t.Fatalf("%d messages held for one session, want %d", i, maxDeferredPerSession)
+			}
+			break
+		}
+		want = append(want, envelope)
+		if i == 0 {
+			// the same envelope again keeps its place
+			if held, err := d.deferMessage([]byte(envelope), ""); err != nil || !held {
+				t.Fatalf("deferMessage of a held envelope: %v, %v", held, err)
+			}
+		}
+	}
+	deferFirst("carol")
+	if held, err := d.deferMessage([]byte("for carol"), ""); err != nil || !held {
+		t.Fatalf("deferMessage after another first message: %v, %v", held, err)
+	}
+	want = append(want, "for carol")
+
+	held, _, err := d.loadDeferred()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, message := range held {
+		got = append(got, string(message.Envelope))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("held in the order %v, want %v", got, want)
+	}
+}
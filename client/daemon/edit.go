@@ -0,0 +1,209 @@
+// message edits and retractions
+
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// isContent returns true if message has contents that should be saved as a
+// message file, as opposed to being purely a control message.
+func isContent(message *proto.Message) bool {
+	return message.Edit == nil && message.Retention == nil && message.History == nil &&
+		(message.MembershipChange == nil || len(message.Contents) != 0)
+}
+
+func messageIndexPath(convDir string, id *proto.MessageId) string {
+	return filepath.Join(convDir, persistence.MessageIndexDirName, persistence.MessageIndexName(id.Dename, id.SequenceNumber))
+}
+
+// heldEditsDir returns the directory of the edits of message id that arrived
+// before the message itself.
+func heldEditsDir(convDir string, id *proto.MessageId) string {
+	return filepath.Join(convDir, persistence.HeldEditsDirName, persistence.MessageIndexName(id.Dename, id.SequenceNumber))
+}
+
+// recordMessageFile records the file name of a message so that later edits of
+// it can be applied.
+func (d *Daemon) recordMessageFile(convName, name string, message *proto.Message) error {
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	if err := os.MkdirAll(filepath.Join(convDir, persistence.MessageIndexDirName), 0700); err != nil {
+		return err
+	}
+	return d.MarshalToFile(messageIndexPath(convDir, &proto.MessageId{Dename: message.Dename, SequenceNumber: message.SequenceNumber}), &proto.MessageFile{
+		Name:           name,
+		Dename:         message.Dename,
+		SequenceNumber: message.SequenceNumber,
+	})
+}
+
+// loadMessageFile returns the file of message id in a conversation, or nil if
+// it is not known.
+func (d *Daemon) loadMessageFile(convName string, id *proto.MessageId) (*proto.MessageFile, error) {
+	file := new(proto.MessageFile)
+	err := persistence.UnmarshalFromFile(messageIndexPath(filepath.Join(d.ConversationDir(), convName), id), file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// applyEdit applies an edit made by sender to the files of a conversation.
+func (d *Daemon) applyEdit(metadata *proto.ConversationMetadata, convName, sender string, edit *proto.MessageEdit, contents []byte) error {
+	if edit.Target.Dename != sender {
+		return fmt.Errorf("%s tried to edit a message of %s", sender, edit.Target.Dename)
+	}
+	file, err := d.loadMessageFile(convName, &edit.Target)
+	if err != nil {
+		return err
+	} else if file == nil {
+		// the message may still be on its way
+		return d.holdEdit(convName, edit, contents)
+	}
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	path := filepath.Join(convDir, file.Name)
+	historyDir := filepath.Join(convDir, persistence.HistoryDirName)
+
+	switch edit.Action {
+	case proto.MessageEdit_REPLACE:
+		if metadata.History == proto.ConversationMetadata_KEEP {
+			if err := os.MkdirAll(historyDir, 0700); err != nil {
+				return err
+			}
+			if err := os.Rename(path, filepath.Join(historyDir, persistence.HistoryName(file.Name, file.Edits))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else if err := shred.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		file.Edits++
+		if err := d.MarshalToFile(messageIndexPath(convDir, &edit.Target), file); err != nil {
+			return err
+		}
+		if err := d.AtomicWriteFile(path, contents, 0600); err != nil {
+			return err
+		}
+		date, _, err := persistence.ParseMessageName(file.Name)
+		if err != nil {
+			return err
+		}
+		if err := d.UnindexMessages(convName, file.Name); err != nil {
+			return err
+		}
+		return d.IndexMessage(convName, file.Name, sender, date, contents)
+	case proto.MessageEdit_RETRACT:
+		return d.forgetMessages(convDir, file.Name)
+	}
+	return fmt.Errorf("unknown edit action %v", edit.Action)
+}
+
+// holdEdit keeps an edit of a message that has not arrived yet so that it can
+// be applied when the message does.
+func (d *Daemon) holdEdit(convName string, edit *proto.MessageEdit, contents []byte) error {
+	dir := heldEditsDir(filepath.Join(d.ConversationDir(), convName), &edit.Target)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	held, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	return d.MarshalToFile(filepath.Join(dir, fmt.Sprintf("%020d", len(held))), &proto.Message{Edit: edit, Contents: contents})
+}
+
+// applyHeldEdits applies the edits of message id that arrived before it, in
+// the order they arrived in.
+func (d *Daemon) applyHeldEdits(metadata *proto.ConversationMetadata, convName string, id *proto.MessageId) error {
+	dir := heldEditsDir(filepath.Join(d.ConversationDir(), convName), id)
+	held, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range held {
+		message := new(proto.Message)
+		if err := persistence.UnmarshalFromFile(filepath.Join(dir, fi.Name()), message); err != nil {
+			return err
+		}
+		if err := d.applyEdit(metadata, convName, id.Dename, message.Edit, message.Contents); err != nil {
+			return err
+		}
+	}
+	return shred.RemoveAll(dir)
+}
+
+// sendEdit sends an edit of one of our messages to the conversation and
+// applies it locally.
+func (d *Daemon) sendEdit(metadata *proto.ConversationMetadata, convName string, edit *proto.MessageEdit, contents []byte) error {
+	edit.Target.Dename = d.Dename
+	if file, err := d.loadMessageFile(convName, &edit.Target); err != nil {
+		return err
+	} else if file == nil {
+		return fmt.Errorf("edit of unknown message %d in \"%s\"", edit.Target.SequenceNumber, convName)
+	}
+	payload := d.newPayload(metadata, contents, d.Now())
+	payload.Edit = edit
+	d.sequenceOutgoing(metadata, payload)
+	if err := d.storeConversationMetadata(convName, metadata); err != nil {
+		return err
+	}
+	if err := d.sendToConversation(metadata, payload); err != nil {
+		return err
+	}
+	if err := d.applyEdit(metadata, convName, d.Dename, edit, contents); err != nil {
+		return err
+	}
+	return d.storeConversationMetadata(convName, metadata)
+}
+
+// applyHistory updates the edit history policy of a conversation if policy
+// supersedes the current one and returns true if it did.
+func applyHistory(metadata *proto.ConversationMetadata, policy *proto.HistoryPolicy) bool {
+	if policy.Version < metadata.HistoryVersion ||
+		policy.Version == metadata.HistoryVersion && (policy.Keep || metadata.History == proto.ConversationMetadata_DISCARD) {
+		return false
+	}
+	metadata.History = proto.ConversationMetadata_DISCARD
+	if policy.Keep {
+		metadata.History = proto.ConversationMetadata_KEEP
+	}
+	metadata.HistoryVersion = policy.Version
+	return true
+}
+
+// historyChanged stores the metadata of a conversation after its edit history
+// policy has changed. If history is no longer kept, the old contents of
+// edited messages are shredded.
+func (d *Daemon) historyChanged(metadata *proto.ConversationMetadata, convName string) error {
+	if err := d.storeConversationMetadata(convName, metadata); err != nil {
+		return err
+	}
+	if metadata.History == proto.ConversationMetadata_KEEP {
+		return nil
+	}
+	return shred.RemoveAll(filepath.Join(d.ConversationDir(), persistence.ConversationName(metadata), persistence.HistoryDirName))
+}
+
+// sendHistory sends a new edit history policy to the conversation and applies
+// it locally.
+func (d *Daemon) sendHistory(metadata *proto.ConversationMetadata, convName string, policy *proto.HistoryPolicy) error {
+	policy.Version = metadata.HistoryVersion + 1
+	payload := d.newPayload(metadata, nil, d.Now())
+	payload.History = policy
+	d.sequenceOutgoing(metadata, payload)
+	applyHistory(metadata, policy)
+	if err := d.historyChanged(metadata, convName); err != nil {
+		return err
+	}
+	return d.sendToConversation(metadata, payload)
+}
@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+func TestApplyEdit(t *testing.T) {
+	metadata := &proto.ConversationMetadata{
+		Participants: []string{"alice", "bob"},
+		History:      proto.ConversationMetadata_KEEP,
+	}
+	convName := persistence.ConversationName(metadata)
+	d := newTestDaemon(t, convName)
+	defer os.RemoveAll(d.RootDir)
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	name := persistence.MessageName(time.Unix(1, 0), "bob")
+	message := &proto.Message{Dename: "bob", SequenceNumber: 1, Contents: []byte("helo")}
+	if err := ioutil.WriteFile(filepath.Join(convDir, name), message.Contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.recordMessageFile(convName, name, message); err != nil {
+		t.Fatal(err)
+	}
+	target := proto.MessageId{Dename: "bob", SequenceNumber: 1}
+
+	edit := &proto.MessageEdit{Action: proto.MessageEdit_REPLACE, Target: target}
+	if err := d.applyEdit(metadata, convName, "alice", edit, []byte("forged")); err == nil {
+		t.Fatal("alice edited a message of bob")
+	}
+	if err := d.applyEdit(metadata, convName, "bob", edit, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(convDir, name)); err != nil || string(contents) != "hello" {
+		t.Fatalf("edited message: %q, %v", contents, err)
+	}
+	history := filepath.Join(convDir, persistence.HistoryDirName, persistence.HistoryName(name, 0))
+	if contents, err := ioutil.ReadFile(history); err != nil || string(contents) != "helo" {
+		t.Fatalf("history: %q, %v", contents, err)
+	}
+	if file, err := d.loadMessageFile(convName, &target); err != nil || file == nil || file.Edits != 1 {
+		t.Fatalf("message file: %v, %v", file, err)
+	}
+	if msgs, err := d.LoadMessages(metadata); err != nil || len(msgs) != 1 {
+		t.Fatalf("LoadMessages: %v, %v", msgs, err)
+	}
+
+	edit = &proto.MessageEdit{Action: proto.MessageEdit_RETRACT, Target: target}
+	if err := d.applyEdit(metadata, convName, "bob", edit, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(convDir, name), history} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after retraction", path)
+		}
+	}
+	if files, err := persistence.ReadMessageFiles(convDir); err != nil || len(files) != 0 {
+		t.Errorf("retracted message still indexed: %v, %v", files, err)
+	}
+}
+
+func TestHeldEdit(t *testing.T) {
+	metadata := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}}
+	convName := persistence.ConversationName(metadata)
+	d := newTestDaemon(t, convName)
+	defer os.RemoveAll(d.RootDir)
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	target := proto.MessageId{Dename: "bob", SequenceNumber: 1}
+	for _, contents := range []string{"hello", "hello!"} {
+		edit := &proto.MessageEdit{Action: proto.MessageEdit_REPLACE, Target: target}
+		if err := d.applyEdit(metadata, convName, "bob", edit, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the message arrives after its edits
+	name := persistence.MessageName(time.Unix(1, 0), "bob")
+	if err := ioutil.WriteFile(filepath.Join(convDir, name), []byte("helo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.recordMessageFile(convName, name, &proto.Message{Dename: "bob", SequenceNumber: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.applyHeldEdits(metadata, convName, &target); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(convDir, name)); err != nil || string(contents) != "hello!" {
+		t.Errorf("edited message: %q, %v", contents, err)
+	}
+	if file, err := d.loadMessageFile(convName, &target); err != nil || file == nil || file.Edits != 2 {
+		t.Errorf("message file: %v, %v", file, err)
+	}
+	if _, err := os.Stat(heldEditsDir(convDir, &target)); !os.IsNotExist(err) {
+		t.Errorf("held edits were kept after they were applied: %v", err)
+	}
+}
+
+func TestApplyHistory(t *testing.T) {
+	metadata := &proto.ConversationMetadata{}
+	for _, tc := range []struct {
+		keep    bool
+		version uint64
+		applied bool
+		history proto.ConversationMetadata_EditHistory
+	}{
+		{true, 1, true, proto.ConversationMetadata_KEEP},
+		{true, 1, false, proto.ConversationMetadata_KEEP},    // same
+		{false, 1, true, proto.ConversationMetadata_DISCARD}, // concurrent, discard
+		{true, 1, false, proto.ConversationMetadata_DISCARD}, // concurrent, keep
+		{true, 2, true, proto.ConversationMetadata_KEEP},
+		{false, 1, false, proto.ConversationMetadata_KEEP}, // old
+	} {
+		policy := &proto.HistoryPolicy{Keep: tc.keep, Version: tc.version}
+		if applied := applyHistory(metadata, policy); applied != tc.applied || metadata.History != tc.history {
+			t.Errorf("%v: applied = %v, history = %v; want %v, %v", policy, applied, metadata.History, tc.applied, tc.history)
+		}
+	}
+}
+
+func TestMigrateMessageFiles(t *testing.T) {
+	metadata := &proto.ConversationMetadata{
+		Participants: []string{"alice", "bob"},
+		Messages:     []proto.MessageFile{{Name: "message", Dename: "bob", SequenceNumber: 1, Edits: 2}},
+	}
+	convName := persistence.ConversationName(metadata)
+	d := newTestDaemon(t, convName)
+	defer os.RemoveAll(d.RootDir)
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	if err := d.MarshalToFile(filepath.Join(convDir, persistence.MetadataFileName), metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateMessageFiles(d); err != nil {
+		t.Fatal(err)
+	}
+	file, err := d.loadMessageFile(convName, &proto.MessageId{Dename: "bob", SequenceNumber: 1})
+	if err != nil || file == nil || file.Name != "message" || file.Edits != 2 {
+		t.Errorf("migrated message file: %v, %v", file, err)
+	}
+	stored, err := persistence.ReadConversationMetadata(convDir)
+	if err != nil || len(stored.Messages) != 0 {
+		t.Errorf("stored metadata: %v, %v", stored, err)
+	}
+}
@@ -3,12 +3,15 @@
 package daemon
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"golang.org/x/exp/fsnotify"
@@ -16,30 +19,67 @@ import (
 	"github.com/andres-erbsen/chatterbox/client/persistence"
 	"github.com/andres-erbsen/chatterbox/proto"
 	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/senderkey"
 	"github.com/andres-erbsen/chatterbox/shred"
 	dename "github.com/andres-erbsen/dename/protocol"
 )
 
 func (d *Daemon) privDir() string        { return filepath.Join(d.RootDir, ".daemon") }
-func (d *Daemon) profilesDir() string    { return filepath.Join(d.privDir(), "profile") }
 func (d *Daemon) prekeysPath() string    { return filepath.Join(d.privDir(), "prekeys.pb") }
 func (d *Daemon) ratchetKeysDir() string { return filepath.Join(d.privDir(), "ratchet") }
 func (d *Daemon) configPath() string     { return filepath.Join(d.privDir(), "config.pb") }
 
+// senderKeysDir contains the sender keys of other members of group
+// conversations, named by key ID. ourSenderKeysDir contains our sender keys,
+// named by conversation ID.
+func (d *Daemon) senderKeysDir() string    { return filepath.Join(d.privDir(), "senderkey") }
+func (d *Daemon) ourSenderKeysDir() string { return filepath.Join(d.privDir(), "oursenderkey") }
+
+// deferredDir contains received messages whose sender we have not looked up
+// yet, named by the hash of the envelope.
+func (d *Daemon) deferredDir() string { return filepath.Join(d.privDir(), "deferred") }
+
+// queueDir contains the outgoing messages that wait for a cover traffic slot,
+// named so that they sort in the order they were queued.
+func (d *Daemon) queueDir() string { return filepath.Join(d.privDir(), "queue") }
+
+// headerKeysDir contains the header keys of our sessions with each contact,
+// named by session ID, so that messages in a session whose ratchet has been
+// lost can still be attributed to the contact.
+func (d *Daemon) headerKeysDir() string { return filepath.Join(d.privDir(), "headerkeys") }
+
+// profilePushDir contains an empty file, named by contact, for each contact
+// that our latest dename profile has not been sent to yet.
+func (d *Daemon) profilePushDir() string { return filepath.Join(d.privDir(), "profilepush") }
+
 func (d *Daemon) ourDenameLookupReplyPath() string {
 	return filepath.Join(d.privDir(), "ourDenameLookupReply.pb")
 }
 
-//TODO: move to persistence and point somewhere other than daemon directory?
-func (d *Daemon) OurChatterboxProfilePath() string {
-	return filepath.Join(d.privDir(), "chatterbox-profile.pb")
+// ourDenameProfilePath contains the latest dename profile of ours whose
+// chatterbox profile differs from the one before it, and when we saw it.
+func (d *Daemon) ourDenameProfilePath() string {
+	return filepath.Join(d.privDir(), "ourDenameProfile.pb")
 }
 
-func (d *Daemon) ratchetPath(name string) string {
+// ratchetDir contains the ratchet sessions with a contact, named by session ID.
+func (d *Daemon) ratchetDir(name string) string {
 	return filepath.Join(d.ratchetKeysDir(), encoding.EscapeFilename(name))
 }
-func (d *Daemon) profilePath(name string) string {
-	return filepath.Join(d.profilesDir(), encoding.EscapeFilename(name))
+func (d *Daemon) ratchetPath(name string, sessionID *proto.Byte32) string {
+	return filepath.Join(d.ratchetDir(name), hex.EncodeToString(sessionID[:]))
+}
+func (d *Daemon) profilePushPath(name string) string {
+	return filepath.Join(d.profilePushDir(), encoding.EscapeFilename(name))
+}
+func (d *Daemon) headerKeysPath(name string, sessionID *proto.Byte32) string {
+	return filepath.Join(d.headerKeysDir(), encoding.EscapeFilename(name), hex.EncodeToString(sessionID[:]))
+}
+func (d *Daemon) senderKeyPath(id *[32]byte) string {
+	return filepath.Join(d.senderKeysDir(), hex.EncodeToString(id[:]))
+}
+func (d *Daemon) ourSenderKeyPath(conversationID *proto.Byte32) string {
+	return filepath.Join(d.ourSenderKeysDir(), hex.EncodeToString(conversationID[:]))
 }
 
 // Copy copyes the contents of file source to dest. NOT atomic.
@@ -66,7 +106,10 @@ func Copy(source string, dest string, perm os.FileMode) error {
 	return cerr
 }
 
+// LoadPrekeys also loads the ML-KEM secrets of hybrid prekeys into
+// d.prekeyKEMSecrets, StorePrekeys stores those that are still needed.
 func LoadPrekeys(d *Daemon) ([]*[32]byte, []*[32]byte, error) {
+	d.prekeyKEMSecrets = make(map[[32]byte][]byte)
 	prekeysProto := new(proto.Prekeys)
 	err := persistence.UnmarshalFromFile(d.prekeysPath(), prekeysProto)
 	if err != nil {
@@ -79,12 +122,18 @@ func LoadPrekeys(d *Daemon) ([]*[32]byte, []*[32]byte, error) {
 	if len(prekeysProto.PrekeyPublics) != len(prekeysProto.PrekeySecrets) {
 		return nil, nil, fmt.Errorf("len(prekeysProto.prekeyPublics) != len(prekeysProto.prekeySecrets)")
 	}
+	if len(prekeysProto.PrekeyKEMSecrets) != 0 && len(prekeysProto.PrekeyKEMSecrets) != len(prekeysProto.PrekeyPublics) {
+		return nil, nil, fmt.Errorf("len(prekeysProto.PrekeyKEMSecrets) != len(prekeysProto.prekeyPublics)")
+	}
 	// convert protobuf proto.Byte32 to *[32]byte
 	prekeySecrets := make([]*[32]byte, len(prekeysProto.PrekeySecrets))
 	prekeyPublics := make([]*[32]byte, len(prekeysProto.PrekeyPublics))
 	for i := 0; i < len(prekeySecrets); i++ {
 		prekeySecrets[i] = (*[32]byte)(&prekeysProto.PrekeySecrets[i])
 		prekeyPublics[i] = (*[32]byte)(&prekeysProto.PrekeyPublics[i])
+		if len(prekeysProto.PrekeyKEMSecrets) != 0 && len(prekeysProto.PrekeyKEMSecrets[i]) != 0 {
+			d.prekeyKEMSecrets[*prekeyPublics[i]] = prekeysProto.PrekeyKEMSecrets[i]
+		}
 	}
 	return prekeyPublics, prekeySecrets, nil
 }
@@ -95,13 +144,21 @@ func StorePrekeys(d *Daemon, prekeyPublics, prekeySecrets []*[32]byte) error {
 	}
 	// convert [32]byte to proto.Byte32
 	prekeysProto := proto.Prekeys{
-		PrekeySecrets: make([]proto.Byte32, len(prekeySecrets)),
-		PrekeyPublics: make([]proto.Byte32, len(prekeySecrets)),
+		PrekeySecrets:    make([]proto.Byte32, len(prekeySecrets)),
+		PrekeyPublics:    make([]proto.Byte32, len(prekeySecrets)),
+		PrekeyKEMSecrets: make([][]byte, len(prekeySecrets)),
 	}
+	// the KEM secrets of prekeys that have been used are dropped here
+	kemSecrets := make(map[[32]byte][]byte)
 	for i := 0; i < len(prekeyPublics); i++ {
 		prekeysProto.PrekeySecrets[i] = (proto.Byte32)(*prekeySecrets[i])
 		prekeysProto.PrekeyPublics[i] = (proto.Byte32)(*prekeyPublics[i])
+		if kemSecret, ok := d.prekeyKEMSecrets[*prekeyPublics[i]]; ok {
+			prekeysProto.PrekeyKEMSecrets[i] = kemSecret
+			kemSecrets[*prekeyPublics[i]] = kemSecret
+		}
 	}
+	d.prekeyKEMSecrets = kemSecrets
 	return d.MarshalToFile(d.prekeysPath(), &prekeysProto)
 }
 
@@ -109,74 +166,286 @@ func StoreLocalAccountConfig(d *Daemon, localAccountConfig *proto.LocalAccountCo
 	return d.MarshalToFile(d.configPath(), localAccountConfig)
 }
 
-func LoadRatchet(d *Daemon, name string, fillAuth func(tag, data []byte, theirAuthPublic *[32]byte), checkAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error) (*ratchet.Ratchet, error) {
+// loadRatchetFile loads a ratchet and applies the session limits of d to it.
+func (d *Daemon) loadRatchetFile(path string, fillAuth func(tag, data []byte, theirAuthPublic *[32]byte), checkAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error) (*ratchet.Ratchet, error) {
 	ratch := new(ratchet.Ratchet)
-	if err := persistence.UnmarshalFromFile(d.ratchetPath(name), ratch); err != nil {
+	if err := persistence.UnmarshalFromFile(path, ratch); err != nil {
 		return nil, err
 	}
 	ratch.FillAuth = fillAuth
 	ratch.CheckAuth = checkAuth
-	return ratch, nil
+	return d.withSessionLimits(ratch), nil
+}
+
+// LoadRatchet loads the session that should be used for sending to name.
+func LoadRatchet(d *Daemon, name string, fillAuth func(tag, data []byte, theirAuthPublic *[32]byte), checkAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error) (*ratchet.Ratchet, error) {
+	sessions, err := d.liveSessions(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("no ratchet session with \"%s\"", name)
+	}
+	return d.loadRatchetFile(filepath.Join(d.ratchetDir(name), sessions[0]), fillAuth, checkAuth)
 }
 
+// StoreRatchet stores a session with name, keeping it retired if it was.
 func StoreRatchet(d *Daemon, name string, ratch *ratchet.Ratchet) error {
-	return d.MarshalToFile(d.ratchetPath(name), ratch)
+	path := d.ratchetPath(name, ratch.GetSessionId())
+	if _, err := os.Stat(path + retiredSessionSuffix); err == nil {
+		path += retiredSessionSuffix
+	}
+	if err := os.MkdirAll(d.ratchetDir(name), 0700); err != nil {
+		return err
+	}
+	if err := d.MarshalToFile(path, ratch); err != nil {
+		return err
+	}
+	return d.indexRatchet(name, ratch)
+}
+
+func LoadSenderKey(path string) (*senderkey.SenderKey, error) {
+	key := new(senderkey.SenderKey)
+	if err := persistence.UnmarshalFromFile(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func StoreSenderKey(d *Daemon, path string, key *senderkey.SenderKey) error {
+	if err := d.MarshalToFile(path, key); err != nil {
+		return err
+	}
+	if !key.Ours() {
+		d.indexSenderKey(key.ID())
+	}
+	return nil
+}
+
+// ForgetSenderKeys removes the sender keys of the given members of a
+// conversation. Our own key is removed if we are one of them.
+func ForgetSenderKeys(d *Daemon, conversationID *proto.Byte32, members []string) error {
+	files, err := ioutil.ReadDir(d.senderKeysDir())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(d.senderKeysDir(), file.Name())
+		key, err := LoadSenderKey(path)
+		if err != nil {
+			return fmt.Errorf("failed to parse sender key \"%s\": %s", file.Name(), err)
+		}
+		if (proto.Byte32)(key.ConversationID) == *conversationID && contains(members, key.Sender) {
+			if err := shred.Remove(path); err != nil {
+				return err
+			}
+			d.unindexSenderKey(key.ID())
+		}
+	}
+	if contains(members, d.Dename) {
+		if err := shred.Remove(d.ourSenderKeyPath(conversationID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 func (d *Daemon) LatestProfile(name string, received *dename.Profile) (*dename.Profile, error) {
 	stored := new(dename.Profile)
-	err := persistence.UnmarshalFromFile(d.profilePath(name), stored)
+	err := persistence.UnmarshalFromFile(d.ProfilePath(name), stored)
 	if err != nil {
 		stored = nil
 	}
 	if received != nil && (stored == nil || *received.Version > *stored.Version) {
-		return received, d.MarshalToFile(d.profilePath(name), received)
+		if err := d.profileReplaced(name, stored, received); err != nil {
+			log.Printf("new profile of %s: %s", name, err)
+		}
+		return received, d.MarshalToFile(d.ProfilePath(name), received)
 	}
 	return stored, nil
 }
 
+// AllRatchets loads all sessions with all contacts, including retired ones.
 func AllRatchets(d *Daemon, fillAuth func(tag, data []byte, theirAuthPublic *[32]byte), checkAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error) ([]*ratchet.Ratchet, error) {
-	files, err := ioutil.ReadDir(d.ratchetKeysDir())
+	contacts, err := ioutil.ReadDir(d.ratchetKeysDir())
 	if err != nil {
 		return nil, err
 	}
-	ret := make([]*ratchet.Ratchet, 0, len(files))
+	var ret []*ratchet.Ratchet
+	for _, contact := range contacts {
+		if !contact.IsDir() {
+			continue
+		}
+		dir := filepath.Join(d.ratchetKeysDir(), contact.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			ratch, err := d.loadRatchetFile(filepath.Join(dir, file.Name()), fillAuth, checkAuth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse ratchet for \"%s\": %s", contact.Name(), err)
+			}
+			ret = append(ret, ratch)
+		}
+	}
+	return ret, nil
+}
+
+// migrateRatchets moves ratchets stored by older versions, one file per
+// contact, into the session directory of the contact. The directory is staged
+// next to the old file under ratchetMigrationPrefix, then the old file is
+// removed and the staged directory renamed into its place, so that a migration
+// interrupted at any step is finished on the next start.
+func migrateRatchets(d *Daemon) error {
+	files, err := ioutil.ReadDir(d.ratchetKeysDir())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.IsDir() || !strings.HasPrefix(file.Name(), ratchetMigrationPrefix) {
+			continue
+		}
+		staged := filepath.Join(d.ratchetKeysDir(), file.Name())
+		sessions, err := ioutil.ReadDir(staged)
+		if err != nil {
+			return err
+		}
+		if len(sessions) == 0 {
+			// interrupted before the ratchet was copied; the old file is
+			// still there and is migrated below
+			if err := os.Remove(staged); err != nil {
+				return err
+			}
+			continue
+		}
+		path := filepath.Join(d.ratchetKeysDir(), strings.TrimPrefix(file.Name(), ratchetMigrationPrefix))
+		if err := finishRatchetMigration(staged, path); err != nil {
+			return err
+		}
+	}
+
+	if files, err = ioutil.ReadDir(d.ratchetKeysDir()); err != nil {
+		return err
+	}
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
-		ratch := new(ratchet.Ratchet)
-		err := persistence.UnmarshalFromFile(filepath.Join(d.ratchetKeysDir(), file.Name()), ratch)
+		path := filepath.Join(d.ratchetKeysDir(), file.Name())
+		ratch, err := d.loadRatchetFile(path, nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to parse ratchet for \"%s\": %s", file.Name(), err)
+		}
+		ratchBytes, err := ioutil.ReadFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse ratchet for \"%s\": %s", file.Name(), err)
+			return err
+		}
+		staged := filepath.Join(d.ratchetKeysDir(), ratchetMigrationPrefix+file.Name())
+		if err := os.Mkdir(staged, 0700); err != nil {
+			return err
+		}
+		if err := d.AtomicWriteFile(filepath.Join(staged, hex.EncodeToString(ratch.GetSessionId()[:])), ratchBytes, 0600); err != nil {
+			return err
+		}
+		if err := finishRatchetMigration(staged, path); err != nil {
+			return err
 		}
-		ratch.FillAuth = fillAuth
-		ratch.CheckAuth = checkAuth
-		ret = append(ret, ratch)
 	}
-	return ret, nil
+	return nil
 }
 
-func InitFs(d *Daemon) error {
-	// create root directory and immediate sub directories
-	os.MkdirAll(d.RootDir, 0700)
-	subdirs := []string{
+// ratchetMigrationPrefix starts the names of the directories staged by
+// migrateRatchets. EscapeFilename never produces it.
+const ratchetMigrationPrefix = "%migrating%"
+
+// finishRatchetMigration replaces the ratchet file of an older version at path
+// with the session directory staged for it.
+func finishRatchetMigration(staged, path string) error {
+	if err := shred.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(staged, path)
+}
+
+// migrateMessageFiles moves the message index of conversations stored by
+// older versions out of their metadata.
+func migrateMessageFiles(d *Daemon) error {
+	conversations, err := ioutil.ReadDir(d.ConversationDir())
+	if err != nil {
+		return err
+	}
+	for _, conversation := range conversations {
+		if !conversation.IsDir() {
+			continue
+		}
+		convName := conversation.Name()
+		metadata := new(proto.ConversationMetadata)
+		if err := persistence.UnmarshalFromFile(filepath.Join(d.ConversationDir(), convName, persistence.MetadataFileName), metadata); err != nil {
+			return fmt.Errorf("failed to parse metadata of \"%s\": %s", convName, err)
+		}
+		if len(metadata.Messages) == 0 {
+			continue
+		}
+		convDir := filepath.Join(d.ConversationDir(), convName)
+		if err := os.MkdirAll(filepath.Join(convDir, persistence.MessageIndexDirName), 0700); err != nil {
+			return err
+		}
+		for i := range metadata.Messages {
+			file := &metadata.Messages[i]
+			id := &proto.MessageId{Dename: file.Dename, SequenceNumber: file.SequenceNumber}
+			if err := d.MarshalToFile(messageIndexPath(convDir, id), file); err != nil {
+				return err
+			}
+		}
+		metadata.Messages = nil
+		if err := d.storeConversationMetadata(convName, metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subdirs returns the directories the daemon keeps its state in.
+func (d *Daemon) subdirs() []string {
+	return []string{
 		d.ConversationDir(),
 		d.OutboxDir(),
 		d.TempDir(),
 		d.privDir(),
-		d.profilesDir(),
+		d.ProfileDir(),
 		d.ratchetKeysDir(),
+		d.headerKeysDir(),
+		d.senderKeysDir(),
+		d.ourSenderKeysDir(),
+		d.deferredDir(),
+		d.queueDir(),
+		d.profilePushDir(),
 	}
-	for _, dir := range subdirs {
+}
+
+func InitFs(d *Daemon) error {
+	// create root directory and immediate sub directories
+	os.MkdirAll(d.RootDir, 0700)
+	for _, dir := range d.subdirs() {
 		os.MkdirAll(dir, 0700) // FIXME: handle error
 	}
+	if err := migrateRatchets(d); err != nil {
+		return err
+	}
+	if err := migrateMessageFiles(d); err != nil {
+		return err
+	}
 
 	// for each existing conversation, create a folder in the outbox
 	copyToOutbox := func(cPath string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if f.IsDir() && cPath != d.ConversationDir() && filepath.Dir(cPath) != d.ConversationDir() {
+			// the edit history, message index and held edits of a conversation
+			return filepath.SkipDir
+		}
 		if cPath != d.ConversationDir() {
 			if f.IsDir() {
 				// create the outbox directory in tmp, then (atomically) move it to outbox
@@ -0,0 +1,545 @@
+// group conversations: sender keys and signed membership changes
+
+package daemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/agl/ed25519"
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/senderkey"
+	dename "github.com/andres-erbsen/dename/protocol"
+)
+
+var errNoSenderKey = errors.New("no sender key for message")
+
+var membershipChangeLabel = []byte("chatterbox membership change")
+
+// isGroup returns true if messages in the conversation should be encrypted
+// with sender keys. Conversations between two people use the pairwise ratchet
+// directly.
+func isGroup(metadata *proto.ConversationMetadata) bool {
+	return len(metadata.Participants) > 2
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newConversationID() (*proto.Byte32, error) {
+	id := new(proto.Byte32)
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// membershipChangeSigned returns the bytes covered by the signature of a
+// membership change.
+func membershipChangeSigned(conversationID *proto.Byte32, change *proto.MembershipChange) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	ret := append([]byte{}, membershipChangeLabel...)
+	ret = append(ret, conversationID[:]...)
+	ret = append(ret, buf[:binary.PutUvarint(buf[:], change.Version)]...)
+	ret = append(ret, buf[:binary.PutUvarint(buf[:], uint64(change.Action))]...)
+	for _, member := range change.Members {
+		ret = append(ret, buf[:binary.PutUvarint(buf[:], uint64(len(member)))]...)
+		ret = append(ret, member...)
+	}
+	return ret
+}
+
+// membershipChangeHash identifies a signed membership change by signer. It
+// orders concurrent changes with the same version.
+func membershipChangeHash(conversationID *proto.Byte32, signer string, change *proto.MembershipChange) *proto.Byte32 {
+	h := sha256.New()
+	h.Write(membershipChangeSigned(conversationID, change))
+	h.Write([]byte(signer))
+	h.Write(change.Signature)
+	ret := new(proto.Byte32)
+	copy(ret[:], h.Sum(nil))
+	return ret
+}
+
+func signMembershipChange(conversationID *proto.Byte32, change *proto.MembershipChange, sk *[64]byte) {
+	change.Signature = ed25519.Sign(sk, membershipChangeSigned(conversationID, change))[:]
+}
+
+func verifyMembershipChange(conversationID *proto.Byte32, change *proto.MembershipChange, pk *[32]byte) bool {
+	if len(change.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	var sig [ed25519.SignatureSize]byte
+	copy(sig[:], change.Signature)
+	return ed25519.Verify(pk, membershipChangeSigned(conversationID, change), &sig)
+}
+
+// applyMembershipChange returns the participants of a conversation after
+// signer has made change to it, or an error if signer is not allowed to.
+func applyMembershipChange(participants []string, signer string, change *proto.MembershipChange) ([]string, error) {
+	if !contains(participants, signer) {
+		return nil, fmt.Errorf("%s is not a member of the conversation", signer)
+	}
+	if len(change.Members) == 0 {
+		return nil, errors.New("membership change without members")
+	}
+	var ret []string
+	switch change.Action {
+	case proto.MembershipChange_ADD:
+		ret = append([]string{}, participants...)
+		for _, member := range change.Members {
+			if contains(ret, member) {
+				return nil, fmt.Errorf("%s is already a member of the conversation", member)
+			}
+			ret = append(ret, member)
+		}
+	case proto.MembershipChange_REMOVE, proto.MembershipChange_LEAVE:
+		if change.Action == proto.MembershipChange_LEAVE && (len(change.Members) != 1 || change.Members[0] != signer) {
+			return nil, errors.New("only the leaving member can be named in a leave")
+		}
+		if change.Action == proto.MembershipChange_REMOVE && contains(change.Members, signer) {
+			return nil, errors.New("members remove themselves by leaving")
+		}
+		for _, member := range change.Members {
+			if !contains(participants, member) {
+				return nil, fmt.Errorf("%s is not a member of the conversation", member)
+			}
+		}
+		for _, p := range participants {
+			if !contains(change.Members, p) {
+				ret = append(ret, p)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown membership change action %v", change.Action)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// previousParticipants undoes change: it returns the participants of a
+// conversation before change turned them into participants.
+func previousParticipants(participants []string, change *proto.MembershipChange) []string {
+	var ret []string
+	if change.Action == proto.MembershipChange_ADD {
+		for _, p := range participants {
+			if !contains(change.Members, p) {
+				ret = append(ret, p)
+			}
+		}
+	} else {
+		ret = undupStrings(append(append([]string{}, participants...), change.Members...))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// chatProfile returns the chatterbox profile of a user whose dename profile
+// we have stored.
+func (d *Daemon) chatProfile(name string) (*proto.Profile, error) {
+	profile := new(dename.Profile)
+	if err := persistence.UnmarshalFromFile(d.ProfilePath(name), profile); err != nil {
+		return nil, err
+	}
+	return util.ChatProfile(profile)
+}
+
+// sendPairwise sends a marshalled proto.Message to one recipient using the
+// pairwise ratchet, establishing it if necessary.
+func (d *Daemon) sendPairwise(msg []byte, recipient string) error {
+	if msgRatch, err := LoadRatchet(d, recipient, d.fillAuth, d.checkAuth); err != nil {
+		return d.sendFirstMessage(msg, recipient)
+	} else {
+		return d.sendMessage(msg, recipient, msgRatch)
+	}
+}
+
+// uploadEnvelope uploads an already encrypted envelope to recipient, or
+// queues it for the next cover traffic slot.
+func (d *Daemon) uploadEnvelope(envelope []byte, recipient string) error {
+	if d.coverTrafficInterval() != 0 {
+		return d.queueMessage(&proto.QueuedMessage{Dename: recipient, Envelope: envelope})
+	}
+	return d.deliverEnvelope(envelope, recipient)
+}
+
+// deliverEnvelope uploads an already encrypted envelope to recipient right
+// away. Connections are cached by server so that fanning out a group message
+// costs one connection per server, not one per recipient.
+func (d *Daemon) deliverEnvelope(envelope []byte, recipient string) error {
+	chatProfile, err := d.chatProfile(recipient)
+	if err != nil {
+		return err
+	}
+	if d.relayTo(chatProfile) {
+		return d.relayEnvelope(envelope, chatProfile)
+	}
+	addrs := d.serverAddresses(chatProfile)
+	pkTransport := (*[32]byte)(&chatProfile.ServerTransportPK)
+	theirPk := (*[32]byte)(&chatProfile.UserIDAtServer)
+	cacheKey := addrs[0]
+
+	conn, err := d.cc.DialServerReplicas(cacheKey, addrs, pkTransport, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := util.UploadMessageToUser(conn, make([]byte, proto.SERVER_MESSAGE_SIZE), theirPk, envelope); err != nil {
+		conn.Close()
+		d.cc.PutClose(cacheKey)
+		return err
+	}
+	d.cc.Put(cacheKey, conn)
+	return nil
+}
+
+// ourSenderKey loads our sender key for a conversation, generating a new one
+// if there is none.
+func (d *Daemon) ourSenderKey(metadata *proto.ConversationMetadata) (*senderkey.SenderKey, error) {
+	key, err := LoadSenderKey(d.ourSenderKeyPath(metadata.Id))
+	if err == nil || !os.IsNotExist(err) {
+		return key, err
+	}
+	key, err = senderkey.New(rand.Reader, d.Dename, (*[32]byte)(metadata.Id))
+	if err != nil {
+		return nil, err
+	}
+	return key, StoreSenderKey(d, d.ourSenderKeyPath(metadata.Id), key)
+}
+
+// sendToConversation sends payload to all other participants of a
+// conversation.
+func (d *Daemon) sendToConversation(metadata *proto.ConversationMetadata, payload *proto.Message) error {
+	if isGroup(metadata) {
+		return d.sendGroupMessage(metadata, payload)
+	}
+	msg, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	for _, recipient := range metadata.Participants {
+		if recipient == d.Dename {
+			continue
+		}
+		if err := d.sendPairwise(msg, recipient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendGroupMessage sends payload to all other participants of a group
+// conversation. Participants who do not have our sender key yet receive it
+// together with the message over the pairwise ratchet, everybody else gets a
+// single ciphertext encrypted with the sender key.
+func (d *Daemon) sendGroupMessage(metadata *proto.ConversationMetadata, payload *proto.Message) error {
+	key, err := d.ourSenderKey(metadata)
+	if err != nil {
+		return err
+	}
+	var fresh, rest []string
+	for _, recipient := range metadata.Participants {
+		if recipient == d.Dename {
+			continue
+		} else if contains(key.DistributedTo, recipient) {
+			rest = append(rest, recipient)
+		} else {
+			fresh = append(fresh, recipient)
+		}
+	}
+
+	if len(fresh) != 0 {
+		withKey := *payload
+		withKey.SenderKey = key.Proto()
+		msg, err := withKey.Marshal()
+		if err != nil {
+			return err
+		}
+		for _, recipient := range fresh {
+			if err := d.sendPairwise(msg, recipient); err != nil {
+				return err
+			}
+			key.DistributedTo = append(key.DistributedTo, recipient)
+			if err := StoreSenderKey(d, d.ourSenderKeyPath(metadata.Id), key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(rest) != 0 {
+		msg, err := payload.Marshal()
+		if err != nil {
+			return err
+		}
+		envelope, err := key.Encrypt(nil, proto.Pad(msg, proto.MAX_MESSAGE_SIZE-senderkey.Overhead))
+		if err != nil {
+			return err
+		}
+		// the used message key must never be used again, even if we crash
+		if err := StoreSenderKey(d, d.ourSenderKeyPath(metadata.Id), key); err != nil {
+			return err
+		}
+		for _, recipient := range rest {
+			if err := d.uploadEnvelope(envelope, recipient); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decryptGroupMessage decrypts an envelope encrypted with a sender key. It
+// returns errNoSenderKey if the envelope is not for any known sender key.
+func (d *Daemon) decryptGroupMessage(envelope []byte) (*proto.Message, *senderkey.SenderKey, error) {
+	keyID, err := d.findSenderKey(envelope)
+	if err != nil {
+		return nil, nil, err
+	} else if keyID == nil {
+		return nil, nil, errNoSenderKey
+	}
+	key, err := LoadSenderKey(d.senderKeyPath(keyID))
+	if os.IsNotExist(err) {
+		d.unindexSenderKey(keyID)
+		return nil, nil, errNoSenderKey
+	} else if err != nil {
+		return nil, nil, err
+	}
+	msg, err := key.Decrypt(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	message := new(proto.Message)
+	if err := message.Unmarshal(proto.Unpad(msg)); err != nil {
+		return nil, nil, err
+	}
+	if message.Dename != key.Sender || message.ConversationId == nil || *message.ConversationId != (proto.Byte32)(key.ConversationID) {
+		return nil, nil, fmt.Errorf("sender key of %s used by %s or in another conversation", key.Sender, message.Dename)
+	}
+	if message.SenderKey != nil || message.MembershipChange != nil {
+		return nil, nil, errors.New("control message encrypted with a sender key")
+	}
+	return message, key, nil
+}
+
+// conversationByID returns the metadata of the conversation with the given ID
+// and its name, or nil if we do not know of such a conversation.
+func (d *Daemon) conversationByID(id *proto.Byte32) (*proto.ConversationMetadata, string, error) {
+	conversations, err := d.ListConversations()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, metadata := range conversations {
+		if metadata.Id != nil && *metadata.Id == *id {
+			return metadata, persistence.ConversationName(metadata), nil
+		}
+	}
+	return nil, "", nil
+}
+
+// storeConversationMetadata writes the metadata of the conversation
+// currently called oldName and renames its directories to match the new
+// metadata.
+func (d *Daemon) storeConversationMetadata(oldName string, metadata *proto.ConversationMetadata) error {
+	newName := persistence.ConversationName(metadata)
+	for _, dir := range []string{d.ConversationDir(), d.OutboxDir()} {
+		oldDir := filepath.Join(dir, oldName)
+		if _, err := os.Stat(oldDir); os.IsNotExist(err) {
+			continue
+		}
+		if err := d.MarshalToFile(filepath.Join(oldDir, persistence.MetadataFileName), metadata); err != nil {
+			return err
+		}
+		if newName != oldName {
+			if err := os.Rename(oldDir, filepath.Join(dir, newName)); err != nil {
+				return err
+			}
+		}
+	}
+	if newName != oldName {
+		return d.RenameIndexedConversation(oldName, newName)
+	}
+	return nil
+}
+
+// receivingConversation finds (or creates) the conversation a received
+// message belongs to. Once we know a conversation, its participants are only
+// changed by verified membership changes, not by what senders claim.
+func (d *Daemon) receivingConversation(message *proto.Message) (*proto.ConversationMetadata, string, error) {
+	metadata, convName, err := d.conversationByID(message.ConversationId)
+	if err != nil {
+		return nil, "", err
+	}
+	if metadata == nil {
+		// a conversation started before it had an ID, or before both sides
+		// picked the same one. An unsigned message does not change an ID we
+		// already have: otherwise any member could move the conversation to
+		// an ID of their choosing. Signed membership changes merge the IDs
+		// in receiveMembershipChange.
+		claimed := &proto.ConversationMetadata{
+			Participants: message.Participants,
+			Subject:      message.Subject,
+		}
+		convName = persistence.ConversationName(claimed)
+		existing, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+		if err == nil {
+			metadata = existing
+			if metadata.Id == nil {
+				metadata.Id = message.ConversationId
+				if err := d.storeConversationMetadata(convName, metadata); err != nil {
+					return nil, "", err
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+	}
+	if metadata == nil {
+		// a new conversation: we have no choice but to believe the participant
+		// list of whoever added us.
+		participants := undupStrings(message.Participants)
+		sort.Strings(participants)
+		if !contains(participants, d.Dename) || !contains(participants, message.Dename) {
+			return nil, "", fmt.Errorf("%s sent a message in a conversation %s is not in", message.Dename, d.Dename)
+		}
+		metadata = &proto.ConversationMetadata{
+			Participants: participants,
+			Subject:      message.Subject,
+			Id:           message.ConversationId,
+		}
+		if change := message.MembershipChange; change != nil {
+			metadata.MembershipVersion = change.Version
+			metadata.MembershipChangeHash = membershipChangeHash(message.ConversationId, message.Dename, change)
+			metadata.PreviousParticipants = previousParticipants(participants, change)
+		}
+		convName = persistence.ConversationName(metadata)
+		if err := d.conversationToConversations(metadata); err != nil {
+			return nil, "", err
+		}
+	} else if !contains(metadata.Participants, message.Dename) {
+		return nil, "", fmt.Errorf("%s is not a member of \"%s\"", message.Dename, convName)
+	}
+	return metadata, convName, nil
+}
+
+// receiveMembershipChange verifies a membership change made by another
+// member and applies it to the conversation. Two members may change the
+// membership at the same time, both with the next version. Everybody then
+// keeps the change with the lower hash, whichever they saw first, so that the
+// group does not split. Members only added by the change that lost are not
+// told, and a change made on top of the losing one before the winning one
+// arrived still splits the group.
+//
+// A change signed in a conversation with another ID, which another member
+// started at the same time as ours, merges the two: the lower ID wins.
+func (d *Daemon) receiveMembershipChange(metadata *proto.ConversationMetadata, convName string, message *proto.Message) error {
+	change := message.MembershipChange
+	id := metadata.Id
+	if message.ConversationId != nil {
+		id = message.ConversationId
+	}
+	hash := membershipChangeHash(id, message.Dename, change)
+	var previous []string
+	switch {
+	case change.Version == metadata.MembershipVersion && metadata.MembershipChangeHash != nil:
+		if bytes.Compare(hash[:], metadata.MembershipChangeHash[:]) >= 0 {
+			return nil // already applied, or lost to the change we applied
+		}
+		previous = metadata.PreviousParticipants
+	case change.Version <= metadata.MembershipVersion:
+		return nil // already applied: we were added to the conversation by it
+	case change.Version == metadata.MembershipVersion+1:
+		previous = metadata.Participants
+	default:
+		return fmt.Errorf("membership change version %d does not follow %d", change.Version, metadata.MembershipVersion)
+	}
+	chatProfile, err := d.chatProfile(message.Dename)
+	if err != nil {
+		return err
+	}
+	if !verifyMembershipChange(id, change, (*[32]byte)(&chatProfile.KeySigningKey)) {
+		return fmt.Errorf("invalid signature on membership change by %s", message.Dename)
+	}
+	participants, err := applyMembershipChange(previous, message.Dename, change)
+	if err != nil {
+		return err
+	}
+	if metadata.Id == nil || bytes.Compare(id[:], metadata.Id[:]) < 0 {
+		metadata.Id = id
+	}
+	return d.changeMembership(metadata, convName, message.Dename, previous, participants, change)
+}
+
+// changeMembership records a verified membership change by signer that
+// turned previous into participants. When somebody leaves, or a change that
+// added them loses to another one, every remaining member starts using a new
+// sender key so that the former member cannot read any further messages.
+func (d *Daemon) changeMembership(metadata *proto.ConversationMetadata, convName, signer string, previous, participants []string, change *proto.MembershipChange) error {
+	var dropped []string
+	for _, p := range metadata.Participants {
+		if !contains(participants, p) {
+			dropped = append(dropped, p)
+		}
+	}
+	metadata.PreviousParticipants = previous
+	metadata.Participants = participants
+	metadata.MembershipVersion = change.Version
+	metadata.MembershipChangeHash = membershipChangeHash(metadata.Id, signer, change)
+	if err := d.storeConversationMetadata(convName, metadata); err != nil {
+		return err
+	}
+	if len(dropped) != 0 {
+		if err := ForgetSenderKeys(d, metadata.Id, append([]string{d.Dename}, dropped...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendMembershipChange signs a membership change, sends it to everybody
+// affected and applies it.
+func (d *Daemon) sendMembershipChange(metadata *proto.ConversationMetadata, convName string, change *proto.MembershipChange) error {
+	change.Version = metadata.MembershipVersion + 1
+	if change.Action == proto.MembershipChange_LEAVE {
+		change.Members = []string{d.Dename}
+	}
+	participants, err := applyMembershipChange(metadata.Participants, d.Dename, change)
+	if err != nil {
+		return err
+	}
+	var sk [64]byte
+	copy(sk[:], d.KeySigningSecretKey[:64])
+	signMembershipChange(metadata.Id, change, &sk)
+
+	payload := d.newPayload(metadata, nil, d.Now())
+	payload.Participants = participants
+	payload.MembershipChange = change
+	msg, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	// removed members are told too, so that they stop sending to the group
+	for _, recipient := range undupStrings(append(append([]string{}, metadata.Participants...), participants...)) {
+		if recipient == d.Dename {
+			continue
+		}
+		if err := d.sendPairwise(msg, recipient); err != nil {
+			log.Printf("membership change to %s: %s", recipient, err)
+		}
+	}
+	return d.changeMembership(metadata, convName, d.Dename, metadata.Participants, participants, change)
+}
@@ -0,0 +1,244 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/agl/ed25519"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/senderkey"
+)
+
+func TestMembershipChangeSignature(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := &proto.Byte32{1}
+	change := &proto.MembershipChange{
+		Action:  proto.MembershipChange_ADD,
+		Members: []string{"carol"},
+		Version: 1,
+	}
+	signMembershipChange(id, change, sk)
+	if !verifyMembershipChange(id, change, pk) {
+		t.Fatal("valid signature rejected")
+	}
+
+	change.Members = []string{"carol", "mallory"}
+	if verifyMembershipChange(id, change, pk) {
+		t.Error("signature accepted for different members")
+	}
+	change.Members = []string{"carol"}
+	change.Version = 2
+	if verifyMembershipChange(id, change, pk) {
+		t.Error("signature accepted for a different version")
+	}
+	change.Version = 1
+	if verifyMembershipChange(&proto.Byte32{2}, change, pk) {
+		t.Error("signature accepted in a different conversation")
+	}
+}
+
+func TestApplyMembershipChange(t *testing.T) {
+	participants := []string{"alice", "bob", "carol"}
+	for _, tc := range []struct {
+		signer string
+		action proto.MembershipChange_Action
+		member []string
+		result []string
+	}{
+		{"alice", proto.MembershipChange_ADD, []string{"dave"}, []string{"alice", "bob", "carol", "dave"}},
+		{"alice", proto.MembershipChange_REMOVE, []string{"bob"}, []string{"alice", "carol"}},
+		{"bob", proto.MembershipChange_LEAVE, []string{"bob"}, []string{"alice", "carol"}},
+		{"alice", proto.MembershipChange_ADD, []string{"bob"}, nil},
+		{"alice", proto.MembershipChange_REMOVE, []string{"dave"}, nil},
+		{"alice", proto.MembershipChange_REMOVE, []string{"alice"}, nil},
+		{"alice", proto.MembershipChange_LEAVE, []string{"bob"}, nil},
+		{"dave", proto.MembershipChange_ADD, []string{"dave"}, nil},
+		{"alice", proto.MembershipChange_ADD, nil, nil},
+	} {
+		change := &proto.MembershipChange{Action: tc.action, Members: tc.member}
+		result, err := applyMembershipChange(participants, tc.signer, change)
+		if tc.result == nil && err == nil {
+			t.Errorf("%s %v %v: accepted, got %v", tc.signer, tc.action, tc.member, result)
+		} else if tc.result != nil && err != nil {
+			t.Errorf("%s %v %v: %s", tc.signer, tc.action, tc.member, err)
+		} else if !reflect.DeepEqual(result, tc.result) {
+			t.Errorf("%s %v %v: got %v, want %v", tc.signer, tc.action, tc.member, result, tc.result)
+		}
+	}
+}
+
+func TestFindSenderKey(t *testing.T) {
+	d := newTestDaemon(t)
+	defer os.RemoveAll(d.RootDir)
+	conversationID := proto.Byte32{1}
+	ours, err := senderkey.New(rand.Reader, "alice", (*[32]byte)(&conversationID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs := senderkey.FromProto(ours.Proto(), "alice", (*[32]byte)(&conversationID))
+	envelope, err := ours.Encrypt(nil, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the index is loaded from the disk and kept up to date
+	if err := StoreSenderKey(d, d.senderKeyPath(theirs.ID()), theirs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if id, err := d.findSenderKey(envelope); err != nil || id == nil || *id != *ours.ID() {
+			t.Fatalf("findSenderKey: %v, %v", id, err)
+		}
+	}
+	other, err := senderkey.New(rand.Reader, "bob", (*[32]byte)(&conversationID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherEnvelope, err := other.Encrypt(nil, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := d.findSenderKey(otherEnvelope); err != nil || id != nil {
+		t.Errorf("found sender key %x (%v) for an unknown key", id, err)
+	}
+	if err := ForgetSenderKeys(d, &conversationID, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := d.findSenderKey(envelope); err != nil || id != nil {
+		t.Errorf("found sender key %x (%v) after it was forgotten", id, err)
+	}
+}
+
+func TestConcurrentMembershipChanges(t *testing.T) {
+	names := []string{"alice", "bob", "carol", "dave"}
+	id := &proto.Byte32{1}
+	profiles := make(map[string]*proto.Profile)
+	sks := make(map[string]*[64]byte)
+	for _, name := range names {
+		pk, sk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		profiles[name] = &proto.Profile{KeySigningKey: *pk}
+		sks[name] = sk
+	}
+	daemons := make(map[string]*Daemon)
+	conversations := make(map[string]*proto.ConversationMetadata)
+	for _, name := range names {
+		d := newTestDaemon(t)
+		defer os.RemoveAll(d.RootDir)
+		d.Dename = name
+		for _, other := range names {
+			if _, err := d.LatestProfile(other, denameProfile(t, 1, profiles[other])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		metadata := &proto.ConversationMetadata{Participants: append([]string{}, names...), Subject: "group", Id: id}
+		if err := d.conversationToConversations(metadata); err != nil {
+			t.Fatal(err)
+		}
+		daemons[name], conversations[name] = d, metadata
+	}
+
+	// bob removes dave while carol removes alice
+	changes := map[string]*proto.MembershipChange{
+		"bob":   {Action: proto.MembershipChange_REMOVE, Members: []string{"dave"}, Version: 1},
+		"carol": {Action: proto.MembershipChange_REMOVE, Members: []string{"alice"}, Version: 1},
+	}
+	for signer, change := range changes {
+		signMembershipChange(id, change, sks[signer])
+		metadata := conversations[signer]
+		participants, err := applyMembershipChange(metadata.Participants, signer, change)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := daemons[signer].changeMembership(metadata, persistence.ConversationName(metadata), signer, metadata.Participants, participants, change); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// everybody sees the changes in a different order
+	for name, signers := range map[string][]string{
+		"alice": {"bob", "carol"},
+		"bob":   {"carol"},
+		"carol": {"bob"},
+		"dave":  {"carol", "bob"},
+	} {
+		for _, signer := range signers {
+			metadata := conversations[name]
+			message := &proto.Message{Dename: signer, ConversationId: id, MembershipChange: changes[signer]}
+			if err := daemons[name].receiveMembershipChange(metadata, persistence.ConversationName(metadata), message); err != nil {
+				t.Fatalf("%s receiving the change by %s: %s", name, signer, err)
+			}
+		}
+	}
+
+	winner := "bob"
+	if bytes.Compare(membershipChangeHash(id, "carol", changes["carol"])[:], membershipChangeHash(id, "bob", changes["bob"])[:]) < 0 {
+		winner = "carol"
+	}
+	want, err := applyMembershipChange(names, winner, changes[winner])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		metadata := conversations[name]
+		if !reflect.DeepEqual(metadata.Participants, want) || metadata.MembershipVersion != 1 {
+			t.Errorf("%s: participants %v at version %d, want %v at version 1", name, metadata.Participants, metadata.MembershipVersion, want)
+		}
+		stored, err := persistence.ReadConversationMetadata(filepath.Join(daemons[name].ConversationDir(), persistence.ConversationName(metadata)))
+		if err != nil || !stored.Equal(metadata) {
+			t.Errorf("%s: stored metadata %v (%v), want %v", name, stored, err, metadata)
+		}
+	}
+}
+
+func TestConversationIDMerge(t *testing.T) {
+	d := newTestDaemon(t)
+	defer os.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.LatestProfile("bob", denameProfile(t, 1, &proto.Profile{KeySigningKey: *pk})); err != nil {
+		t.Fatal(err)
+	}
+	ours, theirs := &proto.Byte32{5}, &proto.Byte32{1}
+	participants := []string{"alice", "bob", "carol"}
+	if err := d.conversationToConversations(&proto.ConversationMetadata{Participants: participants, Subject: "group", Id: ours}); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob claims a lower ID without signing anything
+	message := &proto.Message{Dename: "bob", Participants: participants, Subject: "group", ConversationId: theirs}
+	metadata, convName, err := d.receivingConversation(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *metadata.Id != *ours {
+		t.Fatalf("an unsigned message moved the conversation to %x", metadata.Id[:])
+	}
+
+	// a change signed in the other conversation merges them
+	change := &proto.MembershipChange{Action: proto.MembershipChange_ADD, Members: []string{"dave"}, Version: 1}
+	signMembershipChange(ours, change, sk)
+	message.MembershipChange = change
+	if err := d.receiveMembershipChange(metadata, convName, message); err == nil {
+		t.Fatal("accepted a change signed for a different conversation")
+	}
+	signMembershipChange(theirs, change, sk)
+	if err := d.receiveMembershipChange(metadata, convName, message); err != nil {
+		t.Fatal(err)
+	}
+	if *metadata.Id != *theirs || !contains(metadata.Participants, "dave") {
+		t.Errorf("after a signed change: ID %x, participants %v", metadata.Id[:], metadata.Participants)
+	}
+}
@@ -0,0 +1,114 @@
+// message ordering: per-sender sequence numbers and causal references
+
+package daemon
+
+import (
+	"sort"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// maxRecordedGap bounds the number of missing sequence numbers we record for
+// a single sender, so that a bogus sequence number cannot blow up the metadata.
+const maxRecordedGap = 1000
+
+// senderSequence returns the entry for dename in the metadata of a
+// conversation, creating one if there is none.
+func senderSequence(metadata *proto.ConversationMetadata, dename string) *proto.SenderSequence {
+	for i := range metadata.Senders {
+		if metadata.Senders[i].Dename == dename {
+			return &metadata.Senders[i]
+		}
+	}
+	metadata.Senders = append(metadata.Senders, proto.SenderSequence{Dename: dename})
+	return &metadata.Senders[len(metadata.Senders)-1]
+}
+
+// causalDate returns the date a message should be saved with so that it sorts
+// after every message it causally follows, given the date its sender claims.
+func causalDate(metadata *proto.ConversationMetadata, sender string, seq uint64, date int64, seen []proto.MessageId) int64 {
+	after := func(d int64) {
+		if date <= d {
+			date = d + 1
+		}
+	}
+	for _, s := range metadata.Senders {
+		if s.Dename == sender && seq > s.Received {
+			after(s.Date)
+		}
+	}
+	for _, id := range seen {
+		for _, s := range metadata.Senders {
+			// only the date of their latest message is known
+			if s.Dename == id.Dename && id.SequenceNumber >= s.Received {
+				after(s.Date)
+			}
+		}
+	}
+	return date
+}
+
+// sequenceOutgoing assigns the next sequence number of ours to payload and
+// fills in the latest messages we have seen. The date of payload is adjusted
+// to be after all of them. The caller must store the metadata before sending.
+func (d *Daemon) sequenceOutgoing(metadata *proto.ConversationMetadata, payload *proto.Message) {
+	for _, s := range metadata.Senders {
+		if s.Dename != d.Dename && s.Received != 0 {
+			payload.Seen = append(payload.Seen, proto.MessageId{Dename: s.Dename, SequenceNumber: s.Received})
+		}
+	}
+	ours := senderSequence(metadata, d.Dename)
+	payload.SequenceNumber = ours.Received + 1
+	payload.Date = causalDate(metadata, d.Dename, payload.SequenceNumber, payload.Date, payload.Seen)
+	ours.Received = payload.SequenceNumber
+	ours.Date = payload.Date
+}
+
+// sequenceIncoming records a received message in the metadata of its
+// conversation: the gaps it reveals in the messages of its sender and of
+// everybody whose messages it refers to are added to Missing. It returns the
+// date the message should be saved with. Messages without a sequence number
+// must not be passed in.
+func (d *Daemon) sequenceIncoming(metadata *proto.ConversationMetadata, message *proto.Message) time.Time {
+	date := causalDate(metadata, message.Dename, message.SequenceNumber, message.Date, message.Seen)
+	for _, id := range message.Seen {
+		if id.Dename != d.Dename && id.Dename != message.Dename && contains(metadata.Participants, id.Dename) {
+			observe(senderSequence(metadata, id.Dename), id.SequenceNumber)
+		}
+	}
+	sender := senderSequence(metadata, message.Dename)
+	observe(sender, message.SequenceNumber-1)
+	if message.SequenceNumber >= sender.Received {
+		sender.Received = message.SequenceNumber
+		sender.Date = date
+	}
+	sender.Missing = removeUint64(sender.Missing, message.SequenceNumber)
+	return time.Unix(0, date)
+}
+
+// observe records that sequence number n of a sender exists.
+func observe(s *proto.SenderSequence, n uint64) {
+	if n <= s.Received {
+		return
+	}
+	from := s.Received + 1
+	if n-from >= maxRecordedGap {
+		from = n - maxRecordedGap + 1
+	}
+	for i := from; i <= n; i++ {
+		s.Missing = append(s.Missing, i)
+	}
+	if len(s.Missing) > maxRecordedGap {
+		s.Missing = s.Missing[len(s.Missing)-maxRecordedGap:]
+	}
+	s.Received = n
+}
+
+func removeUint64(xs []uint64, x uint64) []uint64 {
+	i := sort.Search(len(xs), func(i int) bool { return xs[i] >= x })
+	if i < len(xs) && xs[i] == x {
+		return append(xs[:i], xs[i+1:]...)
+	}
+	return xs
+}
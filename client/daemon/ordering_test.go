@@ -0,0 +1,60 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+func TestSequenceGaps(t *testing.T) {
+	d := &Daemon{LocalAccount: proto.LocalAccount{Dename: "alice"}}
+	metadata := &proto.ConversationMetadata{Participants: []string{"alice", "bob", "carol"}}
+	receive := func(sender string, seq uint64, date int64, seen ...proto.MessageId) int64 {
+		return d.sequenceIncoming(metadata, &proto.Message{
+			Dename:         sender,
+			SequenceNumber: seq,
+			Date:           date,
+			Seen:           seen,
+		}).UnixNano()
+	}
+
+	receive("bob", 1, 100)
+	receive("bob", 4, 200)
+	if bob := senderSequence(metadata, "bob"); bob.Received != 4 || !reflect.DeepEqual(bob.Missing, []uint64{2, 3}) {
+		t.Fatalf("bob: %v", bob)
+	}
+	receive("bob", 3, 150)
+	if bob := senderSequence(metadata, "bob"); bob.Received != 4 || !reflect.DeepEqual(bob.Missing, []uint64{2}) {
+		t.Fatalf("bob: %v", bob)
+	}
+
+	// carol has seen two messages of hers that we have not received and bob's
+	// latest, but her clock is behind
+	date := receive("carol", 3, 50, proto.MessageId{Dename: "bob", SequenceNumber: 4})
+	if date <= 200 {
+		t.Errorf("message that saw bob's message at 200 was dated %d", date)
+	}
+	if carol := senderSequence(metadata, "carol"); carol.Received != 3 || !reflect.DeepEqual(carol.Missing, []uint64{1, 2}) {
+		t.Fatalf("carol: %v", carol)
+	}
+
+	payload := &proto.Message{Date: 10}
+	d.sequenceOutgoing(metadata, payload)
+	if payload.SequenceNumber != 1 || payload.Date <= date || len(payload.Seen) != 2 {
+		t.Fatalf("outgoing: %v", payload)
+	}
+	payload = &proto.Message{Date: 10}
+	d.sequenceOutgoing(metadata, payload)
+	if payload.SequenceNumber != 2 {
+		t.Fatalf("second outgoing message has sequence number %d", payload.SequenceNumber)
+	}
+}
+
+func TestSequenceGapLimit(t *testing.T) {
+	s := &proto.SenderSequence{Dename: "bob"}
+	observe(s, 1<<40)
+	if len(s.Missing) != maxRecordedGap || s.Missing[len(s.Missing)-1] != 1<<40 {
+		t.Fatalf("recorded %d missing messages, last %d", len(s.Missing), s.Missing[len(s.Missing)-1])
+	}
+}
@@ -0,0 +1,71 @@
+// changes to the dename profiles of contacts
+
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/proto"
+	dename "github.com/andres-erbsen/dename/protocol"
+)
+
+// A newer dename profile of a contact replaces the stored one, which is how
+// contacts move to another server or replace compromised keys. It is also
+// what an attacker who has taken over the dename name of a contact would do,
+// so the user is told about every change to the chatterbox profile of a
+// contact, and all profiles we have used are kept in the profile history of
+// the contact.
+
+// profileReplaced is called before received replaces stored as the profile of
+// name. stored is nil if we have not seen a profile of name before.
+func (d *Daemon) profileReplaced(name string, stored, received *dename.Profile) error {
+	if err := d.appendProfileHistory(name, received); err != nil {
+		return err
+	}
+	if stored == nil {
+		return nil
+	}
+	newProfile, err := util.ChatProfile(received)
+	if err != nil {
+		return err
+	}
+	oldProfile, err := util.ChatProfile(stored)
+	if err == nil && oldProfile.Equal(newProfile) {
+		return nil
+	}
+	if err == nil && oldProfile.KeySigningKey == newProfile.KeySigningKey && oldProfile.MessageAuthKey == newProfile.MessageAuthKey {
+		return d.saveSystemMessage(name, d.Now(), fmt.Sprintf("%s now receives messages at a different chatterbox server.", name))
+	}
+	if warned, err := d.checkVerifiedProfile(name, newProfile); warned || err != nil {
+		return err
+	}
+	return d.saveSystemMessage(name, d.Now(), fmt.Sprintf("The keys of %s have changed. This happens when they set up chatterbox again, "+
+		"but it could also mean that somebody else has taken over their dename name. Compare safety numbers with %s to be sure.", name, name))
+}
+
+// appendProfileHistory adds profile to the profile history of name.
+func (d *Daemon) appendProfileHistory(name string, profile *dename.Profile) error {
+	history, err := d.ProfileHistory(name)
+	if err != nil {
+		return err
+	}
+	profileBytes, err := profile.Marshal()
+	if err != nil {
+		return err
+	}
+	if n := len(history.Profiles); n > 0 && bytes.Equal(history.Profiles[n-1].Profile, profileBytes) {
+		return nil
+	}
+	var version uint64
+	if profile.Version != nil {
+		version = *profile.Version
+	}
+	history.Profiles = append(history.Profiles, proto.ContactProfile{
+		Date:    d.Now().UnixNano(),
+		Version: version,
+		Profile: profileBytes,
+	})
+	return d.MarshalToFile(d.ProfileHistoryPath(name), history)
+}
@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+func TestProfileChanges(t *testing.T) {
+	d, metadata := daemonWithConversation(t)
+	defer os.RemoveAll(d.RootDir)
+
+	bob := new(proto.Profile)
+	rand.Read(bob.KeySigningKey[:])
+	rand.Read(bob.MessageAuthKey[:])
+	for _, tc := range []struct {
+		version uint64
+		change  func()
+		notice  string
+	}{
+		{1, func() {}, ""},
+		{2, func() {}, ""},
+		{3, func() { bob.ServerPortTCP++ }, "different chatterbox server"},
+		{4, func() { rand.Read(bob.MessageAuthKey[:]) }, "keys of bob have changed"},
+	} {
+		tc.change()
+		time.Sleep(time.Millisecond)
+		if _, err := d.LatestProfile("bob", denameProfile(t, tc.version, bob)); err != nil {
+			t.Fatal(err)
+		}
+		msgs := systemMessages(t, d, metadata)
+		if tc.notice == "" && len(msgs) != 0 {
+			t.Errorf("version %d: unexpected notice %q", tc.version, msgs[len(msgs)-1])
+		} else if tc.notice != "" && !strings.Contains(msgs[len(msgs)-1], tc.notice) {
+			t.Errorf("version %d: notice %q, want one about %q", tc.version, msgs[len(msgs)-1], tc.notice)
+		}
+	}
+
+	// an older profile does not replace the stored one
+	if _, err := d.LatestProfile("bob", denameProfile(t, 2, new(proto.Profile))); err != nil {
+		t.Fatal(err)
+	}
+	history, err := d.ProfileHistory("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Profiles) != 4 {
+		t.Fatalf("%d profiles in history, want 4", len(history.Profiles))
+	}
+	for i, profile := range history.Profiles {
+		if profile.Version != uint64(i+1) {
+			t.Errorf("history[%d] has version %d", i, profile.Version)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// ratchetSession identifies a ratchet session with a contact.
+type ratchetSession struct {
+	name string
+	id   [32]byte
+}
+
+// ratchetIndex maps the header keys that incoming messages may be encrypted
+// with to the session that expects them, so that an incoming message can be
+// matched to a ratchet without loading the ratchets of all contacts.
+type ratchetIndex struct {
+	sync.Mutex
+	loaded      bool
+	byHeaderKey map[[32]byte]ratchetSession
+	headerKeys  map[ratchetSession][]*[32]byte
+}
+
+// set replaces the header keys indexed for the session of ratch.
+func (ri *ratchetIndex) set(name string, ratch *ratchet.Ratchet) {
+	ri.setKeys(ratchetSession{name, *ratch.GetSessionId()}, ratch.RecvHeaderKeys())
+}
+
+func (ri *ratchetIndex) setKeys(session ratchetSession, keys []*[32]byte) {
+	if ri.byHeaderKey == nil {
+		ri.byHeaderKey = make(map[[32]byte]ratchetSession)
+		ri.headerKeys = make(map[ratchetSession][]*[32]byte)
+	}
+	ri.remove(session)
+	for _, key := range keys {
+		ri.byHeaderKey[*key] = session
+	}
+	ri.headerKeys[session] = keys
+}
+
+func (ri *ratchetIndex) remove(session ratchetSession) {
+	for _, key := range ri.headerKeys[session] {
+		delete(ri.byHeaderKey, *key)
+	}
+	delete(ri.headerKeys, session)
+}
+
+// load indexes all ratchets stored on the disk, and the stored header keys of
+// sessions whose ratchets are gone.
+func (ri *ratchetIndex) load(d *Daemon) error {
+	contacts, err := ioutil.ReadDir(d.ratchetKeysDir())
+	if err != nil {
+		return err
+	}
+	for _, contact := range contacts {
+		if !contact.IsDir() {
+			continue
+		}
+		name, err := encoding.UnescapeFilename(contact.Name())
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(d.ratchetKeysDir(), contact.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			ratch, err := d.loadRatchetFile(filepath.Join(dir, file.Name()), d.fillAuth, d.checkAuth)
+			if err != nil {
+				return fmt.Errorf("failed to parse ratchet for \"%s\": %s", contact.Name(), err)
+			}
+			ri.set(name, ratch)
+			// sessions stored by older versions have no header keys file
+			if _, err := os.Stat(d.headerKeysPath(name, ratch.GetSessionId())); os.IsNotExist(err) {
+				if err := d.storeHeaderKeys(name, ratch); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	lost, err := d.lostSessions("")
+	if err != nil {
+		return err
+	}
+	for _, session := range lost {
+		keys, err := d.loadHeaderKeys(session.name, (*proto.Byte32)(&session.id))
+		if err != nil {
+			return err
+		}
+		ri.setKeys(session, keys)
+	}
+	ri.loaded = true
+	return nil
+}
+
+// storeHeaderKeys stores the header keys of a session with name.
+func (d *Daemon) storeHeaderKeys(name string, ratch *ratchet.Ratchet) error {
+	if err := os.MkdirAll(filepath.Join(d.headerKeysDir(), encoding.EscapeFilename(name)), 0700); err != nil {
+		return err
+	}
+	var data []byte
+	for _, key := range ratch.RecvHeaderKeys() {
+		data = append(data, key[:]...)
+	}
+	return d.AtomicWriteFile(d.headerKeysPath(name, ratch.GetSessionId()), data, 0600)
+}
+
+func (d *Daemon) loadHeaderKeys(name string, sessionID *proto.Byte32) ([]*[32]byte, error) {
+	data, err := ioutil.ReadFile(d.headerKeysPath(name, sessionID))
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%32 != 0 {
+		return nil, fmt.Errorf("invalid header keys file for a session with \"%s\"", name)
+	}
+	keys := make([]*[32]byte, len(data)/32)
+	for i := range keys {
+		keys[i] = new([32]byte)
+		copy(keys[i][:], data[32*i:])
+	}
+	return keys, nil
+}
+
+// lostSessions returns the sessions with name, or with anyone if name is
+// empty, whose header keys are stored but whose ratchets are gone.
+func (d *Daemon) lostSessions(name string) ([]ratchetSession, error) {
+	contacts, err := ioutil.ReadDir(d.headerKeysDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ret []ratchetSession
+	for _, contact := range contacts {
+		contactName, err := encoding.UnescapeFilename(contact.Name())
+		if err != nil || !contact.IsDir() || name != "" && contactName != name {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(d.headerKeysDir(), contact.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			id, err := hex.DecodeString(file.Name())
+			if err != nil || len(id) != 32 {
+				continue
+			}
+			session := ratchetSession{name: contactName}
+			copy(session.id[:], id)
+			path := d.ratchetPath(contactName, (*proto.Byte32)(&session.id))
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+			if _, err := os.Stat(path + retiredSessionSuffix); err == nil {
+				continue
+			}
+			ret = append(ret, session)
+		}
+	}
+	return ret, nil
+}
+
+// forgetLostSessions forgets the header keys of the sessions with name whose
+// ratchets are gone. It is called once a new session has replaced them.
+func (d *Daemon) forgetLostSessions(name string) error {
+	lost, err := d.lostSessions(name)
+	if err != nil {
+		return err
+	}
+	d.ratchets.Lock()
+	defer d.ratchets.Unlock()
+	for _, session := range lost {
+		d.ratchets.remove(session)
+		if err := shred.Remove(d.headerKeysPath(session.name, (*proto.Byte32)(&session.id))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexRatchet records the header keys of a session with name. It is called
+// whenever a ratchet is stored.
+func (d *Daemon) indexRatchet(name string, ratch *ratchet.Ratchet) error {
+	d.ratchets.Lock()
+	defer d.ratchets.Unlock()
+	if d.ratchets.loaded {
+		d.ratchets.set(name, ratch)
+	}
+	return d.storeHeaderKeys(name, ratch)
+}
+
+// unindexRatchet forgets the header keys of a removed session.
+func (d *Daemon) unindexRatchet(name string, ratch *ratchet.Ratchet) error {
+	d.ratchets.Lock()
+	defer d.ratchets.Unlock()
+	d.ratchets.remove(ratchetSession{name, *ratch.GetSessionId()})
+	if err := shred.Remove(d.headerKeysPath(name, ratch.GetSessionId())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// findRatchet returns the session whose header keys match envelope and the
+// name of the contact it is with. The name is returned even if the session
+// could not be loaded, such as when its file is gone, so that the failure is
+// attributed to the contact.
+func (d *Daemon) findRatchet(envelope []byte) (string, *ratchet.Ratchet, error) {
+	d.ratchets.Lock()
+	if !d.ratchets.loaded {
+		if err := d.ratchets.load(d); err != nil {
+			d.ratchets.Unlock()
+			return "", nil, err
+		}
+	}
+	var session *ratchetSession
+	for key, s := range d.ratchets.byHeaderKey {
+		if ratchet.OpensHeader(envelope, &key) {
+			session = &s
+			break
+		}
+	}
+	d.ratchets.Unlock()
+	if session == nil {
+		return "", nil, fmt.Errorf("could not find suitable ratchet")
+	}
+	ratch, err := d.loadSession(session.name, &session.id)
+	return session.name, ratch, err
+}
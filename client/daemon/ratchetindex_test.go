@@ -0,0 +1,154 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"testing"
+
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/shred"
+	"golang.org/x/crypto/curve25519"
+)
+
+var dontFillAuth = func([]byte, []byte, *[32]byte) {}
+var dontCheckAuth = func([]byte, []byte, []byte, *[32]byte) error { return nil }
+
+// daemonWithContacts returns a daemon that has ratchets with n contacts and
+// the ratchets of the contacts.
+func daemonWithContacts(tb testing.TB, n int) (*Daemon, []*ratchet.Ratchet) {
+	d := newTestDaemon(tb)
+	d.fillAuth, d.checkAuth = dontFillAuth, dontCheckAuth
+	contacts := make([]*ratchet.Ratchet, n)
+	for i := range contacts {
+		var prekey, prekeyPrivate [32]byte
+		rand.Read(prekeyPrivate[:])
+		curve25519.ScalarBaseMult(&prekey, &prekeyPrivate)
+		ours := &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+		contacts[i] = &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+		if _, err := ours.DecryptFirst(contacts[i].EncryptFirst(nil, nil, &prekey), &prekeyPrivate); err != nil {
+			tb.Fatal(err)
+		}
+		if err := StoreRatchet(d, fmt.Sprintf("contact%d", i), ours); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return d, contacts
+}
+
+func envelopeFrom(tb testing.TB, ratch *ratchet.Ratchet, sender string) []byte {
+	msg, err := (&proto.Message{Dename: sender, Contents: []byte("hello")}).Marshal()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	envelope, _, err := util.EncryptAuth(msg, ratch)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return envelope
+}
+
+func TestFindRatchet(t *testing.T) {
+	d, contacts := daemonWithContacts(t, 10)
+	defer os.RemoveAll(d.RootDir)
+
+	for i := 0; i < 3; i++ {
+		envelope := envelopeFrom(t, contacts[7], "contact7")
+		_, ratch, err := d.findRatchet(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, ratch, err := decryptMessage(envelope, []*ratchet.Ratchet{ratch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := StoreRatchet(d, message.Dename, ratch); err != nil {
+			t.Fatal(err)
+		}
+		// our reply makes the contact switch to new header keys
+		reply, _, err := util.EncryptAuth(nil, ratch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := contacts[7].Decrypt(reply); err != nil {
+			t.Fatal(err)
+		}
+		if err := StoreRatchet(d, message.Dename, ratch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stranger, _ := daemonWithContacts(t, 1)
+	defer os.RemoveAll(stranger.RootDir)
+	other, err := LoadRatchet(stranger, "contact0", dontFillAuth, dontCheckAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.findRatchet(envelopeFrom(t, other, "contact0")); err == nil {
+		t.Fatal("found a ratchet for a message from a stranger")
+	}
+}
+
+func TestFindLostRatchet(t *testing.T) {
+	d, contacts := daemonWithContacts(t, 2)
+	defer os.RemoveAll(d.RootDir)
+	if err := shred.RemoveAll(d.ratchetDir("contact1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a daemon that starts after the ratchet was lost
+	restarted := &Daemon{Paths: d.Paths, Now: d.Now, fillAuth: d.fillAuth, checkAuth: d.checkAuth}
+	for i := 0; i < 2; i++ {
+		name, ratch, err := restarted.findRatchet(envelopeFrom(t, contacts[1], "contact1"))
+		if name != "contact1" || ratch != nil || !os.IsNotExist(err) {
+			t.Fatalf("findRatchet: %q, %v, %v; want the contact of the lost session", name, ratch, err)
+		}
+	}
+	if name, _, err := restarted.findRatchet(envelopeFrom(t, contacts[0], "contact0")); name != "contact0" || err != nil {
+		t.Fatalf("findRatchet: %q, %v", name, err)
+	}
+
+	if err := restarted.forgetLostSessions("contact1"); err != nil {
+		t.Fatal(err)
+	}
+	if name, _, err := restarted.findRatchet(envelopeFrom(t, contacts[1], "contact1")); name != "" || err == nil {
+		t.Errorf("findRatchet: %q, %v after the lost session was forgotten", name, err)
+	}
+}
+
+func BenchmarkDecryptMessageAllRatchets(b *testing.B) {
+	d, contacts := daemonWithContacts(b, 1000)
+	defer os.RemoveAll(d.RootDir)
+	envelope := envelopeFrom(b, contacts[len(contacts)-1], "contact999")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ratchets, err := AllRatchets(d, d.fillAuth, d.checkAuth)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := decryptMessage(envelope, ratchets); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptMessageIndexed(b *testing.B) {
+	d, contacts := daemonWithContacts(b, 1000)
+	defer os.RemoveAll(d.RootDir)
+	envelope := envelopeFrom(b, contacts[len(contacts)-1], "contact999")
+	if _, _, err := d.findRatchet(envelope); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, ratch, err := d.findRatchet(envelope)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := decryptMessage(envelope, []*ratchet.Ratchet{ratch}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
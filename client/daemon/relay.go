@@ -0,0 +1,58 @@
+// store-and-forward delivery through our own server
+
+package daemon
+
+import (
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// With RelayThroughServer set, envelopes to contacts we already have a
+// session with are handed to our own server, which keeps them until the
+// server of the contact accepts them. Sending then does not fail or wait
+// when that server is down or slow, and the server of the contact sees
+// connections from our server instead of from us. In exchange, our server
+// learns whom we send to and when. First messages are always sent directly
+// because they need a prekey from the server of the contact. Our server
+// connects to other servers directly, not through Tor, and does not connect to
+// internal addresses, so messages to a contact whose server publishes only an
+// onion address are sent directly as well.
+
+// relayTo reports whether messages to the contact whose chatterbox profile is
+// chatProfile are sent through our server.
+func (d *Daemon) relayTo(chatProfile *proto.Profile) bool {
+	return d.RelayThroughServer && chatProfile.ServerAddressTCP != ""
+}
+
+// relayCacheKey is the connection cache key of the connection to our own
+// server used for relaying. It is separate from the connection used to
+// receive messages.
+func (d *Daemon) relayCacheKey() string {
+	return "relay " + d.Dename
+}
+
+// relayEnvelope asks our server to deliver envelope to the contact whose
+// chatterbox profile is chatProfile.
+func (d *Daemon) relayEnvelope(envelope []byte, chatProfile *proto.Profile) error {
+	profile := new(proto.Profile)
+	if err := persistence.UnmarshalFromFile(d.OurChatterboxProfilePath(), profile); err != nil {
+		return err
+	}
+	cacheKey := d.relayCacheKey()
+	conn, err := d.cc.DialServerReplicas(cacheKey, d.ourServerAddresses(), (*[32]byte)(&d.ServerTransportPK), (*[32]byte)(&profile.UserIDAtServer),
+		(*[32]byte)(&d.TransportSecretKeyForServer))
+	if err != nil {
+		return err
+	}
+	// our server connects to the server of the contact directly, so it needs
+	// the TCP address even if we would connect to the onion service
+	if err := util.RelayEnvelope(conn, make([]byte, proto.SERVER_MESSAGE_SIZE), (*[32]byte)(&chatProfile.UserIDAtServer),
+		chatProfile.ServerAddressTCP, int(chatProfile.ServerPortTCP), chatProfile.ServerReplicasTCP, (*[32]byte)(&chatProfile.ServerTransportPK), envelope); err != nil {
+		conn.Close()
+		d.cc.PutClose(cacheKey)
+		return err
+	}
+	d.cc.Put(cacheKey, conn)
+	return nil
+}
@@ -0,0 +1,130 @@
+// ratchet session reset
+
+package daemon
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+)
+
+// A ratchet whose file was lost or that got out of sync with the contact's
+// can not decrypt anything the contact sends. After maxDecryptionFailures
+// different messages from a contact that we could not decrypt, we start a new
+// session by sending an authenticated first message to a fresh prekey of the
+// contact, and both sides note the reset in their conversations with the
+// contact.
+//
+// Anyone can deliver envelopes to us, so only failures that others can not
+// cause are counted. The header of the message must open with a header key of
+// one of our sessions with the contact, which only the contact knows, and the
+// message must not be one the session has already received, as a replayed
+// envelope would be. The header keys of each session are also stored apart
+// from its ratchet, so messages in a session whose ratchet was lost are still
+// attributed after a restart. Messages that match no session are not
+// attributed to anyone and never cause a reset.
+const maxDecryptionFailures = 3
+
+// decryptionFailed records that envelope from name could not be decrypted
+// because of err and resets the session once this has happened for too many
+// different envelopes in a row. name is empty if the sender is not known.
+func (d *Daemon) decryptionFailed(name string, envelope []byte, err error) {
+	if name == "" || err == ratchet.ErrDuplicate {
+		return
+	}
+	if d.decryptionFailures == nil {
+		d.decryptionFailures = make(map[string]map[[32]byte]struct{})
+	}
+	if d.decryptionFailures[name] == nil {
+		d.decryptionFailures[name] = make(map[[32]byte]struct{})
+	}
+	d.decryptionFailures[name][sha256.Sum256(envelope)] = struct{}{}
+	if len(d.decryptionFailures[name]) < maxDecryptionFailures {
+		return
+	}
+	delete(d.decryptionFailures, name)
+	if err := d.resetSession(name); err != nil {
+		log.Printf("session reset with %s: %s", name, err)
+	}
+}
+
+// decryptionSucceeded clears the failures counted for name.
+func (d *Daemon) decryptionSucceeded(name string) {
+	delete(d.decryptionFailures, name)
+}
+
+// resetSession retires all sessions with name and starts a new one.
+func (d *Daemon) resetSession(name string) error {
+	sessions, err := d.liveSessions(name)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := d.retireSession(name, session); err != nil {
+			return err
+		}
+	}
+	if err := d.forgetLostSessions(name); err != nil {
+		return err
+	}
+	d.ourDenameLookupMu.Lock()
+	message := &proto.Message{
+		Dename:       d.Dename,
+		DenameLookup: d.ourDenameLookup,
+		SessionReset: true,
+		Date:         d.Now().UnixNano(),
+	}
+	d.ourDenameLookupMu.Unlock()
+	msg, err := message.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := d.sendFirstMessage(msg, name); err != nil {
+		return err
+	}
+	return d.saveSystemMessage(name, time.Unix(0, message.Date),
+		fmt.Sprintf("Messages from %s could not be decrypted. A new encrypted session was started; some messages may have been lost.", name))
+}
+
+// receiveSessionReset tells the user that a contact has started a new
+// session with us. The notice is dated when we received it, not with the
+// date the contact chose.
+func (d *Daemon) receiveSessionReset(message *proto.Message) error {
+	return d.saveSystemMessage(message.Dename, d.Now(),
+		fmt.Sprintf("%s could not decrypt our messages and started a new encrypted session; some messages may have been lost.", message.Dename))
+}
+
+// saveSystemMessage writes text into all conversations with name. A notice
+// that would have the same name as an earlier one is dated a nanosecond later.
+func (d *Daemon) saveSystemMessage(name string, date time.Time, text string) error {
+	conversations, err := d.ListConversations()
+	if err != nil {
+		return err
+	}
+	for _, metadata := range conversations {
+		if !contains(metadata.Participants, name) {
+			continue
+		}
+		convDir := filepath.Join(d.ConversationDir(), persistence.ConversationName(metadata))
+		var path string
+		for t := date; ; t = t.Add(time.Nanosecond) {
+			path = filepath.Join(convDir, persistence.MessageName(t, persistence.SystemSender))
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		if err := d.AtomicWriteFile(path, []byte(text), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+func TestReceiveSessionReset(t *testing.T) {
+	d, metadata := daemonWithConversation(t)
+	defer os.RemoveAll(d.RootDir)
+	now := time.Unix(1000000, 0)
+	d.Now = func() time.Time { return now }
+
+	future := now.Add(24 * time.Hour).UnixNano()
+	for i := 0; i < 2; i++ {
+		if err := d.saveMessage(&proto.Message{Dename: "alice", SessionReset: true, Date: future}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msgs := systemMessages(t, d, metadata); len(msgs) != 2 {
+		t.Errorf("%d session reset notices, want 2", len(msgs))
+	}
+	convDir := filepath.Join(d.ConversationDir(), persistence.ConversationName(metadata))
+	if _, err := os.Stat(filepath.Join(convDir, persistence.MessageName(now, persistence.SystemSender))); err != nil {
+		t.Errorf("the notice is not dated when it was received: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+// disappearing messages
+
+package daemon
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// sweepInterval is how often the daemon looks for expired messages.
+const sweepInterval = 10 * time.Minute
+
+// maxRetention caps retentions so that expiry dates can be computed without
+// overflowing. Received messages are never dated in the future, so their
+// expiry dates stay within the range of NextExpiry.
+const maxRetention = 100 * 365 * 24 * time.Hour
+
+// retentionPeriod returns how long the messages of a conversation are kept.
+func retentionPeriod(metadata *proto.ConversationMetadata) time.Duration {
+	if metadata.Retention >= uint64(maxRetention/time.Second) {
+		return maxRetention
+	}
+	return time.Duration(metadata.Retention) * time.Second
+}
+
+// applyRetention updates the retention policy of a conversation if policy
+// supersedes the current one and returns true if it did.
+func applyRetention(metadata *proto.ConversationMetadata, policy *proto.RetentionPolicy) bool {
+	if policy.Version < metadata.RetentionVersion ||
+		policy.Version == metadata.RetentionVersion && !shorterRetention(policy.Seconds, metadata.Retention) {
+		return false
+	}
+	metadata.Retention = policy.Seconds
+	metadata.RetentionVersion = policy.Version
+	return true
+}
+
+// shorterRetention returns true if messages are kept for less time with a
+// retention of a seconds than with a retention of b seconds.
+func shorterRetention(a, b uint64) bool {
+	return a != 0 && (b == 0 || a < b)
+}
+
+// sendRetention sends a new retention policy to the conversation and applies
+// it locally.
+func (d *Daemon) sendRetention(metadata *proto.ConversationMetadata, convName string, policy *proto.RetentionPolicy) error {
+	policy.Version = metadata.RetentionVersion + 1
+	payload := d.newPayload(metadata, nil, d.Now())
+	payload.Retention = policy
+	d.sequenceOutgoing(metadata, payload)
+	applyRetention(metadata, policy)
+	if err := d.storeConversationMetadata(convName, metadata); err != nil {
+		return err
+	}
+	if err := d.sendToConversation(metadata, payload); err != nil {
+		return err
+	}
+	return d.sweepConversation(metadata, convName)
+}
+
+// sweepConversations shreds all messages that are older than the retention
+// of their conversation.
+func (d *Daemon) sweepConversations() error {
+	conversations, err := d.ListConversations()
+	if err != nil {
+		return err
+	}
+	for _, metadata := range conversations {
+		if metadata.Retention == 0 {
+			continue
+		}
+		if err := d.sweepConversation(metadata, persistence.ConversationName(metadata)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepConversation shreds the expired messages of one conversation and
+// records when the next message will expire.
+func (d *Daemon) sweepConversation(metadata *proto.ConversationMetadata, convName string) error {
+	if metadata.Retention == 0 {
+		if metadata.NextExpiry == 0 {
+			return nil
+		}
+		metadata.NextExpiry = 0
+		return d.storeConversationMetadata(convName, metadata)
+	}
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	fis, err := ioutil.ReadDir(convDir)
+	if err != nil {
+		return err
+	}
+	retention := retentionPeriod(metadata)
+	now := d.Now()
+	var nextExpiry int64
+	var expired []string
+	for _, fi := range fis {
+		if fi.IsDir() || fi.Name() == persistence.MetadataFileName {
+			continue
+		}
+		date, _, err := persistence.ParseMessageName(fi.Name())
+		if err != nil {
+			log.Printf("sweep \"%s\": %s", convName, err)
+			continue
+		}
+		expiry := date.Add(retention)
+		if expiry.After(now) {
+			if nextExpiry == 0 || expiry.UnixNano() < nextExpiry {
+				nextExpiry = expiry.UnixNano()
+			}
+			continue
+		}
+		expired = append(expired, fi.Name())
+	}
+	if len(expired) != 0 {
+		if err := d.forgetMessages(convDir, expired...); err != nil {
+			return err
+		}
+	}
+	metadata.NextExpiry = nextExpiry
+	return d.storeConversationMetadata(convName, metadata)
+}
+
+// forgetMessages shreds message files, their edit histories and their
+// entries in the message index and the search index of the conversation.
+func (d *Daemon) forgetMessages(convDir string, names ...string) error {
+	files, err := persistence.ReadMessageFiles(convDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := shred.Remove(filepath.Join(convDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, file := range files {
+			if file.Name != name {
+				continue
+			}
+			for j := uint32(0); j < file.Edits; j++ {
+				if err := shred.Remove(filepath.Join(convDir, persistence.HistoryDirName, persistence.HistoryName(name, j))); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			id := &proto.MessageId{Dename: file.Dename, SequenceNumber: file.SequenceNumber}
+			if err := shred.Remove(messageIndexPath(convDir, id)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			break
+		}
+	}
+	return d.UnindexMessages(filepath.Base(convDir), names...)
+}
@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+func TestApplyRetention(t *testing.T) {
+	metadata := &proto.ConversationMetadata{}
+	for _, tc := range []struct {
+		seconds, version uint64
+		applied          bool
+		retention        uint64
+	}{
+		{3600, 1, true, 3600},
+		{7200, 1, false, 3600}, // concurrent, longer
+		{0, 1, false, 3600},    // concurrent, forever
+		{60, 1, true, 60},      // concurrent, shorter
+		{0, 2, true, 0},
+		{60, 1, false, 0}, // old
+		{60, 2, true, 60},
+	} {
+		policy := &proto.RetentionPolicy{Seconds: tc.seconds, Version: tc.version}
+		if applied := applyRetention(metadata, policy); applied != tc.applied || metadata.Retention != tc.retention {
+			t.Errorf("%v: applied = %v, retention = %d; want %v, %d", policy, applied, metadata.Retention, tc.applied, tc.retention)
+		}
+	}
+}
+
+func TestSweepConversation(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	metadata := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Retention: 3600}
+	convName := persistence.ConversationName(metadata)
+	d := newTestDaemon(t, convName)
+	defer os.RemoveAll(d.RootDir)
+	d.Now = func() time.Time { return now }
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	old := persistence.MessageName(now.Add(-2*time.Hour), "bob")
+	recent := persistence.MessageName(now.Add(-30*time.Minute), "bob")
+	for i, name := range []string{old, recent} {
+		if err := ioutil.WriteFile(filepath.Join(convDir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.recordMessageFile(convName, name, &proto.Message{Dename: "bob", SequenceNumber: uint64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.sweepConversation(metadata, convName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(convDir, old)); !os.IsNotExist(err) {
+		t.Error("expired message was not shredded")
+	}
+	if _, err := os.Stat(filepath.Join(convDir, recent)); err != nil {
+		t.Error(err)
+	}
+	if files, err := persistence.ReadMessageFiles(convDir); err != nil || len(files) != 1 || files[0].Name != recent {
+		t.Errorf("index after sweep: %v, %v", files, err)
+	}
+	if want := now.Add(30 * time.Minute).UnixNano(); metadata.NextExpiry != want {
+		t.Errorf("NextExpiry = %d, want %d", metadata.NextExpiry, want)
+	}
+	stored, err := persistence.ReadConversationMetadata(convDir)
+	if err != nil || stored.NextExpiry != metadata.NextExpiry {
+		t.Errorf("stored metadata: %v, %v", stored, err)
+	}
+}
+
+func TestRetentionLimits(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	d := newTestDaemon(t)
+	defer os.RemoveAll(d.RootDir)
+	d.Now = func() time.Time { return now }
+	d.Dename = "alice"
+
+	// bob can not date a message after the messages sent later
+	message := &proto.Message{
+		Dename:       "bob",
+		Participants: []string{"alice", "bob"},
+		Date:         math.MaxInt64,
+		Contents:     []byte("from the future"),
+	}
+	if err := d.saveMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	metadata := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}}
+	convName := persistence.ConversationName(metadata)
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	files, err := filepath.Glob(filepath.Join(convDir, "*bob"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("saved messages: %v, %v", files, err)
+	}
+	if date, _, err := persistence.ParseMessageName(filepath.Base(files[0])); err != nil || date.After(now) {
+		t.Errorf("message saved with date %s (%v), after %s", date, err, now)
+	}
+
+	// a retention too long for a time.Duration keeps messages
+	metadata.Retention = math.MaxUint64
+	if err := d.sweepConversation(metadata, convName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(files[0]); err != nil {
+		t.Error(err)
+	}
+	if want := now.Add(maxRetention).UnixNano(); metadata.NextExpiry != want {
+		t.Errorf("NextExpiry = %d, want %d", metadata.NextExpiry, want)
+	}
+}
@@ -0,0 +1,172 @@
+// pushing changes of our profile to contacts
+
+package daemon
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	dename "github.com/andres-erbsen/dename/protocol"
+)
+
+// Contacts use the newest of our dename profiles they have seen, and they
+// only see one when it is bundled with a message from us. When the chatterbox
+// profile in our dename profile changes, for example because the user revoked
+// keys that were compromised, we push the new dename lookup to all contacts
+// we have a session with. A contact that looked up our old profile before the
+// change but first messages us after it does not get the push, so for a while
+// after the change we also send the lookup to everyone who starts a new
+// session with us.
+const defaultRevocationNoticeWindow = 30 * 24 * time.Hour
+
+func (d *Daemon) revocationNoticeWindow() time.Duration {
+	if d.RevocationNoticeWindow == 0 {
+		return defaultRevocationNoticeWindow
+	}
+	return time.Duration(d.RevocationNoticeWindow) * time.Second
+}
+
+// checkOurProfile returns true if the chatterbox profile in profile, a
+// fresh lookup of our dename name, differs from the one we last saw, and
+// records the change.
+func (d *Daemon) checkOurProfile(profile *dename.Profile) (bool, error) {
+	chatProfile, err := util.ChatProfile(profile)
+	if err != nil {
+		return false, err
+	}
+	previous := new(proto.Profile)
+	record := new(proto.ContactProfile)
+	if err := persistence.UnmarshalFromFile(d.ourDenameProfilePath(), record); os.IsNotExist(err) {
+		// no change seen yet: compare with the profile we published ourselves
+		if err := persistence.UnmarshalFromFile(d.OurChatterboxProfilePath(), previous); err != nil {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	} else {
+		previousDename := new(dename.Profile)
+		if err := previousDename.Unmarshal(record.Profile); err != nil {
+			return false, err
+		}
+		if previous, err = util.ChatProfile(previousDename); err != nil {
+			return false, err
+		}
+	}
+	if previous.Equal(chatProfile) {
+		return false, nil
+	}
+
+	profileBytes, err := profile.Marshal()
+	if err != nil {
+		return false, err
+	}
+	record = &proto.ContactProfile{Date: d.Now().UnixNano(), Profile: profileBytes}
+	if profile.Version != nil {
+		record.Version = *profile.Version
+	}
+	return true, d.MarshalToFile(d.ourDenameProfilePath(), record)
+}
+
+// inRevocationNoticeWindow returns true if our chatterbox profile has changed
+// recently enough that new contacts should be told about it.
+func (d *Daemon) inRevocationNoticeWindow() (bool, error) {
+	record := new(proto.ContactProfile)
+	err := persistence.UnmarshalFromFile(d.ourDenameProfilePath(), record)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return d.Now().Before(time.Unix(0, record.Date).Add(d.revocationNoticeWindow())), nil
+}
+
+// profileUpdate returns a message that makes the recipient use our current
+// dename profile.
+func (d *Daemon) profileUpdate() ([]byte, error) {
+	d.ourDenameLookupMu.Lock()
+	message := &proto.Message{
+		Dename:        d.Dename,
+		DenameLookup:  d.ourDenameLookup,
+		ProfileUpdate: true,
+		Date:          d.Now().UnixNano(),
+	}
+	d.ourDenameLookupMu.Unlock()
+	return message.Marshal()
+}
+
+// broadcastProfile sends our current dename profile to all contacts we have a
+// session with. The contacts it could not be sent to are retried on every
+// sweep until it is.
+func (d *Daemon) broadcastProfile() error {
+	contacts, err := d.contactsWithSession()
+	if err != nil {
+		return err
+	}
+	for _, name := range contacts {
+		if err := ioutil.WriteFile(d.profilePushPath(name), nil, 0600); err != nil {
+			return err
+		}
+	}
+	return d.pushProfile()
+}
+
+// pushProfile sends our current dename profile to the contacts it has not been
+// sent to yet. Contacts we no longer have a session with are dropped, they get
+// the profile from noticeNewContact if they start a new one soon enough.
+func (d *Daemon) pushProfile() error {
+	pending, err := ioutil.ReadDir(d.profilePushDir())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if len(pending) == 0 {
+		return nil
+	}
+	msg, err := d.profileUpdate()
+	if err != nil {
+		return err
+	}
+	for _, file := range pending {
+		name, err := encoding.UnescapeFilename(file.Name())
+		if err != nil {
+			continue
+		}
+		sessions, err := d.liveSessions(name)
+		if err != nil {
+			return err
+		}
+		if len(sessions) != 0 {
+			ratch, err := LoadRatchet(d, name, d.fillAuth, d.checkAuth)
+			if err == nil {
+				err = d.sendMessage(msg, name, ratch)
+			}
+			if err != nil {
+				log.Printf("sending our new profile to %s: %s", name, err)
+				continue
+			}
+		}
+		if err := os.Remove(d.profilePushPath(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noticeNewContact sends our current dename profile to a contact that has
+// just started its first session with us if our profile changed recently.
+func (d *Daemon) noticeNewContact(name string) error {
+	if ok, err := d.inRevocationNoticeWindow(); !ok || err != nil {
+		return err
+	}
+	msg, err := d.profileUpdate()
+	if err != nil {
+		return err
+	}
+	return d.sendPairwise(msg, name)
+}
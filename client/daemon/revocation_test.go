@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+func TestCheckOurProfile(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	d := newTestDaemon(t)
+	defer os.RemoveAll(d.RootDir)
+	d.Now = func() time.Time { return now }
+	d.RevocationNoticeWindow = 3600
+	ours := new(proto.Profile)
+	rand.Read(ours.KeySigningKey[:])
+	rand.Read(ours.MessageAuthKey[:])
+	if err := d.MarshalToFile(d.OurChatterboxProfilePath(), ours); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked := *ours
+	rand.Read(revoked.MessageAuthKey[:])
+	for i, tc := range []struct {
+		profile *proto.Profile
+		changed bool
+	}{
+		{ours, false},
+		{ours, false},
+		{&revoked, true},
+		{&revoked, false},
+		{ours, true},
+	} {
+		changed, err := d.checkOurProfile(denameProfile(t, uint64(i+1), tc.profile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != tc.changed {
+			t.Errorf("profile %d: changed = %v, want %v", i+1, changed, tc.changed)
+		}
+	}
+
+	now = now.Add(59 * time.Minute)
+	if ok, err := d.inRevocationNoticeWindow(); err != nil || !ok {
+		t.Errorf("not in the notice window right after the change (%v)", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if ok, err := d.inRevocationNoticeWindow(); err != nil || ok {
+		t.Errorf("still in the notice window after it ended (%v)", err)
+	}
+}
+
+func TestPushProfile(t *testing.T) {
+	d, _ := daemonWithContacts(t, 2)
+	defer os.RemoveAll(d.RootDir)
+	pending := func() int {
+		files, err := ioutil.ReadDir(d.profilePushDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	// the profiles of the contacts are not known, so sending fails
+	if err := d.broadcastProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(); n != 2 {
+		t.Fatalf("%d contacts pending after failed sends, want 2", n)
+	}
+
+	d.CoverTrafficInterval = 60
+	if err := d.pushProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(); n != 0 {
+		t.Errorf("%d contacts pending after successful sends", n)
+	}
+	if queued, err := ioutil.ReadDir(d.queueDir()); err != nil || len(queued) != 2 {
+		t.Errorf("%d messages queued (%v), want 2", len(queued), err)
+	}
+}
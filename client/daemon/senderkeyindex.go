@@ -0,0 +1,81 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/andres-erbsen/chatterbox/senderkey"
+)
+
+// senderKeyIndex maps the header keys of the sender keys of other members of
+// our group conversations to the IDs of the keys, so that a group message can
+// be matched to its sender key without loading all of them.
+type senderKeyIndex struct {
+	sync.Mutex
+	loaded      bool
+	byHeaderKey map[[32]byte][32]byte
+}
+
+func (si *senderKeyIndex) add(id *[32]byte) {
+	if si.byHeaderKey == nil {
+		si.byHeaderKey = make(map[[32]byte][32]byte)
+	}
+	si.byHeaderKey[*senderkey.HeaderKey(id)] = *id
+}
+
+// load indexes all sender keys stored on the disk. Their files are named by
+// their IDs, so the keys themselves do not have to be loaded.
+func (si *senderKeyIndex) load(d *Daemon) error {
+	files, err := ioutil.ReadDir(d.senderKeysDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		idBytes, err := hex.DecodeString(file.Name())
+		if err != nil || len(idBytes) != 32 {
+			continue
+		}
+		var id [32]byte
+		copy(id[:], idBytes)
+		si.add(&id)
+	}
+	si.loaded = true
+	return nil
+}
+
+// indexSenderKey records the header key of the sender key of another member
+// with the given ID. It is called whenever such a key is stored.
+func (d *Daemon) indexSenderKey(id *[32]byte) {
+	d.senderKeys.Lock()
+	defer d.senderKeys.Unlock()
+	if d.senderKeys.loaded {
+		d.senderKeys.add(id)
+	}
+}
+
+// unindexSenderKey forgets the header key of a removed sender key.
+func (d *Daemon) unindexSenderKey(id *[32]byte) {
+	d.senderKeys.Lock()
+	defer d.senderKeys.Unlock()
+	delete(d.senderKeys.byHeaderKey, *senderkey.HeaderKey(id))
+}
+
+// findSenderKey returns the ID of the sender key whose header key matches
+// envelope, or nil if there is none.
+func (d *Daemon) findSenderKey(envelope []byte) (*[32]byte, error) {
+	d.senderKeys.Lock()
+	defer d.senderKeys.Unlock()
+	if !d.senderKeys.loaded {
+		if err := d.senderKeys.load(d); err != nil {
+			return nil, err
+		}
+	}
+	for headerKey, id := range d.senderKeys.byHeaderKey {
+		if senderkey.OpensHeader(envelope, &headerKey) {
+			return &id, nil
+		}
+	}
+	return nil, nil
+}
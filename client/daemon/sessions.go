@@ -0,0 +1,224 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// If both we and a contact send a first message before receiving the other's,
+// we end up with two ratchet sessions. Messages are decrypted with whichever
+// session they were encrypted with, but both sides send using the live
+// session with the smallest ID, so they converge on the same one. The other
+// sessions are retired once the contact is seen using the chosen one. Retired
+// sessions are still used for decrypting delayed messages, and they are
+// removed once they have not been used for sessionRetirementPeriod.
+const (
+	sessionRetirementPeriod = 30 * 24 * time.Hour
+	retiredSessionSuffix    = ".retired"
+)
+
+// Sessions keep the keys of up to maxMissingMessages messages in a row that
+// have not arrived yet, and the keys are deleted by sweepSessions after
+// savedKeyLifetime. The limits are applied to every session when it is
+// loaded, so changing them in the configuration also affects sessions that
+// were started before, including those stored without limits by older
+// versions. The defaults of the ratchet package are lower because they also
+// bound the saved keys of callers that never flush them; the daemon flushes
+// them in sweepSessions, and messages to it are delayed and dropped more
+// often, for example by cover traffic or while it is offline.
+const (
+	defaultMaxMissingMessages = 1000
+	defaultSavedKeyLifetime   = 14 * 24 * time.Hour
+	// ratchets store the lifetime in seconds as a uint32
+	maxSavedKeyLifetime = math.MaxUint32 * time.Second
+)
+
+func (d *Daemon) maxMissingMessages() uint32 {
+	if d.MaxMissingMessages == 0 {
+		return defaultMaxMissingMessages
+	}
+	return d.MaxMissingMessages
+}
+
+func (d *Daemon) savedKeyLifetime() time.Duration {
+	if d.SavedKeyLifetime == 0 {
+		return defaultSavedKeyLifetime
+	}
+	if d.SavedKeyLifetime > uint64(maxSavedKeyLifetime/time.Second) {
+		return maxSavedKeyLifetime
+	}
+	return time.Duration(d.SavedKeyLifetime) * time.Second
+}
+
+// withSessionLimits applies the limits of the daemon to a ratchet.
+func (d *Daemon) withSessionLimits(ratch *ratchet.Ratchet) *ratchet.Ratchet {
+	ratch.MaxMissingMessages = d.maxMissingMessages()
+	ratch.SavedKeyLifetime = d.savedKeyLifetime()
+	return ratch
+}
+
+// liveSessions returns the file names of the sessions with name that have
+// not been retired, sorted by session ID.
+func (d *Daemon) liveSessions(name string) ([]string, error) {
+	files, err := ioutil.ReadDir(d.ratchetDir(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), retiredSessionSuffix) {
+			ret = append(ret, file.Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// contactsWithSession returns the names of the contacts we have a live
+// session with.
+func (d *Daemon) contactsWithSession() ([]string, error) {
+	contacts, err := ioutil.ReadDir(d.ratchetKeysDir())
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, contact := range contacts {
+		name, err := encoding.UnescapeFilename(contact.Name())
+		if err != nil || !contact.IsDir() {
+			continue
+		}
+		sessions, err := d.liveSessions(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(sessions) != 0 {
+			ret = append(ret, name)
+		}
+	}
+	return ret, nil
+}
+
+// loadSession loads a session with name by ID, whether it is retired or not.
+func (d *Daemon) loadSession(name string, sessionID *[32]byte) (*ratchet.Ratchet, error) {
+	path := filepath.Join(d.ratchetDir(name), hex.EncodeToString(sessionID[:]))
+	ratch, err := d.loadRatchetFile(path, d.fillAuth, d.checkAuth)
+	if os.IsNotExist(err) {
+		return d.loadRatchetFile(path+retiredSessionSuffix, d.fillAuth, d.checkAuth)
+	}
+	return ratch, err
+}
+
+// storeIncomingSession stores the session message was received with and
+// retires the sessions that the sender is not going to use any more. first is
+// true if the message started the session.
+func (d *Daemon) storeIncomingSession(message *proto.Message, ratch *ratchet.Ratchet, first bool) error {
+	name := message.Dename
+	if err := StoreRatchet(d, name, ratch); err != nil {
+		return err
+	}
+	sessions, err := d.liveSessions(name)
+	if err != nil {
+		return err
+	}
+	current := hex.EncodeToString(ratch.GetSessionId()[:])
+	preferred := len(sessions) != 0 && sessions[0] == current
+	for _, session := range sessions {
+		if session == current {
+			continue
+		}
+		if !preferred {
+			if !first {
+				continue
+			}
+			// A contact who has answered us in a session only starts
+			// a new one after losing the old one.
+			other, err := d.loadRatchetFile(filepath.Join(d.ratchetDir(name), session), nil, nil)
+			if err != nil {
+				return err
+			}
+			if other.GetRecvCount() == 0 && !message.SessionReset {
+				continue
+			}
+		}
+		if err := d.retireSession(name, session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retireSession stops using a session for sending.
+func (d *Daemon) retireSession(name, session string) error {
+	path := filepath.Join(d.ratchetDir(name), session)
+	if err := os.Rename(path, path+retiredSessionSuffix); err != nil {
+		return err
+	}
+	now := d.Now()
+	return os.Chtimes(path+retiredSessionSuffix, now, now)
+}
+
+// sweepSessions removes the retired sessions that have not been used for
+// sessionRetirementPeriod and the expired keys of missing messages from the
+// live sessions. Retired sessions keep their keys until they are removed.
+func (d *Daemon) sweepSessions() error {
+	contacts, err := ioutil.ReadDir(d.ratchetKeysDir())
+	if err != nil {
+		return err
+	}
+	for _, contact := range contacts {
+		if !contact.IsDir() {
+			continue
+		}
+		name, err := encoding.UnescapeFilename(contact.Name())
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(d.ratchetKeysDir(), contact.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			path := filepath.Join(dir, file.Name())
+			if !strings.HasSuffix(file.Name(), retiredSessionSuffix) {
+				ratch, err := d.loadRatchetFile(path, d.fillAuth, d.checkAuth)
+				if err != nil {
+					return err
+				}
+				if ratch.FlushSavedKeys(d.Now()) {
+					if err := StoreRatchet(d, name, ratch); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if d.Now().Sub(file.ModTime()) < sessionRetirementPeriod {
+				continue
+			}
+			ratch, err := d.loadRatchetFile(path, nil, nil)
+			if err != nil {
+				return err
+			}
+			if err := shred.Remove(path); err != nil {
+				return err
+			}
+			if err := d.unindexRatchet(name, ratch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+	"golang.org/x/crypto/curve25519"
+)
+
+// firstMessage starts a session from one daemon to another and returns the
+// ratchets of the sender and the recipient.
+func firstMessage(t *testing.T) (from, to *ratchet.Ratchet) {
+	var prekey, prekeyPrivate [32]byte
+	rand.Read(prekeyPrivate[:])
+	curve25519.ScalarBaseMult(&prekey, &prekeyPrivate)
+	from = &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	to = &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	if _, err := to.DecryptFirst(from.EncryptFirst(nil, nil, &prekey), &prekeyPrivate); err != nil {
+		t.Fatal(err)
+	}
+	return from, to
+}
+
+// deliver encrypts a message using the session from uses for sending to
+// toName and decrypts it at to.
+func deliver(t *testing.T, from *Daemon, toName string, to *Daemon, fromName string) {
+	ratch, err := LoadRatchet(from, toName, from.fillAuth, from.checkAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := ratch.Encrypt(nil, []byte("hello"))
+	if err := StoreRatchet(from, toName, ratch); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(to, fromName, envelope); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive decrypts envelope from fromName at to.
+func receive(to *Daemon, fromName string, envelope []byte) error {
+	_, ratch, err := to.findRatchet(envelope)
+	if err != nil {
+		return err
+	}
+	if _, err := ratch.Decrypt(envelope); err != nil {
+		return err
+	}
+	return to.storeIncomingSession(&proto.Message{Dename: fromName}, ratch, false)
+}
+
+func liveSessionIDs(t *testing.T, d *Daemon, name string) []string {
+	sessions, err := d.liveSessions(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+func TestSimultaneousSessions(t *testing.T) {
+	alice, _ := daemonWithContacts(t, 0)
+	defer os.RemoveAll(alice.RootDir)
+	bob, _ := daemonWithContacts(t, 0)
+	defer os.RemoveAll(bob.RootDir)
+
+	// both send a first message before receiving the other's
+	aliceToBob, bobFromAlice := firstMessage(t)
+	bobToAlice, aliceFromBob := firstMessage(t)
+	if err := StoreRatchet(alice, "bob", aliceToBob); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreRatchet(bob, "alice", bobToAlice); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.storeIncomingSession(&proto.Message{Dename: "alice"}, bobFromAlice, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.storeIncomingSession(&proto.Message{Dename: "bob"}, aliceFromBob, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		deliver(t, alice, "bob", bob, "alice")
+		deliver(t, bob, "alice", alice, "bob")
+	}
+	aliceSessions, bobSessions := liveSessionIDs(t, alice, "bob"), liveSessionIDs(t, bob, "alice")
+	if len(aliceSessions) != 1 || len(bobSessions) != 1 || aliceSessions[0] != bobSessions[0] {
+		t.Fatalf("sessions did not converge: alice has %v, bob has %v", aliceSessions, bobSessions)
+	}
+
+	// retired sessions are kept around for a while
+	ratchets, err := AllRatchets(alice, alice.fillAuth, alice.checkAuth)
+	if err != nil || len(ratchets) != 2 {
+		t.Fatalf("AllRatchets: %d, %v", len(ratchets), err)
+	}
+	alice.Now = func() time.Time { return time.Now().Add(sessionRetirementPeriod + time.Hour) }
+	if err := alice.sweepSessions(); err != nil {
+		t.Fatal(err)
+	}
+	ratchets, err = AllRatchets(alice, alice.fillAuth, alice.checkAuth)
+	if err != nil || len(ratchets) != 1 {
+		t.Fatalf("AllRatchets after sweep: %d, %v", len(ratchets), err)
+	}
+	deliver(t, bob, "alice", alice, "bob")
+}
+
+func TestRestartedSession(t *testing.T) {
+	alice, _ := daemonWithContacts(t, 0)
+	defer os.RemoveAll(alice.RootDir)
+	bob, _ := daemonWithContacts(t, 0)
+	defer os.RemoveAll(bob.RootDir)
+
+	aliceToBob, bobFromAlice := firstMessage(t)
+	if err := StoreRatchet(alice, "bob", aliceToBob); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.storeIncomingSession(&proto.Message{Dename: "alice"}, bobFromAlice, true); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, bob, "alice", alice, "bob")
+
+	// bob loses his ratchet and starts over
+	if err := os.RemoveAll(bob.ratchetDir("alice")); err != nil {
+		t.Fatal(err)
+	}
+	bobToAlice, aliceFromBob := firstMessage(t)
+	if err := StoreRatchet(bob, "alice", bobToAlice); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.storeIncomingSession(&proto.Message{Dename: "bob"}, aliceFromBob, true); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, alice, "bob", bob, "alice")
+	if sessions := liveSessionIDs(t, alice, "bob"); len(sessions) != 1 {
+		t.Fatalf("alice still uses the old session: %v", sessions)
+	}
+}
+
+func TestMigrateRatchets(t *testing.T) {
+	d, _ := daemonWithContacts(t, 0)
+	defer os.RemoveAll(d.RootDir)
+	ratch, _ := firstMessage(t)
+	if err := d.MarshalToFile(d.ratchetDir("bob"), ratch); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateRatchets(d); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := LoadRatchet(d, "bob", d.fillAuth, d.checkAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *migrated.GetSessionId() != *ratch.GetSessionId() {
+		t.Error("migrated session has a different id")
+	}
+}
+
+// TestMigrateRatchetsInterrupted checks that a migration that was interrupted
+// after each of its steps is finished by the next one.
+func TestMigrateRatchetsInterrupted(t *testing.T) {
+	d, _ := daemonWithContacts(t, 0)
+	defer os.RemoveAll(d.RootDir)
+	ratch, _ := firstMessage(t)
+	sessionName := hex.EncodeToString(ratch.GetSessionId()[:])
+	for i, tc := range []struct {
+		oldFile, stagedDir, stagedFile bool
+	}{
+		{true, true, false}, // after creating the staged directory
+		{true, true, true},  // after copying the ratchet
+		{false, true, true}, // after removing the old file
+	} {
+		name := fmt.Sprintf("contact%d", i)
+		staged := filepath.Join(d.ratchetKeysDir(), ratchetMigrationPrefix+name)
+		if tc.oldFile {
+			if err := d.MarshalToFile(d.ratchetDir(name), ratch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tc.stagedDir {
+			if err := os.Mkdir(staged, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tc.stagedFile {
+			if err := d.MarshalToFile(filepath.Join(staged, sessionName), ratch); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := migrateRatchets(d); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		migrated, err := LoadRatchet(d, fmt.Sprintf("contact%d", i), d.fillAuth, d.checkAuth)
+		if err != nil {
+			t.Fatalf("contact%d: %s", i, err)
+		}
+		if *migrated.GetSessionId() != *ratch.GetSessionId() {
+			t.Errorf("contact%d: migrated session has a different id", i)
+		}
+	}
+	if files, err := ioutil.ReadDir(d.ratchetKeysDir()); err != nil || len(files) != 3 {
+		t.Errorf("%d entries in the ratchet directory after migration (%v)", len(files), err)
+	}
+}
+
+func TestSweepSavedKeys(t *testing.T) {
+	bob, _ := daemonWithContacts(t, 0)
+	defer os.RemoveAll(bob.RootDir)
+
+	aliceToBob, bobFromAlice := firstMessage(t)
+	if err := StoreRatchet(bob, "alice", bob.withSessionLimits(bobFromAlice)); err != nil {
+		t.Fatal(err)
+	}
+	delayed := aliceToBob.Encrypt(nil, []byte("delayed"))
+	expired := aliceToBob.Encrypt(nil, []byte("expired"))
+	if err := receive(bob, "alice", aliceToBob.Encrypt(nil, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.sweepSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(bob, "alice", delayed); err != nil {
+		t.Fatal(err)
+	}
+	bob.Now = func() time.Time { return time.Now().Add(defaultSavedKeyLifetime + time.Hour) }
+	if err := bob.sweepSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(bob, "alice", expired); err == nil {
+		t.Fatal("received a message after its key expired")
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	bob, _ := daemonWithContacts(t, 0)
+	defer os.RemoveAll(bob.RootDir)
+	bob.MaxMissingMessages = 2
+	bob.SavedKeyLifetime = 3600
+
+	// a session stored without limits, as by older versions
+	aliceToBob, bobFromAlice := firstMessage(t)
+	if err := StoreRatchet(bob, "alice", bobFromAlice); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(bob, "alice", aliceToBob.Encrypt(nil, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	delayed := aliceToBob.Encrypt(nil, []byte("delayed"))
+	aliceToBob.Encrypt(nil, []byte("lost"))
+	if err := receive(bob, "alice", aliceToBob.Encrypt(nil, []byte("small gap"))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		aliceToBob.Encrypt(nil, []byte("lost"))
+	}
+	if err := receive(bob, "alice", aliceToBob.Encrypt(nil, []byte("gap"))); err == nil {
+		t.Fatal("received a message after more than MaxMissingMessages missing ones")
+	}
+
+	bob.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := bob.sweepSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(bob, "alice", delayed); err == nil {
+		t.Fatal("received a message after its key expired")
+	}
+}
+
+func TestSavedKeyLifetimeOverflow(t *testing.T) {
+	d := &Daemon{}
+	d.SavedKeyLifetime = math.MaxUint64
+	if lifetime := d.savedKeyLifetime(); lifetime != maxSavedKeyLifetime {
+		t.Errorf("savedKeyLifetime() = %v, want %v", lifetime, maxSavedKeyLifetime)
+	}
+}
@@ -2,8 +2,12 @@ package daemon
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	protobuf "golang.org/x/oprotobuf/proto"
 	cbClient "github.com/andres-erbsen/chatterbox/client"
@@ -27,8 +31,7 @@ func PrepareTestAccountDaemon(name string, rootDir string, denameConfig *denameC
 	}
 
 	//create the accounts with Init
-	torAddr := "DANGEROUS_NO_TOR"
-	err = Init(rootDir, name, addr, port, serverPk, torAddr)
+	err = Init(rootDir, name, addr, "", port, nil, serverPk, "", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -65,3 +68,29 @@ func PrepareTestAccountDaemon(name string, rootDir string, denameConfig *denameC
 
 	return theDaemon
 }
+
+// newTestDaemon returns a daemon that has not been loaded from an account, in
+// a new temporary directory that the caller should remove. The directories the
+// daemon keeps its state in are created, as is a directory for each of the
+// named conversations.
+func newTestDaemon(tb testing.TB, conversations ...string) *Daemon {
+	dir, err := ioutil.TempDir("", "chatterbox-daemon")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	d := &Daemon{
+		Paths: persistence.Paths{RootDir: dir, Application: "daemon"},
+		Now:   time.Now,
+	}
+	dirs := d.subdirs()
+	for _, convName := range conversations {
+		dirs = append(dirs, filepath.Join(d.ConversationDir(), convName))
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			os.RemoveAll(d.RootDir)
+			tb.Fatal(err)
+		}
+	}
+	return d
+}
@@ -1,6 +1,7 @@
 package daemon
 
 import (
+	"crypto/mlkem"
 	"golang.org/x/crypto/nacl/box"
 	"crypto/rand"
 )
@@ -22,3 +23,22 @@ func GeneratePrekeys(numKeys int) ([]*[32]byte, []*[32]byte, error) {
 
 	return public, secret, nil
 }
+
+// GenerateKEMKeys generates ML-KEM-768 keys for hybrid prekeys and returns
+// their encapsulation keys and the seeds of their decapsulation keys.
+func GenerateKEMKeys(numKeys int) ([][]byte, [][]byte, error) {
+	public := make([][]byte, numKeys)
+	secret := make([][]byte, numKeys)
+
+	for i := 0; i < numKeys; i++ {
+		dk, err := mlkem.GenerateKey768()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		public[i] = dk.EncapsulationKey().Bytes()
+		secret[i] = dk.Bytes()
+	}
+
+	return public, secret, nil
+}
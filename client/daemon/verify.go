@@ -0,0 +1,27 @@
+package daemon
+
+import (
+	"fmt"
+
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// checkVerifiedProfile warns the user in all conversations with name if the
+// keys in profile, which replaces the stored profile of name, differ from the
+// keys the user has verified. It returns true if the user was warned.
+func (d *Daemon) checkVerifiedProfile(name string, profile *proto.Profile) (bool, error) {
+	verification, err := d.ContactVerification(name)
+	if err != nil || verification == nil || verification.Changed {
+		return false, err
+	}
+	if *util.ProfileFingerprint(name, profile) == [32]byte(verification.Fingerprint) {
+		return false, nil
+	}
+	verification.Changed = true
+	if err := d.StoreContactVerification(name, verification); err != nil {
+		return false, err
+	}
+	return true, d.saveSystemMessage(name, d.Now(), fmt.Sprintf("WARNING: the keys of %s have changed since you verified them. "+
+		"Somebody may be impersonating %s. Compare safety numbers again before trusting this conversation.", name, name))
+}
@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	denameClient "github.com/andres-erbsen/dename/client"
+	dename "github.com/andres-erbsen/dename/protocol"
+)
+
+// daemonWithConversation returns a daemon whose user has a conversation with
+// bob.
+func daemonWithConversation(t *testing.T) (*Daemon, *proto.ConversationMetadata) {
+	metadata := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}}
+	convName := persistence.ConversationName(metadata)
+	d := newTestDaemon(t, convName)
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	if err := d.MarshalToFile(filepath.Join(convDir, persistence.MetadataFileName), metadata); err != nil {
+		t.Fatal(err)
+	}
+	return d, metadata
+}
+
+// systemMessages returns the messages the daemon has written into the
+// conversation.
+func systemMessages(t *testing.T, d *Daemon, metadata *proto.ConversationMetadata) []string {
+	msgs, err := d.LoadMessages(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret []string
+	for _, msg := range msgs {
+		if msg.Sender == persistence.SystemSender {
+			ret = append(ret, msg.Content)
+		}
+	}
+	return ret
+}
+
+// denameProfile returns a dename profile of the given version that contains
+// chatProfile.
+func denameProfile(t *testing.T, version uint64, chatProfile *proto.Profile) *dename.Profile {
+	profile, _, err := denameClient.NewProfile(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatProfileBytes, err := chatProfile.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := denameClient.SetProfileField(profile, util.PROFILE_FIELD_ID, chatProfileBytes); err != nil {
+		t.Fatal(err)
+	}
+	profile.Version = &version
+	return profile
+}
+
+func TestVerifiedKeysChanged(t *testing.T) {
+	d, metadata := daemonWithConversation(t)
+	defer os.RemoveAll(d.RootDir)
+	warnings := func() int {
+		n := 0
+		for _, msg := range systemMessages(t, d, metadata) {
+			if strings.HasPrefix(msg, "WARNING") {
+				n++
+			}
+		}
+		return n
+	}
+
+	bob := new(proto.Profile)
+	rand.Read(bob.KeySigningKey[:])
+	rand.Read(bob.MessageAuthKey[:])
+	if _, err := d.LatestProfile("bob", denameProfile(t, 1, bob)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.StoreContactVerification("bob", &proto.ContactVerification{
+		Fingerprint: (proto.Byte32)(*util.ProfileFingerprint("bob", bob)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new version of the profile with the same keys is fine
+	bob.ServerPortTCP = 1
+	if _, err := d.LatestProfile("bob", denameProfile(t, 2, bob)); err != nil {
+		t.Fatal(err)
+	}
+	if n := warnings(); n != 0 {
+		t.Fatalf("%d warnings about an unchanged profile", n)
+	}
+
+	rand.Read(bob.KeySigningKey[:])
+	if _, err := d.LatestProfile("bob", denameProfile(t, 3, bob)); err != nil {
+		t.Fatal(err)
+	}
+	if n := warnings(); n != 1 {
+		t.Fatalf("%d warnings about changed keys, want 1", n)
+	}
+	verification, err := d.ContactVerification("bob")
+	if err != nil || verification == nil || !verification.Changed {
+		t.Fatalf("verification after the keys changed: %v, %v", verification, err)
+	}
+
+	// the user is only warned once, until they verify the contact again
+	time.Sleep(time.Millisecond)
+	if _, err := d.LatestProfile("bob", denameProfile(t, 4, bob)); err != nil {
+		t.Fatal(err)
+	}
+	if n := warnings(); n != 1 {
+		t.Fatalf("%d warnings, want 1", n)
+	}
+}
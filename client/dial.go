@@ -1,10 +1,14 @@
 package client
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/andres-erbsen/chatterbox/proto"
@@ -17,12 +21,26 @@ type ConnectionCache struct {
 	connections map[string]chan *transport.Conn
 
 	dialer proxy.Dialer
+	// TransportConfig is used for the handshakes of new connections. If it
+	// is nil, transport.DefaultConfig is used.
+	TransportConfig *transport.Config
+
+	// tickets holds a resumption ticket for each cache key and long-term key
+	// that connections were authenticated with. Anonymous connections do not
+	// use tickets because a ticket would link them.
+	tickets map[ticketKey]*transport.Ticket
+}
+
+type ticketKey struct {
+	cacheKey string
+	pk       [32]byte
 }
 
 func NewConnectionCache(dialer proxy.Dialer) *ConnectionCache {
 	return &ConnectionCache{
 		connections: make(map[string]chan *transport.Conn),
 		dialer:      dialer,
+		tickets:     make(map[ticketKey]*transport.Ticket),
 	}
 }
 
@@ -59,6 +77,13 @@ func (cc *ConnectionCache) PutClose(k string) {
 
 // Caller MUST call Put or PutClose after this
 func (cc *ConnectionCache) DialServer(cacheKey, addr string, port int, serverPK, pk, sk *[32]byte) (conn *transport.Conn, err error) {
+	return cc.DialServerReplicas(cacheKey, []string{net.JoinHostPort(addr, strconv.Itoa(port))}, serverPK, pk, sk)
+}
+
+// DialServerReplicas is like DialServer, but it connects to the first of the
+// replicas of a server at the host:port addresses addrs that accepts the
+// connection. Replicas that are not serving clients close the connection.
+func (cc *ConnectionCache) DialServerReplicas(cacheKey string, addrs []string, serverPK, pk, sk *[32]byte) (conn *transport.Conn, err error) {
 	cc.Lock()
 	ch, ok := cc.connections[cacheKey]
 	if !ok {
@@ -75,39 +100,158 @@ func (cc *ConnectionCache) DialServer(cacheKey, addr string, port int, serverPK,
 	}
 	// ch is empty now
 
-	plainconn, err := cc.dialer.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	// connections authenticated with our long-term key are for fetching our
+	// own messages and all others are for delivering messages to others
+	purpose := PurposeDeliver
+	if pk != nil {
+		purpose = PurposeInbox
+	}
+	config := cc.TransportConfig
+	if config == nil {
+		config = &transport.DefaultConfig
+	}
+	// replicas that did not issue the ticket do a full handshake instead
+	ticket := cc.takeTicket(cacheKey, serverPK, pk)
+	err = errors.New("no server addresses")
+	for _, addr := range addrs {
+		if conn, err = cc.dialReplica(addr, purpose, ticket, serverPK, pk, sk, config); err == nil {
+			break
+		}
+		ticket = nil
+	}
 	if err != nil {
 		cc.PutClose(cacheKey)
 		return nil, err
 	}
-	conn, _, err = transport.Handshake(plainconn, pk, sk, serverPK, proto.SERVER_MESSAGE_SIZE)
+	if pk != nil && conn.Ticket() != nil {
+		cc.Lock()
+		cc.tickets[ticketKey{cacheKey, *pk}] = conn.Ticket()
+		cc.Unlock()
+	}
+
+	return conn, nil
+}
+
+func (cc *ConnectionCache) dialReplica(addr, purpose string, ticket *transport.Ticket, serverPK, pk, sk *[32]byte, config *transport.Config) (conn *transport.Conn, err error) {
+	plainconn, err := IsolatedDialer(cc.dialer, purpose).Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if ticket != nil {
+		conn, _, err = transport.ResumeHandshake(plainconn, ticket, pk, sk, serverPK, proto.SERVER_MESSAGE_SIZE, config)
+	} else {
+		conn, _, err = transport.HandshakeConfig(plainconn, pk, sk, serverPK, proto.SERVER_MESSAGE_SIZE, config)
+	}
 	if err != nil {
-		conn.Close()
-		cc.PutClose(cacheKey)
+		plainconn.Close()
 		return nil, err
 	}
-
 	return conn, nil
 }
 
-type anonDialer struct{ torAddr string }
+// takeTicket removes the ticket for cacheKey from the cache and returns it if
+// it can be used to connect to serverPK as pk. A ticket is only ever used once.
+func (cc *ConnectionCache) takeTicket(cacheKey string, serverPK, pk *[32]byte) *transport.Ticket {
+	if pk == nil {
+		return nil
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	ticket := cc.tickets[ticketKey{cacheKey, *pk}]
+	delete(cc.tickets, ticketKey{cacheKey, *pk})
+	if ticket == nil || serverPK == nil || *ticket.PeerPK() != *serverPK {
+		return nil
+	}
+	return ticket
+}
+
+// ServerAddress returns the address at which the dialer of cc should reach a
+// server that listens at tcpAddr and, if onionAddr is not empty, at the
+// onion service onionAddr. Onion services are only used over Tor, where they
+// also save the exit node.
+func (cc *ConnectionCache) ServerAddress(tcpAddr, onionAddr string) string {
+	if _, ok := cc.dialer.(*torDialer); ok && onionAddr != "" {
+		return onionAddr
+	}
+	return tcpAddr
+}
+
+// ServerAddresses returns the host:port addresses at which the dialer of cc
+// should try to reach a server that is described like in ServerAddress and
+// has replicas at the host:port addresses replicas.
+func (cc *ConnectionCache) ServerAddresses(tcpAddr, onionAddr string, port int, replicas []string) []string {
+	return append([]string{net.JoinHostPort(cc.ServerAddress(tcpAddr, onionAddr), strconv.Itoa(port))}, replicas...)
+}
 
-func NewAnonDialer(torAddr string) proxy.Dialer { return &anonDialer{torAddr} }
+// NewDialer returns the dialer that config asks for: direct TCP connections if
+// config.DirectTCP is set and connections through Tor at config.TorAddress
+// otherwise.
+func NewDialer(config *proto.LocalAccountConfig) proxy.Dialer {
+	if config.DirectTCP {
+		return proxy.Direct
+	}
+	return NewAnonDialer(config.TorAddress)
+}
 
-func (dl *anonDialer) Dial(network, addr string) (c net.Conn, err error) {
-	if dl.torAddr == "DANGEROUS_NO_TOR" {
-		return proxy.Direct.Dial(network, addr)
+// NewAnonDialer returns a dialer that connects through the Tor SOCKS proxy at
+// torAddr, or directly if torAddr is "DANGEROUS_NO_TOR".
+func NewAnonDialer(torAddr string) proxy.Dialer {
+	if torAddr == "DANGEROUS_NO_TOR" {
+		return proxy.Direct
 	}
-	var identity [16]byte
-	if _, err := rand.Read(identity[:]); err != nil {
+	dl := &torDialer{torAddr: torAddr}
+	if _, err := rand.Read(dl.secret[:]); err != nil {
 		panic(err)
 	}
-	dialer, err := proxy.SOCKS5("tcp", dl.torAddr, &proxy.Auth{
-		User:     fmt.Sprintf("%x", identity[:8]),
-		Password: fmt.Sprintf("%x", identity[8:]),
-	}, proxy.Direct)
+	return dl
+}
+
+// Purposes of connections that should not share Tor circuits even if they go
+// to the same destination.
+const (
+	PurposeInbox   = "inbox"
+	PurposeDeliver = "deliver"
+	PurposeDename  = "dename"
+)
+
+// IsolatedDialer returns a dialer whose connections are only sent over the
+// same Tor circuits as other connections for the same purpose to the same
+// destination. Dialers that do not use Tor are returned as they are.
+func IsolatedDialer(dialer proxy.Dialer, purpose string) proxy.Dialer {
+	dl, ok := dialer.(*torDialer)
+	if !ok {
+		return dialer
+	}
+	return &torDialer{torAddr: dl.torAddr, secret: dl.secret, purpose: purpose}
+}
+
+// torDialer isolates the connections to each destination from connections to
+// other destinations: Tor only sends streams that were opened with the same
+// SOCKS credentials over the same circuit, and the credentials are derived
+// from the purpose and the destination address. The secret makes the
+// credentials of different dialers unrelated.
+type torDialer struct {
+	torAddr string
+	secret  [32]byte
+	purpose string
+}
+
+func (dl *torDialer) Dial(network, addr string) (c net.Conn, err error) {
+	dialer, err := proxy.SOCKS5("tcp", dl.torAddr, dl.credentials(addr), proxy.Direct)
 	if err != nil {
 		return nil, err
 	}
 	return dialer.Dial(network, addr)
 }
+
+func (dl *torDialer) credentials(addr string) *proxy.Auth {
+	h := hmac.New(sha256.New, dl.secret[:])
+	h.Write([]byte(dl.purpose))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.ToLower(addr)))
+	identity := h.Sum(nil)
+	return &proxy.Auth{
+		User:     fmt.Sprintf("%x", identity[:8]),
+		Password: fmt.Sprintf("%x", identity[8:16]),
+	}
+}
@@ -0,0 +1,295 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/transport"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/proxy"
+)
+
+// ticketServer accepts connections that issue resumption tickets and reports
+// whether each of them was resumed.
+func ticketServer(t *testing.T, serverPK, serverSK *[32]byte) (int, chan bool) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := transport.DefaultConfig
+	config.TicketKey = new([32]byte)
+	rand.Read(config.TicketKey[:])
+	resumed := make(chan bool)
+	go func() {
+		defer listener.Close()
+		for {
+			plainconn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn, _, err := transport.HandshakeConfig(plainconn, serverPK, serverSK, nil, proto.SERVER_MESSAGE_SIZE, &config)
+			if err != nil {
+				plainconn.Close()
+				resumed <- false
+				continue
+			}
+			resumed <- conn.Resumed()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, resumed
+}
+
+func TestConnectionCacheResumes(t *testing.T) {
+	serverPK, serverSK, _ := box.GenerateKey(rand.Reader)
+	pk, sk, _ := box.GenerateKey(rand.Reader)
+	port, resumed := ticketServer(t, serverPK, serverSK)
+	cc := NewConnectionCache(proxy.Direct)
+
+	for i, tc := range []struct {
+		pk, sk  *[32]byte
+		resumed bool
+	}{
+		{pk, sk, false},
+		{pk, sk, true},
+		{pk, sk, true},
+		{nil, nil, false}, // anonymous connections do not use tickets
+	} {
+		conn, err := cc.DialServer("home", "127.0.0.1", port, serverPK, tc.pk, tc.sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serverResumed := <-resumed; conn.Resumed() != tc.resumed || serverResumed != tc.resumed {
+			t.Errorf("connection %d: resumed=%v (server: %v), want %v", i, conn.Resumed(), serverResumed, tc.resumed)
+		}
+		cc.PutClose("home")
+		conn.Close()
+	}
+}
+
+func TestDialServerReplicas(t *testing.T) {
+	serverPK, serverSK, _ := box.GenerateKey(rand.Reader)
+	port, resumed := ticketServer(t, serverPK, serverSK)
+	go func() {
+		for range resumed {
+		}
+	}()
+	// a backup, which closes connections from clients
+	backup, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	go func() {
+		for {
+			conn, err := backup.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// a replica that is down
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	cc := NewConnectionCache(proxy.Direct)
+	addrs := []string{down.Addr().String(), backup.Addr().String(), net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+	conn, err := cc.DialServerReplicas("server", addrs, serverPK, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.PutClose("server")
+	conn.Close()
+	if _, err := cc.DialServerReplicas("server", addrs[:2], serverPK, nil, nil); err == nil {
+		t.Error("connected although no replica serves clients")
+	}
+}
+
+func TestTorDialerCredentials(t *testing.T) {
+	dl := NewAnonDialer("127.0.0.1:9050").(*torDialer)
+	other := NewAnonDialer("127.0.0.1:9050").(*torDialer)
+	if *dl.credentials("a.example:1984") != *dl.credentials("A.example:1984") {
+		t.Error("connections to the same server use different credentials")
+	}
+	if *dl.credentials("a.example:1984") == *dl.credentials("b.example:1984") {
+		t.Error("connections to different servers use the same credentials")
+	}
+	if *dl.credentials("a.example:1984") == *other.credentials("a.example:1984") {
+		t.Error("different dialers use the same credentials")
+	}
+}
+
+func TestServerAddress(t *testing.T) {
+	for _, tc := range []struct {
+		config          proto.LocalAccountConfig
+		onion, expected string
+	}{
+		{proto.LocalAccountConfig{TorAddress: "127.0.0.1:9050"}, "x.onion", "x.onion"},
+		{proto.LocalAccountConfig{TorAddress: "127.0.0.1:9050"}, "", "example.com"},
+		{proto.LocalAccountConfig{TorAddress: "127.0.0.1:9050", DirectTCP: true}, "x.onion", "example.com"},
+		{proto.LocalAccountConfig{TorAddress: "DANGEROUS_NO_TOR"}, "x.onion", "example.com"},
+	} {
+		cc := NewConnectionCache(NewDialer(&tc.config))
+		if addr := cc.ServerAddress("example.com", tc.onion); addr != tc.expected {
+			t.Errorf("%+v: connected to %q, want %q", tc.config, addr, tc.expected)
+		}
+		addrs := cc.ServerAddresses("example.com", tc.onion, 1984, []string{"replica.example.com:1984"})
+		if len(addrs) != 2 || addrs[0] != tc.expected+":1984" || addrs[1] != "replica.example.com:1984" {
+			t.Errorf("%+v: replicas %q", tc.config, addrs)
+		}
+	}
+}
+
+// socksRequest is what fakeSOCKS learned about a connection.
+type socksRequest struct {
+	user, password, addr string
+}
+
+// fakeSOCKS is a SOCKS5 proxy that only accepts username/password
+// authentication, reports the credentials and the destination of each
+// connection and then connects it to the destination directly.
+func fakeSOCKS(t *testing.T) (string, chan socksRequest) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan socksRequest, 16)
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				req, err := socksHandshake(conn)
+				if err != nil {
+					t.Error(err)
+					conn.Close()
+					return
+				}
+				requests <- *req
+				dest, err := net.Dial("tcp", req.addr)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				// success, bound to 0.0.0.0:0
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go func() { io.Copy(dest, conn); dest.Close() }()
+				io.Copy(conn, dest)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func socksHandshake(conn net.Conn) (*socksRequest, error) {
+	var err error
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if err == nil {
+			_, err = io.ReadFull(conn, b)
+		}
+		return b
+	}
+	greeting := read(2)
+	if methods := read(int(greeting[1])); err != nil || greeting[0] != 5 || !bytes.Contains(methods, []byte{2}) {
+		return nil, errors.New("the client did not offer username/password authentication")
+	}
+	conn.Write([]byte{5, 2})
+	req := new(socksRequest)
+	read(1) // version of the authentication subnegotiation
+	req.user = string(read(int(read(1)[0])))
+	req.password = string(read(int(read(1)[0])))
+	conn.Write([]byte{1, 0})
+	header := read(4)
+	var host string
+	switch header[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	case 4:
+		host = net.IP(read(16)).String()
+	}
+	port := binary.BigEndian.Uint16(read(2))
+	if err != nil || header[1] != 1 {
+		return nil, errors.New("malformed SOCKS5 connect request")
+	}
+	req.addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return req, nil
+}
+
+func TestStreamIsolation(t *testing.T) {
+	serverPK, serverSK, _ := box.GenerateKey(rand.Reader)
+	pk, sk, _ := box.GenerateKey(rand.Reader)
+	port, resumed := ticketServer(t, serverPK, serverSK)
+	go func() {
+		for range resumed {
+		}
+	}()
+	socksAddr, requests := fakeSOCKS(t)
+	dialer := NewAnonDialer(socksAddr)
+	cc := NewConnectionCache(dialer)
+
+	dial := func(pk, sk *[32]byte) socksRequest {
+		conn, err := cc.DialServer("server", "127.0.0.1", port, serverPK, pk, sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc.PutClose("server")
+		conn.Close()
+		return <-requests
+	}
+	inbox := dial(pk, sk)
+	deliver := dial(nil, nil)
+	deliverAgain := dial(nil, nil)
+	if inbox.addr != net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) {
+		t.Errorf("connected to %s, want the server", inbox.addr)
+	}
+	if inbox.user == "" || inbox.password == "" {
+		t.Error("no isolation credentials")
+	}
+	if inbox == deliver {
+		t.Error("fetching our messages and delivering messages share credentials")
+	}
+	if deliver != deliverAgain {
+		t.Error("deliveries to the same server use different credentials")
+	}
+
+	// a second server to deliver to
+	otherPort, otherResumed := ticketServer(t, serverPK, serverSK)
+	go func() {
+		for range otherResumed {
+		}
+	}()
+	conn, err := cc.DialServer("other", "127.0.0.1", otherPort, serverPK, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.PutClose("other")
+	conn.Close()
+	if other := <-requests; other.user == deliver.user {
+		t.Error("deliveries to different servers share credentials")
+	}
+
+	if conn, err := IsolatedDialer(dialer, PurposeDename).Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		conn.Close()
+	}
+	if lookup := <-requests; lookup.user == inbox.user || lookup.user == deliver.user {
+		t.Error("dename lookups share credentials with chatterbox connections")
+	}
+}
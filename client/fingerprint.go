@@ -0,0 +1,122 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/dename/client"
+	dename "github.com/andres-erbsen/dename/protocol"
+	"rsc.io/qr"
+)
+
+var fingerprintLabel = []byte("chatterbox profile fingerprint")
+
+// Verification states of a contact, as returned by VerificationStatus.
+const (
+	NotVerified         = "not verified"
+	Verified            = "verified"
+	VerifiedKeysChanged = "KEYS CHANGED since they were verified"
+)
+
+// ChatProfile returns the chatterbox profile in a dename profile.
+func ChatProfile(profile *dename.Profile) (*proto.Profile, error) {
+	chatProfileBytes, err := client.GetProfileField(profile, PROFILE_FIELD_ID)
+	if err != nil {
+		return nil, err
+	}
+	chatProfile := new(proto.Profile)
+	if err := chatProfile.Unmarshal(chatProfileBytes); err != nil {
+		return nil, err
+	}
+	return chatProfile, nil
+}
+
+// ProfileFingerprint returns a hash of a dename name and the long-term keys in
+// its chatterbox profile.
+func ProfileFingerprint(name string, profile *proto.Profile) *[32]byte {
+	var buf [binary.MaxVarintLen64]byte
+	h := sha256.New()
+	h.Write(fingerprintLabel)
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(name)))])
+	h.Write([]byte(name))
+	h.Write(profile.KeySigningKey[:])
+	h.Write(profile.MessageAuthKey[:])
+	ret := new([32]byte)
+	h.Sum(ret[:0])
+	return ret
+}
+
+// fingerprintDigits encodes the first 30 bytes of a fingerprint as 30 decimal
+// digits, 5 digits for every 5 bytes.
+func fingerprintDigits(fingerprint *[32]byte) string {
+	ret := ""
+	for i := 0; i < 30; i += 5 {
+		var chunk uint64
+		for _, b := range fingerprint[i : i+5] {
+			chunk = chunk<<8 | uint64(b)
+		}
+		ret += fmt.Sprintf("%05d", chunk%100000)
+	}
+	return ret
+}
+
+// SafetyNumber returns a number that two users can compare in person or over a
+// channel they trust to make sure that they have each other's keys. Both users
+// get the same number, half of which depends on the profile of each.
+func SafetyNumber(name string, profile *proto.Profile, otherName string, otherProfile *proto.Profile) string {
+	ours := fingerprintDigits(ProfileFingerprint(name, profile))
+	theirs := fingerprintDigits(ProfileFingerprint(otherName, otherProfile))
+	if theirs < ours {
+		ours, theirs = theirs, ours
+	}
+	digits := ours + theirs
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
+
+// SafetyNumberQR encodes a safety number as a QR code.
+func SafetyNumberQR(safetyNumber string) (*qr.Code, error) {
+	return qr.Encode(strings.Replace(safetyNumber, " ", "", -1), qr.M)
+}
+
+// ContactSafetyNumber computes the safety number between the account in p and
+// contact from the profiles stored by the daemon. It also returns the
+// fingerprint of the profile of the contact.
+func ContactSafetyNumber(p *persistence.Paths, contact string) (string, *[32]byte, error) {
+	account := new(proto.LocalAccount)
+	if err := persistence.UnmarshalFromFile(p.AccountPath(), account); err != nil {
+		return "", nil, err
+	}
+	ours := new(proto.Profile)
+	if err := persistence.UnmarshalFromFile(p.OurChatterboxProfilePath(), ours); err != nil {
+		return "", nil, err
+	}
+	profile := new(dename.Profile)
+	if err := persistence.UnmarshalFromFile(p.ProfilePath(contact), profile); err != nil {
+		return "", nil, fmt.Errorf("no profile of %s: %s", contact, err)
+	}
+	theirs, err := ChatProfile(profile)
+	if err != nil {
+		return "", nil, err
+	}
+	return SafetyNumber(account.Dename, ours, contact, theirs), ProfileFingerprint(contact, theirs), nil
+}
+
+// VerificationStatus describes the verification state of a contact whose
+// profile currently has the given fingerprint.
+func VerificationStatus(verification *proto.ContactVerification, fingerprint *[32]byte) string {
+	switch {
+	case verification == nil:
+		return NotVerified
+	case verification.Changed || [32]byte(verification.Fingerprint) != *fingerprint:
+		return VerifiedKeysChanged
+	}
+	return Verified
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+func randomProfile() *proto.Profile {
+	profile := new(proto.Profile)
+	rand.Read(profile.KeySigningKey[:])
+	rand.Read(profile.MessageAuthKey[:])
+	return profile
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob := randomProfile(), randomProfile()
+	number := SafetyNumber("alice", alice, "bob", bob)
+	if number != SafetyNumber("bob", bob, "alice", alice) {
+		t.Errorf("safety number depends on who computes it")
+	}
+	if digits := strings.Replace(number, " ", "", -1); len(digits) != 60 || len(strings.Fields(number)) != 12 {
+		t.Errorf("badly formatted safety number %q", number)
+	}
+	if SafetyNumber("alice", alice, "bob", randomProfile()) == number {
+		t.Errorf("safety number does not depend on the keys of the contact")
+	}
+	if SafetyNumber("alice", alice, "carol", bob) == number {
+		t.Errorf("safety number does not depend on the name of the contact")
+	}
+	if _, err := SafetyNumberQR(number); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerificationStatus(t *testing.T) {
+	fingerprint := ProfileFingerprint("bob", randomProfile())
+	verification := &proto.ContactVerification{Fingerprint: (proto.Byte32)(*fingerprint)}
+	if s := VerificationStatus(nil, fingerprint); s != NotVerified {
+		t.Errorf("unverified contact is %q", s)
+	}
+	if s := VerificationStatus(verification, fingerprint); s != Verified {
+		t.Errorf("verified contact is %q", s)
+	}
+	if s := VerificationStatus(verification, ProfileFingerprint("bob", randomProfile())); s != VerifiedKeysChanged {
+		t.Errorf("contact with new keys is %q", s)
+	}
+	verification.Changed = true
+	if s := VerificationStatus(verification, fingerprint); s != VerifiedKeysChanged {
+		t.Errorf("contact whose keys changed and changed back is %q", s)
+	}
+}
@@ -0,0 +1,73 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// The daemon keeps the latest dename profile of every contact in ProfileDir,
+// named by the escaped dename name of the contact. The other files about a
+// contact are named by the escaped name and a %-suffix, which can not occur
+// in an escaped name.
+const (
+	verificationSuffix = "%verified"
+	historySuffix      = "%history"
+)
+
+func (p *Paths) ProfileDir() string { return filepath.Join(p.RootDir, ".daemon", "profile") }
+
+func (p *Paths) ProfilePath(name string) string {
+	return filepath.Join(p.ProfileDir(), encoding.EscapeFilename(name))
+}
+
+func (p *Paths) VerificationPath(name string) string {
+	return p.ProfilePath(name) + verificationSuffix
+}
+
+func (p *Paths) ProfileHistoryPath(name string) string {
+	return p.ProfilePath(name) + historySuffix
+}
+
+// OurChatterboxProfilePath is the chatterbox profile of the account, as
+// published in its dename profile.
+func (p *Paths) OurChatterboxProfilePath() string {
+	return filepath.Join(p.RootDir, ".daemon", "chatterbox-profile.pb")
+}
+
+// ContactVerification returns the record of the user having verified the
+// safety number with name, or nil if they have not.
+func (p *Paths) ContactVerification(name string) (*proto.ContactVerification, error) {
+	verification := new(proto.ContactVerification)
+	err := UnmarshalFromFile(p.VerificationPath(name), verification)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
+
+// StoreContactVerification records the verification state of name. A nil
+// verification forgets that name was verified.
+func (p *Paths) StoreContactVerification(name string, verification *proto.ContactVerification) error {
+	if verification == nil {
+		if err := os.Remove(p.VerificationPath(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return p.MarshalToFile(p.VerificationPath(name), verification)
+}
+
+// ProfileHistory returns the profiles of name that the daemon has used.
+func (p *Paths) ProfileHistory(name string) (*proto.ContactProfileHistory, error) {
+	history := new(proto.ContactProfileHistory)
+	err := UnmarshalFromFile(p.ProfileHistoryPath(name), history)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return history, nil
+}
@@ -24,6 +24,24 @@ type Paths struct {
 const (
 	MetadataFileName = "metadata.pb"
 	AccountFileName  = "account.pb"
+	// ControlFileSuffix marks files in the outbox that contain a
+	// proto.Message with control fields instead of message text.
+	ControlFileSuffix = ".control.pb"
+	// HistoryDirName is the directory inside a conversation that keeps the
+	// old contents of edited messages.
+	HistoryDirName = ".history"
+	// MessageIndexDirName is the directory inside a conversation that maps the
+	// IDs of messages to the files they are saved in. It contains one
+	// proto.MessageFile per message, named by MessageIndexName.
+	MessageIndexDirName = ".messages"
+	// HeldEditsDirName is the directory inside a conversation that keeps
+	// edits that arrived before the messages they edit, in one directory per
+	// message named by MessageIndexName.
+	HeldEditsDirName = ".edits"
+	// SystemSender is the sender of messages written by the daemon itself,
+	// for example when an encrypted session had to be reset. It cannot be
+	// a dename name.
+	SystemSender = "%system"
 )
 
 func (p *Paths) ConversationDir() string { return filepath.Join(p.RootDir, "conversations") }
@@ -57,6 +75,52 @@ func MessageName(date time.Time, sender string) string {
 	return fmt.Sprintf("%s-%s", dateStr, sender)
 }
 
+// ParseMessageName returns the date and the sender encoded in the name of a
+// message file by MessageName.
+func ParseMessageName(name string) (time.Time, string, error) {
+	i := strings.Index(name, "Z-")
+	if i == -1 {
+		return time.Time{}, "", fmt.Errorf("badly formatted message filename: %s", name)
+	}
+	date, err := time.Parse(time.RFC3339Nano, name[:i+1])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return date, name[i+2:], nil
+}
+
+// HistoryName returns the name of the file in HistoryDirName that contains
+// the contents of message messageName before edit number edit.
+func HistoryName(messageName string, edit uint32) string {
+	return fmt.Sprintf("%s.%d", messageName, edit)
+}
+
+// MessageIndexName returns the name of the file in MessageIndexDirName that
+// contains the proto.MessageFile of message number sequenceNumber of sender.
+func MessageIndexName(sender string, sequenceNumber uint64) string {
+	return fmt.Sprintf("%d-%s", sequenceNumber, encoding.EscapeFilename(sender))
+}
+
+// ReadMessageFiles returns the proto.MessageFiles of the conversation stored
+// in convDir.
+func ReadMessageFiles(convDir string) ([]*proto.MessageFile, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(convDir, MessageIndexDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ret := make([]*proto.MessageFile, 0, len(fis))
+	for _, fi := range fis {
+		file := new(proto.MessageFile)
+		if err := UnmarshalFromFile(filepath.Join(convDir, MessageIndexDirName, fi.Name()), file); err != nil {
+			return nil, err
+		}
+		ret = append(ret, file)
+	}
+	return ret, nil
+}
+
 func (p *Paths) MkdirInTemp() (string, error) {
 	if err := os.Mkdir(p.TempDir(), 0700); err != nil && !os.IsExist(err) {
 		return "", err
@@ -142,6 +206,71 @@ func (p *Paths) MessageToOutbox(conversationName, message string) error {
 	return os.Rename(filepath.Join(p.TempDir(), base), filepath.Join(conv_outbox, base))
 }
 
+// ControlToOutbox asks the daemon to send a control message (for example, a
+// membership change) in conversation conversationName. Only the control fields
+// of message need to be set; the daemon fills in the rest.
+func (p *Paths) ControlToOutbox(conversationName string, message *proto.Message) error {
+	tempfile, err := p.TempFile()
+	defer shred.Remove(tempfile)
+	if err != nil {
+		return err
+	}
+	if err := p.MarshalToFile(tempfile, message); err != nil {
+		return err
+	}
+	dst := filepath.Join(p.OutboxDir(), conversationName, filepath.Base(tempfile)+ControlFileSuffix)
+	return os.Rename(tempfile, dst)
+}
+
+// EditToOutbox asks the daemon to replace the contents of our message
+// messageName in conversation conversationName for all participants.
+func (p *Paths) EditToOutbox(conversationName, messageName string, contents []byte) error {
+	return p.editToOutbox(conversationName, messageName, proto.MessageEdit_REPLACE, contents)
+}
+
+// RetractToOutbox asks the daemon to remove our message messageName in
+// conversation conversationName for all participants.
+func (p *Paths) RetractToOutbox(conversationName, messageName string) error {
+	return p.editToOutbox(conversationName, messageName, proto.MessageEdit_RETRACT, nil)
+}
+
+// RetentionToOutbox asks the daemon to agree with the other participants of
+// conversation conversationName to shred its messages retention after they
+// were sent. A retention of 0 means that messages are kept forever.
+func (p *Paths) RetentionToOutbox(conversationName string, retention time.Duration) error {
+	return p.ControlToOutbox(conversationName, &proto.Message{
+		Retention: &proto.RetentionPolicy{Seconds: uint64(retention / time.Second)},
+	})
+}
+
+// HistoryToOutbox asks the daemon to agree with the other participants of
+// conversation conversationName on whether to keep the old contents of edited
+// messages.
+func (p *Paths) HistoryToOutbox(conversationName string, keep bool) error {
+	return p.ControlToOutbox(conversationName, &proto.Message{
+		History: &proto.HistoryPolicy{Keep: keep},
+	})
+}
+
+func (p *Paths) editToOutbox(conversationName, messageName string, action proto.MessageEdit_Action, contents []byte) error {
+	files, err := ReadMessageFiles(filepath.Join(p.ConversationDir(), conversationName))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Name == messageName {
+			return p.ControlToOutbox(conversationName, &proto.Message{
+				Contents: contents,
+				Edit: &proto.MessageEdit{
+					Action: action,
+					Target: proto.MessageId{Dename: file.Dename, SequenceNumber: file.SequenceNumber},
+				},
+			})
+		}
+	}
+	return fmt.Errorf("message %s in %s cannot be edited", messageName, conversationName)
+}
+
 func (p *Paths) AtomicWriteFile(path string, bs []byte, perm os.FileMode) error {
 	tempfile, err := p.TempFile()
 	defer shred.Remove(tempfile)
@@ -180,11 +309,10 @@ type Message struct {
 }
 
 func ReadMessageFromFile(path string) (*Message, error) {
-	base := filepath.Base(path)
-	if len(base) < len("2015-02-16T07:09:55Z-") {
-		return nil, fmt.Errorf("badly formatted message filename : " + path)
+	_, sender, err := ParseMessageName(filepath.Base(path))
+	if err != nil {
+		return nil, err
 	}
-	sender := base[len("2015-02-16T07:09:55Z-"):]
 	contents, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("badly formatted message filename : " + path)
@@ -200,7 +328,7 @@ func (p *Paths) LoadMessages(conv *proto.ConversationMetadata) ([]*Message, erro
 	}
 	ret := make([]*Message, 0, len(fis))
 	for _, fi := range fis {
-		if fi.Name() == MetadataFileName {
+		if fi.Name() == MetadataFileName || fi.IsDir() {
 			continue
 		}
 		msg, err := ReadMessageFromFile(filepath.Join(p.ConversationDir(), ConversationName(conv), fi.Name()))
@@ -0,0 +1,463 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/shred"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// The search index is split into segments, each a proto.SearchIndex encrypted
+// with a key of its own. The keys are kept with the other secrets of the
+// daemon, not next to the index. Segments are named by sequence numbers, and
+// a newer segment has a higher number. A new message is written as a new
+// segment, and the two newest segments are merged for as long as the older one
+// is not larger than the newer one, so each message is rewritten about log n
+// times over the life of an index of n messages.
+//
+// Whenever something is removed from a segment, the segment is re-encrypted
+// with a new key and the old key is shredded, so that removed messages cannot
+// be recovered from old copies of the index on the disk. Only the segments
+// that contained removed messages are rewritten.
+//
+// A segment file starts with the ID of the key it is encrypted with, followed
+// by the nonce and the secretbox.
+
+const (
+	searchKeyIDSize = 8
+	searchNonceSize = 24
+)
+
+var errBadSearchIndex = errors.New("search index is corrupted")
+
+func (p *Paths) searchDir() string    { return filepath.Join(p.RootDir, "search") }
+func (p *Paths) searchKeyDir() string { return filepath.Join(p.RootDir, ".daemon", "searchkey") }
+func (p *Paths) searchSegmentPath(segment uint64) string {
+	return filepath.Join(p.searchDir(), fmt.Sprintf("%020d", segment))
+}
+func (p *Paths) searchKeyPath(id []byte) string {
+	return filepath.Join(p.searchKeyDir(), hex.EncodeToString(id))
+}
+
+// SearchResult is a message that matched a search query.
+type SearchResult struct {
+	Conversation, Sender, Path string
+	Date                       time.Time
+}
+
+// SearchTerms returns the distinct lowercase words of text, sorted.
+func SearchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	sort.Strings(words)
+	ret := words[:0]
+	for i, w := range words {
+		if i == 0 || w != words[i-1] {
+			ret = append(ret, w)
+		}
+	}
+	return ret
+}
+
+// Search returns the messages that contain all words of query, in the order
+// they were indexed. Words of the query match any word they are a prefix of.
+//
+// Search does not lock the index against the daemon. Segments and keys are
+// only ever replaced atomically, and a segment is shredded only after its
+// entries have been written to another one, so a search that runs into a
+// segment or key that has disappeared or is being shredded starts over.
+func (p *Paths) Search(query string) ([]*SearchResult, error) {
+	terms := SearchTerms(query)
+	for i := 0; ; i++ {
+		ret, err := p.search(terms)
+		if (os.IsNotExist(err) || err == errBadSearchIndex) && i < searchRetries {
+			time.Sleep(searchRetryDelay)
+			continue
+		}
+		return ret, err
+	}
+}
+
+// Search starts over at most searchRetries times, searchRetryDelay apart,
+// when the index is changed under it.
+const (
+	searchRetries    = 20
+	searchRetryDelay = 10 * time.Millisecond
+)
+
+func (p *Paths) search(terms []string) ([]*SearchResult, error) {
+	segments, err := p.searchSegments()
+	if err != nil {
+		return nil, err
+	}
+	var ret []*SearchResult
+	seen := make(map[string]struct{})
+	for _, segment := range segments {
+		index, _, err := p.loadSearchSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range matchingEntries(index, terms) {
+			entry := &index.Entries[i]
+			path := filepath.Join(p.ConversationDir(), entry.Conversation, entry.Message)
+			// an interrupted merge may leave a message in two segments
+			if _, ok := seen[path]; ok {
+				continue
+			}
+			seen[path] = struct{}{}
+			ret = append(ret, &SearchResult{
+				Conversation: entry.Conversation,
+				Sender:       entry.Sender,
+				Date:         time.Unix(0, entry.Date),
+				Path:         path,
+			})
+		}
+	}
+	return ret, nil
+}
+
+// matchingEntries returns the positions of the entries of a segment that
+// contain all of terms, in ascending order.
+func matchingEntries(index *proto.SearchIndex, terms []string) []uint32 {
+	var ret []uint32
+	if len(terms) == 0 {
+		for i := range index.Entries {
+			ret = append(ret, uint32(i))
+		}
+		return ret
+	}
+	for i, w := range terms {
+		matches := make(map[uint32]struct{})
+		for j := sort.Search(len(index.Terms), func(j int) bool { return index.Terms[j].Term >= w }); j < len(index.Terms) && strings.HasPrefix(index.Terms[j].Term, w); j++ {
+			for _, entry := range index.Terms[j].Entries {
+				matches[entry] = struct{}{}
+			}
+		}
+		if i == 0 {
+			for entry := range matches {
+				ret = append(ret, entry)
+			}
+			continue
+		}
+		filtered := ret[:0]
+		for _, entry := range ret {
+			if _, ok := matches[entry]; ok {
+				filtered = append(filtered, entry)
+			}
+		}
+		ret = filtered
+	}
+	sort.Sort(uint32s(ret))
+	return ret
+}
+
+type uint32s []uint32
+
+func (s uint32s) Len() int           { return len(s) }
+func (s uint32s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// IndexMessage adds a new message to the search index. To index new contents
+// of a message that is already indexed, remove it with UnindexMessages first.
+func (p *Paths) IndexMessage(conversationName, messageName, sender string, date time.Time, contents []byte) error {
+	segments, err := p.searchSegments()
+	if err != nil {
+		return err
+	}
+	var next uint64
+	if len(segments) != 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	index := &proto.SearchIndex{
+		Entries: []proto.SearchEntry{{
+			Conversation: conversationName,
+			Message:      messageName,
+			Sender:       sender,
+			Date:         date.UnixNano(),
+		}},
+	}
+	for _, term := range SearchTerms(string(contents)) {
+		index.Terms = append(index.Terms, proto.SearchTerm{Term: term, Entries: []uint32{0}})
+	}
+	if err := p.storeSearchSegment(next, index, nil); err != nil {
+		return err
+	}
+	return p.mergeSearchSegments(append(segments, next))
+}
+
+// mergeSearchSegments merges the two newest segments for as long as the older
+// one is not larger than the newer one.
+func (p *Paths) mergeSearchSegments(segments []uint64) error {
+	for len(segments) >= 2 {
+		older, newer := segments[len(segments)-2], segments[len(segments)-1]
+		olderInfo, err := os.Stat(p.searchSegmentPath(older))
+		if err != nil {
+			return err
+		}
+		newerInfo, err := os.Stat(p.searchSegmentPath(newer))
+		if err != nil {
+			return err
+		}
+		if olderInfo.Size() > newerInfo.Size() {
+			return nil
+		}
+		olderIndex, olderKeyID, err := p.loadSearchSegment(older)
+		if err != nil {
+			return err
+		}
+		newerIndex, newerKeyID, err := p.loadSearchSegment(newer)
+		if err != nil {
+			return err
+		}
+		if err := p.storeSearchSegment(older, mergeSearchIndexes(olderIndex, newerIndex), olderKeyID); err != nil {
+			return err
+		}
+		if err := p.removeSearchSegment(newer, newerKeyID); err != nil {
+			return err
+		}
+		segments = segments[:len(segments)-1]
+	}
+	return nil
+}
+
+// mergeSearchIndexes returns a segment with the entries of a followed by the
+// entries of b.
+func mergeSearchIndexes(a, b *proto.SearchIndex) *proto.SearchIndex {
+	ret := &proto.SearchIndex{Entries: append(append([]proto.SearchEntry{}, a.Entries...), b.Entries...)}
+	offset := uint32(len(a.Entries))
+	i, j := 0, 0
+	for i < len(a.Terms) || j < len(b.Terms) {
+		switch {
+		case j == len(b.Terms) || i < len(a.Terms) && a.Terms[i].Term < b.Terms[j].Term:
+			ret.Terms = append(ret.Terms, a.Terms[i])
+			i++
+		case i == len(a.Terms) || b.Terms[j].Term < a.Terms[i].Term:
+			ret.Terms = append(ret.Terms, proto.SearchTerm{Term: b.Terms[j].Term, Entries: offsetEntries(nil, b.Terms[j].Entries, offset)})
+			j++
+		default:
+			entries := append([]uint32{}, a.Terms[i].Entries...)
+			ret.Terms = append(ret.Terms, proto.SearchTerm{Term: a.Terms[i].Term, Entries: offsetEntries(entries, b.Terms[j].Entries, offset)})
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+func offsetEntries(dst, entries []uint32, offset uint32) []uint32 {
+	for _, entry := range entries {
+		dst = append(dst, entry+offset)
+	}
+	return dst
+}
+
+// UnindexMessages removes messages of a conversation from the search index.
+// If no messageNames are given, the whole conversation is removed.
+func (p *Paths) UnindexMessages(conversationName string, messageNames ...string) error {
+	remove := func(entry *proto.SearchEntry) bool {
+		if entry.Conversation != conversationName {
+			return false
+		}
+		for _, name := range messageNames {
+			if entry.Message == name {
+				return true
+			}
+		}
+		return len(messageNames) == 0
+	}
+	segments, err := p.searchSegments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		index, keyID, err := p.loadSearchSegment(segment)
+		if err != nil {
+			return err
+		}
+		if !removeSearchEntries(index, remove) {
+			continue
+		}
+		if len(index.Entries) == 0 {
+			err = p.removeSearchSegment(segment, keyID)
+		} else {
+			err = p.storeSearchSegment(segment, index, keyID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameIndexedConversation updates the search index after a conversation
+// directory has been renamed.
+func (p *Paths) RenameIndexedConversation(oldName, newName string) error {
+	segments, err := p.searchSegments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		index, keyID, err := p.loadSearchSegment(segment)
+		if err != nil {
+			return err
+		}
+		renamed := false
+		for i := range index.Entries {
+			if index.Entries[i].Conversation == oldName {
+				index.Entries[i].Conversation = newName
+				renamed = true
+			}
+		}
+		if renamed {
+			if err := p.storeSearchSegment(segment, index, keyID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeSearchEntries removes the entries of a segment for which remove
+// returns true and renumbers the rest. It returns true if it removed any.
+func removeSearchEntries(index *proto.SearchIndex, remove func(*proto.SearchEntry) bool) bool {
+	renumbered := make([]int, len(index.Entries))
+	entries := index.Entries[:0]
+	for i := range index.Entries {
+		if remove(&index.Entries[i]) {
+			renumbered[i] = -1
+			continue
+		}
+		renumbered[i] = len(entries)
+		entries = append(entries, index.Entries[i])
+	}
+	if len(entries) == len(index.Entries) {
+		return false
+	}
+	index.Entries = entries
+	terms := index.Terms[:0]
+	for _, term := range index.Terms {
+		kept := term.Entries[:0]
+		for _, entry := range term.Entries {
+			if renumbered[entry] != -1 {
+				kept = append(kept, uint32(renumbered[entry]))
+			}
+		}
+		if len(kept) != 0 {
+			terms = append(terms, proto.SearchTerm{Term: term.Term, Entries: kept})
+		}
+	}
+	index.Terms = terms
+	return true
+}
+
+// searchSegments returns the sequence numbers of the segments of the search
+// index, oldest first.
+func (p *Paths) searchSegments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(p.searchDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ret []uint64
+	for _, file := range files {
+		segment, err := strconv.ParseUint(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, segment)
+	}
+	return ret, nil
+}
+
+// loadSearchSegment returns a segment of the search index and the ID of the
+// key it is encrypted with.
+func (p *Paths) loadSearchSegment(segment uint64) (*proto.SearchIndex, []byte, error) {
+	box, err := ioutil.ReadFile(p.searchSegmentPath(segment))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(box) < searchKeyIDSize+searchNonceSize+secretbox.Overhead {
+		return nil, nil, errBadSearchIndex
+	}
+	keyID := box[:searchKeyIDSize]
+	keyBytes, err := ioutil.ReadFile(p.searchKeyPath(keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keyBytes) != 32 {
+		return nil, nil, errBadSearchIndex
+	}
+	var key [32]byte
+	copy(key[:], keyBytes)
+	var nonce [searchNonceSize]byte
+	copy(nonce[:], box[searchKeyIDSize:])
+	msg, ok := secretbox.Open(nil, box[searchKeyIDSize+searchNonceSize:], &nonce, &key)
+	if !ok {
+		return nil, nil, errBadSearchIndex
+	}
+	index := new(proto.SearchIndex)
+	if err := index.Unmarshal(msg); err != nil {
+		return nil, nil, err
+	}
+	return index, keyID, nil
+}
+
+// storeSearchSegment encrypts a segment with a new key and stores it. The key
+// the segment was previously encrypted with, if any, is then shredded.
+func (p *Paths) storeSearchSegment(segment uint64, index *proto.SearchIndex, oldKeyID []byte) error {
+	for _, dir := range []string{p.searchDir(), p.searchKeyDir()} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	keyID := make([]byte, searchKeyIDSize)
+	var key [32]byte
+	if _, err := rand.Read(keyID); err != nil {
+		return err
+	}
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	if err := p.AtomicWriteFile(p.searchKeyPath(keyID), key[:], 0600); err != nil {
+		return err
+	}
+	msg, err := index.Marshal()
+	if err != nil {
+		return err
+	}
+	var nonce [searchNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	box := append(append([]byte{}, keyID...), nonce[:]...)
+	box = secretbox.Seal(box, msg, &nonce, &key)
+	if err := p.AtomicWriteFile(p.searchSegmentPath(segment), box, 0600); err != nil {
+		return err
+	}
+	if oldKeyID != nil {
+		return shred.Remove(p.searchKeyPath(oldKeyID))
+	}
+	return nil
+}
+
+// removeSearchSegment shreds a segment and its key.
+func (p *Paths) removeSearchSegment(segment uint64, keyID []byte) error {
+	if err := shred.Remove(p.searchSegmentPath(segment)); err != nil {
+		return err
+	}
+	return shred.Remove(p.searchKeyPath(keyID))
+}
@@ -0,0 +1,201 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchTerms(t *testing.T) {
+	got := SearchTerms("Hello, hello world! Grüße 2015")
+	want := []string{"2015", "grüße", "hello", "world"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SearchTerms: got %v, want %v", got, want)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatterbox-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &Paths{RootDir: dir, Application: "test"}
+	if err := os.MkdirAll(p.TempDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Unix(1424070595, 0)
+	if err := p.IndexMessage("conv", "m1", "alice", date, []byte("the secret plan")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.IndexMessage("conv", "m2", "bob", date, []byte("a different plan")); err != nil {
+		t.Fatal(err)
+	}
+	results, err := p.Search("PLAN sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Sender != "alice" || !results[0].Date.Equal(date) ||
+		results[0].Path != filepath.Join(p.ConversationDir(), "conv", "m1") {
+		t.Fatalf("results: %v", results)
+	}
+
+	var oldKeyPath string
+	segments, err := p.searchSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, segment := range segments {
+		index, keyID, err := p.loadSearchSegment(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range index.Entries {
+			if entry.Message == "m1" {
+				oldKeyPath = p.searchKeyPath(keyID)
+			}
+		}
+	}
+	if err := p.UnindexMessages("conv", "m1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldKeyPath); !os.IsNotExist(err) {
+		t.Error("key of the index was not shredded after removing a message")
+	}
+	if results, err := p.Search("plan"); err != nil || len(results) != 1 || results[0].Sender != "bob" {
+		t.Fatalf("after removal: %v, %v", results, err)
+	}
+
+	if err := p.RenameIndexedConversation("conv", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if results, err := p.Search("different"); err != nil || len(results) != 1 || results[0].Conversation != "renamed" {
+		t.Fatalf("after rename: %v, %v", results, err)
+	}
+}
+
+func TestSearchSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatterbox-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &Paths{RootDir: dir, Application: "test"}
+	if err := os.MkdirAll(p.TempDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	const n = 200
+	for i := 0; i < n; i++ {
+		contents := fmt.Sprintf("message %d", i)
+		if i%2 == 0 {
+			contents += " even"
+		}
+		if err := p.IndexMessage("conv", fmt.Sprint(i), "alice", time.Unix(int64(i), 0), []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := p.searchSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) > 16 {
+		t.Errorf("%d segments for %d messages", len(segments), n)
+	}
+	keys, err := ioutil.ReadDir(p.searchKeyDir())
+	if err != nil || len(keys) != len(segments) {
+		t.Errorf("%d keys for %d segments (%v)", len(keys), len(segments), err)
+	}
+
+	check := func(query string, want []string) {
+		results, err := p.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range results {
+			got = append(got, filepath.Base(r.Path))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Search(%q) = %v, want %v", query, got, want)
+		}
+	}
+	var even []string
+	for i := 0; i < n; i += 2 {
+		even = append(even, fmt.Sprint(i))
+	}
+	check("even mess", even)
+	check("199", []string{"199"})
+	check("199 even", nil)
+
+	var removed []string
+	for i := 0; i < n; i += 4 {
+		removed = append(removed, fmt.Sprint(i))
+	}
+	if err := p.UnindexMessages("conv", removed...); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for i := 2; i < n; i += 4 {
+		left = append(left, fmt.Sprint(i))
+	}
+	check("even", left)
+	if err := p.UnindexMessages("conv"); err != nil {
+		t.Fatal(err)
+	}
+	check("message", nil)
+	if segments, err := p.searchSegments(); err != nil || len(segments) != 0 {
+		t.Errorf("segments of an empty index: %v, %v", segments, err)
+	}
+}
+
+// TestSearchWhileIndexing checks that searches do not fail while the daemon
+// merges and re-encrypts segments under them.
+func TestSearchWhileIndexing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatterbox-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &Paths{RootDir: dir, Application: "test"}
+	if err := os.MkdirAll(p.TempDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	const n = 100
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := p.IndexMessage("conv", fmt.Sprint(i), "alice", time.Unix(int64(i), 0), []byte("message")); err != nil {
+				done <- err
+				return
+			}
+			if i%10 == 9 {
+				if err := p.UnindexMessages("conv", fmt.Sprint(i-5)); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := p.Search("message")
+			if err != nil || len(results) != n-n/10 {
+				t.Fatalf("%d results after indexing (%v)", len(results), err)
+			}
+			return
+		default:
+		}
+		if _, err := p.Search("message"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
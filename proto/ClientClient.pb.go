@@ -11,11 +11,20 @@
 		DenameChatProfile.proto
 		LocalAccount.proto
 		LocalAccountConfig.proto
+		LocalContact.proto
 		LocalConversationMetadata.proto
+		LocalSearchIndex.proto
+		LocalSenderKey.proto
 		Prekeys.proto
 
 	It has these top-level messages:
 		Message
+		MessageId
+		MessageEdit
+		RetentionPolicy
+		HistoryPolicy
+		SenderKey
+		MembershipChange
 */
 package proto
 
@@ -36,6 +45,75 @@ import bytes "bytes"
 var _ = proto1.Marshal
 var _ = math.Inf
 
+type MessageEdit_Action int32
+
+const (
+	MessageEdit_REPLACE MessageEdit_Action = 0
+	MessageEdit_RETRACT MessageEdit_Action = 1
+)
+
+var MessageEdit_Action_name = map[int32]string{
+	0: "REPLACE",
+	1: "RETRACT",
+}
+var MessageEdit_Action_value = map[string]int32{
+	"REPLACE": 0,
+	"RETRACT": 1,
+}
+
+func (x MessageEdit_Action) Enum() *MessageEdit_Action {
+	p := new(MessageEdit_Action)
+	*p = x
+	return p
+}
+func (x MessageEdit_Action) String() string {
+	return proto1.EnumName(MessageEdit_Action_name, int32(x))
+}
+func (x *MessageEdit_Action) UnmarshalJSON(data []byte) error {
+	value, err := proto1.UnmarshalJSONEnum(MessageEdit_Action_value, data, "MessageEdit_Action")
+	if err != nil {
+		return err
+	}
+	*x = MessageEdit_Action(value)
+	return nil
+}
+
+type MembershipChange_Action int32
+
+const (
+	MembershipChange_ADD    MembershipChange_Action = 0
+	MembershipChange_REMOVE MembershipChange_Action = 1
+	MembershipChange_LEAVE  MembershipChange_Action = 2
+)
+
+var MembershipChange_Action_name = map[int32]string{
+	0: "ADD",
+	1: "REMOVE",
+	2: "LEAVE",
+}
+var MembershipChange_Action_value = map[string]int32{
+	"ADD":    0,
+	"REMOVE": 1,
+	"LEAVE":  2,
+}
+
+func (x MembershipChange_Action) Enum() *MembershipChange_Action {
+	p := new(MembershipChange_Action)
+	*p = x
+	return p
+}
+func (x MembershipChange_Action) String() string {
+	return proto1.EnumName(MembershipChange_Action_name, int32(x))
+}
+func (x *MembershipChange_Action) UnmarshalJSON(data []byte) error {
+	value, err := proto1.UnmarshalJSONEnum(MembershipChange_Action_value, data, "MembershipChange_Action")
+	if err != nil {
+		return err
+	}
+	*x = MembershipChange_Action(value)
+	return nil
+}
+
 type Message struct {
 	Contents         []byte                                                `protobuf:"bytes,1,req,name=contents" json:"contents"`
 	Subject          string                                                `protobuf:"bytes,2,req,name=subject" json:"subject"`
@@ -43,6 +121,17 @@ type Message struct {
 	Date             int64                                                 `protobuf:"varint,4,req,name=date" json:"date"`
 	Dename           string                                                `protobuf:"bytes,5,req,name=dename" json:"dename"`
 	DenameLookup     *github_com_andres_erbsen_dename_protocol.ClientReply `protobuf:"bytes,6,req,name=dename_lookup,customtype=github.com/andres-erbsen/dename/protocol.ClientReply" json:"dename_lookup,omitempty"`
+	ConversationId   *Byte32                                               `protobuf:"bytes,7,opt,name=conversation_id,customtype=Byte32" json:"conversation_id,omitempty"`
+	SenderKey        *SenderKey                                            `protobuf:"bytes,8,opt,name=sender_key" json:"sender_key,omitempty"`
+	MembershipChange *MembershipChange                                     `protobuf:"bytes,9,opt,name=membership_change" json:"membership_change,omitempty"`
+	SequenceNumber   uint64                                                `protobuf:"varint,10,opt,name=sequence_number" json:"sequence_number"`
+	Seen             []MessageId                                           `protobuf:"bytes,11,rep,name=seen" json:"seen"`
+	Edit             *MessageEdit                                          `protobuf:"bytes,12,opt,name=edit" json:"edit,omitempty"`
+	Retention        *RetentionPolicy                                      `protobuf:"bytes,13,opt,name=retention" json:"retention,omitempty"`
+	SessionReset     bool                                                  `protobuf:"varint,14,opt,name=session_reset" json:"session_reset"`
+	ProfileUpdate    bool                                                  `protobuf:"varint,15,opt,name=profile_update" json:"profile_update"`
+	Dummy            bool                                                  `protobuf:"varint,16,opt,name=dummy" json:"dummy"`
+	History          *HistoryPolicy                                        `protobuf:"bytes,17,opt,name=history" json:"history,omitempty"`
 	XXX_unrecognized []byte                                                `json:"-"`
 }
 
@@ -50,7 +139,73 @@ func (m *Message) Reset()         { *m = Message{} }
 func (m *Message) String() string { return proto1.CompactTextString(m) }
 func (*Message) ProtoMessage()    {}
 
+type MessageId struct {
+	Dename           string `protobuf:"bytes,1,req,name=dename" json:"dename"`
+	SequenceNumber   uint64 `protobuf:"varint,2,req,name=sequence_number" json:"sequence_number"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *MessageId) Reset()         { *m = MessageId{} }
+func (m *MessageId) String() string { return proto1.CompactTextString(m) }
+func (*MessageId) ProtoMessage()    {}
+
+type MessageEdit struct {
+	Action           MessageEdit_Action `protobuf:"varint,1,req,name=action,enum=proto.MessageEdit_Action" json:"action"`
+	Target           MessageId          `protobuf:"bytes,2,req,name=target" json:"target"`
+	XXX_unrecognized []byte             `json:"-"`
+}
+
+func (m *MessageEdit) Reset()         { *m = MessageEdit{} }
+func (m *MessageEdit) String() string { return proto1.CompactTextString(m) }
+func (*MessageEdit) ProtoMessage()    {}
+
+type RetentionPolicy struct {
+	Seconds          uint64 `protobuf:"varint,1,req,name=seconds" json:"seconds"`
+	Version          uint64 `protobuf:"varint,2,req,name=version" json:"version"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *RetentionPolicy) Reset()         { *m = RetentionPolicy{} }
+func (m *RetentionPolicy) String() string { return proto1.CompactTextString(m) }
+func (*RetentionPolicy) ProtoMessage()    {}
+
+type HistoryPolicy struct {
+	Keep             bool   `protobuf:"varint,1,req,name=keep" json:"keep"`
+	Version          uint64 `protobuf:"varint,2,req,name=version" json:"version"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *HistoryPolicy) Reset()         { *m = HistoryPolicy{} }
+func (m *HistoryPolicy) String() string { return proto1.CompactTextString(m) }
+func (*HistoryPolicy) ProtoMessage()    {}
+
+type SenderKey struct {
+	Id               Byte32 `protobuf:"bytes,1,req,name=id,customtype=Byte32" json:"id"`
+	ChainKey         Byte32 `protobuf:"bytes,2,req,name=chain_key,customtype=Byte32" json:"chain_key"`
+	Iteration        uint32 `protobuf:"varint,3,req,name=iteration" json:"iteration"`
+	SigningKey       Byte32 `protobuf:"bytes,4,req,name=signing_key,customtype=Byte32" json:"signing_key"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *SenderKey) Reset()         { *m = SenderKey{} }
+func (m *SenderKey) String() string { return proto1.CompactTextString(m) }
+func (*SenderKey) ProtoMessage()    {}
+
+type MembershipChange struct {
+	Action           MembershipChange_Action `protobuf:"varint,1,req,name=action,enum=proto.MembershipChange_Action" json:"action"`
+	Members          []string                `protobuf:"bytes,2,rep,name=members" json:"members"`
+	Version          uint64                  `protobuf:"varint,3,req,name=version" json:"version"`
+	Signature        []byte                  `protobuf:"bytes,4,req,name=signature" json:"signature"`
+	XXX_unrecognized []byte                  `json:"-"`
+}
+
+func (m *MembershipChange) Reset()         { *m = MembershipChange{} }
+func (m *MembershipChange) String() string { return proto1.CompactTextString(m) }
+func (*MembershipChange) ProtoMessage()    {}
+
 func init() {
+	proto1.RegisterEnum("proto.MessageEdit_Action", MessageEdit_Action_name, MessageEdit_Action_value)
+	proto1.RegisterEnum("proto.MembershipChange_Action", MembershipChange_Action_name, MembershipChange_Action_value)
 }
 func (m *Message) Unmarshal(data []byte) error {
 	l := len(data)
@@ -199,6 +354,257 @@ func (m *Message) Unmarshal(data []byte) error {
 				return err
 			}
 			index = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ConversationId", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ConversationId = &Byte32{}
+			if err := m.ConversationId.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SenderKey", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.SenderKey == nil {
+				m.SenderKey = &SenderKey{}
+			}
+			if err := m.SenderKey.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MembershipChange", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.MembershipChange == nil {
+				m.MembershipChange = &MembershipChange{}
+			}
+			if err := m.MembershipChange.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SequenceNumber", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.SequenceNumber |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Seen", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Seen = append(m.Seen, MessageId{})
+			if err := m.Seen[len(m.Seen)-1].Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Edit", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Edit == nil {
+				m.Edit = &MessageEdit{}
+			}
+			if err := m.Edit.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Retention", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Retention == nil {
+				m.Retention = &RetentionPolicy{}
+			}
+			if err := m.Retention.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SessionReset", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.SessionReset = bool(v != 0)
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ProfileUpdate", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ProfileUpdate = bool(v != 0)
+		case 16:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Dummy", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Dummy = bool(v != 0)
+		case 17:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field History", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.History == nil {
+				m.History = &HistoryPolicy{}
+			}
+			if err := m.History.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -222,48 +628,1049 @@ func (m *Message) Unmarshal(data []byte) error {
 	}
 	return nil
 }
-func (m *Message) Size() (n int) {
-	var l int
-	_ = l
-	if m.Contents != nil {
-		l = len(m.Contents)
-		n += 1 + l + sovClientClient(uint64(l))
-	}
-	l = len(m.Subject)
-	n += 1 + l + sovClientClient(uint64(l))
-	if len(m.Participants) > 0 {
-		for _, s := range m.Participants {
-			l = len(s)
-			n += 1 + l + sovClientClient(uint64(l))
+func (m *MessageId) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
 		}
-	}
-	n += 1 + sovClientClient(uint64(m.Date))
-	l = len(m.Dename)
-	n += 1 + l + sovClientClient(uint64(l))
-	if m.DenameLookup != nil {
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Dename", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Dename = string(data[index:postIndex])
+			index = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SequenceNumber", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.SequenceNumber |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *MessageEdit) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Action", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Action |= (MessageEdit_Action(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Target", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.Target.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *RetentionPolicy) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Seconds", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Seconds |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Version", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Version |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *HistoryPolicy) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Keep", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Keep = bool(v != 0)
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Version", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Version |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *SenderKey) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Id", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.Id.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ChainKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.ChainKey.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Iteration", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Iteration |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SigningKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.SigningKey.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *MembershipChange) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Action", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Action |= (MembershipChange_Action(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Members", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Members = append(m.Members, string(data[index:postIndex]))
+			index = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Version", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Version |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Signature = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *Message) Size() (n int) {
+	var l int
+	_ = l
+	if m.Contents != nil {
+		l = len(m.Contents)
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	l = len(m.Subject)
+	n += 1 + l + sovClientClient(uint64(l))
+	if len(m.Participants) > 0 {
+		for _, s := range m.Participants {
+			l = len(s)
+			n += 1 + l + sovClientClient(uint64(l))
+		}
+	}
+	n += 1 + sovClientClient(uint64(m.Date))
+	l = len(m.Dename)
+	n += 1 + l + sovClientClient(uint64(l))
+	if m.DenameLookup != nil {
 		l = m.DenameLookup.Size()
 		n += 1 + l + sovClientClient(uint64(l))
 	}
+	if m.ConversationId != nil {
+		l = m.ConversationId.Size()
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	if m.SenderKey != nil {
+		l = m.SenderKey.Size()
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	if m.MembershipChange != nil {
+		l = m.MembershipChange.Size()
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	n += 1 + sovClientClient(uint64(m.SequenceNumber))
+	if len(m.Seen) > 0 {
+		for _, e := range m.Seen {
+			l = e.Size()
+			n += 1 + l + sovClientClient(uint64(l))
+		}
+	}
+	if m.Edit != nil {
+		l = m.Edit.Size()
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	if m.Retention != nil {
+		l = m.Retention.Size()
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	n += 2
+	n += 2
+	n += 3
+	if m.History != nil {
+		l = m.History.Size()
+		n += 2 + l + sovClientClient(uint64(l))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *MessageId) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Dename)
+	n += 1 + l + sovClientClient(uint64(l))
+	n += 1 + sovClientClient(uint64(m.SequenceNumber))
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *MessageEdit) Size() (n int) {
+	var l int
+	_ = l
+	n += 1 + sovClientClient(uint64(m.Action))
+	l = m.Target.Size()
+	n += 1 + l + sovClientClient(uint64(l))
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *RetentionPolicy) Size() (n int) {
+	var l int
+	_ = l
+	n += 1 + sovClientClient(uint64(m.Seconds))
+	n += 1 + sovClientClient(uint64(m.Version))
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *HistoryPolicy) Size() (n int) {
+	var l int
+	_ = l
+	n += 2
+	n += 1 + sovClientClient(uint64(m.Version))
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *SenderKey) Size() (n int) {
+	var l int
+	_ = l
+	l = m.Id.Size()
+	n += 1 + l + sovClientClient(uint64(l))
+	l = m.ChainKey.Size()
+	n += 1 + l + sovClientClient(uint64(l))
+	n += 1 + sovClientClient(uint64(m.Iteration))
+	l = m.SigningKey.Size()
+	n += 1 + l + sovClientClient(uint64(l))
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *MembershipChange) Size() (n int) {
+	var l int
+	_ = l
+	n += 1 + sovClientClient(uint64(m.Action))
+	if len(m.Members) > 0 {
+		for _, s := range m.Members {
+			l = len(s)
+			n += 1 + l + sovClientClient(uint64(l))
+		}
+	}
+	n += 1 + sovClientClient(uint64(m.Version))
+	if m.Signature != nil {
+		l = len(m.Signature)
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func sovClientClient(x uint64) (n int) {
+	for {
+		n++
+		x >>= 7
+		if x == 0 {
+			break
+		}
+	}
+	return n
+}
+func sozClientClient(x uint64) (n int) {
+	return sovClientClient(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+}
+func (m *Message) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *Message) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.Contents != nil {
+		data[i] = 0xa
+		i++
+		i = encodeVarintClientClient(data, i, uint64(len(m.Contents)))
+		i += copy(data[i:], m.Contents)
+	}
+	data[i] = 0x12
+	i++
+	i = encodeVarintClientClient(data, i, uint64(len(m.Subject)))
+	i += copy(data[i:], m.Subject)
+	if len(m.Participants) > 0 {
+		for _, s := range m.Participants {
+			data[i] = 0x1a
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				data[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			data[i] = uint8(l)
+			i++
+			i += copy(data[i:], s)
+		}
+	}
+	data[i] = 0x20
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Date))
+	data[i] = 0x2a
+	i++
+	i = encodeVarintClientClient(data, i, uint64(len(m.Dename)))
+	i += copy(data[i:], m.Dename)
+	if m.DenameLookup != nil {
+		data[i] = 0x32
+		i++
+		i = encodeVarintClientClient(data, i, uint64(m.DenameLookup.Size()))
+		n1, err := m.DenameLookup.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n1
+	}
+	if m.ConversationId != nil {
+		data[i] = 0x3a
+		i++
+		i = encodeVarintClientClient(data, i, uint64(m.ConversationId.Size()))
+		n2, err := m.ConversationId.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n2
+	}
+	if m.SenderKey != nil {
+		data[i] = 0x42
+		i++
+		i = encodeVarintClientClient(data, i, uint64(m.SenderKey.Size()))
+		n3, err := m.SenderKey.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n3
+	}
+	if m.MembershipChange != nil {
+		data[i] = 0x4a
+		i++
+		i = encodeVarintClientClient(data, i, uint64(m.MembershipChange.Size()))
+		n4, err := m.MembershipChange.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n4
+	}
+	data[i] = 0x50
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.SequenceNumber))
+	if len(m.Seen) > 0 {
+		for _, msg := range m.Seen {
+			data[i] = 0x5a
+			i++
+			i = encodeVarintClientClient(data, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(data[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if m.Edit != nil {
+		data[i] = 0x62
+		i++
+		i = encodeVarintClientClient(data, i, uint64(m.Edit.Size()))
+		n5, err := m.Edit.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n5
+	}
+	if m.Retention != nil {
+		data[i] = 0x6a
+		i++
+		i = encodeVarintClientClient(data, i, uint64(m.Retention.Size()))
+		n6, err := m.Retention.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n6
+	}
+	data[i] = 0x70
+	i++
+	if m.SessionReset {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x78
+	i++
+	if m.ProfileUpdate {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x80
+	i++
+	data[i] = 0x1
+	i++
+	if m.Dummy {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	if m.History != nil {
+		data[i] = 0x8a
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintClientClient(data, i, uint64(m.History.Size()))
+		n7, err := m.History.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n7
+	}
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func (m *MessageId) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *MessageId) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0xa
+	i++
+	i = encodeVarintClientClient(data, i, uint64(len(m.Dename)))
+	i += copy(data[i:], m.Dename)
+	data[i] = 0x10
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.SequenceNumber))
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func (m *MessageEdit) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *MessageEdit) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0x8
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Action))
+	data[i] = 0x12
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Target.Size()))
+	n8, err := m.Target.MarshalTo(data[i:])
+	if err != nil {
+		return 0, err
+	}
+	i += n8
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func (m *RetentionPolicy) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *RetentionPolicy) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0x8
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Seconds))
+	data[i] = 0x10
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Version))
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func (m *HistoryPolicy) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *HistoryPolicy) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0x8
+	i++
+	if m.Keep {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x10
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Version))
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func (m *SenderKey) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *SenderKey) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0xa
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Id.Size()))
+	n9, err := m.Id.MarshalTo(data[i:])
+	if err != nil {
+		return 0, err
+	}
+	i += n9
+	data[i] = 0x12
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.ChainKey.Size()))
+	n10, err := m.ChainKey.MarshalTo(data[i:])
+	if err != nil {
+		return 0, err
+	}
+	i += n10
+	data[i] = 0x18
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Iteration))
+	data[i] = 0x22
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.SigningKey.Size()))
+	n11, err := m.SigningKey.MarshalTo(data[i:])
+	if err != nil {
+		return 0, err
+	}
+	i += n11
 	if m.XXX_unrecognized != nil {
-		n += len(m.XXX_unrecognized)
+		i += copy(data[i:], m.XXX_unrecognized)
 	}
-	return n
+	return i, nil
 }
 
-func sovClientClient(x uint64) (n int) {
-	for {
-		n++
-		x >>= 7
-		if x == 0 {
-			break
-		}
-	}
-	return n
-}
-func sozClientClient(x uint64) (n int) {
-	return sovClientClient(uint64((x << 1) ^ uint64((int64(x) >> 63))))
-}
-func (m *Message) Marshal() (data []byte, err error) {
+func (m *MembershipChange) Marshal() (data []byte, err error) {
 	size := m.Size()
 	data = make([]byte, size)
 	n, err := m.MarshalTo(data)
@@ -273,24 +1680,17 @@ func (m *Message) Marshal() (data []byte, err error) {
 	return data[:n], nil
 }
 
-func (m *Message) MarshalTo(data []byte) (n int, err error) {
+func (m *MembershipChange) MarshalTo(data []byte) (n int, err error) {
 	var i int
 	_ = i
 	var l int
 	_ = l
-	if m.Contents != nil {
-		data[i] = 0xa
-		i++
-		i = encodeVarintClientClient(data, i, uint64(len(m.Contents)))
-		i += copy(data[i:], m.Contents)
-	}
-	data[i] = 0x12
+	data[i] = 0x8
 	i++
-	i = encodeVarintClientClient(data, i, uint64(len(m.Subject)))
-	i += copy(data[i:], m.Subject)
-	if len(m.Participants) > 0 {
-		for _, s := range m.Participants {
-			data[i] = 0x1a
+	i = encodeVarintClientClient(data, i, uint64(m.Action))
+	if len(m.Members) > 0 {
+		for _, s := range m.Members {
+			data[i] = 0x12
 			i++
 			l = len(s)
 			for l >= 1<<7 {
@@ -303,22 +1703,14 @@ func (m *Message) MarshalTo(data []byte) (n int, err error) {
 			i += copy(data[i:], s)
 		}
 	}
-	data[i] = 0x20
-	i++
-	i = encodeVarintClientClient(data, i, uint64(m.Date))
-	data[i] = 0x2a
+	data[i] = 0x18
 	i++
-	i = encodeVarintClientClient(data, i, uint64(len(m.Dename)))
-	i += copy(data[i:], m.Dename)
-	if m.DenameLookup != nil {
-		data[i] = 0x32
+	i = encodeVarintClientClient(data, i, uint64(m.Version))
+	if m.Signature != nil {
+		data[i] = 0x22
 		i++
-		i = encodeVarintClientClient(data, i, uint64(m.DenameLookup.Size()))
-		n1, err := m.DenameLookup.MarshalTo(data[i:])
-		if err != nil {
-			return 0, err
-		}
-		i += n1
+		i = encodeVarintClientClient(data, i, uint64(len(m.Signature)))
+		i += copy(data[i:], m.Signature)
 	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
@@ -400,6 +1792,251 @@ func (this *Message) Equal(that interface{}) bool {
 	} else if !this.DenameLookup.Equal(*that1.DenameLookup) {
 		return false
 	}
+	if that1.ConversationId == nil {
+		if this.ConversationId != nil {
+			return false
+		}
+	} else if !this.ConversationId.Equal(*that1.ConversationId) {
+		return false
+	}
+	if !this.SenderKey.Equal(that1.SenderKey) {
+		return false
+	}
+	if !this.MembershipChange.Equal(that1.MembershipChange) {
+		return false
+	}
+	if this.SequenceNumber != that1.SequenceNumber {
+		return false
+	}
+	if len(this.Seen) != len(that1.Seen) {
+		return false
+	}
+	for i := range this.Seen {
+		if !this.Seen[i].Equal(&that1.Seen[i]) {
+			return false
+		}
+	}
+	if !this.Edit.Equal(that1.Edit) {
+		return false
+	}
+	if !this.Retention.Equal(that1.Retention) {
+		return false
+	}
+	if this.SessionReset != that1.SessionReset {
+		return false
+	}
+	if this.ProfileUpdate != that1.ProfileUpdate {
+		return false
+	}
+	if this.Dummy != that1.Dummy {
+		return false
+	}
+	if !this.History.Equal(that1.History) {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
+func (this *MessageId) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*MessageId)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if this.Dename != that1.Dename {
+		return false
+	}
+	if this.SequenceNumber != that1.SequenceNumber {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
+func (this *MessageEdit) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*MessageEdit)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if this.Action != that1.Action {
+		return false
+	}
+	if !this.Target.Equal(&that1.Target) {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
+func (this *RetentionPolicy) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*RetentionPolicy)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if this.Seconds != that1.Seconds {
+		return false
+	}
+	if this.Version != that1.Version {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
+func (this *HistoryPolicy) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*HistoryPolicy)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if this.Keep != that1.Keep {
+		return false
+	}
+	if this.Version != that1.Version {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
+func (this *SenderKey) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*SenderKey)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if !this.Id.Equal(that1.Id) {
+		return false
+	}
+	if !this.ChainKey.Equal(that1.ChainKey) {
+		return false
+	}
+	if this.Iteration != that1.Iteration {
+		return false
+	}
+	if !this.SigningKey.Equal(that1.SigningKey) {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
+func (this *MembershipChange) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*MembershipChange)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if this.Action != that1.Action {
+		return false
+	}
+	if len(this.Members) != len(that1.Members) {
+		return false
+	}
+	for i := range this.Members {
+		if this.Members[i] != that1.Members[i] {
+			return false
+		}
+	}
+	if this.Version != that1.Version {
+		return false
+	}
+	if !bytes.Equal(this.Signature, that1.Signature) {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
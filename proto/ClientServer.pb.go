@@ -86,6 +86,7 @@ type ClientToServer struct {
 	GetSignedKey     *Byte32                         `protobuf:"bytes,9,opt,name=get_signed_key,customtype=Byte32" json:"get_signed_key,omitempty"`
 	ReceiveEnvelopes *bool                           `protobuf:"varint,10,opt,name=receive_envelopes" json:"receive_envelopes,omitempty"`
 	GetNumKeys       *bool                           `protobuf:"varint,11,opt,name=get_num_keys" json:"get_num_keys,omitempty"`
+	RelayEnvelope    *ClientToServer_RelayEnvelope   `protobuf:"bytes,12,opt,name=relay_envelope" json:"relay_envelope,omitempty"`
 	XXX_unrecognized []byte                          `json:"-"`
 }
 
@@ -103,6 +104,20 @@ func (m *ClientToServer_DeliverEnvelope) Reset()         { *m = ClientToServer_D
 func (m *ClientToServer_DeliverEnvelope) String() string { return proto1.CompactTextString(m) }
 func (*ClientToServer_DeliverEnvelope) ProtoMessage()    {}
 
+type ClientToServer_RelayEnvelope struct {
+	User              *Byte32  `protobuf:"bytes,1,req,customtype=Byte32" json:"User,omitempty"`
+	ServerAddress     *string  `protobuf:"bytes,2,req" json:"ServerAddress,omitempty"`
+	ServerPort        *int32   `protobuf:"varint,3,req" json:"ServerPort,omitempty"`
+	ServerTransportPK *Byte32  `protobuf:"bytes,4,req,customtype=Byte32" json:"ServerTransportPK,omitempty"`
+	Envelope          []byte   `protobuf:"bytes,5,req" json:"Envelope,omitempty"`
+	ServerReplicas    []string `protobuf:"bytes,6,rep" json:"ServerReplicas,omitempty"`
+	XXX_unrecognized  []byte   `json:"-"`
+}
+
+func (m *ClientToServer_RelayEnvelope) Reset()         { *m = ClientToServer_RelayEnvelope{} }
+func (m *ClientToServer_RelayEnvelope) String() string { return proto1.CompactTextString(m) }
+func (*ClientToServer_RelayEnvelope) ProtoMessage()    {}
+
 func init() {
 	proto1.RegisterEnum("proto.ServerToClient_StatusCode", ServerToClient_StatusCode_name, ServerToClient_StatusCode_value)
 }
@@ -488,6 +503,33 @@ func (m *ClientToServer) Unmarshal(data []byte) error {
 			}
 			b := bool(v != 0)
 			m.GetNumKeys = &b
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayEnvelope", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.RelayEnvelope == nil {
+				m.RelayEnvelope = &ClientToServer_RelayEnvelope{}
+			}
+			if err := m.RelayEnvelope.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -600,6 +642,182 @@ func (m *ClientToServer_DeliverEnvelope) Unmarshal(data []byte) error {
 	}
 	return nil
 }
+func (m *ClientToServer_RelayEnvelope) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field User", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.User = &Byte32{}
+			if err := m.User.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerAddress", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			s := string(data[index:postIndex])
+			m.ServerAddress = &s
+			index = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerPort", wireType)
+			}
+			var v int32
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ServerPort = &v
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerTransportPK", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServerTransportPK = &Byte32{}
+			if err := m.ServerTransportPK.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Envelope", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Envelope = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerReplicas", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServerReplicas = append(m.ServerReplicas, string(data[index:postIndex]))
+			index = postIndex
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
 func (m *ServerToClient) Size() (n int) {
 	var l int
 	_ = l
@@ -672,6 +890,10 @@ func (m *ClientToServer) Size() (n int) {
 	if m.GetNumKeys != nil {
 		n += 2
 	}
+	if m.RelayEnvelope != nil {
+		l = m.RelayEnvelope.Size()
+		n += 1 + l + sovClientServer(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -695,6 +917,40 @@ func (m *ClientToServer_DeliverEnvelope) Size() (n int) {
 	return n
 }
 
+func (m *ClientToServer_RelayEnvelope) Size() (n int) {
+	var l int
+	_ = l
+	if m.User != nil {
+		l = m.User.Size()
+		n += 1 + l + sovClientServer(uint64(l))
+	}
+	if m.ServerAddress != nil {
+		l = len(*m.ServerAddress)
+		n += 1 + l + sovClientServer(uint64(l))
+	}
+	if m.ServerPort != nil {
+		n += 1 + sovClientServer(uint64(*m.ServerPort))
+	}
+	if m.ServerTransportPK != nil {
+		l = m.ServerTransportPK.Size()
+		n += 1 + l + sovClientServer(uint64(l))
+	}
+	if m.Envelope != nil {
+		l = len(m.Envelope)
+		n += 1 + l + sovClientServer(uint64(l))
+	}
+	if len(m.ServerReplicas) > 0 {
+		for _, s := range m.ServerReplicas {
+			l = len(s)
+			n += 1 + l + sovClientServer(uint64(l))
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
 func sovClientServer(x uint64) (n int) {
 	for {
 		n++
@@ -796,8 +1052,11 @@ func NewPopulatedClientToServer(r randyClientServer, easy bool) *ClientToServer
 		v14 := bool(r.Intn(2) == 0)
 		this.GetNumKeys = &v14
 	}
+	if r.Intn(10) != 0 {
+		this.RelayEnvelope = NewPopulatedClientToServer_RelayEnvelope(r, easy)
+	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedClientServer(r, 12)
+		this.XXX_unrecognized = randUnrecognizedClientServer(r, 13)
 	}
 	return this
 }
@@ -816,6 +1075,35 @@ func NewPopulatedClientToServer_DeliverEnvelope(r randyClientServer, easy bool)
 	return this
 }
 
+func NewPopulatedClientToServer_RelayEnvelope(r randyClientServer, easy bool) *ClientToServer_RelayEnvelope {
+	this := &ClientToServer_RelayEnvelope{}
+	this.User = NewPopulatedByte32(r)
+	v16 := randStringClientServer(r)
+	this.ServerAddress = &v16
+	v17 := r.Int31()
+	if r.Intn(2) == 0 {
+		v17 *= -1
+	}
+	this.ServerPort = &v17
+	this.ServerTransportPK = NewPopulatedByte32(r)
+	v18 := r.Intn(100)
+	this.Envelope = make([]byte, v18)
+	for i := 0; i < v18; i++ {
+		this.Envelope[i] = byte(r.Intn(256))
+	}
+	if r.Intn(10) != 0 {
+		v19 := r.Intn(10)
+		this.ServerReplicas = make([]string, v19)
+		for i := 0; i < v19; i++ {
+			this.ServerReplicas[i] = randStringClientServer(r)
+		}
+	}
+	if !easy && r.Intn(10) != 0 {
+		this.XXX_unrecognized = randUnrecognizedClientServer(r, 7)
+	}
+	return this
+}
+
 type randyClientServer interface {
 	Float32() float32
 	Float64() float64
@@ -829,9 +1117,9 @@ func randUTF8RuneClientServer(r randyClientServer) rune {
 	return rune(r.Intn(126-43) + 43)
 }
 func randStringClientServer(r randyClientServer) string {
-	v16 := r.Intn(100)
-	tmps := make([]rune, v16)
-	for i := 0; i < v16; i++ {
+	v20 := r.Intn(100)
+	tmps := make([]rune, v20)
+	for i := 0; i < v20; i++ {
 		tmps[i] = randUTF8RuneClientServer(r)
 	}
 	return string(tmps)
@@ -853,11 +1141,11 @@ func randFieldClientServer(data []byte, r randyClientServer, fieldNumber int, wi
 	switch wire {
 	case 0:
 		data = encodeVarintPopulateClientServer(data, uint64(key))
-		v17 := r.Int63()
+		v21 := r.Int63()
 		if r.Intn(2) == 0 {
-			v17 *= -1
+			v21 *= -1
 		}
-		data = encodeVarintPopulateClientServer(data, uint64(v17))
+		data = encodeVarintPopulateClientServer(data, uint64(v21))
 	case 1:
 		data = encodeVarintPopulateClientServer(data, uint64(key))
 		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -1052,6 +1340,16 @@ func (m *ClientToServer) MarshalTo(data []byte) (n int, err error) {
 		}
 		i++
 	}
+	if m.RelayEnvelope != nil {
+		data[i] = 0x62
+		i++
+		i = encodeVarintClientServer(data, i, uint64(m.RelayEnvelope.Size()))
+		n5, err := m.RelayEnvelope.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n5
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -1077,11 +1375,11 @@ func (m *ClientToServer_DeliverEnvelope) MarshalTo(data []byte) (n int, err erro
 		data[i] = 0x1a
 		i++
 		i = encodeVarintClientServer(data, i, uint64(m.User.Size()))
-		n5, err := m.User.MarshalTo(data[i:])
+		n6, err := m.User.MarshalTo(data[i:])
 		if err != nil {
 			return 0, err
 		}
-		i += n5
+		i += n6
 	}
 	if m.Envelope != nil {
 		data[i] = 0x22
@@ -1095,6 +1393,79 @@ func (m *ClientToServer_DeliverEnvelope) MarshalTo(data []byte) (n int, err erro
 	return i, nil
 }
 
+func (m *ClientToServer_RelayEnvelope) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *ClientToServer_RelayEnvelope) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.User != nil {
+		data[i] = 0xa
+		i++
+		i = encodeVarintClientServer(data, i, uint64(m.User.Size()))
+		n7, err := m.User.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n7
+	}
+	if m.ServerAddress != nil {
+		data[i] = 0x12
+		i++
+		i = encodeVarintClientServer(data, i, uint64(len(*m.ServerAddress)))
+		i += copy(data[i:], *m.ServerAddress)
+	}
+	if m.ServerPort != nil {
+		data[i] = 0x18
+		i++
+		i = encodeVarintClientServer(data, i, uint64(*m.ServerPort))
+	}
+	if m.ServerTransportPK != nil {
+		data[i] = 0x22
+		i++
+		i = encodeVarintClientServer(data, i, uint64(m.ServerTransportPK.Size()))
+		n8, err := m.ServerTransportPK.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n8
+	}
+	if m.Envelope != nil {
+		data[i] = 0x2a
+		i++
+		i = encodeVarintClientServer(data, i, uint64(len(m.Envelope)))
+		i += copy(data[i:], m.Envelope)
+	}
+	if len(m.ServerReplicas) > 0 {
+		for _, s := range m.ServerReplicas {
+			data[i] = 0x32
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				data[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			data[i] = uint8(l)
+			i++
+			i += copy(data[i:], s)
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
 func encodeFixed64ClientServer(data []byte, offset int, v uint64) int {
 	data[offset] = uint8(v)
 	data[offset+1] = uint8(v >> 8)
@@ -1275,6 +1646,9 @@ func (this *ClientToServer) Equal(that interface{}) bool {
 	} else if that1.GetNumKeys != nil {
 		return false
 	}
+	if !this.RelayEnvelope.Equal(that1.RelayEnvelope) {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -1315,3 +1689,71 @@ func (this *ClientToServer_DeliverEnvelope) Equal(that interface{}) bool {
 	}
 	return true
 }
+func (this *ClientToServer_RelayEnvelope) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*ClientToServer_RelayEnvelope)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if that1.User == nil {
+		if this.User != nil {
+			return false
+		}
+	} else if !this.User.Equal(*that1.User) {
+		return false
+	}
+	if this.ServerAddress != nil && that1.ServerAddress != nil {
+		if *this.ServerAddress != *that1.ServerAddress {
+			return false
+		}
+	} else if this.ServerAddress != nil {
+		return false
+	} else if that1.ServerAddress != nil {
+		return false
+	}
+	if this.ServerPort != nil && that1.ServerPort != nil {
+		if *this.ServerPort != *that1.ServerPort {
+			return false
+		}
+	} else if this.ServerPort != nil {
+		return false
+	} else if that1.ServerPort != nil {
+		return false
+	}
+	if that1.ServerTransportPK == nil {
+		if this.ServerTransportPK != nil {
+			return false
+		}
+	} else if !this.ServerTransportPK.Equal(*that1.ServerTransportPK) {
+		return false
+	}
+	if !bytes.Equal(this.Envelope, that1.Envelope) {
+		return false
+	}
+	if len(this.ServerReplicas) != len(that1.ServerReplicas) {
+		return false
+	}
+	for i := range this.ServerReplicas {
+		if this.ServerReplicas[i] != that1.ServerReplicas[i] {
+			return false
+		}
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
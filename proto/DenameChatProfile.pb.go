@@ -20,13 +20,17 @@ var _ = proto1.Marshal
 var _ = math.Inf
 
 type Profile struct {
-	ServerAddressTCP  string `protobuf:"bytes,1,req" json:"ServerAddressTCP"`
-	ServerPortTCP     int32  `protobuf:"varint,2,req" json:"ServerPortTCP"`
-	ServerTransportPK Byte32 `protobuf:"bytes,3,req,customtype=Byte32" json:"ServerTransportPK"`
-	UserIDAtServer    Byte32 `protobuf:"bytes,4,req,customtype=Byte32" json:"UserIDAtServer"`
-	KeySigningKey     Byte32 `protobuf:"bytes,5,req,customtype=Byte32" json:"KeySigningKey"`
-	MessageAuthKey    Byte32 `protobuf:"bytes,6,req,customtype=Byte32" json:"MessageAuthKey"`
-	XXX_unrecognized  []byte `json:"-"`
+	ServerAddressTCP   string   `protobuf:"bytes,1,req" json:"ServerAddressTCP"`
+	ServerPortTCP      int32    `protobuf:"varint,2,req" json:"ServerPortTCP"`
+	ServerTransportPK  Byte32   `protobuf:"bytes,3,req,customtype=Byte32" json:"ServerTransportPK"`
+	UserIDAtServer     Byte32   `protobuf:"bytes,4,req,customtype=Byte32" json:"UserIDAtServer"`
+	KeySigningKey      Byte32   `protobuf:"bytes,5,req,customtype=Byte32" json:"KeySigningKey"`
+	MessageAuthKey     Byte32   `protobuf:"bytes,6,req,customtype=Byte32" json:"MessageAuthKey"`
+	PostQuantumPrekeys bool     `protobuf:"varint,7,opt" json:"PostQuantumPrekeys"`
+	ServerAddressOnion string   `protobuf:"bytes,8,opt" json:"ServerAddressOnion"`
+	ServerReplicasTCP  []string `protobuf:"bytes,9,rep" json:"ServerReplicasTCP"`
+	ShortPrekeyIDs     bool     `protobuf:"varint,10,opt" json:"ShortPrekeyIDs"`
+	XXX_unrecognized   []byte   `json:"-"`
 }
 
 func (m *Profile) Reset()         { *m = Profile{} }
@@ -187,6 +191,84 @@ func (m *Profile) Unmarshal(data []byte) error {
 				return err
 			}
 			index = postIndex
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PostQuantumPrekeys", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.PostQuantumPrekeys = bool(v != 0)
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerAddressOnion", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServerAddressOnion = string(data[index:postIndex])
+			index = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerReplicasTCP", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServerReplicasTCP = append(m.ServerReplicasTCP, string(data[index:postIndex]))
+			index = postIndex
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ShortPrekeyIDs", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ShortPrekeyIDs = bool(v != 0)
 		default:
 			var sizeOfWire int
 			for {
@@ -224,6 +306,16 @@ func (m *Profile) Size() (n int) {
 	n += 1 + l + sovDenameChatProfile(uint64(l))
 	l = m.MessageAuthKey.Size()
 	n += 1 + l + sovDenameChatProfile(uint64(l))
+	n += 2
+	l = len(m.ServerAddressOnion)
+	n += 1 + l + sovDenameChatProfile(uint64(l))
+	if len(m.ServerReplicasTCP) > 0 {
+		for _, s := range m.ServerReplicasTCP {
+			l = len(s)
+			n += 1 + l + sovDenameChatProfile(uint64(l))
+		}
+	}
+	n += 2
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -258,8 +350,18 @@ func NewPopulatedProfile(r randyDenameChatProfile, easy bool) *Profile {
 	this.KeySigningKey = *v3
 	v4 := NewPopulatedByte32(r)
 	this.MessageAuthKey = *v4
+	this.PostQuantumPrekeys = bool(r.Intn(2) == 0)
+	this.ServerAddressOnion = randStringDenameChatProfile(r)
+	if r.Intn(10) != 0 {
+		v5 := r.Intn(10)
+		this.ServerReplicasTCP = make([]string, v5)
+		for i := 0; i < v5; i++ {
+			this.ServerReplicasTCP[i] = randStringDenameChatProfile(r)
+		}
+	}
+	this.ShortPrekeyIDs = bool(r.Intn(2) == 0)
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedDenameChatProfile(r, 7)
+		this.XXX_unrecognized = randUnrecognizedDenameChatProfile(r, 11)
 	}
 	return this
 }
@@ -277,9 +379,9 @@ func randUTF8RuneDenameChatProfile(r randyDenameChatProfile) rune {
 	return rune(r.Intn(126-43) + 43)
 }
 func randStringDenameChatProfile(r randyDenameChatProfile) string {
-	v5 := r.Intn(100)
-	tmps := make([]rune, v5)
-	for i := 0; i < v5; i++ {
+	v6 := r.Intn(100)
+	tmps := make([]rune, v6)
+	for i := 0; i < v6; i++ {
 		tmps[i] = randUTF8RuneDenameChatProfile(r)
 	}
 	return string(tmps)
@@ -301,11 +403,11 @@ func randFieldDenameChatProfile(data []byte, r randyDenameChatProfile, fieldNumb
 	switch wire {
 	case 0:
 		data = encodeVarintPopulateDenameChatProfile(data, uint64(key))
-		v6 := r.Int63()
+		v7 := r.Int63()
 		if r.Intn(2) == 0 {
-			v6 *= -1
+			v7 *= -1
 		}
-		data = encodeVarintPopulateDenameChatProfile(data, uint64(v6))
+		data = encodeVarintPopulateDenameChatProfile(data, uint64(v7))
 	case 1:
 		data = encodeVarintPopulateDenameChatProfile(data, uint64(key))
 		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -384,6 +486,41 @@ func (m *Profile) MarshalTo(data []byte) (n int, err error) {
 		return 0, err
 	}
 	i += n4
+	data[i] = 0x38
+	i++
+	if m.PostQuantumPrekeys {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x42
+	i++
+	i = encodeVarintDenameChatProfile(data, i, uint64(len(m.ServerAddressOnion)))
+	i += copy(data[i:], m.ServerAddressOnion)
+	if len(m.ServerReplicasTCP) > 0 {
+		for _, s := range m.ServerReplicasTCP {
+			data[i] = 0x4a
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				data[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			data[i] = uint8(l)
+			i++
+			i += copy(data[i:], s)
+		}
+	}
+	data[i] = 0x50
+	i++
+	if m.ShortPrekeyIDs {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -455,6 +592,23 @@ func (this *Profile) Equal(that interface{}) bool {
 	if !this.MessageAuthKey.Equal(that1.MessageAuthKey) {
 		return false
 	}
+	if this.PostQuantumPrekeys != that1.PostQuantumPrekeys {
+		return false
+	}
+	if this.ServerAddressOnion != that1.ServerAddressOnion {
+		return false
+	}
+	if len(this.ServerReplicasTCP) != len(that1.ServerReplicasTCP) {
+		return false
+	}
+	for i := range this.ServerReplicasTCP {
+		if this.ServerReplicasTCP[i] != that1.ServerReplicasTCP[i] {
+			return false
+		}
+	}
+	if this.ShortPrekeyIDs != that1.ShortPrekeyIDs {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
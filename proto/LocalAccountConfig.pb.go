@@ -20,14 +20,25 @@ var _ = proto1.Marshal
 var _ = math.Inf
 
 type LocalAccountConfig struct {
-	ServerAddressTCP            string `protobuf:"bytes,1,req" json:"ServerAddressTCP"`
-	ServerPortTCP               int32  `protobuf:"varint,2,req" json:"ServerPortTCP"`
-	ServerTransportPK           Byte32 `protobuf:"bytes,3,req,customtype=Byte32" json:"ServerTransportPK"`
-	TransportSecretKeyForServer Byte32 `protobuf:"bytes,4,req,customtype=Byte32" json:"TransportSecretKeyForServer"`
-	KeySigningSecretKey         []byte `protobuf:"bytes,5,req" json:"KeySigningSecretKey"`
-	MessageAuthSecretKey        Byte32 `protobuf:"bytes,6,req,customtype=Byte32" json:"MessageAuthSecretKey"`
-	TorAddress                  string `protobuf:"bytes,8,req" json:"TorAddress"`
-	XXX_unrecognized            []byte `json:"-"`
+	ServerAddressTCP            string   `protobuf:"bytes,1,req" json:"ServerAddressTCP"`
+	ServerPortTCP               int32    `protobuf:"varint,2,req" json:"ServerPortTCP"`
+	ServerTransportPK           Byte32   `protobuf:"bytes,3,req,customtype=Byte32" json:"ServerTransportPK"`
+	TransportSecretKeyForServer Byte32   `protobuf:"bytes,4,req,customtype=Byte32" json:"TransportSecretKeyForServer"`
+	KeySigningSecretKey         []byte   `protobuf:"bytes,5,req" json:"KeySigningSecretKey"`
+	MessageAuthSecretKey        Byte32   `protobuf:"bytes,6,req,customtype=Byte32" json:"MessageAuthSecretKey"`
+	TorAddress                  string   `protobuf:"bytes,8,req" json:"TorAddress"`
+	RevocationNoticeWindow      uint64   `protobuf:"varint,9,opt" json:"RevocationNoticeWindow"`
+	MaxLookupDelay              uint64   `protobuf:"varint,10,opt" json:"MaxLookupDelay"`
+	CoverTrafficInterval        uint64   `protobuf:"varint,11,opt" json:"CoverTrafficInterval"`
+	FetchInterval               uint64   `protobuf:"varint,12,opt" json:"FetchInterval"`
+	PostQuantum                 bool     `protobuf:"varint,13,opt" json:"PostQuantum"`
+	ServerAddressOnion          string   `protobuf:"bytes,14,opt" json:"ServerAddressOnion"`
+	DirectTCP                   bool     `protobuf:"varint,15,opt" json:"DirectTCP"`
+	RelayThroughServer          bool     `protobuf:"varint,16,opt" json:"RelayThroughServer"`
+	ServerReplicasTCP           []string `protobuf:"bytes,17,rep" json:"ServerReplicasTCP"`
+	MaxMissingMessages          uint32   `protobuf:"varint,18,opt" json:"MaxMissingMessages"`
+	SavedKeyLifetime            uint64   `protobuf:"varint,19,opt" json:"SavedKeyLifetime"`
+	XXX_unrecognized            []byte   `json:"-"`
 }
 
 func (m *LocalAccountConfig) Reset()         { *m = LocalAccountConfig{} }
@@ -208,6 +219,191 @@ func (m *LocalAccountConfig) Unmarshal(data []byte) error {
 			}
 			m.TorAddress = string(data[index:postIndex])
 			index = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RevocationNoticeWindow", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.RevocationNoticeWindow |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxLookupDelay", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.MaxLookupDelay |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CoverTrafficInterval", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.CoverTrafficInterval |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FetchInterval", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.FetchInterval |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PostQuantum", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.PostQuantum = bool(v != 0)
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerAddressOnion", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServerAddressOnion = string(data[index:postIndex])
+			index = postIndex
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DirectTCP", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.DirectTCP = bool(v != 0)
+		case 16:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayThroughServer", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.RelayThroughServer = bool(v != 0)
+		case 17:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerReplicasTCP", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServerReplicasTCP = append(m.ServerReplicasTCP, string(data[index:postIndex]))
+			index = postIndex
+		case 18:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxMissingMessages", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.MaxMissingMessages |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 19:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SavedKeyLifetime", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.SavedKeyLifetime |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			var sizeOfWire int
 			for {
@@ -249,6 +445,23 @@ func (m *LocalAccountConfig) Size() (n int) {
 	n += 1 + l + sovLocalAccountConfig(uint64(l))
 	l = len(m.TorAddress)
 	n += 1 + l + sovLocalAccountConfig(uint64(l))
+	n += 1 + sovLocalAccountConfig(uint64(m.RevocationNoticeWindow))
+	n += 1 + sovLocalAccountConfig(uint64(m.MaxLookupDelay))
+	n += 1 + sovLocalAccountConfig(uint64(m.CoverTrafficInterval))
+	n += 1 + sovLocalAccountConfig(uint64(m.FetchInterval))
+	n += 2
+	l = len(m.ServerAddressOnion)
+	n += 1 + l + sovLocalAccountConfig(uint64(l))
+	n += 2
+	n += 3
+	if len(m.ServerReplicasTCP) > 0 {
+		for _, s := range m.ServerReplicasTCP {
+			l = len(s)
+			n += 2 + l + sovLocalAccountConfig(uint64(l))
+		}
+	}
+	n += 2 + sovLocalAccountConfig(uint64(m.MaxMissingMessages))
+	n += 2 + sovLocalAccountConfig(uint64(m.SavedKeyLifetime))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -287,8 +500,25 @@ func NewPopulatedLocalAccountConfig(r randyLocalAccountConfig, easy bool) *Local
 	v4 := NewPopulatedByte32(r)
 	this.MessageAuthSecretKey = *v4
 	this.TorAddress = randStringLocalAccountConfig(r)
+	this.RevocationNoticeWindow = uint64(r.Uint32())
+	this.MaxLookupDelay = uint64(r.Uint32())
+	this.CoverTrafficInterval = uint64(r.Uint32())
+	this.FetchInterval = uint64(r.Uint32())
+	this.PostQuantum = bool(r.Intn(2) == 0)
+	this.ServerAddressOnion = randStringLocalAccountConfig(r)
+	this.DirectTCP = bool(r.Intn(2) == 0)
+	this.RelayThroughServer = bool(r.Intn(2) == 0)
+	if r.Intn(10) != 0 {
+		v5 := r.Intn(10)
+		this.ServerReplicasTCP = make([]string, v5)
+		for i := 0; i < v5; i++ {
+			this.ServerReplicasTCP[i] = randStringLocalAccountConfig(r)
+		}
+	}
+	this.MaxMissingMessages = r.Uint32()
+	this.SavedKeyLifetime = uint64(r.Uint32())
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedLocalAccountConfig(r, 9)
+		this.XXX_unrecognized = randUnrecognizedLocalAccountConfig(r, 20)
 	}
 	return this
 }
@@ -306,9 +536,9 @@ func randUTF8RuneLocalAccountConfig(r randyLocalAccountConfig) rune {
 	return rune(r.Intn(126-43) + 43)
 }
 func randStringLocalAccountConfig(r randyLocalAccountConfig) string {
-	v5 := r.Intn(100)
-	tmps := make([]rune, v5)
-	for i := 0; i < v5; i++ {
+	v6 := r.Intn(100)
+	tmps := make([]rune, v6)
+	for i := 0; i < v6; i++ {
 		tmps[i] = randUTF8RuneLocalAccountConfig(r)
 	}
 	return string(tmps)
@@ -330,11 +560,11 @@ func randFieldLocalAccountConfig(data []byte, r randyLocalAccountConfig, fieldNu
 	switch wire {
 	case 0:
 		data = encodeVarintPopulateLocalAccountConfig(data, uint64(key))
-		v6 := r.Int63()
+		v7 := r.Int63()
 		if r.Intn(2) == 0 {
-			v6 *= -1
+			v7 *= -1
 		}
-		data = encodeVarintPopulateLocalAccountConfig(data, uint64(v6))
+		data = encodeVarintPopulateLocalAccountConfig(data, uint64(v7))
 	case 1:
 		data = encodeVarintPopulateLocalAccountConfig(data, uint64(key))
 		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -415,6 +645,75 @@ func (m *LocalAccountConfig) MarshalTo(data []byte) (n int, err error) {
 	i++
 	i = encodeVarintLocalAccountConfig(data, i, uint64(len(m.TorAddress)))
 	i += copy(data[i:], m.TorAddress)
+	data[i] = 0x48
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.RevocationNoticeWindow))
+	data[i] = 0x50
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.MaxLookupDelay))
+	data[i] = 0x58
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.CoverTrafficInterval))
+	data[i] = 0x60
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.FetchInterval))
+	data[i] = 0x68
+	i++
+	if m.PostQuantum {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x72
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(len(m.ServerAddressOnion)))
+	i += copy(data[i:], m.ServerAddressOnion)
+	data[i] = 0x78
+	i++
+	if m.DirectTCP {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x80
+	i++
+	data[i] = 0x1
+	i++
+	if m.RelayThroughServer {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	if len(m.ServerReplicasTCP) > 0 {
+		for _, s := range m.ServerReplicasTCP {
+			data[i] = 0x8a
+			i++
+			data[i] = 0x1
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				data[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			data[i] = uint8(l)
+			i++
+			i += copy(data[i:], s)
+		}
+	}
+	data[i] = 0x90
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.MaxMissingMessages))
+	data[i] = 0x98
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.SavedKeyLifetime))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -489,6 +788,44 @@ func (this *LocalAccountConfig) Equal(that interface{}) bool {
 	if this.TorAddress != that1.TorAddress {
 		return false
 	}
+	if this.RevocationNoticeWindow != that1.RevocationNoticeWindow {
+		return false
+	}
+	if this.MaxLookupDelay != that1.MaxLookupDelay {
+		return false
+	}
+	if this.CoverTrafficInterval != that1.CoverTrafficInterval {
+		return false
+	}
+	if this.FetchInterval != that1.FetchInterval {
+		return false
+	}
+	if this.PostQuantum != that1.PostQuantum {
+		return false
+	}
+	if this.ServerAddressOnion != that1.ServerAddressOnion {
+		return false
+	}
+	if this.DirectTCP != that1.DirectTCP {
+		return false
+	}
+	if this.RelayThroughServer != that1.RelayThroughServer {
+		return false
+	}
+	if len(this.ServerReplicasTCP) != len(that1.ServerReplicasTCP) {
+		return false
+	}
+	for i := range this.ServerReplicasTCP {
+		if this.ServerReplicasTCP[i] != that1.ServerReplicasTCP[i] {
+			return false
+		}
+	}
+	if this.MaxMissingMessages != that1.MaxMissingMessages {
+		return false
+	}
+	if this.SavedKeyLifetime != that1.SavedKeyLifetime {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -19,17 +19,86 @@ import bytes "bytes"
 var _ = proto1.Marshal
 var _ = math.Inf
 
+type ConversationMetadata_EditHistory int32
+
+const (
+	ConversationMetadata_DISCARD ConversationMetadata_EditHistory = 0
+	ConversationMetadata_KEEP    ConversationMetadata_EditHistory = 1
+)
+
+var ConversationMetadata_EditHistory_name = map[int32]string{
+	0: "DISCARD",
+	1: "KEEP",
+}
+var ConversationMetadata_EditHistory_value = map[string]int32{
+	"DISCARD": 0,
+	"KEEP":    1,
+}
+
+func (x ConversationMetadata_EditHistory) Enum() *ConversationMetadata_EditHistory {
+	p := new(ConversationMetadata_EditHistory)
+	*p = x
+	return p
+}
+func (x ConversationMetadata_EditHistory) String() string {
+	return proto1.EnumName(ConversationMetadata_EditHistory_name, int32(x))
+}
+func (x *ConversationMetadata_EditHistory) UnmarshalJSON(data []byte) error {
+	value, err := proto1.UnmarshalJSONEnum(ConversationMetadata_EditHistory_value, data, "ConversationMetadata_EditHistory")
+	if err != nil {
+		return err
+	}
+	*x = ConversationMetadata_EditHistory(value)
+	return nil
+}
+
 type ConversationMetadata struct {
-	Participants     []string `protobuf:"bytes,1,rep" json:"Participants"`
-	Subject          string   `protobuf:"bytes,2,req" json:"Subject"`
-	XXX_unrecognized []byte   `json:"-"`
+	Participants         []string                         `protobuf:"bytes,1,rep" json:"Participants"`
+	Subject              string                           `protobuf:"bytes,2,req" json:"Subject"`
+	Id                   *Byte32                          `protobuf:"bytes,3,opt,customtype=Byte32" json:"Id,omitempty"`
+	MembershipVersion    uint64                           `protobuf:"varint,4,opt" json:"MembershipVersion"`
+	Senders              []SenderSequence                 `protobuf:"bytes,5,rep" json:"Senders"`
+	Messages             []MessageFile                    `protobuf:"bytes,6,rep" json:"Messages"`
+	History              ConversationMetadata_EditHistory `protobuf:"varint,7,opt,enum=proto.ConversationMetadata_EditHistory" json:"History"`
+	Retention            uint64                           `protobuf:"varint,8,opt" json:"Retention"`
+	RetentionVersion     uint64                           `protobuf:"varint,9,opt" json:"RetentionVersion"`
+	NextExpiry           int64                            `protobuf:"varint,10,opt" json:"NextExpiry"`
+	MembershipChangeHash *Byte32                          `protobuf:"bytes,11,opt,customtype=Byte32" json:"MembershipChangeHash,omitempty"`
+	PreviousParticipants []string                         `protobuf:"bytes,12,rep" json:"PreviousParticipants"`
+	HistoryVersion       uint64                           `protobuf:"varint,13,opt" json:"HistoryVersion"`
+	XXX_unrecognized     []byte                           `json:"-"`
 }
 
 func (m *ConversationMetadata) Reset()         { *m = ConversationMetadata{} }
 func (m *ConversationMetadata) String() string { return proto1.CompactTextString(m) }
 func (*ConversationMetadata) ProtoMessage()    {}
 
+type SenderSequence struct {
+	Dename           string   `protobuf:"bytes,1,req" json:"Dename"`
+	Received         uint64   `protobuf:"varint,2,req" json:"Received"`
+	Missing          []uint64 `protobuf:"varint,3,rep" json:"Missing"`
+	Date             int64    `protobuf:"varint,4,req" json:"Date"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *SenderSequence) Reset()         { *m = SenderSequence{} }
+func (m *SenderSequence) String() string { return proto1.CompactTextString(m) }
+func (*SenderSequence) ProtoMessage()    {}
+
+type MessageFile struct {
+	Name             string `protobuf:"bytes,1,req" json:"Name"`
+	Dename           string `protobuf:"bytes,2,req" json:"Dename"`
+	SequenceNumber   uint64 `protobuf:"varint,3,req" json:"SequenceNumber"`
+	Edits            uint32 `protobuf:"varint,4,req" json:"Edits"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *MessageFile) Reset()         { *m = MessageFile{} }
+func (m *MessageFile) String() string { return proto1.CompactTextString(m) }
+func (*MessageFile) ProtoMessage()    {}
+
 func init() {
+	proto1.RegisterEnum("proto.ConversationMetadata_EditHistory", ConversationMetadata_EditHistory_name, ConversationMetadata_EditHistory_value)
 }
 func (m *ConversationMetadata) Unmarshal(data []byte) error {
 	l := len(data)
@@ -70,30 +139,469 @@ func (m *ConversationMetadata) Unmarshal(data []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.Participants = append(m.Participants, string(data[index:postIndex]))
-			index = postIndex
-		case 2:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Subject", wireType)
+			m.Participants = append(m.Participants, string(data[index:postIndex]))
+			index = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Subject", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Subject = string(data[index:postIndex])
+			index = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Id", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Id = &Byte32{}
+			if err := m.Id.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MembershipVersion", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.MembershipVersion |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Senders", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Senders = append(m.Senders, SenderSequence{})
+			if err := m.Senders[len(m.Senders)-1].Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Messages", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Messages = append(m.Messages, MessageFile{})
+			if err := m.Messages[len(m.Messages)-1].Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field History", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.History |= (ConversationMetadata_EditHistory(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Retention", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Retention |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RetentionVersion", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.RetentionVersion |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field NextExpiry", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.NextExpiry |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MembershipChangeHash", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.MembershipChangeHash = &Byte32{}
+			if err := m.MembershipChangeHash.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PreviousParticipants", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PreviousParticipants = append(m.PreviousParticipants, string(data[index:postIndex]))
+			index = postIndex
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HistoryVersion", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.HistoryVersion |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *SenderSequence) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Dename", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Dename = string(data[index:postIndex])
+			index = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Received", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Received |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Missing", wireType)
+			}
+			var v uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Missing = append(m.Missing, v)
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Date", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Date |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *MessageFile) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Name", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Name = string(data[index:postIndex])
+			index = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Dename", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Dename = string(data[index:postIndex])
+			index = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SequenceNumber", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.SequenceNumber |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Edits", wireType)
 			}
-			var stringLen uint64
 			for shift := uint(0); ; shift += 7 {
 				if index >= l {
 					return io.ErrUnexpectedEOF
 				}
 				b := data[index]
 				index++
-				stringLen |= (uint64(b) & 0x7F) << shift
+				m.Edits |= (uint32(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			postIndex := index + int(stringLen)
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			m.Subject = string(data[index:postIndex])
-			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -128,6 +636,71 @@ func (m *ConversationMetadata) Size() (n int) {
 	}
 	l = len(m.Subject)
 	n += 1 + l + sovLocalConversationMetadata(uint64(l))
+	if m.Id != nil {
+		l = m.Id.Size()
+		n += 1 + l + sovLocalConversationMetadata(uint64(l))
+	}
+	n += 1 + sovLocalConversationMetadata(uint64(m.MembershipVersion))
+	if len(m.Senders) > 0 {
+		for _, e := range m.Senders {
+			l = e.Size()
+			n += 1 + l + sovLocalConversationMetadata(uint64(l))
+		}
+	}
+	if len(m.Messages) > 0 {
+		for _, e := range m.Messages {
+			l = e.Size()
+			n += 1 + l + sovLocalConversationMetadata(uint64(l))
+		}
+	}
+	n += 1 + sovLocalConversationMetadata(uint64(m.History))
+	n += 1 + sovLocalConversationMetadata(uint64(m.Retention))
+	n += 1 + sovLocalConversationMetadata(uint64(m.RetentionVersion))
+	n += 1 + sovLocalConversationMetadata(uint64(m.NextExpiry))
+	if m.MembershipChangeHash != nil {
+		l = m.MembershipChangeHash.Size()
+		n += 1 + l + sovLocalConversationMetadata(uint64(l))
+	}
+	if len(m.PreviousParticipants) > 0 {
+		for _, s := range m.PreviousParticipants {
+			l = len(s)
+			n += 1 + l + sovLocalConversationMetadata(uint64(l))
+		}
+	}
+	n += 1 + sovLocalConversationMetadata(uint64(m.HistoryVersion))
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *SenderSequence) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Dename)
+	n += 1 + l + sovLocalConversationMetadata(uint64(l))
+	n += 1 + sovLocalConversationMetadata(uint64(m.Received))
+	if len(m.Missing) > 0 {
+		for _, e := range m.Missing {
+			n += 1 + sovLocalConversationMetadata(uint64(e))
+		}
+	}
+	n += 1 + sovLocalConversationMetadata(uint64(m.Date))
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *MessageFile) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Name)
+	n += 1 + l + sovLocalConversationMetadata(uint64(l))
+	l = len(m.Dename)
+	n += 1 + l + sovLocalConversationMetadata(uint64(l))
+	n += 1 + sovLocalConversationMetadata(uint64(m.SequenceNumber))
+	n += 1 + sovLocalConversationMetadata(uint64(m.Edits))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -157,8 +730,79 @@ func NewPopulatedConversationMetadata(r randyLocalConversationMetadata, easy boo
 		}
 	}
 	this.Subject = randStringLocalConversationMetadata(r)
+	if r.Intn(10) != 0 {
+		this.Id = NewPopulatedByte32(r)
+	}
+	this.MembershipVersion = uint64(r.Uint32())
+	if r.Intn(10) != 0 {
+		v2 := r.Intn(10)
+		this.Senders = make([]SenderSequence, v2)
+		for i := 0; i < v2; i++ {
+			v3 := NewPopulatedSenderSequence(r, easy)
+			this.Senders[i] = *v3
+		}
+	}
+	if r.Intn(10) != 0 {
+		v4 := r.Intn(10)
+		this.Messages = make([]MessageFile, v4)
+		for i := 0; i < v4; i++ {
+			v5 := NewPopulatedMessageFile(r, easy)
+			this.Messages[i] = *v5
+		}
+	}
+	this.History = ConversationMetadata_EditHistory([]int32{0, 1}[r.Intn(2)])
+	this.Retention = uint64(r.Uint32())
+	this.RetentionVersion = uint64(r.Uint32())
+	this.NextExpiry = r.Int63()
+	if r.Intn(2) == 0 {
+		this.NextExpiry *= -1
+	}
+	if r.Intn(10) != 0 {
+		this.MembershipChangeHash = NewPopulatedByte32(r)
+	}
+	if r.Intn(10) != 0 {
+		v6 := r.Intn(10)
+		this.PreviousParticipants = make([]string, v6)
+		for i := 0; i < v6; i++ {
+			this.PreviousParticipants[i] = randStringLocalConversationMetadata(r)
+		}
+	}
+	this.HistoryVersion = uint64(r.Uint32())
+	if !easy && r.Intn(10) != 0 {
+		this.XXX_unrecognized = randUnrecognizedLocalConversationMetadata(r, 14)
+	}
+	return this
+}
+
+func NewPopulatedSenderSequence(r randyLocalConversationMetadata, easy bool) *SenderSequence {
+	this := &SenderSequence{}
+	this.Dename = randStringLocalConversationMetadata(r)
+	this.Received = uint64(r.Uint32())
+	if r.Intn(10) != 0 {
+		v7 := r.Intn(100)
+		this.Missing = make([]uint64, v7)
+		for i := 0; i < v7; i++ {
+			this.Missing[i] = uint64(r.Uint32())
+		}
+	}
+	this.Date = r.Int63()
+	if r.Intn(2) == 0 {
+		this.Date *= -1
+	}
+	if !easy && r.Intn(10) != 0 {
+		this.XXX_unrecognized = randUnrecognizedLocalConversationMetadata(r, 5)
+	}
+	return this
+}
+
+func NewPopulatedMessageFile(r randyLocalConversationMetadata, easy bool) *MessageFile {
+	this := &MessageFile{}
+	this.Name = randStringLocalConversationMetadata(r)
+	this.Dename = randStringLocalConversationMetadata(r)
+	this.SequenceNumber = uint64(r.Uint32())
+	this.Edits = r.Uint32()
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedLocalConversationMetadata(r, 3)
+		this.XXX_unrecognized = randUnrecognizedLocalConversationMetadata(r, 5)
 	}
 	return this
 }
@@ -176,9 +820,9 @@ func randUTF8RuneLocalConversationMetadata(r randyLocalConversationMetadata) run
 	return rune(r.Intn(126-43) + 43)
 }
 func randStringLocalConversationMetadata(r randyLocalConversationMetadata) string {
-	v2 := r.Intn(100)
-	tmps := make([]rune, v2)
-	for i := 0; i < v2; i++ {
+	v8 := r.Intn(100)
+	tmps := make([]rune, v8)
+	for i := 0; i < v8; i++ {
 		tmps[i] = randUTF8RuneLocalConversationMetadata(r)
 	}
 	return string(tmps)
@@ -200,11 +844,11 @@ func randFieldLocalConversationMetadata(data []byte, r randyLocalConversationMet
 	switch wire {
 	case 0:
 		data = encodeVarintPopulateLocalConversationMetadata(data, uint64(key))
-		v3 := r.Int63()
+		v9 := r.Int63()
 		if r.Intn(2) == 0 {
-			v3 *= -1
+			v9 *= -1
 		}
-		data = encodeVarintPopulateLocalConversationMetadata(data, uint64(v3))
+		data = encodeVarintPopulateLocalConversationMetadata(data, uint64(v9))
 	case 1:
 		data = encodeVarintPopulateLocalConversationMetadata(data, uint64(key))
 		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -263,6 +907,156 @@ func (m *ConversationMetadata) MarshalTo(data []byte) (n int, err error) {
 	i++
 	i = encodeVarintLocalConversationMetadata(data, i, uint64(len(m.Subject)))
 	i += copy(data[i:], m.Subject)
+	if m.Id != nil {
+		data[i] = 0x1a
+		i++
+		i = encodeVarintLocalConversationMetadata(data, i, uint64(m.Id.Size()))
+		n1, err := m.Id.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n1
+	}
+	data[i] = 0x20
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.MembershipVersion))
+	if len(m.Senders) > 0 {
+		for _, msg := range m.Senders {
+			data[i] = 0x2a
+			i++
+			i = encodeVarintLocalConversationMetadata(data, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(data[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if len(m.Messages) > 0 {
+		for _, msg := range m.Messages {
+			data[i] = 0x32
+			i++
+			i = encodeVarintLocalConversationMetadata(data, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(data[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	data[i] = 0x38
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.History))
+	data[i] = 0x40
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.Retention))
+	data[i] = 0x48
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.RetentionVersion))
+	data[i] = 0x50
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.NextExpiry))
+	if m.MembershipChangeHash != nil {
+		data[i] = 0x5a
+		i++
+		i = encodeVarintLocalConversationMetadata(data, i, uint64(m.MembershipChangeHash.Size()))
+		n2, err := m.MembershipChangeHash.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n2
+	}
+	if len(m.PreviousParticipants) > 0 {
+		for _, s := range m.PreviousParticipants {
+			data[i] = 0x62
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				data[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			data[i] = uint8(l)
+			i++
+			i += copy(data[i:], s)
+		}
+	}
+	data[i] = 0x68
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.HistoryVersion))
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func (m *SenderSequence) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *SenderSequence) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0xa
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(len(m.Dename)))
+	i += copy(data[i:], m.Dename)
+	data[i] = 0x10
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.Received))
+	if len(m.Missing) > 0 {
+		for _, num := range m.Missing {
+			data[i] = 0x18
+			i++
+			i = encodeVarintLocalConversationMetadata(data, i, uint64(num))
+		}
+	}
+	data[i] = 0x20
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.Date))
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func (m *MessageFile) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *MessageFile) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0xa
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(len(m.Name)))
+	i += copy(data[i:], m.Name)
+	data[i] = 0x12
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(len(m.Dename)))
+	i += copy(data[i:], m.Dename)
+	data[i] = 0x18
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.SequenceNumber))
+	data[i] = 0x20
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.Edits))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -327,6 +1121,141 @@ func (this *ConversationMetadata) Equal(that interface{}) bool {
 	if this.Subject != that1.Subject {
 		return false
 	}
+	if that1.Id == nil {
+		if this.Id != nil {
+			return false
+		}
+	} else if !this.Id.Equal(*that1.Id) {
+		return false
+	}
+	if this.MembershipVersion != that1.MembershipVersion {
+		return false
+	}
+	if len(this.Senders) != len(that1.Senders) {
+		return false
+	}
+	for i := range this.Senders {
+		if !this.Senders[i].Equal(&that1.Senders[i]) {
+			return false
+		}
+	}
+	if len(this.Messages) != len(that1.Messages) {
+		return false
+	}
+	for i := range this.Messages {
+		if !this.Messages[i].Equal(&that1.Messages[i]) {
+			return false
+		}
+	}
+	if this.History != that1.History {
+		return false
+	}
+	if this.Retention != that1.Retention {
+		return false
+	}
+	if this.RetentionVersion != that1.RetentionVersion {
+		return false
+	}
+	if this.NextExpiry != that1.NextExpiry {
+		return false
+	}
+	if that1.MembershipChangeHash == nil {
+		if this.MembershipChangeHash != nil {
+			return false
+		}
+	} else if !this.MembershipChangeHash.Equal(*that1.MembershipChangeHash) {
+		return false
+	}
+	if len(this.PreviousParticipants) != len(that1.PreviousParticipants) {
+		return false
+	}
+	for i := range this.PreviousParticipants {
+		if this.PreviousParticipants[i] != that1.PreviousParticipants[i] {
+			return false
+		}
+	}
+	if this.HistoryVersion != that1.HistoryVersion {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
+func (this *SenderSequence) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*SenderSequence)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if this.Dename != that1.Dename {
+		return false
+	}
+	if this.Received != that1.Received {
+		return false
+	}
+	if len(this.Missing) != len(that1.Missing) {
+		return false
+	}
+	for i := range this.Missing {
+		if this.Missing[i] != that1.Missing[i] {
+			return false
+		}
+	}
+	if this.Date != that1.Date {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
+func (this *MessageFile) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*MessageFile)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if this.Name != that1.Name {
+		return false
+	}
+	if this.Dename != that1.Dename {
+		return false
+	}
+	if this.SequenceNumber != that1.SequenceNumber {
+		return false
+	}
+	if this.Edits != that1.Edits {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
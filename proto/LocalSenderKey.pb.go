@@ -0,0 +1,452 @@
+// Code generated by protoc-gen-gogo.
+// source: LocalSenderKey.proto
+// DO NOT EDIT!
+
+package proto
+
+import proto1 "github.com/gogo/protobuf/proto"
+import math "math"
+
+// discarding unused import gogoproto "github.com/gogo/protobuf/gogoproto/gogo.pb"
+
+import io "io"
+import fmt "fmt"
+import github_com_gogo_protobuf_proto "github.com/gogo/protobuf/proto"
+
+import bytes "bytes"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto1.Marshal
+var _ = math.Inf
+
+type SenderKeyState struct {
+	Key              SenderKey `protobuf:"bytes,1,req" json:"Key"`
+	ConversationId   Byte32    `protobuf:"bytes,2,req,customtype=Byte32" json:"ConversationId"`
+	Sender           string    `protobuf:"bytes,3,req" json:"Sender"`
+	SigningSecretKey []byte    `protobuf:"bytes,4,opt" json:"SigningSecretKey"`
+	DistributedTo    []string  `protobuf:"bytes,5,rep" json:"DistributedTo"`
+	SavedIterations  []uint32  `protobuf:"varint,6,rep" json:"SavedIterations"`
+	SavedKeys        []Byte32  `protobuf:"bytes,7,rep,customtype=Byte32" json:"SavedKeys"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *SenderKeyState) Reset()         { *m = SenderKeyState{} }
+func (m *SenderKeyState) String() string { return proto1.CompactTextString(m) }
+func (*SenderKeyState) ProtoMessage()    {}
+
+func init() {
+}
+func (m *SenderKeyState) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.Key.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ConversationId", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.ConversationId.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sender", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Sender = string(data[index:postIndex])
+			index = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SigningSecretKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.SigningSecretKey = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DistributedTo", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.DistributedTo = append(m.DistributedTo, string(data[index:postIndex]))
+			index = postIndex
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SavedIterations", wireType)
+			}
+			var v uint32
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.SavedIterations = append(m.SavedIterations, v)
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SavedKeys", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.SavedKeys = append(m.SavedKeys, Byte32{})
+			m.SavedKeys[len(m.SavedKeys)-1].Unmarshal(data[index:postIndex])
+			index = postIndex
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *SenderKeyState) Size() (n int) {
+	var l int
+	_ = l
+	l = m.Key.Size()
+	n += 1 + l + sovLocalSenderKey(uint64(l))
+	l = m.ConversationId.Size()
+	n += 1 + l + sovLocalSenderKey(uint64(l))
+	l = len(m.Sender)
+	n += 1 + l + sovLocalSenderKey(uint64(l))
+	if m.SigningSecretKey != nil {
+		l = len(m.SigningSecretKey)
+		n += 1 + l + sovLocalSenderKey(uint64(l))
+	}
+	if len(m.DistributedTo) > 0 {
+		for _, s := range m.DistributedTo {
+			l = len(s)
+			n += 1 + l + sovLocalSenderKey(uint64(l))
+		}
+	}
+	if len(m.SavedIterations) > 0 {
+		for _, e := range m.SavedIterations {
+			n += 1 + sovLocalSenderKey(uint64(e))
+		}
+	}
+	if len(m.SavedKeys) > 0 {
+		for _, e := range m.SavedKeys {
+			l = e.Size()
+			n += 1 + l + sovLocalSenderKey(uint64(l))
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func sovLocalSenderKey(x uint64) (n int) {
+	for {
+		n++
+		x >>= 7
+		if x == 0 {
+			break
+		}
+	}
+	return n
+}
+func sozLocalSenderKey(x uint64) (n int) {
+	return sovLocalSenderKey(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+}
+func (m *SenderKeyState) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *SenderKeyState) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0xa
+	i++
+	i = encodeVarintLocalSenderKey(data, i, uint64(m.Key.Size()))
+	n1, err := m.Key.MarshalTo(data[i:])
+	if err != nil {
+		return 0, err
+	}
+	i += n1
+	data[i] = 0x12
+	i++
+	i = encodeVarintLocalSenderKey(data, i, uint64(m.ConversationId.Size()))
+	n2, err := m.ConversationId.MarshalTo(data[i:])
+	if err != nil {
+		return 0, err
+	}
+	i += n2
+	data[i] = 0x1a
+	i++
+	i = encodeVarintLocalSenderKey(data, i, uint64(len(m.Sender)))
+	i += copy(data[i:], m.Sender)
+	if m.SigningSecretKey != nil {
+		data[i] = 0x22
+		i++
+		i = encodeVarintLocalSenderKey(data, i, uint64(len(m.SigningSecretKey)))
+		i += copy(data[i:], m.SigningSecretKey)
+	}
+	if len(m.DistributedTo) > 0 {
+		for _, s := range m.DistributedTo {
+			data[i] = 0x2a
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				data[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			data[i] = uint8(l)
+			i++
+			i += copy(data[i:], s)
+		}
+	}
+	if len(m.SavedIterations) > 0 {
+		for _, num := range m.SavedIterations {
+			data[i] = 0x30
+			i++
+			i = encodeVarintLocalSenderKey(data, i, uint64(num))
+		}
+	}
+	if len(m.SavedKeys) > 0 {
+		for _, msg := range m.SavedKeys {
+			data[i] = 0x3a
+			i++
+			i = encodeVarintLocalSenderKey(data, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(data[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func encodeFixed64LocalSenderKey(data []byte, offset int, v uint64) int {
+	data[offset] = uint8(v)
+	data[offset+1] = uint8(v >> 8)
+	data[offset+2] = uint8(v >> 16)
+	data[offset+3] = uint8(v >> 24)
+	data[offset+4] = uint8(v >> 32)
+	data[offset+5] = uint8(v >> 40)
+	data[offset+6] = uint8(v >> 48)
+	data[offset+7] = uint8(v >> 56)
+	return offset + 8
+}
+func encodeFixed32LocalSenderKey(data []byte, offset int, v uint32) int {
+	data[offset] = uint8(v)
+	data[offset+1] = uint8(v >> 8)
+	data[offset+2] = uint8(v >> 16)
+	data[offset+3] = uint8(v >> 24)
+	return offset + 4
+}
+func encodeVarintLocalSenderKey(data []byte, offset int, v uint64) int {
+	for v >= 1<<7 {
+		data[offset] = uint8(v&0x7f | 0x80)
+		v >>= 7
+		offset++
+	}
+	data[offset] = uint8(v)
+	return offset + 1
+}
+func (this *SenderKeyState) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*SenderKeyState)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if !this.Key.Equal(&that1.Key) {
+		return false
+	}
+	if !this.ConversationId.Equal(that1.ConversationId) {
+		return false
+	}
+	if this.Sender != that1.Sender {
+		return false
+	}
+	if !bytes.Equal(this.SigningSecretKey, that1.SigningSecretKey) {
+		return false
+	}
+	if len(this.DistributedTo) != len(that1.DistributedTo) {
+		return false
+	}
+	for i := range this.DistributedTo {
+		if this.DistributedTo[i] != that1.DistributedTo[i] {
+			return false
+		}
+	}
+	if len(this.SavedIterations) != len(that1.SavedIterations) {
+		return false
+	}
+	for i := range this.SavedIterations {
+		if this.SavedIterations[i] != that1.SavedIterations[i] {
+			return false
+		}
+	}
+	if len(this.SavedKeys) != len(that1.SavedKeys) {
+		return false
+	}
+	for i := range this.SavedKeys {
+		if !this.SavedKeys[i].Equal(that1.SavedKeys[i]) {
+			return false
+		}
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
@@ -22,6 +22,7 @@ var _ = math.Inf
 type Prekeys struct {
 	PrekeySecrets    []Byte32 `protobuf:"bytes,1,rep,customtype=Byte32" json:"PrekeySecrets"`
 	PrekeyPublics    []Byte32 `protobuf:"bytes,2,rep,customtype=Byte32" json:"PrekeyPublics"`
+	PrekeyKEMSecrets [][]byte `protobuf:"bytes,3,rep" json:"PrekeyKEMSecrets"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -96,6 +97,29 @@ func (m *Prekeys) Unmarshal(data []byte) error {
 			m.PrekeyPublics = append(m.PrekeyPublics, Byte32{})
 			m.PrekeyPublics[len(m.PrekeyPublics)-1].Unmarshal(data[index:postIndex])
 			index = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PrekeyKEMSecrets", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PrekeyKEMSecrets = append(m.PrekeyKEMSecrets, make([]byte, postIndex-index))
+			copy(m.PrekeyKEMSecrets[len(m.PrekeyKEMSecrets)-1], data[index:postIndex])
+			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -134,6 +158,12 @@ func (m *Prekeys) Size() (n int) {
 			n += 1 + l + sovPrekeys(uint64(l))
 		}
 	}
+	if len(m.PrekeyKEMSecrets) > 0 {
+		for _, b := range m.PrekeyKEMSecrets {
+			l = len(b)
+			n += 1 + l + sovPrekeys(uint64(l))
+		}
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -171,8 +201,19 @@ func NewPopulatedPrekeys(r randyPrekeys, easy bool) *Prekeys {
 			this.PrekeyPublics[i] = *v4
 		}
 	}
+	if r.Intn(10) != 0 {
+		v5 := r.Intn(100)
+		this.PrekeyKEMSecrets = make([][]byte, v5)
+		for i := 0; i < v5; i++ {
+			v6 := r.Intn(100)
+			this.PrekeyKEMSecrets[i] = make([]byte, v6)
+			for j := 0; j < v6; j++ {
+				this.PrekeyKEMSecrets[i][j] = byte(r.Intn(256))
+			}
+		}
+	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedPrekeys(r, 3)
+		this.XXX_unrecognized = randUnrecognizedPrekeys(r, 4)
 	}
 	return this
 }
@@ -190,9 +231,9 @@ func randUTF8RunePrekeys(r randyPrekeys) rune {
 	return rune(r.Intn(126-43) + 43)
 }
 func randStringPrekeys(r randyPrekeys) string {
-	v5 := r.Intn(100)
-	tmps := make([]rune, v5)
-	for i := 0; i < v5; i++ {
+	v7 := r.Intn(100)
+	tmps := make([]rune, v7)
+	for i := 0; i < v7; i++ {
 		tmps[i] = randUTF8RunePrekeys(r)
 	}
 	return string(tmps)
@@ -214,11 +255,11 @@ func randFieldPrekeys(data []byte, r randyPrekeys, fieldNumber int, wire int) []
 	switch wire {
 	case 0:
 		data = encodeVarintPopulatePrekeys(data, uint64(key))
-		v6 := r.Int63()
+		v8 := r.Int63()
 		if r.Intn(2) == 0 {
-			v6 *= -1
+			v8 *= -1
 		}
-		data = encodeVarintPopulatePrekeys(data, uint64(v6))
+		data = encodeVarintPopulatePrekeys(data, uint64(v8))
 	case 1:
 		data = encodeVarintPopulatePrekeys(data, uint64(key))
 		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -282,6 +323,14 @@ func (m *Prekeys) MarshalTo(data []byte) (n int, err error) {
 			i += n
 		}
 	}
+	if len(m.PrekeyKEMSecrets) > 0 {
+		for _, b := range m.PrekeyKEMSecrets {
+			data[i] = 0x1a
+			i++
+			i = encodeVarintPrekeys(data, i, uint64(len(b)))
+			i += copy(data[i:], b)
+		}
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -351,6 +400,14 @@ func (this *Prekeys) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if len(this.PrekeyKEMSecrets) != len(that1.PrekeyKEMSecrets) {
+		return false
+	}
+	for i := range this.PrekeyKEMSecrets {
+		if !bytes.Equal(this.PrekeyKEMSecrets[i], that1.PrekeyKEMSecrets[i]) {
+			return false
+		}
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -1,7 +1,11 @@
 package proto
 
 const MAX_MESSAGE_SIZE = 16 * 1024
-const SERVER_MESSAGE_SIZE = MAX_MESSAGE_SIZE + 100
+
+// SERVER_MESSAGE_SIZE leaves room for a message of MAX_MESSAGE_SIZE and the
+// destination of a relayed envelope. Messages are padded to the frame size of
+// the connection, which is smaller when talking to older implementations.
+const SERVER_MESSAGE_SIZE = MAX_MESSAGE_SIZE + 512
 
 func ToProtoByte32List(list []*[32]byte) []Byte32 {
 	newList := make([]Byte32, 0)
@@ -25,6 +25,9 @@ func (r *Ratchet) GetRecvChainKey() *proto.Byte32       { return (*proto.Byte32)
 func (r *Ratchet) GetSendCount() uint32                 { return r.sendCount }
 func (r *Ratchet) GetRecvCount() uint32                 { return r.recvCount }
 func (r *Ratchet) GetPrevSendCount() uint32             { return r.prevSendCount }
+func (r *Ratchet) GetSessionId() *proto.Byte32          { return (*proto.Byte32)(&r.sessionID) }
+func (r *Ratchet) GetMaxMissingMessages() uint32        { return r.MaxMissingMessages }
+func (r *Ratchet) GetSavedKeyLifetime() uint32          { return uint32(r.SavedKeyLifetime / time.Second) }
 
 func newByte32(bs *[32]byte) *proto.Byte32 {
 	ret := new(proto.Byte32)
@@ -78,6 +81,12 @@ func (r *Ratchet) FillFromFace(that RatchetStateFace) *Ratchet {
 	r.ourAuthPrivate = *that.GetOurAuthPrivate()
 	r.prevAuthPrivate = *that.GetPrevAuthPrivate()
 	r.theirAuthPublic = *that.GetTheirAuthPublic()
+	r.sessionID = [32]byte{}
+	if sessionID := that.GetSessionId(); sessionID != nil {
+		r.sessionID = *sessionID
+	}
+	r.MaxMissingMessages = that.GetMaxMissingMessages()
+	r.SavedKeyLifetime = time.Duration(that.GetSavedKeyLifetime()) * time.Second
 	r.saved = make(map[[32]byte]map[uint32]savedKey)
 	for _, saved := range that.GetSavedKeys() {
 		messageKeys := make(map[uint32]savedKey)
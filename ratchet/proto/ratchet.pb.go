@@ -58,11 +58,19 @@ type RatchetState struct {
 	// they are kept around longer. Public-key authenticators between the
 	// sender's long-term key and the receiver's current auth key can be used
 	// to authenticate messages.
-	PrevAuthPrivate  *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,14,req,name=prev_auth_private,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"prev_auth_private,omitempty"`
-	OurAuthPrivate   *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,15,req,name=our_auth_private,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"our_auth_private,omitempty"`
-	TheirAuthPublic  *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,16,req,name=their_auth_public,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"their_auth_public,omitempty"`
-	SavedKeys        []RatchetState_SavedKeys                          `protobuf:"bytes,17,rep,name=saved_keys" json:"saved_keys"`
-	XXX_unrecognized []byte                                            `json:"-"`
+	PrevAuthPrivate *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,14,req,name=prev_auth_private,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"prev_auth_private,omitempty"`
+	OurAuthPrivate  *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,15,req,name=our_auth_private,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"our_auth_private,omitempty"`
+	TheirAuthPublic *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,16,req,name=their_auth_public,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"their_auth_public,omitempty"`
+	SavedKeys       []RatchetState_SavedKeys                          `protobuf:"bytes,17,rep,name=saved_keys" json:"saved_keys"`
+	// Both parties derive the same session id from the first message, it
+	// can be used to tell apart concurrent sessions between them.
+	SessionId *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,18,opt,name=session_id,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"session_id,omitempty"`
+	// Keys for skipped messages are kept for at most max_missing_messages
+	// messages in a row and deleted saved_key_lifetime seconds after they
+	// were saved. Zero means the default.
+	MaxMissingMessages uint32 `protobuf:"varint,19,opt,name=max_missing_messages" json:"max_missing_messages"`
+	SavedKeyLifetime   uint32 `protobuf:"varint,20,opt,name=saved_key_lifetime" json:"saved_key_lifetime"`
+	XXX_unrecognized   []byte `json:"-"`
 }
 
 func (m *RatchetState) Reset()         { *m = RatchetState{} }
@@ -497,6 +505,61 @@ func (m *RatchetState) Unmarshal(data []byte) error {
 			m.SavedKeys = append(m.SavedKeys, RatchetState_SavedKeys{})
 			m.SavedKeys[len(m.SavedKeys)-1].Unmarshal(data[index:postIndex])
 			index = postIndex
+		case 18:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SessionId", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.SessionId = &github_com_andres_erbsen_chatterbox_proto.Byte32{}
+			if err := m.SessionId.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 19:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxMissingMessages", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.MaxMissingMessages |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 20:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SavedKeyLifetime", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.SavedKeyLifetime |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			var sizeOfWire int
 			for {
@@ -793,6 +856,12 @@ func (m *RatchetState) Size() (n int) {
 			n += 2 + l + sovRatchet(uint64(l))
 		}
 	}
+	if m.SessionId != nil {
+		l = m.SessionId.Size()
+		n += 2 + l + sovRatchet(uint64(l))
+	}
+	n += 2 + sovRatchet(uint64(m.MaxMissingMessages))
+	n += 2 + sovRatchet(uint64(m.SavedKeyLifetime))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -876,8 +945,13 @@ func NewPopulatedRatchetState(r randyRatchet, easy bool) *RatchetState {
 			this.SavedKeys[i] = *v2
 		}
 	}
+	if r.Intn(10) != 0 {
+		this.SessionId = github_com_andres_erbsen_chatterbox_proto.NewPopulatedByte32(r)
+	}
+	this.MaxMissingMessages = r.Uint32()
+	this.SavedKeyLifetime = r.Uint32()
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedRatchet(r, 18)
+		this.XXX_unrecognized = randUnrecognizedRatchet(r, 21)
 	}
 	return this
 }
@@ -1148,6 +1222,28 @@ func (m *RatchetState) MarshalTo(data []byte) (n int, err error) {
 			i += n
 		}
 	}
+	if m.SessionId != nil {
+		data[i] = 0x92
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintRatchet(data, i, uint64(m.SessionId.Size()))
+		n13, err := m.SessionId.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n13
+	}
+	data[i] = 0x98
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintRatchet(data, i, uint64(m.MaxMissingMessages))
+	data[i] = 0xa0
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintRatchet(data, i, uint64(m.SavedKeyLifetime))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -1291,6 +1387,9 @@ type RatchetStateFace interface {
 	GetOurAuthPrivate() *github_com_andres_erbsen_chatterbox_proto.Byte32
 	GetTheirAuthPublic() *github_com_andres_erbsen_chatterbox_proto.Byte32
 	GetSavedKeys() []RatchetState_SavedKeys
+	GetSessionId() *github_com_andres_erbsen_chatterbox_proto.Byte32
+	GetMaxMissingMessages() uint32
+	GetSavedKeyLifetime() uint32
 }
 
 func (this *RatchetState) Proto() github_com_gogo_protobuf_proto.Message {
@@ -1369,6 +1468,18 @@ func (this *RatchetState) GetSavedKeys() []RatchetState_SavedKeys {
 	return this.SavedKeys
 }
 
+func (this *RatchetState) GetSessionId() *github_com_andres_erbsen_chatterbox_proto.Byte32 {
+	return this.SessionId
+}
+
+func (this *RatchetState) GetMaxMissingMessages() uint32 {
+	return this.MaxMissingMessages
+}
+
+func (this *RatchetState) GetSavedKeyLifetime() uint32 {
+	return this.SavedKeyLifetime
+}
+
 func NewRatchetStateFromFace(that RatchetStateFace) *RatchetState {
 	this := &RatchetState{}
 	this.RootKey = that.GetRootKey()
@@ -1388,6 +1499,9 @@ func NewRatchetStateFromFace(that RatchetStateFace) *RatchetState {
 	this.OurAuthPrivate = that.GetOurAuthPrivate()
 	this.TheirAuthPublic = that.GetTheirAuthPublic()
 	this.SavedKeys = that.GetSavedKeys()
+	this.SessionId = that.GetSessionId()
+	this.MaxMissingMessages = that.GetMaxMissingMessages()
+	this.SavedKeyLifetime = that.GetSavedKeyLifetime()
 	return this
 }
 
@@ -1585,6 +1699,19 @@ func (this *RatchetState) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if that1.SessionId == nil {
+		if this.SessionId != nil {
+			return false
+		}
+	} else if !this.SessionId.Equal(*that1.SessionId) {
+		return false
+	}
+	if this.MaxMissingMessages != that1.MaxMissingMessages {
+		return false
+	}
+	if this.SavedKeyLifetime != that1.SavedKeyLifetime {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -9,12 +9,16 @@
 // established between the same two parties, and it is the application's
 // responsibility to close one of them.
 //
+// Both parties derive the same session id from the first message of a session,
+// so the application can agree with the other party on which session to keep.
+//
 // The key exchange is assumed to be externally authenticated and no identity
 // key verification (or exchange) is performed.
 package ratchet
 
 import (
 	"crypto/hmac"
+	"crypto/mlkem"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
@@ -46,12 +50,23 @@ type Ratchet struct {
 
 	// ourAuthPrivate is updated together with ourRatchetPrivate, but not flushed
 	ourAuthPrivate, prevAuthPrivate, theirAuthPublic [32]byte
+	// sessionID is derived from the first message and never changes.
+	sessionID [32]byte
 
 	FillAuth  func(tag, data []byte, theirAuthPublic *[32]byte)
 	CheckAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error
 
 	Rand io.Reader
 	Now  func() time.Time
+
+	// MaxMissingMessages is the largest number of messages in a row that may
+	// be missing before a message that we can still decrypt. Zero means
+	// DefaultMaxMissingMessages.
+	MaxMissingMessages uint32
+	// SavedKeyLifetime is how long FlushSavedKeys keeps the keys of missing
+	// messages. Zero means DefaultSavedKeyLifetime. It is persisted with
+	// a precision of one second.
+	SavedKeyLifetime time.Duration
 }
 
 // savedKey contains a message key and timestamp for a message which has not
@@ -95,6 +110,8 @@ var (
 	sendHeaderKeyLabel     = []byte("next send header key")
 	messageKeyLabel        = []byte("message key")
 	chainKeyStepLabel      = []byte("chain key step")
+	sessionIDLabel         = []byte("session id")
+	hybridKEMLabel         = []byte("hybrid kem")
 )
 
 const (
@@ -112,15 +129,55 @@ const (
 	// Overhead is the total difference between the encrypted and decrypted length
 	Overhead      = authSize + sealedHeaderSize + secretbox.Overhead
 	OverheadFirst = authSize + handshakePreHeaderSize + sealedHeaderSize + secretbox.Overhead
+	// OverheadFirstHybrid also accounts for the ML-KEM ciphertext
+	OverheadFirstHybrid = OverheadFirst + mlkem.CiphertextSize768
 	// nonceInHeaderOffset is the offset of the message nonce in the
 	// header's plaintext.
 	nonceInHeaderOffset = 4 + 4 + 32 + 32
-	// maxMissingMessages is the maximum number of missing messages that
-	// we'll keep track of.
-	maxMissingMessages = 8
+	// DefaultMaxMissingMessages is the maximum number of missing messages
+	// that we'll keep track of unless configured otherwise.
+	DefaultMaxMissingMessages = 8
+	// DefaultSavedKeyLifetime is how long the keys of missing messages are
+	// kept unless configured otherwise.
+	DefaultSavedKeyLifetime = 30 * 24 * time.Hour
 )
 
+// ErrDuplicate is returned by Decrypt for a message that was decrypted before,
+// or whose key has expired. A replayed message fails this way.
+var ErrDuplicate = errors.New("ratchet: duplicate message or message delayed longer than tolerance")
+
+func (r *Ratchet) maxMissingMessages() uint32 {
+	if r.MaxMissingMessages == 0 {
+		return DefaultMaxMissingMessages
+	}
+	return r.MaxMissingMessages
+}
+
+func (r *Ratchet) savedKeyLifetime() time.Duration {
+	if r.SavedKeyLifetime == 0 {
+		return DefaultSavedKeyLifetime
+	}
+	return r.SavedKeyLifetime
+}
+
 func (r *Ratchet) EncryptFirst(out, msg []byte, theirRatchetPublic *[32]byte) []byte {
+	return r.encryptFirst(out, msg, theirRatchetPublic, nil, nil)
+}
+
+// EncryptFirstHybrid is like EncryptFirst, but also encapsulates a secret to
+// theirKEMPublic, an ML-KEM-768 encapsulation key, and mixes it into the
+// initial keys of the session. The message can then only be decrypted using
+// DecryptFirstHybrid.
+func (r *Ratchet) EncryptFirstHybrid(out, msg []byte, theirRatchetPublic *[32]byte, theirKEMPublic []byte) ([]byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(theirKEMPublic)
+	if err != nil {
+		return nil, err
+	}
+	kemShared, kemCiphertext := ek.Encapsulate()
+	return r.encryptFirst(out, msg, theirRatchetPublic, kemShared, kemCiphertext), nil
+}
+
+func (r *Ratchet) encryptFirst(out, msg []byte, theirRatchetPublic *[32]byte, kemShared, kemCiphertext []byte) []byte {
 	r.saved = make(map[[32]byte]map[uint32]savedKey)
 	r.ratchet = true
 	r.randBytes(r.ourRatchetPrivate[:])
@@ -129,28 +186,54 @@ func (r *Ratchet) EncryptFirst(out, msg []byte, theirRatchetPublic *[32]byte) []
 
 	var sharedKey [32]byte
 	curve25519.ScalarMult(&sharedKey, &r.ourRatchetPrivate, &r.theirRatchetPublic)
+	if kemShared != nil {
+		mixKEM(&sharedKey, kemShared)
+	}
 	h := hmac.New(sha256.New, sharedKey[:])
 	deriveKey(&r.rootKey, rootKeyLabel, h)
 	deriveKey(&r.recvHeaderKey, headerKeyLabel, h)
 	deriveKey(&r.nextSendHeaderKey, sendHeaderKeyLabel, h)
 	deriveKey(&r.nextRecvHeaderKey, nextRecvHeaderKeyLabel, h)
 	deriveKey(&r.recvChainKey, chainKeyLabel, h)
+	deriveKey(&r.sessionID, sessionIDLabel, h)
 
 	var ourRatchetPublic [32]byte
 	curve25519.ScalarBaseMult(&ourRatchetPublic, &r.ourRatchetPrivate)
 	tag_idx := len(out)
 	out = append(out, make([]byte, authSize)...)
 	out = append(out, ourRatchetPublic[:]...)
+	out = append(out, kemCiphertext...)
 	out = r.encrypt(out, msg)
 	r.FillAuth(out[tag_idx:][:authSize], out[tag_idx+authSize:], theirRatchetPublic)
 	return out
 }
 
 func (r *Ratchet) DecryptFirst(ciphertext []byte, ourRatchetPrivate *[32]byte) ([]byte, error) {
-	r.saved = make(map[[32]byte]map[uint32]savedKey)
 	if len(ciphertext) < OverheadFirst {
 		return nil, errors.New("first message too short")
 	}
+	return r.decryptFirst(ciphertext, ourRatchetPrivate, nil, 0)
+}
+
+// DecryptFirstHybrid decrypts a message created by EncryptFirstHybrid.
+// ourKEMPrivate is the 64-byte seed of the ML-KEM-768 decapsulation key.
+func (r *Ratchet) DecryptFirstHybrid(ciphertext []byte, ourRatchetPrivate *[32]byte, ourKEMPrivate []byte) ([]byte, error) {
+	if len(ciphertext) < OverheadFirstHybrid {
+		return nil, errors.New("first message too short")
+	}
+	dk, err := mlkem.NewDecapsulationKey768(ourKEMPrivate)
+	if err != nil {
+		return nil, err
+	}
+	kemShared, err := dk.Decapsulate(ciphertext[authSize+handshakePreHeaderSize:][:mlkem.CiphertextSize768])
+	if err != nil {
+		return nil, err
+	}
+	return r.decryptFirst(ciphertext, ourRatchetPrivate, kemShared, mlkem.CiphertextSize768)
+}
+
+func (r *Ratchet) decryptFirst(ciphertext []byte, ourRatchetPrivate *[32]byte, kemShared []byte, kemCiphertextSize int) ([]byte, error) {
+	r.saved = make(map[[32]byte]map[uint32]savedKey)
 	copy(r.ourRatchetPrivate[:], ourRatchetPrivate[:])
 	copy(r.ourAuthPrivate[:], ourRatchetPrivate[:])
 
@@ -158,14 +241,26 @@ func (r *Ratchet) DecryptFirst(ciphertext []byte, ourRatchetPrivate *[32]byte) (
 	var sharedKey [32]byte
 	copy(r.theirRatchetPublic[:], ciphertext[authSize:][:handshakePreHeaderSize])
 	curve25519.ScalarMult(&sharedKey, &r.ourRatchetPrivate, &r.theirRatchetPublic)
+	if kemShared != nil {
+		mixKEM(&sharedKey, kemShared)
+	}
 	h := hmac.New(sha256.New, sharedKey[:])
 	deriveKey(&r.rootKey, rootKeyLabel, h)
 	deriveKey(&r.sendHeaderKey, headerKeyLabel, h)
 	deriveKey(&r.nextRecvHeaderKey, sendHeaderKeyLabel, h)
 	deriveKey(&r.nextSendHeaderKey, nextRecvHeaderKeyLabel, h)
 	deriveKey(&r.sendChainKey, chainKeyLabel, h)
+	deriveKey(&r.sessionID, sessionIDLabel, h)
 
-	return r.decryptAndCheckAuth(tag, ciphertext[authSize:], ciphertext[authSize+handshakePreHeaderSize:])
+	return r.decryptAndCheckAuth(tag, ciphertext[authSize:], ciphertext[authSize+handshakePreHeaderSize+kemCiphertextSize:])
+}
+
+// mixKEM replaces sharedKey with HMAC(sharedKey, label || kemShared).
+func mixKEM(sharedKey *[32]byte, kemShared []byte) {
+	h := hmac.New(sha256.New, sharedKey[:])
+	h.Write(hybridKEMLabel)
+	h.Write(kemShared)
+	h.Sum(sharedKey[:0])
 }
 
 // encrypt acts like append() but appends an encrypted version of msg to out.
@@ -247,6 +342,11 @@ func (r *Ratchet) trySavedKeysAndCheckAuth(authTag, authBody, ciphertext []byte)
 		msgNum := binary.LittleEndian.Uint32(header[:4])
 		msgKey, ok := messageKeys[msgNum]
 		if !ok {
+			if headerKey != r.recvHeaderKey {
+				// No more keys are derived in an old chain, so
+				// the message was received before.
+				return nil, ErrDuplicate
+			}
 			// This is a fairly common case: the message key might
 			// not have been saved because it's the next message
 			// key.
@@ -283,12 +383,12 @@ func (r *Ratchet) saveKeys(headerKey, recvChainKey *[32]byte, messageNum, receiv
 		// This is a message from the past, but we didn't have a saved
 		// key for it, which means that it's a duplicate message or we
 		// expired the save key.
-		err = errors.New("ratchet: duplicate message or message delayed longer than tolerance")
+		err = ErrDuplicate
 		return
 	}
 
 	missingMessages := messageNum - receivedCount
-	if missingMessages > maxMissingMessages {
+	if missingMessages > r.maxMissingMessages() {
 		err = errors.New("ratchet: message exceeds reordering limit")
 		return
 	}
@@ -468,10 +568,52 @@ func (r *Ratchet) Decrypt(ciphertext []byte) ([]byte, error) {
 	return r.decryptAndCheckAuth(ciphertext[:authSize], ciphertext[authSize:], ciphertext[authSize:])
 }
 
-func (r *Ratchet) FlushSavedKeys(now time.Time, lifetime time.Duration) {
+// RecvHeaderKeys returns the header keys that incoming messages may be
+// encrypted with: the current and next receiving header keys and the header
+// keys of messages that are still missing.
+func (r *Ratchet) RecvHeaderKeys() []*[32]byte {
+	ret := make([]*[32]byte, 0, 2+len(r.saved))
+	if !isZeroKey(&r.recvHeaderKey) {
+		ret = append(ret, newKey(&r.recvHeaderKey))
+	}
+	if !isZeroKey(&r.nextRecvHeaderKey) {
+		ret = append(ret, newKey(&r.nextRecvHeaderKey))
+	}
+	for headerKey := range r.saved {
+		ret = append(ret, newKey(&headerKey))
+	}
+	return ret
+}
+
+func newKey(key *[32]byte) *[32]byte {
+	ret := new([32]byte)
+	*ret = *key
+	return ret
+}
+
+// OpensHeader returns true if the header of ciphertext, as output by Encrypt,
+// can be decrypted using headerKey. This is much cheaper than Decrypt and can
+// be used to find the ratchet that should be used to decrypt a message.
+func OpensHeader(ciphertext []byte, headerKey *[32]byte) bool {
+	if len(ciphertext) < authSize+sealedHeaderSize {
+		return false
+	}
+	sealedHeader := ciphertext[authSize : authSize+sealedHeaderSize]
+	var nonce [24]byte
+	copy(nonce[:], sealedHeader)
+	var header [headerSize]byte
+	_, ok := secretbox.Open(header[:0], sealedHeader[len(nonce):], &nonce, headerKey)
+	return ok
+}
+
+// FlushSavedKeys deletes the keys of missing messages that were saved more
+// than SavedKeyLifetime before now, and returns true if it deleted any.
+func (r *Ratchet) FlushSavedKeys(now time.Time) (flushed bool) {
+	lifetime := r.savedKeyLifetime()
 	for headerKey, messageKeys := range r.saved {
 		for messageNum, savedKey := range messageKeys {
 			if now.Sub(savedKey.timestamp) > lifetime {
+				flushed = true
 				for i := range savedKey.key {
 					savedKey.key[i] = 0
 				}
@@ -485,4 +627,5 @@ func (r *Ratchet) FlushSavedKeys(now time.Time, lifetime time.Duration) {
 			delete(r.saved, headerKey) // safe: http://golang.org/doc/effective_go.html#for
 		}
 	}
+	return
 }
@@ -5,6 +5,7 @@ package ratchet
 
 import (
 	"bytes"
+	"crypto/mlkem"
 	"crypto/rand"
 	"testing"
 	"time"
@@ -73,7 +74,7 @@ const (
 )
 
 func reinitRatchet(t *testing.T, r *Ratchet) *Ratchet {
-	r.FlushSavedKeys(nowFunc(), 1*time.Hour)
+	r.FlushSavedKeys(nowFunc())
 	data, err := r.Marshal()
 	if err != nil {
 		t.Fatalf("Failed to marshal: %s", err)
@@ -227,3 +228,183 @@ func TestOverhead(t *testing.T) {
 		t.Errorf("expected subsequent message overhead %d, got %d", Overhead, len(encrypted))
 	}
 }
+
+func TestHybridFirst(t *testing.T) {
+	var preKeyA, preKeyAPrivate [32]byte
+	rand.Read(preKeyAPrivate[:])
+	curve25519.ScalarBaseMult(&preKeyA, &preKeyAPrivate)
+	kemKeyA, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Ratchet{Now: nowFunc, FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	b := &Ratchet{Now: nowFunc, FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	msg := []byte("test message")
+	encryptedFirst, err := b.EncryptFirstHybrid(nil, msg, &preKeyA, kemKeyA.EncapsulationKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encryptedFirst) != OverheadFirstHybrid+len(msg) {
+		t.Errorf("expected hybrid first message overhead %d, got %d", OverheadFirstHybrid, len(encryptedFirst)-len(msg))
+	}
+	if _, err := new(Ratchet).DecryptFirst(encryptedFirst, &preKeyAPrivate); err == nil {
+		t.Error("hybrid first message decrypted without the KEM key")
+	}
+	result, err := a.DecryptFirstHybrid(encryptedFirst, &preKeyAPrivate, kemKeyA.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, result) {
+		t.Fatalf("result doesn't match: %x vs %x", msg, result)
+	}
+	if a.sessionID != b.sessionID {
+		t.Error("session ids differ")
+	}
+
+	encrypted := a.Encrypt(nil, msg)
+	if _, err := b.Decrypt(encrypted); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func opensWithAny(ciphertext []byte, keys []*[32]byte) bool {
+	for _, key := range keys {
+		if OpensHeader(ciphertext, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRecvHeaderKeys(t *testing.T) {
+	a, b := pairedRatchet()
+	c, _ := pairedRatchet()
+
+	dropped := a.Encrypt(nil, []byte("dropped"))
+	for i := 0; i < 2; i++ {
+		msg := a.Encrypt(nil, []byte("test message"))
+		if !opensWithAny(msg, b.RecvHeaderKeys()) {
+			t.Fatalf("message %d not matched by the header keys of the recipient", i)
+		}
+		if opensWithAny(msg, c.RecvHeaderKeys()) {
+			t.Fatalf("message %d matched by the header keys of an unrelated ratchet", i)
+		}
+		if _, err := b.Decrypt(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Decrypt(b.Encrypt(nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !opensWithAny(dropped, b.RecvHeaderKeys()) {
+		t.Fatal("delayed message not matched by a saved header key")
+	}
+	if OpensHeader(dropped[:authSize], b.RecvHeaderKeys()[0]) {
+		t.Fatal("truncated message matched")
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	a, b := pairedRatchet()
+	c, _ := pairedRatchet()
+	if *a.GetSessionId() != *b.GetSessionId() {
+		t.Error("the two ends of a session have different session ids")
+	}
+	if *a.GetSessionId() == *c.GetSessionId() {
+		t.Error("two sessions have the same session id")
+	}
+	b2 := reinitRatchet(t, b)
+	if *b2.GetSessionId() != *b.GetSessionId() {
+		t.Error("session id was not persisted")
+	}
+}
+
+func TestLargeGap(t *testing.T) {
+	a, b := pairedRatchet()
+	for i := 0; i < DefaultMaxMissingMessages+1; i++ {
+		a.Encrypt(nil, nil)
+	}
+	if _, err := b.Decrypt(a.Encrypt(nil, nil)); err == nil {
+		t.Fatal("decrypted a message after a gap larger than the default limit")
+	}
+
+	a, b = pairedRatchet()
+	b.MaxMissingMessages = 100
+	b = reinitRatchet(t, b)
+	var skipped [][]byte
+	for i := 0; i < 100; i++ {
+		skipped = append(skipped, a.Encrypt(nil, []byte{byte(i)}))
+	}
+	if _, err := b.Decrypt(a.Encrypt(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	// the skipped messages arrive in reverse order
+	for i := len(skipped) - 1; i >= 0; i-- {
+		b = reinitRatchet(t, b)
+		msg, err := b.Decrypt(skipped[i])
+		if err != nil {
+			t.Fatalf("skipped message %d: %s", i, err)
+		}
+		if !bytes.Equal(msg, []byte{byte(i)}) {
+			t.Fatalf("skipped message %d: got %x", i, msg)
+		}
+	}
+}
+
+func TestSavedKeyExpiry(t *testing.T) {
+	a, b := pairedRatchet()
+	now := time.Unix(1424070595, 0)
+	b.Now = func() time.Time { return now }
+	b.SavedKeyLifetime = time.Hour
+	b = reinitRatchet(t, b)
+
+	delayed := a.Encrypt(nil, []byte("delayed"))
+	expired := a.Encrypt(nil, []byte("expired"))
+	if _, err := b.Decrypt(a.Encrypt(nil, []byte("test message"))); err != nil {
+		t.Fatal(err)
+	}
+	if b.FlushSavedKeys(now.Add(time.Hour)) {
+		t.Fatal("flushed keys before their lifetime")
+	}
+	if _, err := b.Decrypt(delayed); err != nil {
+		t.Fatal(err)
+	}
+	if !b.FlushSavedKeys(now.Add(time.Hour + time.Second)) {
+		t.Fatal("did not flush expired keys")
+	}
+	if _, err := b.Decrypt(expired); err == nil {
+		t.Fatal("decrypted a message whose key had expired")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	a, b := pairedRatchet()
+	first := a.Encrypt(nil, []byte("first"))
+	a.Encrypt(nil, []byte("missing"))
+	third := a.Encrypt(nil, []byte("third"))
+	for _, msg := range [][]byte{third, first} {
+		if _, err := b.Decrypt(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range [][]byte{first, third} {
+		if _, err := b.Decrypt(msg); err != ErrDuplicate {
+			t.Fatalf("replayed message: got %v, want ErrDuplicate", err)
+		}
+	}
+
+	// the chain of the replayed messages is still known after a ratchet
+	// step because a message in it is missing
+	if _, err := a.Decrypt(b.Encrypt(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Decrypt(a.Encrypt(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range [][]byte{first, third} {
+		if _, err := b.Decrypt(msg); err != ErrDuplicate {
+			t.Fatalf("replayed message: got %v, want ErrDuplicate", err)
+		}
+	}
+}
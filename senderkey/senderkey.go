@@ -0,0 +1,346 @@
+// Package senderkey implements sender keys for group conversations. Each
+// member of a group encrypts their messages once, using a symmetric chain key
+// that has previously been sent to every other member over a pairwise ratchet.
+// The ciphertext can then be uploaded to all members as is.
+//
+// Every member knows the chain key of every other member, so ciphertexts are
+// additionally signed with a signing key that only the sender knows. The
+// public half of the signing key is distributed with the chain key.
+//
+// Ciphertexts do not name the sender key they were encrypted with, so a server
+// that sees them can not tell which of them come from the same sender. The
+// iteration of the chain is encrypted with a header key derived from the key
+// ID, which only the members know, and recipients find the key by trying the
+// header keys of the keys they have.
+//
+// A sender key provides forward secrecy with respect to the chain key: the
+// chain is stepped after each message and old keys are forgotten. It does not
+// provide the future secrecy of the axolotl ratchet; a new sender key has to be
+// generated (and distributed) to recover from a compromise.
+package senderkey
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/agl/ed25519"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	iterationSize = 4
+	nonceSize     = 24
+	// a ciphertext starts with the nonce of the header and the sealed
+	// header, which contains the iteration and the nonce of the message
+	headerSize       = iterationSize + nonceSize
+	sealedHeaderSize = nonceSize + headerSize + secretbox.Overhead
+	// Overhead is the difference between the length of a ciphertext and the
+	// length of the message it contains.
+	Overhead = sealedHeaderSize + secretbox.Overhead + ed25519.SignatureSize
+	// maxSkip is the number of messages of a single sender that can be
+	// missing before we refuse to step the chain any further.
+	maxSkip = 1000
+	// maxSavedKeys is the maximum number of keys of missing messages that we
+	// keep around in case the messages arrive out of order.
+	maxSavedKeys = 64
+)
+
+var (
+	messageKeyLabel   = []byte("message key")
+	chainKeyStepLabel = []byte("chain key step")
+	headerKeyLabel    = []byte("header key")
+)
+
+var (
+	ErrWrongKey     = errors.New("senderkey: message is not encrypted with this key")
+	ErrNotOurs      = errors.New("senderkey: cannot encrypt with a key received from somebody else")
+	errShort        = errors.New("senderkey: ciphertext too short")
+	errSignature    = errors.New("senderkey: invalid signature")
+	errDecrypt      = errors.New("senderkey: decryption failed")
+	errTooFarAhead  = errors.New("senderkey: message too far in the future")
+	errDuplicate    = errors.New("senderkey: duplicate or expired message")
+	errBadSecretKey = errors.New("senderkey: stored signing secret key has wrong length")
+)
+
+// SenderKey is the chain of message keys used by one member of one group
+// conversation.
+type SenderKey struct {
+	id            [32]byte
+	chainKey      [32]byte
+	iteration     uint32
+	signingPublic [32]byte
+	// signingSecret is nil unless this key belongs to us.
+	signingSecret *[64]byte
+	// saved maps the iterations of messages that have not been received yet
+	// to their keys.
+	saved map[uint32][32]byte
+
+	// Sender is the dename of the member who encrypts with this key.
+	Sender string
+	// ConversationID identifies the group conversation.
+	ConversationID [32]byte
+	// DistributedTo lists the members who have been sent this key. It is only
+	// maintained for our own keys.
+	DistributedTo []string
+
+	Rand io.Reader
+}
+
+func (s *SenderKey) randBytes(buf []byte) {
+	rnd := rand.Reader
+	if s.Rand != nil {
+		rnd = s.Rand
+	}
+	if _, err := io.ReadFull(rnd, buf); err != nil {
+		panic(err)
+	}
+}
+
+// New generates a fresh sender key for sender in conversation conversationID.
+func New(rnd io.Reader, sender string, conversationID *[32]byte) (*SenderKey, error) {
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	s := &SenderKey{
+		Sender:         sender,
+		ConversationID: *conversationID,
+		saved:          make(map[uint32][32]byte),
+		Rand:           rnd,
+	}
+	if _, err := io.ReadFull(rnd, s.id[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rnd, s.chainKey[:]); err != nil {
+		return nil, err
+	}
+	pk, sk, err := ed25519.GenerateKey(rnd)
+	if err != nil {
+		return nil, err
+	}
+	s.signingPublic = *pk
+	s.signingSecret = sk
+	return s, nil
+}
+
+// FromProto creates the receiving side of a sender key distributed by sender.
+func FromProto(p *proto.SenderKey, sender string, conversationID *[32]byte) *SenderKey {
+	return &SenderKey{
+		id:             ([32]byte)(p.Id),
+		chainKey:       ([32]byte)(p.ChainKey),
+		iteration:      p.Iteration,
+		signingPublic:  ([32]byte)(p.SigningKey),
+		saved:          make(map[uint32][32]byte),
+		Sender:         sender,
+		ConversationID: *conversationID,
+	}
+}
+
+// Proto returns the current state of the chain, suitable for sending to a new
+// recipient. The recipient will be able to decrypt messages encrypted after
+// this call, but not before.
+func (s *SenderKey) Proto() *proto.SenderKey {
+	return &proto.SenderKey{
+		Id:         (proto.Byte32)(s.id),
+		ChainKey:   (proto.Byte32)(s.chainKey),
+		Iteration:  s.iteration,
+		SigningKey: (proto.Byte32)(s.signingPublic),
+	}
+}
+
+// ID returns the identifier of s. It is as secret as the chain key.
+func (s *SenderKey) ID() *[32]byte { return &s.id }
+
+// Ours returns true if s can be used for encryption.
+func (s *SenderKey) Ours() bool { return s.signingSecret != nil }
+
+// HeaderKey returns the key that the headers of messages encrypted with the
+// sender key with the given ID are encrypted with.
+func HeaderKey(id *[32]byte) *[32]byte {
+	headerKey := new([32]byte)
+	deriveKey(headerKey, id, headerKeyLabel)
+	return headerKey
+}
+
+// OpensHeader returns true if the header of ciphertext, as output by Encrypt,
+// can be decrypted using headerKey. This is much cheaper than Decrypt and can
+// be used to find the sender key that should be used to decrypt a message.
+func OpensHeader(ciphertext []byte, headerKey *[32]byte) bool {
+	_, ok := openHeader(ciphertext, headerKey)
+	return ok
+}
+
+func openHeader(ciphertext []byte, headerKey *[32]byte) ([]byte, bool) {
+	if len(ciphertext) < Overhead {
+		return nil, false
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], ciphertext)
+	var header [headerSize]byte
+	return secretbox.Open(header[:0], ciphertext[nonceSize:sealedHeaderSize], &nonce, headerKey)
+}
+
+// deriveKey sets out = HMAC-SHA256(key, label).
+func deriveKey(out, key *[32]byte, label []byte) {
+	h := hmac.New(sha256.New, key[:])
+	h.Write(label)
+	h.Sum(out[:0])
+}
+
+// step returns the key for the current iteration and advances the chain.
+func (s *SenderKey) step() (messageKey [32]byte) {
+	deriveKey(&messageKey, &s.chainKey, messageKeyLabel)
+	deriveKey(&s.chainKey, &s.chainKey, chainKeyStepLabel)
+	s.iteration++
+	return
+}
+
+// Encrypt appends the encryption of msg to out and returns the result.
+func (s *SenderKey) Encrypt(out, msg []byte) ([]byte, error) {
+	if s.signingSecret == nil {
+		return nil, ErrNotOurs
+	}
+	var iteration [iterationSize]byte
+	binary.LittleEndian.PutUint32(iteration[:], s.iteration)
+	messageKey := s.step()
+
+	var headerNonce, nonce [nonceSize]byte
+	s.randBytes(headerNonce[:])
+	s.randBytes(nonce[:])
+
+	start := len(out)
+	out = append(out, headerNonce[:]...)
+	out = secretbox.Seal(out, append(iteration[:], nonce[:]...), &headerNonce, HeaderKey(&s.id))
+	out = secretbox.Seal(out, msg, &nonce, &messageKey)
+	sig := ed25519.Sign(s.signingSecret, out[start:])
+	return append(out, sig[:]...), nil
+}
+
+// Decrypt authenticates and decrypts a ciphertext produced by Encrypt. The
+// state of s is only changed if decryption is successful.
+func (s *SenderKey) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < Overhead {
+		return nil, errShort
+	}
+	header, ok := openHeader(ciphertext, HeaderKey(&s.id))
+	if !ok {
+		return nil, ErrWrongKey
+	}
+	signed := ciphertext[:len(ciphertext)-ed25519.SignatureSize]
+	var sig [ed25519.SignatureSize]byte
+	copy(sig[:], ciphertext[len(signed):])
+	if !ed25519.Verify(&s.signingPublic, signed, &sig) {
+		return nil, errSignature
+	}
+	iteration := binary.LittleEndian.Uint32(header)
+	var nonce [nonceSize]byte
+	copy(nonce[:], header[iterationSize:])
+	box := signed[sealedHeaderSize:]
+
+	if iteration < s.iteration {
+		messageKey, ok := s.saved[iteration]
+		if !ok {
+			return nil, errDuplicate
+		}
+		msg, ok := secretbox.Open(nil, box, &nonce, &messageKey)
+		if !ok {
+			return nil, errDecrypt
+		}
+		delete(s.saved, iteration)
+		return msg, nil
+	}
+	if iteration-s.iteration > maxSkip {
+		return nil, errTooFarAhead
+	}
+
+	// derive the keys on a copy so that s stays unchanged if the message is bad
+	chain := *s
+	chain.saved = make(map[uint32][32]byte, len(s.saved))
+	for i, k := range s.saved {
+		chain.saved[i] = k
+	}
+	for chain.iteration < iteration {
+		i := chain.iteration
+		chain.saved[i] = chain.step()
+	}
+	messageKey := chain.step()
+	msg, ok := secretbox.Open(nil, box, &nonce, &messageKey)
+	if !ok {
+		return nil, errDecrypt
+	}
+	chain.pruneSaved()
+	*s = chain
+	return msg, nil
+}
+
+// pruneSaved forgets the keys of the oldest missing messages if there are
+// more than maxSavedKeys of them.
+func (s *SenderKey) pruneSaved() {
+	if len(s.saved) <= maxSavedKeys {
+		return
+	}
+	iterations := s.savedIterations()
+	for _, i := range iterations[:len(iterations)-maxSavedKeys] {
+		delete(s.saved, i)
+	}
+}
+
+func (s *SenderKey) savedIterations() []uint32 {
+	ret := make([]uint32, 0, len(s.saved))
+	for i := range s.saved {
+		ret = append(ret, i)
+	}
+	sort.Sort(uint32s(ret))
+	return ret
+}
+
+type uint32s []uint32
+
+func (a uint32s) Len() int           { return len(a) }
+func (a uint32s) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint32s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func (s *SenderKey) Marshal() ([]byte, error) {
+	state := &proto.SenderKeyState{
+		Key:            *s.Proto(),
+		ConversationId: (proto.Byte32)(s.ConversationID),
+		Sender:         s.Sender,
+		DistributedTo:  s.DistributedTo,
+	}
+	if s.signingSecret != nil {
+		state.SigningSecretKey = s.signingSecret[:]
+	}
+	for _, i := range s.savedIterations() {
+		state.SavedIterations = append(state.SavedIterations, i)
+		state.SavedKeys = append(state.SavedKeys, (proto.Byte32)(s.saved[i]))
+	}
+	return state.Marshal()
+}
+
+func (s *SenderKey) Unmarshal(data []byte) error {
+	state := new(proto.SenderKeyState)
+	if err := state.Unmarshal(data); err != nil {
+		return err
+	}
+	if len(state.SavedIterations) != len(state.SavedKeys) {
+		return errors.New("senderkey: len(SavedIterations) != len(SavedKeys)")
+	}
+	*s = *FromProto(&state.Key, state.Sender, (*[32]byte)(&state.ConversationId))
+	s.DistributedTo = state.DistributedTo
+	if len(state.SigningSecretKey) != 0 {
+		if len(state.SigningSecretKey) != 64 {
+			return errBadSecretKey
+		}
+		s.signingSecret = new([64]byte)
+		copy(s.signingSecret[:], state.SigningSecretKey)
+	}
+	for j, i := range state.SavedIterations {
+		s.saved[i] = ([32]byte)(state.SavedKeys[j])
+	}
+	return nil
+}
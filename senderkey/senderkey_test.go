@@ -0,0 +1,188 @@
+package senderkey
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+var conversationID = [32]byte{1, 2, 3}
+
+func pairedSenderKey() (ours, theirs *SenderKey) {
+	ours, err := New(rand.Reader, "alice", &conversationID)
+	if err != nil {
+		panic(err)
+	}
+	return ours, FromProto(ours.Proto(), "alice", &conversationID)
+}
+
+func mustEncrypt(t *testing.T, s *SenderKey, msg []byte) []byte {
+	c, err := s.Encrypt(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestExchange(t *testing.T) {
+	a, b := pairedSenderKey()
+	for _, msg := range [][]byte{[]byte("first"), []byte("second"), nil} {
+		c := mustEncrypt(t, a, msg)
+		if len(c) != len(msg)+Overhead {
+			t.Errorf("len(c) = %d, want %d", len(c), len(msg)+Overhead)
+		}
+		if !OpensHeader(c, HeaderKey(a.ID())) {
+			t.Error("the header does not open with the header key")
+		}
+		result, err := b.Decrypt(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, result) {
+			t.Fatalf("result doesn't match: %x vs %x", msg, result)
+		}
+	}
+}
+
+func TestReorderAndReplay(t *testing.T) {
+	a, b := pairedSenderKey()
+	c0 := mustEncrypt(t, a, []byte("0"))
+	c1 := mustEncrypt(t, a, []byte("1"))
+	c2 := mustEncrypt(t, a, []byte("2"))
+	for _, c := range [][]byte{c2, c0, c1} {
+		if _, err := b.Decrypt(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range [][]byte{c2, c0, c1} {
+		if _, err := b.Decrypt(c); err == nil {
+			t.Fatal("replayed message was accepted")
+		}
+	}
+}
+
+func TestLateDistribution(t *testing.T) {
+	a, _ := pairedSenderKey()
+	early := mustEncrypt(t, a, []byte("before"))
+	b := FromProto(a.Proto(), "alice", &conversationID)
+	if _, err := b.Decrypt(early); err == nil {
+		t.Fatal("decrypted a message sent before the key was distributed")
+	}
+	if _, err := b.Decrypt(mustEncrypt(t, a, []byte("after"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForgery(t *testing.T) {
+	a, b := pairedSenderKey()
+	// a member who knows the chain key but not the signing key
+	mallory, err := New(rand.Reader, "mallory", &conversationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory.id, mallory.chainKey, mallory.iteration = a.id, a.chainKey, a.iteration
+	if _, err := b.Decrypt(mustEncrypt(t, mallory, []byte("forged"))); err != errSignature {
+		t.Fatalf("forged message: got error %v, want %v", err, errSignature)
+	}
+
+	c := mustEncrypt(t, a, []byte("tampered"))
+	c[sealedHeaderSize] ^= 1
+	if _, err := b.Decrypt(c); err == nil {
+		t.Fatal("tampered message was accepted")
+	}
+	// the failures must not have advanced the chain
+	if _, err := b.Decrypt(mustEncrypt(t, a, []byte("genuine"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoKeyIdentifier(t *testing.T) {
+	a, _ := pairedSenderKey()
+	c0 := mustEncrypt(t, a, []byte("same"))
+	c1 := mustEncrypt(t, a, []byte("same"))
+	for _, c := range [][]byte{c0, c1} {
+		if bytes.Contains(c, a.id[:]) {
+			t.Error("the ciphertext contains the key ID")
+		}
+	}
+	if bytes.Equal(c0[:sealedHeaderSize], c1[:sealedHeaderSize]) {
+		t.Error("two messages have the same header")
+	}
+	other, _ := pairedSenderKey()
+	if OpensHeader(c0, HeaderKey(other.ID())) {
+		t.Error("the header opens with the header key of another sender key")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	a, _ := pairedSenderKey()
+	_, b := pairedSenderKey()
+	if _, err := b.Decrypt(mustEncrypt(t, a, []byte("hi"))); err != ErrWrongKey {
+		t.Fatalf("got error %v, want %v", err, ErrWrongKey)
+	}
+	if _, err := b.Encrypt(nil, []byte("hi")); err != ErrNotOurs {
+		t.Fatalf("got error %v, want %v", err, ErrNotOurs)
+	}
+}
+
+func TestTooFarAhead(t *testing.T) {
+	a, b := pairedSenderKey()
+	a.iteration += maxSkip + 1
+	if _, err := b.Decrypt(mustEncrypt(t, a, []byte("far"))); err != errTooFarAhead {
+		t.Fatalf("got error %v, want %v", err, errTooFarAhead)
+	}
+}
+
+func TestSavedKeysLimit(t *testing.T) {
+	a, b := pairedSenderKey()
+	var skipped [][]byte
+	for i := 0; i < maxSavedKeys+10; i++ {
+		skipped = append(skipped, mustEncrypt(t, a, []byte("skipped")))
+	}
+	if _, err := b.Decrypt(mustEncrypt(t, a, []byte("last"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.saved) != maxSavedKeys {
+		t.Fatalf("len(b.saved) = %d, want %d", len(b.saved), maxSavedKeys)
+	}
+	if _, err := b.Decrypt(skipped[0]); err != errDuplicate {
+		t.Fatalf("oldest skipped message: got error %v, want %v", err, errDuplicate)
+	}
+	if _, err := b.Decrypt(skipped[len(skipped)-1]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	a, b := pairedSenderKey()
+	a.DistributedTo = []string{"bob", "carol"}
+	c0 := mustEncrypt(t, a, []byte("0"))
+	if _, err := b.Decrypt(mustEncrypt(t, a, []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	reload := func(s *SenderKey) *SenderKey {
+		bs, err := s.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := new(SenderKey)
+		if err := ret.Unmarshal(bs); err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	a, b = reload(a), reload(b)
+	if !a.Ours() || b.Ours() {
+		t.Fatalf("a.Ours() = %v, b.Ours() = %v", a.Ours(), b.Ours())
+	}
+	if len(a.DistributedTo) != 2 || a.Sender != "alice" || b.ConversationID != conversationID {
+		t.Fatalf("metadata not preserved: %#v, %#v", a, b)
+	}
+	if _, err := b.Decrypt(c0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Decrypt(mustEncrypt(t, a, []byte("2"))); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/transport"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	protobuf "golang.org/x/oprotobuf/proto"
+)
+
+// Users can ask their own server to deliver an envelope to a user of another
+// server. The envelope is stored in the database until the other server
+// accepts it, so it is delivered even if that server is down when the message
+// is sent. The server of the sender learns who the envelope is for, but not
+// its contents.
+//
+// Only public addresses are dialed, so users can not make the server connect
+// to itself or to hosts on its internal network. Each user can have at most
+// maxRelayQueuePerUser envelopes queued. Envelopes that are due are sent to
+// each destination server separately, and after a failed attempt the other
+// envelopes for the same server are rescheduled without trying, so a server
+// that is down only delays the envelopes for it.
+//
+// Queued envelopes are stored under 'r' || due || id, where due is the time
+// of the next attempt (unix nanoseconds, big-endian) and id is random. The
+// value is queued || attempts || uid || relay: the time the envelope was
+// queued (unix nanoseconds, big-endian uint64), the number of failed attempts
+// (big-endian uint32), the user who queued it and the marshalled
+// ClientToServer_RelayEnvelope. The envelopes queued by each user are also
+// listed under 'q' || uid || id.
+const (
+	relayKeyLength    = 1 + 8 + 16
+	relayHeaderLength = 8 + 4 + 32
+
+	maxRelayRetryInterval = time.Hour
+	// relayLifetime is how long an envelope is retried before it is dropped.
+	relayLifetime = 7 * 24 * time.Hour
+	// relayTimeout bounds each attempt to deliver an envelope.
+	relayTimeout = 30 * time.Second
+	// maxRelayQueuePerUser is how many envelopes each user can have queued.
+	maxRelayQueuePerUser = 256
+	// maxRelayBatch is how many due envelopes are read from the queue at once.
+	maxRelayBatch = 1024
+	// maxRelayConnections is how many servers envelopes are sent to at once.
+	maxRelayConnections = 16
+)
+
+// relayRetryInterval is how long the first retry of a failed relay attempt is
+// delayed. The delay doubles with each failure up to maxRelayRetryInterval.
+var relayRetryInterval = time.Minute
+
+// relayDestinationAllowed reports whether envelopes may be relayed to ip.
+var relayDestinationAllowed = isPublicIP
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// checkRelayAddress rejects a destination address that is an IP address we
+// do not relay to. Host names are checked when they are resolved.
+func checkRelayAddress(host string, port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid relay destination port %d", port)
+	}
+	if ip := net.ParseIP(host); ip != nil && !relayDestinationAllowed(ip) {
+		return fmt.Errorf("relaying to %s is not allowed", host)
+	}
+	return nil
+}
+
+func relayKey(due time.Time, id []byte) []byte {
+	key := make([]byte, 1+8, relayKeyLength)
+	key[0] = 'r'
+	binary.BigEndian.PutUint64(key[1:], uint64(due.UnixNano()))
+	return append(key, id...)
+}
+
+func relayOwnerKey(uid *[32]byte, id []byte) []byte {
+	return append(append([]byte{'q'}, uid[:]...), id...)
+}
+
+// queueRelay stores an envelope that uid asked us to deliver to another
+// server and wakes up relayLoop.
+func (server *Server) queueRelay(uid *[32]byte, relay *proto.ClientToServer_RelayEnvelope) error {
+	if _, err := server.database.Get(append([]byte{'u'}, uid[:]...), nil); err != nil {
+		return fmt.Errorf("relay request from a user without an account: %v", err)
+	}
+	if len(relay.Envelope) > proto.MAX_MESSAGE_SIZE {
+		return errors.New("relayed envelope too large")
+	}
+	if *(*[32]byte)(relay.ServerTransportPK) != *server.pk {
+		if err := checkRelayAddress(*relay.ServerAddress, int(*relay.ServerPort)); err != nil {
+			return err
+		}
+		for _, addr := range relay.ServerReplicas {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return err
+			}
+			portNum, err := strconv.Atoi(port)
+			if err != nil {
+				return err
+			}
+			if err := checkRelayAddress(host, portNum); err != nil {
+				return err
+			}
+		}
+	}
+	iter := server.database.NewIterator(util.BytesPrefix(append([]byte{'q'}, uid[:]...)), nil)
+	queued := 0
+	for queued < maxRelayQueuePerUser && iter.Next() {
+		queued++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if queued >= maxRelayQueuePerUser {
+		return errors.New("too many relayed envelopes queued")
+	}
+	relayBytes, err := protobuf.Marshal(relay)
+	if err != nil {
+		return err
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	now := time.Now()
+	value := make([]byte, relayHeaderLength, relayHeaderLength+len(relayBytes))
+	binary.BigEndian.PutUint64(value[:8], uint64(now.UnixNano()))
+	copy(value[12:relayHeaderLength], uid[:])
+	value = append(value, relayBytes...)
+	batch := new(leveldb.Batch)
+	batch.Put(relayKey(now, id[:]), value)
+	batch.Put(relayOwnerKey(uid, id[:]), nil)
+	if err := server.write(batch); err != nil {
+		return err
+	}
+	select {
+	case server.relayWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// relayLoop delivers queued envelopes when they are due until the server is
+// shut down.
+func (server *Server) relayLoop() {
+	defer server.wg.Done()
+	for {
+		next, err := server.relayDue()
+		if err != nil {
+			fmt.Printf("Server error: %v\n", err)
+			next = time.Now().Add(relayRetryInterval)
+		}
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(time.Now()))
+			due = timer.C
+		}
+		select {
+		case <-server.shutdown:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-server.relayWake:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// queuedRelay is an envelope in the relay queue.
+type queuedRelay struct {
+	key, value []byte
+	relay      *proto.ClientToServer_RelayEnvelope
+}
+
+func (q *queuedRelay) owner() *[32]byte {
+	return (*[32]byte)(q.value[12:relayHeaderLength])
+}
+
+// relayDue starts delivering the envelopes that are due, one goroutine for
+// each server they are for, and returns when the next one will be due, or the
+// zero time if there is none. A goroutine wakes relayLoop up when it is done.
+func (server *Server) relayDue() (time.Time, error) {
+	for {
+		select {
+		case <-server.shutdown:
+			return time.Time{}, nil
+		default:
+		}
+		byServer, next, err := server.dueRelays(time.Now())
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(byServer) == 0 {
+			return next, nil
+		}
+		for dst, queued := range byServer {
+			server.relayMutex.Lock()
+			server.relaying[dst] = struct{}{}
+			server.relayMutex.Unlock()
+			server.wg.Add(1)
+			go func(dst [32]byte, queued []*queuedRelay) {
+				defer server.wg.Done()
+				server.relayTo(queued)
+				server.relayMutex.Lock()
+				delete(server.relaying, dst)
+				server.relayMutex.Unlock()
+				select {
+				case server.relayWake <- struct{}{}:
+				default:
+				}
+			}(dst, queued)
+		}
+	}
+}
+
+// dueRelays returns the envelopes that are due at now by the server they are
+// for, and when the first envelope that is not due yet is due. Envelopes for
+// servers that envelopes are being sent to already are skipped.
+func (server *Server) dueRelays(now time.Time) (map[[32]byte][]*queuedRelay, time.Time, error) {
+	server.relayMutex.Lock()
+	defer server.relayMutex.Unlock()
+	iter := server.database.NewIterator(util.BytesPrefix([]byte{'r'}), nil)
+	defer iter.Release()
+	byServer := make(map[[32]byte][]*queuedRelay)
+	batch := new(leveldb.Batch)
+	var next time.Time
+	for n := 0; n < maxRelayBatch && iter.Next(); {
+		key := append([]byte{}, iter.Key()...)
+		value := append([]byte{}, iter.Value()...)
+		relay := new(proto.ClientToServer_RelayEnvelope)
+		if len(key) != relayKeyLength || len(value) < relayHeaderLength || relay.Unmarshal(value[relayHeaderLength:]) != nil {
+			batch.Delete(key)
+			if len(key) == relayKeyLength && len(value) >= relayHeaderLength {
+				batch.Delete(relayOwnerKey((*[32]byte)(value[12:relayHeaderLength]), key[1+8:]))
+			}
+			continue
+		}
+		if due := time.Unix(0, int64(binary.BigEndian.Uint64(key[1:9]))); due.After(now) {
+			next = due
+			break
+		}
+		dst := *(*[32]byte)(relay.ServerTransportPK)
+		if _, busy := server.relaying[dst]; busy {
+			continue
+		}
+		if _, ok := byServer[dst]; !ok && len(server.relaying)+len(byServer) >= maxRelayConnections {
+			continue
+		}
+		byServer[dst] = append(byServer[dst], &queuedRelay{key, value, relay})
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return nil, time.Time{}, err
+	}
+	if batch.Len() != 0 {
+		if err := server.write(batch); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return byServer, next, nil
+}
+
+// relayTo makes one attempt to deliver envelopes queued for the same server.
+// If an attempt fails, that envelope and the ones after it are rescheduled
+// with exponential backoff.
+func (server *Server) relayTo(queued []*queuedRelay) {
+	var err error
+	for _, q := range queued {
+		if err == nil {
+			if err = server.forward(q.relay); err == nil {
+				err = server.deleteRelay(q)
+				if err != nil {
+					fmt.Printf("Server error: %v\n", err)
+				}
+				continue
+			}
+		}
+		if err := server.retryRelay(q, err); err != nil {
+			fmt.Printf("Server error: %v\n", err)
+		}
+	}
+}
+
+// retryRelay reschedules an envelope after a failed attempt, or drops it if
+// it has been queued for too long.
+func (server *Server) retryRelay(q *queuedRelay, cause error) error {
+	queued := time.Unix(0, int64(binary.BigEndian.Uint64(q.value[:8])))
+	if time.Since(queued) > relayLifetime {
+		fmt.Printf("Server error: dropping envelope for %s: %v\n", *q.relay.ServerAddress, cause)
+		return server.deleteRelay(q)
+	}
+	attempts := binary.BigEndian.Uint32(q.value[8:12]) + 1
+	binary.BigEndian.PutUint32(q.value[8:12], attempts)
+	delay := relayRetryInterval
+	for i := uint32(1); i < attempts && delay < maxRelayRetryInterval; i++ {
+		delay *= 2
+	}
+	if delay > maxRelayRetryInterval {
+		delay = maxRelayRetryInterval
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(q.key)
+	batch.Put(relayKey(time.Now().Add(delay), q.key[1+8:]), q.value)
+	return server.write(batch)
+}
+
+func (server *Server) deleteRelay(q *queuedRelay) error {
+	batch := new(leveldb.Batch)
+	batch.Delete(q.key)
+	batch.Delete(relayOwnerKey(q.owner(), q.key[1+8:]))
+	return server.write(batch)
+}
+
+// forward delivers an envelope to the server it is for like any other sender
+// would, without authenticating. The replicas of the server are tried in
+// order.
+func (server *Server) forward(relay *proto.ClientToServer_RelayEnvelope) error {
+	if *(*[32]byte)(relay.ServerTransportPK) == *server.pk {
+		_, err := server.newMessage((*[32]byte)(relay.User), relay.Envelope)
+		return err
+	}
+	addrs := append([]string{net.JoinHostPort(*relay.ServerAddress, strconv.Itoa(int(*relay.ServerPort)))}, relay.ServerReplicas...)
+	var err error
+	for _, addr := range addrs {
+		if err = forwardTo(addr, relay); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkRelayDial refuses connections to addresses we do not relay to once
+// the host name of the destination has been resolved.
+func checkRelayDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !relayDestinationAllowed(ip) {
+		return fmt.Errorf("relaying to %s is not allowed", host)
+	}
+	return nil
+}
+
+func forwardTo(addr string, relay *proto.ClientToServer_RelayEnvelope) error {
+	dialer := &net.Dialer{Timeout: relayTimeout, Control: checkRelayDial}
+	plainconn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	plainconn.SetDeadline(time.Now().Add(relayTimeout))
+	conn, _, err := transport.HandshakeConfig(plainconn, nil, nil, (*[32]byte)(relay.ServerTransportPK), proto.SERVER_MESSAGE_SIZE, &transport.HybridConfig)
+	if err != nil {
+		plainconn.Close()
+		return err
+	}
+	defer conn.Close()
+
+	cmdBytes, err := protobuf.Marshal(&proto.ClientToServer{
+		DeliverEnvelope: &proto.ClientToServer_DeliverEnvelope{
+			User:     relay.User,
+			Envelope: relay.Envelope,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteFrame(proto.Pad(cmdBytes, conn.MaxFrameSize())); err != nil {
+		return err
+	}
+	inBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
+	n, err := conn.ReadFrame(inBuf)
+	if err != nil {
+		return err
+	}
+	response := new(proto.ServerToClient)
+	if err := response.Unmarshal(proto.Unpad(inBuf[:n])); err != nil {
+		return err
+	}
+	if response.Status == nil || *response.Status != proto.ServerToClient_OK {
+		return fmt.Errorf("%s did not accept the envelope", addr)
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/transport"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func openTestDB(t *testing.T) (*leveldb.DB, func()) {
+	dir, err := ioutil.TempDir("", "testdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func relayEnvelope(conn *transport.Conn, t *testing.T, server *Server, uid *[32]byte, envelope []byte) *proto.ServerToClient {
+	addr := server.listener.Addr().(*net.TCPAddr)
+	return relayEnvelopeTo(conn, t, "127.0.0.1", addr.Port, server.pk, uid, envelope)
+}
+
+func relayEnvelopeTo(conn *transport.Conn, t *testing.T, addr string, port int, serverPK, uid *[32]byte, envelope []byte) *proto.ServerToClient {
+	port32 := int32(port)
+	command := &proto.ClientToServer{
+		RelayEnvelope: &proto.ClientToServer_RelayEnvelope{
+			User:              (*proto.Byte32)(uid),
+			ServerAddress:     &addr,
+			ServerPort:        &port32,
+			ServerTransportPK: (*proto.Byte32)(serverPK),
+			Envelope:          envelope,
+		},
+	}
+	writeProtobuf(conn, make([]byte, proto.SERVER_MESSAGE_SIZE), command, t)
+	response := new(proto.ServerToClient)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	inBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
+	num, err := conn.ReadFrame(inBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := response.Unmarshal(proto.Unpad(inBuf[:num])); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// waitForEnvelope waits until server has stored envelope for uid.
+func waitForEnvelope(t *testing.T, server *Server, uid *[32]byte, envelope []byte) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		messages, err := server.getMessageList(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range messages {
+			stored, err := server.getEnvelope(uid, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(stored, envelope) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the envelope was not delivered")
+}
+
+func relayQueueLength(t *testing.T, server *Server) int {
+	iter := server.database.NewIterator(util.BytesPrefix([]byte{'r'}), nil)
+	defer iter.Release()
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// allowLoopbackRelays lets the tests relay to servers on the loopback
+// interface until the returned function is called.
+func allowLoopbackRelays() func() {
+	allowed := relayDestinationAllowed
+	relayDestinationAllowed = func(net.IP) bool { return true }
+	return func() { relayDestinationAllowed = allowed }
+}
+
+func TestRelay(t *testing.T) {
+	defer allowLoopbackRelays()()
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	theirDB, theirCleanup := openTestDB(t)
+	defer theirCleanup()
+
+	ourServer, conn, inBuf, outBuf, _ := setUpServerTest(db, t)
+	defer ourServer.StopServer()
+	defer conn.Close()
+	theirServer, theirConn, theirInBuf, theirOutBuf, theirPK := setUpServerTest(theirDB, t)
+	defer theirServer.StopServer()
+	defer theirConn.Close()
+	createAccount(conn, inBuf, outBuf, t)
+	createAccount(theirConn, theirInBuf, theirOutBuf, t)
+
+	envelope := []byte("Relayed")
+	if response := relayEnvelope(conn, t, theirServer, theirPK, envelope); *response.Status != proto.ServerToClient_OK {
+		t.Fatalf("relay request failed: %v", response.Status)
+	}
+	waitForEnvelope(t, theirServer, theirPK, envelope)
+
+	// an envelope for a user of the same server is delivered locally
+	ourPK, _, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	local := []byte("Local")
+	if response := relayEnvelope(conn, t, ourServer, ourPK, local); *response.Status != proto.ServerToClient_OK {
+		t.Fatalf("relay request failed: %v", response.Status)
+	}
+	waitForEnvelope(t, ourServer, ourPK, local)
+
+	for i := 0; relayQueueLength(t, ourServer) != 0; i++ {
+		if i == 100 {
+			t.Fatal("delivered envelopes were not removed from the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelayRetry(t *testing.T) {
+	defer func(interval time.Duration) { relayRetryInterval = interval }(relayRetryInterval)
+	relayRetryInterval = 10 * time.Millisecond
+	defer allowLoopbackRelays()()
+
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	theirDB, theirCleanup := openTestDB(t)
+	defer theirCleanup()
+
+	ourServer, conn, inBuf, outBuf, _ := setUpServerTest(db, t)
+	defer ourServer.StopServer()
+	defer conn.Close()
+	createAccount(conn, inBuf, outBuf, t)
+
+	// the server of the recipient is not running yet
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	theirServerPK, theirServerSK, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	theirPK, _, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+
+	envelope := []byte("Delayed")
+	if response := relayEnvelopeTo(conn, t, "127.0.0.1", port, theirServerPK, theirPK, envelope); *response.Status != proto.ServerToClient_OK {
+		t.Fatalf("relay request failed: %v", response.Status)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if relayQueueLength(t, ourServer) != 1 {
+		t.Fatal("the envelope is not queued")
+	}
+
+	theirServer, err := StartServer(theirDB, make(chan struct{}), theirServerPK, theirServerSK, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer theirServer.StopServer()
+	waitForEnvelope(t, theirServer, theirPK, envelope)
+}
+
+func TestRelayWithoutAccount(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	server, conn, _, _, pkp := setUpServerTest(db, t)
+	defer server.StopServer()
+	defer conn.Close()
+
+	if response := relayEnvelope(conn, t, server, pkp, []byte("Spam")); *response.Status == proto.ServerToClient_OK {
+		t.Error("relayed an envelope for a user without an account")
+	}
+	if relayQueueLength(t, server) != 0 {
+		t.Error("queued an envelope for a user without an account")
+	}
+}
+
+func TestRelayDestinations(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	server, conn, inBuf, outBuf, _ := setUpServerTest(db, t)
+	defer server.StopServer()
+	defer conn.Close()
+	createAccount(conn, inBuf, outBuf, t)
+
+	theirServerPK, _, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	theirPK, _, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "::1", "0.0.0.0"} {
+		if response := relayEnvelopeTo(conn, t, addr, 1984, theirServerPK, theirPK, []byte("Probe")); *response.Status == proto.ServerToClient_OK {
+			t.Errorf("accepted an envelope for %s", addr)
+		}
+	}
+	if relayQueueLength(t, server) != 0 {
+		t.Error("queued an envelope for an internal address")
+	}
+
+	// host names are checked once they are resolved
+	if err := checkRelayDial("tcp", "127.0.0.1:1984", nil); err == nil {
+		t.Error("allowed a connection to the loopback interface")
+	}
+	if err := checkRelayDial("tcp", "198.51.100.1:1984", nil); err != nil {
+		t.Errorf("refused a connection to a public address: %s", err)
+	}
+}
+
+func TestRelayQuota(t *testing.T) {
+	defer allowLoopbackRelays()()
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	server, conn, inBuf, outBuf, _ := setUpServerTest(db, t)
+	defer server.StopServer()
+	defer conn.Close()
+	createAccount(conn, inBuf, outBuf, t)
+
+	// nothing listens at the destination, so the envelopes stay queued
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	theirServerPK, _, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	theirPK, _, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	for i := 0; i < maxRelayQueuePerUser; i++ {
+		if response := relayEnvelopeTo(conn, t, "127.0.0.1", port, theirServerPK, theirPK, []byte("Queued")); *response.Status != proto.ServerToClient_OK {
+			t.Fatalf("relay request %d failed: %v", i, response.Status)
+		}
+	}
+	if response := relayEnvelopeTo(conn, t, "127.0.0.1", port, theirServerPK, theirPK, []byte("Queued")); *response.Status == proto.ServerToClient_OK {
+		t.Error("queued more envelopes than the quota allows")
+	}
+}
+
+func TestRelayUnresponsiveServer(t *testing.T) {
+	defer allowLoopbackRelays()()
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	theirDB, theirCleanup := openTestDB(t)
+	defer theirCleanup()
+
+	ourServer, conn, inBuf, outBuf, _ := setUpServerTest(db, t)
+	defer ourServer.StopServer()
+	defer conn.Close()
+	theirServer, theirConn, theirInBuf, theirOutBuf, theirPK := setUpServerTest(theirDB, t)
+	defer theirServer.StopServer()
+	defer theirConn.Close()
+	createAccount(conn, inBuf, outBuf, t)
+	createAccount(theirConn, theirInBuf, theirOutBuf, t)
+
+	// a server that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	defer func() {
+		listener.Close()
+		select {
+		case c := <-accepted:
+			c.Close()
+		default:
+		}
+	}()
+	silentPK, _, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	port := listener.Addr().(*net.TCPAddr).Port
+	if response := relayEnvelopeTo(conn, t, "127.0.0.1", port, silentPK, theirPK, []byte("Stuck")); *response.Status != proto.ServerToClient_OK {
+		t.Fatalf("relay request failed: %v", response.Status)
+	}
+
+	envelope := []byte("Relayed")
+	if response := relayEnvelope(conn, t, theirServer, theirPK, envelope); *response.Status != proto.ServerToClient_OK {
+		t.Fatalf("relay request failed: %v", response.Status)
+	}
+	waitForEnvelope(t, theirServer, theirPK, envelope)
+}
@@ -0,0 +1,600 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/transport"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Several instances of a server can share its state: the primary serves
+// clients and sends every batch it writes to its database to each of its
+// backups, which apply it to theirs. Backups do not serve clients, so clients
+// that try the addresses of the server in order end up at the primary.
+//
+// A backup is in sync from when it has installed a copy of the database of the
+// primary until a batch can not be sent to it. Batches are sent to the backups
+// that are in sync before the write returns. A backup that falls out of sync
+// stops counting: writes go on without it, so the server stays available
+// while a backup is down or slow. The backup receives a new copy, which
+// includes everything it missed, when the primary reconnects. Prekeys are the
+// exception: a prekey is only handed out once every backup has deleted it, so
+// no prekeys are handed out while a backup is out of sync. The copy is read from a snapshot of the
+// database while clients keep writing; their writes are held back and sent
+// after it. The backup stages the copy and replaces its data with it in one
+// write once all of it has arrived, so a backup whose primary fails while
+// sending a copy keeps the previous one.
+//
+// Failover is manual: stop the primary if it still runs and restart a backup
+// as the primary, with the other replicas as its backups. A backup that never
+// installed a complete copy refuses to become the primary. A backup that was
+// out of sync when the primary failed is behind: it may lack messages, but it
+// does not hand out a prekey again.
+//
+// Each promotion raises the epoch of the database, which the backups learn
+// with their next copy. A primary with backups only serves clients once one of
+// them has accepted its epoch, and stops accepting clients when one has
+// followed a newer primary. So an old primary that is restarted by mistake
+// does not serve clients next to the new one, at least once the new primary
+// has sent a copy to one of the backups of the old one.
+//
+// All instances use the same long-term key, and the primary and a backup
+// authenticate each other with keys derived from it for each role. The
+// primary sends frames that consist of a kind and a payload, and the backup
+// acknowledges each of them by sending back the kind:
+//
+//	'e' (epoch): the payload is the epoch of the primary (big-endian uint64).
+//	    The backup answers 'x' instead if it has followed a newer primary.
+//	'c' (clear): the backup discards any staged data
+//	's' (stage): the payload is a leveldb batch of the copy of the database
+//	'i' (install): the backup replaces its data with the staged copy
+//	'b' (batch): the payload is a leveldb batch in the format of Batch.Dump
+//
+// The epoch is stored under "Repoch" and replicated. Backups stage copies
+// under "Rstaging" || key and record under "Rcopy" whether they have
+// installed a complete one; these keys are never replicated.
+
+// ReplicationConfig makes a server the primary or a backup of a replicated
+// server.
+type ReplicationConfig struct {
+	// Backups are the replication addresses of the backups of a primary.
+	Backups []string
+	// ListenAddr is the address at which a backup accepts the connection
+	// from the primary. A server with ListenAddr set is a backup.
+	ListenAddr string
+}
+
+const (
+	replicateEpoch      = 'e'
+	replicateSuperseded = 'x'
+	replicateClear      = 'c'
+	replicateStage      = 's'
+	replicateInstall    = 'i'
+	replicateBatch      = 'b'
+
+	replicationFrameSize = 1 << 20
+	// snapshotBatchSize is the amount of data sent in each batch when
+	// sending a copy of the database.
+	snapshotBatchSize  = replicationFrameSize / 2
+	replicationTimeout = 10 * time.Second
+	// maxSnapshotTail bounds the writes held back while a copy is sent. If
+	// there are more, the copy is abandoned and sent again.
+	maxSnapshotTail = 64 << 20
+
+	copyComplete   = "complete"
+	copyIncomplete = "incomplete"
+)
+
+var (
+	epochKey      = []byte("Repoch")
+	copyStateKey  = []byte("Rcopy")
+	stagingPrefix = []byte("Rstaging")
+
+	errSuperseded = errors.New("a backup has followed a newer primary")
+)
+
+// replicationRetryInterval is how often the primary tries to reconnect to a
+// backup that is not in sync.
+var replicationRetryInterval = 5 * time.Second
+
+// replicationKey derives the key pair that replicas in role ("primary" or
+// "backup") use on replication connections from the long-term secret key sk.
+func replicationKey(sk *[32]byte, role string) (*[32]byte, *[32]byte) {
+	var pk, roleSK [32]byte
+	h := hmac.New(sha256.New, sk[:])
+	h.Write([]byte("chatterbox replication " + role))
+	h.Sum(roleSK[:0])
+	curve25519.ScalarBaseMult(&pk, &roleSK)
+	return &pk, &roleSK
+}
+
+type backup struct {
+	addr string
+	// The fields below are guarded by server.writeMutex. conn is nil while
+	// the backup is not connected.
+	conn *transport.Conn
+	// inSync is false while a copy of the database is sent to the backup.
+	// The batches written meanwhile are held back in tail.
+	inSync       bool
+	tail         [][]byte
+	tailSize     int
+	tailOverflow bool
+	// lost is closed when the backup falls out of sync.
+	lost chan struct{}
+}
+
+// write writes batch to the database and sends it to the backups that are in
+// sync. A backup that does not apply it falls out of sync.
+func (server *Server) write(batch *leveldb.Batch) error {
+	server.writeMutex.Lock()
+	defer server.writeMutex.Unlock()
+	if err := server.database.Write(batch, wO_sync); err != nil {
+		return err
+	}
+	if len(server.backups) == 0 {
+		return nil
+	}
+	data := batch.Dump()
+	for _, b := range server.backups {
+		switch {
+		case b.conn == nil:
+		case !b.inSync:
+			if b.tailSize += len(data); b.tailSize > maxSnapshotTail {
+				b.tail, b.tailOverflow = nil, true
+			} else if !b.tailOverflow {
+				b.tail = append(b.tail, data)
+			}
+		default:
+			if err := sendFrame(b.conn, replicateBatch, data); err != nil {
+				fmt.Printf("Server error: backup %s: %v\n", b.addr, err)
+				b.close()
+			}
+		}
+	}
+	return nil
+}
+
+// writeEverywhere writes batch to the database and to every backup, and
+// returns an error unless all of them applied it. Nothing is written while a
+// backup is out of sync.
+func (server *Server) writeEverywhere(batch *leveldb.Batch) error {
+	server.writeMutex.Lock()
+	defer server.writeMutex.Unlock()
+	for _, b := range server.backups {
+		if b.conn == nil || !b.inSync {
+			return fmt.Errorf("backup %s is not in sync", b.addr)
+		}
+	}
+	if err := server.database.Write(batch, wO_sync); err != nil {
+		return err
+	}
+	data := batch.Dump()
+	var err error
+	for _, b := range server.backups {
+		if sendErr := sendFrame(b.conn, replicateBatch, data); sendErr != nil {
+			err = fmt.Errorf("backup %s: %v", b.addr, sendErr)
+			fmt.Printf("Server error: %v\n", err)
+			b.close()
+		}
+	}
+	return err
+}
+
+// sendFrame sends a frame to a backup and waits for it to be acknowledged.
+func sendFrame(conn *transport.Conn, kind byte, payload []byte) error {
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	if _, err := conn.WriteFrame(append([]byte{kind}, payload...)); err != nil {
+		return err
+	}
+	var ack [1]byte
+	n, err := conn.ReadFrame(ack[:])
+	if err != nil {
+		return err
+	}
+	if n == 1 && ack[0] == replicateSuperseded && kind == replicateEpoch {
+		return errSuperseded
+	}
+	if n != 1 || ack[0] != kind {
+		return errors.New("invalid acknowledgement")
+	}
+	return nil
+}
+
+// close marks b as out of sync. The caller must hold server.writeMutex.
+func (b *backup) close() {
+	b.conn.Close()
+	b.conn, b.inSync, b.tail = nil, false, nil
+	close(b.lost)
+}
+
+// backupLoop keeps b in sync until the server is shut down.
+func (server *Server) backupLoop(b *backup) {
+	defer server.wg.Done()
+	for {
+		lost, err := server.connectBackup(b)
+		if err != nil {
+			select {
+			case <-server.shutdown:
+				return
+			default:
+			}
+			fmt.Printf("Server error: backup %s: %v\n", b.addr, err)
+			select {
+			case <-server.shutdown:
+				return
+			case <-time.After(replicationRetryInterval):
+			}
+			continue
+		}
+		select {
+		case <-server.shutdown:
+			server.writeMutex.Lock()
+			if b.conn != nil {
+				b.close()
+			}
+			server.writeMutex.Unlock()
+			return
+		case <-lost:
+		}
+	}
+}
+
+// connectBackup connects to b and sends it a copy of the database followed by
+// the writes made while it was sent.
+func (server *Server) connectBackup(b *backup) (chan struct{}, error) {
+	plainconn, err := net.DialTimeout("tcp", b.addr, replicationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	plainconn.SetDeadline(time.Now().Add(replicationTimeout))
+	pk, sk := replicationKey(server.sk, "primary")
+	backupPK, _ := replicationKey(server.sk, "backup")
+	conn, _, err := transport.HandshakeConfig(plainconn, pk, sk, backupPK, replicationFrameSize, &transport.HybridConfig)
+	if err != nil {
+		plainconn.Close()
+		return nil, err
+	}
+	epoch := make([]byte, 8)
+	binary.BigEndian.PutUint64(epoch, server.epoch)
+	if err := sendFrame(conn, replicateEpoch, epoch); err != nil {
+		conn.Close()
+		if err == errSuperseded {
+			server.roleMutex.Lock()
+			server.superseded = true
+			server.roleMutex.Unlock()
+		}
+		return nil, err
+	}
+	server.roleMutex.Lock()
+	server.confirmed = true
+	server.roleMutex.Unlock()
+
+	server.writeMutex.Lock()
+	snapshot, err := server.database.GetSnapshot()
+	if err != nil {
+		server.writeMutex.Unlock()
+		conn.Close()
+		return nil, err
+	}
+	b.conn, b.inSync, b.lost = conn, false, make(chan struct{})
+	b.tail, b.tailSize, b.tailOverflow = nil, 0, false
+	server.writeMutex.Unlock()
+
+	err = server.sendCopy(conn, snapshot)
+	snapshot.Release()
+
+	server.writeMutex.Lock()
+	defer server.writeMutex.Unlock()
+	if err == nil && b.tailOverflow {
+		err = errors.New("too many writes while sending a copy of the database")
+	}
+	if err == nil {
+		err = sendFrame(conn, replicateInstall, nil)
+	}
+	for _, data := range b.tail {
+		if err != nil {
+			break
+		}
+		err = sendFrame(conn, replicateBatch, data)
+	}
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	b.inSync, b.tail = true, nil
+	return b.lost, nil
+}
+
+// sendCopy sends the data in snapshot to be staged by a backup.
+func (server *Server) sendCopy(conn *transport.Conn, snapshot *leveldb.Snapshot) error {
+	if err := sendFrame(conn, replicateClear, nil); err != nil {
+		return err
+	}
+	iter := snapshot.NewIterator(nil, nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	size := 0
+	for iter.Next() {
+		if isLocalKey(iter.Key()) {
+			continue
+		}
+		batch.Put(iter.Key(), iter.Value())
+		size += len(iter.Key()) + len(iter.Value())
+		if size >= snapshotBatchSize {
+			select {
+			case <-server.shutdown:
+				return errors.New("shutting down")
+			default:
+			}
+			if err := sendFrame(conn, replicateStage, batch.Dump()); err != nil {
+				return err
+			}
+			batch.Reset()
+			size = 0
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return sendFrame(conn, replicateStage, batch.Dump())
+}
+
+// isLocalKey reports whether a database key is bookkeeping of a backup that
+// is not replicated.
+func isLocalKey(key []byte) bool {
+	return bytes.Equal(key, copyStateKey) || bytes.HasPrefix(key, stagingPrefix)
+}
+
+// readEpoch returns the epoch stored in db.
+func readEpoch(db *leveldb.DB) (uint64, error) {
+	value, err := db.Get(epochKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, errors.New("invalid epoch in database")
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// takeOver prepares the database of a server that does not run as a backup.
+// If it is a copy from a primary, it must be complete, and the epoch is
+// raised so the backups stop following the previous primary.
+func (server *Server) takeOver() (err error) {
+	if server.epoch, err = readEpoch(server.database); err != nil {
+		return err
+	}
+	state, err := server.database.Get(copyStateKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if string(state) != copyComplete {
+		return errors.New("the database does not hold a complete copy from a primary")
+	}
+	batch, err := server.stagingDeletions()
+	if err != nil {
+		return err
+	}
+	server.epoch++
+	epoch := make([]byte, 8)
+	binary.BigEndian.PutUint64(epoch, server.epoch)
+	batch.Put(epochKey, epoch)
+	batch.Delete(copyStateKey)
+	return server.database.Write(batch, wO_sync)
+}
+
+// becomeBackup marks the database of a backup as incomplete until it has
+// installed a copy from the primary.
+func (server *Server) becomeBackup() error {
+	if _, err := server.database.Get(copyStateKey, nil); err != leveldb.ErrNotFound {
+		return err
+	}
+	return server.database.Put(copyStateKey, []byte(copyIncomplete), wO_sync)
+}
+
+// serving reports whether the server accepts clients.
+func (server *Server) serving() bool {
+	if server.replicationListener != nil {
+		// backups do not serve clients, who should try the next replica
+		return false
+	}
+	if len(server.backups) == 0 {
+		return true
+	}
+	server.roleMutex.Lock()
+	defer server.roleMutex.Unlock()
+	return server.confirmed && !server.superseded
+}
+
+// serveReplication accepts connections from the primary until the server is
+// shut down.
+func (server *Server) serveReplication() {
+	defer server.wg.Done()
+	for {
+		plainconn, err := server.replicationListener.Accept()
+		if err != nil {
+			return
+		}
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			err := server.followPrimary(plainconn)
+			select {
+			case <-server.shutdown:
+			default:
+				fmt.Printf("Server error: replication: %v\n", err)
+			}
+		}()
+	}
+}
+
+// followPrimary applies the changes the primary sends over plainconn.
+func (server *Server) followPrimary(plainconn net.Conn) error {
+	plainconn.SetDeadline(time.Now().Add(replicationTimeout))
+	pk, sk := replicationKey(server.sk, "backup")
+	primaryPK, _ := replicationKey(server.sk, "primary")
+	conn, peerPK, err := transport.HandshakeConfig(plainconn, pk, sk, nil, replicationFrameSize, &transport.HybridConfig)
+	if err != nil {
+		plainconn.Close()
+		return err
+	}
+	defer conn.Close()
+	if *peerPK != *primaryPK {
+		return errors.New("replication connection from a different server")
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the primary only reconnects if the previous connection failed, even
+	// if we have not noticed yet
+	server.writeMutex.Lock()
+	if server.primaryConn != nil {
+		server.primaryConn.Close()
+	}
+	server.primaryConn = conn
+	server.writeMutex.Unlock()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-server.shutdown:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	frame := make([]byte, replicationFrameSize)
+	epochChecked, installed := false, false
+	for {
+		n, err := conn.ReadFrame(frame)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.New("empty replication frame")
+		}
+		kind, payload := frame[0], frame[1:n]
+		ack := kind
+		server.writeMutex.Lock()
+		if server.primaryConn != conn {
+			server.writeMutex.Unlock()
+			return errors.New("superseded by a new connection from the primary")
+		}
+		switch {
+		case kind == replicateEpoch && len(payload) == 8:
+			var ours uint64
+			if ours, err = readEpoch(server.database); err == nil && binary.BigEndian.Uint64(payload) < ours {
+				ack = replicateSuperseded
+			}
+			epochChecked = true
+		case !epochChecked:
+			err = errors.New("replication started without an epoch")
+		case kind == replicateClear:
+			var batch *leveldb.Batch
+			if batch, err = server.stagingDeletions(); err == nil {
+				err = server.database.Write(batch, wO_sync)
+			}
+		case kind == replicateStage:
+			err = server.stage(payload)
+		case kind == replicateInstall:
+			err = server.installCopy()
+			installed = err == nil
+		case kind == replicateBatch && installed:
+			batch := new(leveldb.Batch)
+			if err = batch.Load(payload); err == nil {
+				err = server.database.Write(batch, wO_sync)
+			}
+		default:
+			err = fmt.Errorf("unexpected replication frame kind %d", kind)
+		}
+		server.writeMutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if _, err := conn.WriteFrame([]byte{ack}); err != nil {
+			return err
+		}
+		if ack == replicateSuperseded {
+			return errors.New("refused a primary with an older epoch")
+		}
+	}
+}
+
+// stagingDeletions returns a batch that deletes all staged data.
+func (server *Server) stagingDeletions() (*leveldb.Batch, error) {
+	iter := server.database.NewIterator(util.BytesPrefix(stagingPrefix), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	return batch, iter.Error()
+}
+
+type stagingBatch struct {
+	*leveldb.Batch
+}
+
+func (s stagingBatch) Put(key, value []byte) {
+	s.Batch.Put(append(append([]byte{}, stagingPrefix...), key...), value)
+}
+
+func (s stagingBatch) Delete(key []byte) {
+	s.Batch.Delete(append(append([]byte{}, stagingPrefix...), key...))
+}
+
+// stage writes a batch of a copy from the primary to the staging area.
+func (server *Server) stage(data []byte) error {
+	batch := new(leveldb.Batch)
+	if err := batch.Load(data); err != nil {
+		return err
+	}
+	staged := stagingBatch{new(leveldb.Batch)}
+	if err := batch.Replay(staged); err != nil {
+		return err
+	}
+	return server.database.Write(staged.Batch, wO_sync)
+}
+
+// installCopy replaces the data of a backup with the staged copy in a single
+// write.
+func (server *Server) installCopy() error {
+	batch := new(leveldb.Batch)
+	iter := server.database.NewIterator(nil, nil)
+	for iter.Next() {
+		if !isLocalKey(iter.Key()) {
+			batch.Delete(iter.Key())
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	// the staged keys come after the deletions so that they win
+	iter = server.database.NewIterator(util.BytesPrefix(stagingPrefix), nil)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		batch.Put(iter.Key()[len(stagingPrefix):], iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	batch.Put(copyStateKey, []byte(copyComplete))
+	return server.database.Write(batch, wO_sync)
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/transport"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// startReplicas starts a backup and a primary that share a key. The backup
+// listens for the primary at backupAddr, or at a random port if it is empty.
+func startReplicas(t *testing.T, backupAddr string) (primary, backup *Server, teardown func()) {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	db, cleanup := openTestDB(t)
+	backupDB, backupCleanup := openTestDB(t)
+	if backupAddr == "" {
+		backup, err = StartReplicatedServer(backupDB, make(chan struct{}), pk, sk, "127.0.0.1:0", &ReplicationConfig{ListenAddr: "127.0.0.1:0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupAddr = backup.replicationListener.Addr().String()
+	}
+	primary, err = StartReplicatedServer(db, make(chan struct{}), pk, sk, "127.0.0.1:0", &ReplicationConfig{Backups: []string{backupAddr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup != nil {
+		waitServing(t, primary)
+	}
+	return primary, backup, func() {
+		primary.StopServer()
+		if backup != nil {
+			backup.StopServer()
+		}
+		cleanup()
+		backupCleanup()
+	}
+}
+
+// waitServing waits until a primary accepts clients.
+func waitServing(t *testing.T, server *Server) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if server.serving() {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for the primary to serve clients")
+}
+
+// startBackup starts a backup that listens for its primary at addr. The
+// returned function removes its database once it has been stopped.
+func startBackup(t *testing.T, pk, sk *[32]byte, addr string) (*Server, func()) {
+	db, cleanup := openTestDB(t)
+	backup, err := StartReplicatedServer(db, make(chan struct{}), pk, sk, "127.0.0.1:0", &ReplicationConfig{ListenAddr: addr})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return backup, cleanup
+}
+
+func connectAccount(t *testing.T, server *Server) (*transport.Conn, *[32]byte) {
+	oldConn, err := net.Dial("tcp", server.listener.Addr().String())
+	handleError(err, t)
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	conn, _, err := transport.Handshake(oldConn, pk, sk, server.pk, proto.SERVER_MESSAGE_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createAccount(conn, make([]byte, proto.SERVER_MESSAGE_SIZE), make([]byte, proto.SERVER_MESSAGE_SIZE), t)
+	return conn, pk
+}
+
+// waitForKey waits until server has (or, if present is false, does not have)
+// the database key key.
+func waitForKey(t *testing.T, server *Server, key []byte, present bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ok, err := server.database.Has(key, nil); err != nil {
+			t.Fatal(err)
+		} else if ok == present {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %q (present: %v)", key, present)
+}
+
+// requestKey asks for a prekey of uid and returns it, or nil if the server
+// did not hand one out.
+func requestKey(t *testing.T, conn *transport.Conn, uid *[32]byte) []byte {
+	writeProtobuf(conn, make([]byte, proto.SERVER_MESSAGE_SIZE), &proto.ClientToServer{GetSignedKey: (*proto.Byte32)(uid)}, t)
+	inBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	num, err := conn.ReadFrame(inBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := new(proto.ServerToClient)
+	if err := response.Unmarshal(proto.Unpad(inBuf[:num])); err != nil {
+		t.Fatal(err)
+	}
+	if *response.Status != proto.ServerToClient_OK {
+		return nil
+	}
+	return response.SignedKey
+}
+
+func TestReplication(t *testing.T) {
+	primary, backup, teardown := startReplicas(t, "")
+	defer teardown()
+
+	conn, uid := connectAccount(t, primary)
+	defer conn.Close()
+	inBuf, outBuf := make([]byte, proto.SERVER_MESSAGE_SIZE), make([]byte, proto.SERVER_MESSAGE_SIZE)
+	keys := [][]byte{[]byte("key1"), []byte("key2")}
+	uploadKeys(conn, inBuf, outBuf, t, keys)
+	uploadMessageToUser(conn, inBuf, outBuf, t, uid, []byte("Envelope"))
+
+	waitForKey(t, backup, append([]byte{'u'}, uid[:]...), true)
+	messages, err := backup.getMessageList(uid)
+	handleError(err, t)
+	if len(messages) != 1 {
+		t.Fatalf("the backup has %d messages, want 1", len(messages))
+	}
+	if n, err := backup.getNumKeys(uid); err != nil || *n != 2 {
+		t.Fatalf("the backup has %d prekeys (%v), want 2", *n, err)
+	}
+
+	key := getKey(conn, inBuf, outBuf, t, uid)
+	if n, err := backup.getNumKeys(uid); err != nil || *n != 1 {
+		t.Errorf("the backup has %d prekeys (%v) after one was handed out, want 1", *n, err)
+	}
+	if other, err := backup.getKey(uid); err != nil || bytes.Equal(other, key) {
+		t.Errorf("the backup handed out %q (%v) again", other, err)
+	}
+}
+
+func TestBackupRefusesClients(t *testing.T) {
+	_, backup, teardown := startReplicas(t, "")
+	defer teardown()
+
+	oldConn, err := net.Dial("tcp", backup.listener.Addr().String())
+	handleError(err, t)
+	defer oldConn.Close()
+	oldConn.SetDeadline(time.Now().Add(time.Second))
+	if _, _, err := transport.Handshake(oldConn, nil, nil, backup.pk, proto.SERVER_MESSAGE_SIZE); err == nil {
+		t.Error("a backup accepted a client")
+	}
+}
+
+func TestBackupOutOfSync(t *testing.T) {
+	defer func(interval time.Duration) { replicationRetryInterval = interval }(replicationRetryInterval)
+	replicationRetryInterval = 10 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupAddr := listener.Addr().String()
+	listener.Close()
+	primary, _, teardown := startReplicas(t, backupAddr)
+	defer teardown()
+	backup, backupCleanup := startBackup(t, primary.pk, primary.sk, backupAddr)
+	defer backupCleanup()
+	waitServing(t, primary)
+
+	conn, uid := connectAccount(t, primary)
+	defer conn.Close()
+	inBuf, outBuf := make([]byte, proto.SERVER_MESSAGE_SIZE), make([]byte, proto.SERVER_MESSAGE_SIZE)
+	uploadKeys(conn, inBuf, outBuf, t, [][]byte{[]byte("key1"), []byte("key2")})
+	waitForKey(t, backup, append([]byte{'u'}, uid[:]...), true)
+	backup.StopServer()
+
+	// the backup would not know that the key was handed out
+	if key := requestKey(t, conn, uid); key != nil {
+		t.Fatalf("handed out %q while the backup was down", key)
+	}
+
+	backup, backupCleanup = startBackup(t, primary.pk, primary.sk, backupAddr)
+	defer backupCleanup()
+	defer backup.StopServer()
+	waitForKey(t, backup, copyStateKey, true)
+	waitForKey(t, backup, append([]byte{'u'}, uid[:]...), true)
+
+	for deadline := time.Now().Add(5 * time.Second); requestKey(t, conn, uid) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no prekey handed out after the backup caught up")
+		}
+	}
+	// a key whose deletion did not reach the backup is not handed out at all
+	want, err := primary.getNumKeys(uid)
+	handleError(err, t)
+	if n, err := backup.getNumKeys(uid); err != nil || *n != *want {
+		t.Errorf("the backup has %d prekeys (%v), want %d", *n, err, *want)
+	}
+}
+
+func TestPromoteLaggingBackup(t *testing.T) {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	backup, backupCleanup := startBackup(t, pk, sk, "127.0.0.1:0")
+	defer backupCleanup()
+	db, primaryCleanup := openTestDB(t)
+	defer primaryCleanup()
+	primary, err := StartReplicatedServer(db, make(chan struct{}), pk, sk, "127.0.0.1:0", &ReplicationConfig{Backups: []string{backup.replicationListener.Addr().String()}})
+	handleError(err, t)
+	defer primary.StopServer()
+	waitServing(t, primary)
+
+	conn, uid := connectAccount(t, primary)
+	defer conn.Close()
+	inBuf, outBuf := make([]byte, proto.SERVER_MESSAGE_SIZE), make([]byte, proto.SERVER_MESSAGE_SIZE)
+	uploadKeys(conn, inBuf, outBuf, t, [][]byte{[]byte("key1"), []byte("key2"), []byte("key3")})
+	waitForKey(t, backup, append([]byte{'u'}, uid[:]...), true)
+	handedOut := [][]byte{getKey(conn, inBuf, outBuf, t, uid)}
+
+	// the backup falls behind, and the primary fails
+	backup.StopServer()
+	for i := 0; i < 2; i++ {
+		if key := requestKey(t, conn, uid); key != nil {
+			handedOut = append(handedOut, key)
+		}
+	}
+
+	promoted, err := StartServer(backup.database, make(chan struct{}), pk, sk, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer promoted.StopServer()
+	promotedConn, _ := connectAccount(t, promoted)
+	defer promotedConn.Close()
+	for key := requestKey(t, promotedConn, uid); key != nil; key = requestKey(t, promotedConn, uid) {
+		handedOut = append(handedOut, key)
+	}
+	seen := make(map[string]bool)
+	for _, key := range handedOut {
+		if seen[string(key)] {
+			t.Errorf("%q was handed out twice", key)
+		}
+		seen[string(key)] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("handed out %d distinct prekeys, want at least 2", len(seen))
+	}
+}
+
+// dialBackup connects to a backup of the server with secret key sk as its
+// primary.
+func dialBackup(t *testing.T, backup *Server, sk *[32]byte) *transport.Conn {
+	plainconn, err := net.Dial("tcp", backup.replicationListener.Addr().String())
+	handleError(err, t)
+	pk, primarySK := replicationKey(sk, "primary")
+	backupPK, _ := replicationKey(sk, "backup")
+	conn, _, err := transport.HandshakeConfig(plainconn, pk, primarySK, backupPK, replicationFrameSize, &transport.HybridConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestIncompleteCopy(t *testing.T) {
+	primary, backup, teardown := startReplicas(t, "")
+	defer teardown()
+	conn, uid := connectAccount(t, primary)
+	conn.Close()
+	userKey := append([]byte{'u'}, uid[:]...)
+	waitForKey(t, backup, userKey, true)
+
+	// a primary that fails while sending a copy
+	primaryConn := dialBackup(t, backup, primary.sk)
+	if err := sendFrame(primaryConn, replicateEpoch, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendFrame(primaryConn, replicateClear, nil); err != nil {
+		t.Fatal(err)
+	}
+	batch := new(leveldb.Batch)
+	batch.Put([]byte("unfinished"), []byte{})
+	if err := sendFrame(primaryConn, replicateStage, batch.Dump()); err != nil {
+		t.Fatal(err)
+	}
+	primaryConn.Close()
+
+	for _, key := range [][]byte{userKey, copyStateKey} {
+		if ok, err := backup.database.Has(key, nil); err != nil || !ok {
+			t.Errorf("the backup lost %q (%v) when the copy was not finished", key, err)
+		}
+	}
+	if ok, err := backup.database.Has([]byte("unfinished"), nil); err != nil || ok {
+		t.Errorf("the backup installed part of a copy (%v)", err)
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+
+	// a backup that never received a copy
+	backup, cleanup := startBackup(t, pk, sk, "127.0.0.1:0")
+	defer cleanup()
+	backup.StopServer()
+	if _, err := StartServer(backup.database, make(chan struct{}), pk, sk, "127.0.0.1:0"); err == nil {
+		t.Fatal("an incomplete backup became the primary")
+	}
+
+	// a backup with a copy
+	backup, cleanup = startBackup(t, pk, sk, "127.0.0.1:0")
+	defer cleanup()
+	db, primaryCleanup := openTestDB(t)
+	defer primaryCleanup()
+	primary, err := StartReplicatedServer(db, make(chan struct{}), pk, sk, "127.0.0.1:0", &ReplicationConfig{Backups: []string{backup.replicationListener.Addr().String()}})
+	handleError(err, t)
+	defer primary.StopServer()
+	waitServing(t, primary)
+	conn, uid := connectAccount(t, primary)
+	conn.Close()
+	waitForKey(t, backup, append([]byte{'u'}, uid[:]...), true)
+	backup.StopServer()
+
+	promoted, err := StartServer(backup.database, make(chan struct{}), pk, sk, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer promoted.StopServer()
+	if promoted.epoch != primary.epoch+1 {
+		t.Errorf("the promoted backup has epoch %d, want %d", promoted.epoch, primary.epoch+1)
+	}
+	if ok, err := promoted.database.Has(copyStateKey, nil); err != nil || ok {
+		t.Errorf("the promoted backup is still marked as a copy (%v)", err)
+	}
+	conn, _ = connectAccount(t, promoted)
+	conn.Close()
+}
+
+func TestStalePrimary(t *testing.T) {
+	defer func(interval time.Duration) { replicationRetryInterval = interval }(replicationRetryInterval)
+	replicationRetryInterval = 10 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupAddr := listener.Addr().String()
+	listener.Close()
+	primary, _, teardown := startReplicas(t, backupAddr)
+	defer teardown()
+
+	// the backup has followed a primary that was promoted after this one
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	epoch := make([]byte, 8)
+	binary.BigEndian.PutUint64(epoch, primary.epoch+1)
+	handleError(db.Put(epochKey, epoch, nil), t)
+	backup, err := StartReplicatedServer(db, make(chan struct{}), primary.pk, primary.sk, "127.0.0.1:0", &ReplicationConfig{ListenAddr: backupAddr})
+	handleError(err, t)
+	defer backup.StopServer()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		primary.roleMutex.Lock()
+		superseded := primary.superseded
+		primary.roleMutex.Unlock()
+		if superseded {
+			break
+		}
+	}
+	if primary.serving() {
+		t.Fatal("a superseded primary serves clients")
+	}
+	oldConn, err := net.Dial("tcp", primary.listener.Addr().String())
+	handleError(err, t)
+	defer oldConn.Close()
+	oldConn.SetDeadline(time.Now().Add(time.Second))
+	if _, _, err := transport.Handshake(oldConn, nil, nil, primary.pk, proto.SERVER_MESSAGE_SIZE); err == nil {
+		t.Error("a superseded primary accepted a client")
+	}
+}
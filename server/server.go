@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 
 	protobuf "golang.org/x/oprotobuf/proto"
@@ -28,29 +29,104 @@ type Server struct {
 	pk       *[32]byte
 	sk       *[32]byte
 	keyMutex sync.Mutex
+	// transportConfig has a random ticket key, so tickets issued before a
+	// restart are not accepted after it.
+	transportConfig transport.Config
+	// relayWake is signalled when an envelope is queued for relaying or
+	// envelopes have been sent to a server.
+	relayWake chan struct{}
+	// relaying holds the servers that envelopes are being sent to.
+	relayMutex sync.Mutex
+	relaying   map[[32]byte]struct{}
+
+	// writeMutex orders the writes to the database and the batches sent to
+	// backups.
+	writeMutex          sync.Mutex
+	backups             []*backup
+	replicationListener net.Listener
+	// primaryConn is the connection from the primary that a backup follows.
+	primaryConn *transport.Conn
+	// epoch is the epoch of a primary. A primary with backups serves clients
+	// once a backup has confirmed it and until one has superseded it, both
+	// guarded by roleMutex.
+	epoch                 uint64
+	roleMutex             sync.Mutex
+	confirmed, superseded bool
 }
 
+// StartServer starts a server that listens on the TCP address listenAddr, or
+// on a Unix socket if listenAddr is "unix:" followed by its path. The Unix
+// socket is meant for a Tor onion service running on the same machine.
 func StartServer(db *leveldb.DB, shutdown chan struct{}, pk *[32]byte, sk *[32]byte, listenAddr string) (*Server, error) {
-	listener, err := net.Listen("tcp", listenAddr)
+	return StartReplicatedServer(db, shutdown, pk, sk, listenAddr, nil)
+}
+
+// StartReplicatedServer starts a server like StartServer that is the primary
+// or a backup of a replicated server as configured by replication, which may
+// be nil.
+func StartReplicatedServer(db *leveldb.DB, shutdown chan struct{}, pk *[32]byte, sk *[32]byte, listenAddr string, replication *ReplicationConfig) (*Server, error) {
+	network := "tcp"
+	if strings.HasPrefix(listenAddr, "unix:") {
+		network, listenAddr = "unix", strings.TrimPrefix(listenAddr, "unix:")
+	}
+	listener, err := net.Listen(network, listenAddr)
 	if err != nil {
 		return nil, err
 	}
 	server := &Server{
-		database: db,
-		shutdown: shutdown,
-		listener: listener,
-		notifier: Notifier{waiters: make(map[[32]byte][]chan *MessageWithId)},
-		pk:       pk,
-		sk:       sk,
+		database:  db,
+		shutdown:  shutdown,
+		listener:  listener,
+		notifier:  Notifier{waiters: make(map[[32]byte][]chan *MessageWithId)},
+		pk:        pk,
+		sk:        sk,
+		relayWake: make(chan struct{}, 1),
+		relaying:  make(map[[32]byte]struct{}),
+	}
+	server.transportConfig = transport.HybridConfig
+	server.transportConfig.TicketKey = new([32]byte)
+	if _, err := rand.Read(server.transportConfig.TicketKey[:]); err != nil {
+		listener.Close()
+		return nil, err
 	}
-	server.wg.Add(1)
+	if replication != nil && replication.ListenAddr != "" {
+		if err := server.becomeBackup(); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if server.replicationListener, err = net.Listen("tcp", replication.ListenAddr); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		server.wg.Add(2)
+		go server.RunServer()
+		go server.serveReplication()
+		return server, nil
+	}
+	if err := server.takeOver(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if replication != nil {
+		for _, addr := range replication.Backups {
+			server.backups = append(server.backups, &backup{addr: addr})
+		}
+	}
+	server.wg.Add(2 + len(server.backups))
 	go server.RunServer()
+	go server.relayLoop()
+	for _, b := range server.backups {
+		go server.backupLoop(b)
+	}
 	return server, nil
 }
 
 func (server *Server) StopServer() {
 	close(server.shutdown)
 	server.listener.Close()
+	if server.replicationListener != nil {
+		server.replicationListener.Close()
+	}
 	server.wg.Wait()
 }
 
@@ -129,7 +205,10 @@ func (server *Server) readClientNotifications(notificationsIn chan *MessageWithI
 //for each client, listen for commands
 func (server *Server) handleClient(connection net.Conn) error {
 	defer server.wg.Done()
-	newConnection, uid, err := transport.Handshake(connection, server.pk, server.sk, nil, proto.SERVER_MESSAGE_SIZE) //TODO: Decide on this bound
+	if !server.serving() {
+		return connection.Close()
+	}
+	newConnection, uid, err := transport.HandshakeConfig(connection, server.pk, server.sk, nil, proto.SERVER_MESSAGE_SIZE, &server.transportConfig) //TODO: Decide on this bound
 	if err != nil {
 		return err
 	}
@@ -164,6 +243,8 @@ func (server *Server) handleClient(connection net.Conn) error {
 					return err
 				}
 				response.MessageId = (*proto.Byte32)(msg_id)
+			} else if cmd.RelayEnvelope != nil {
+				err = server.queueRelay(uid, cmd.RelayEnvelope)
 			} else if cmd.ListMessages != nil && *cmd.ListMessages {
 				var messageList []*[32]byte
 				messageList, err = server.getMessageList(uid)
@@ -239,10 +320,14 @@ func (server *Server) getNumKeys(user *[32]byte) (*int64, error) { //TODO: Batch
 	return &numRecords, iter.Error()
 }
 
+// deleteKey deletes a prekey on all replicas, so that none of them hands it
+// out again, even one that is promoted later.
 func (server *Server) deleteKey(uid *[32]byte, key []byte) error {
 	keyHash := sha256.Sum256((key))
 	dbKey := append(append([]byte{'k'}, uid[:]...), keyHash[:]...)
-	return server.database.Delete(dbKey, wO_sync)
+	batch := new(leveldb.Batch)
+	batch.Delete(dbKey)
+	return server.writeEverywhere(batch)
 }
 
 func (server *Server) getKey(user *[32]byte) ([]byte, error) {
@@ -260,9 +345,13 @@ func (server *Server) getKey(user *[32]byte) ([]byte, error) {
 	if iter.First() == false {
 		return nil, errors.New("No keys left in database")
 	}
-	err = iter.Error()
-	server.deleteKey(user, iter.Value())
-	return append([]byte{}, iter.Value()...), err
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if err := server.deleteKey(user, iter.Value()); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, iter.Value()...), nil
 }
 
 func (server *Server) newKeys(uid *[32]byte, keyList [][]byte) error {
@@ -272,7 +361,7 @@ func (server *Server) newKeys(uid *[32]byte, keyList [][]byte) error {
 		dbKey := append(append([]byte{'k'}, uid[:]...), keyHash[:]...)
 		batch.Put(dbKey, key)
 	}
-	return server.database.Write(batch, wO_sync)
+	return server.write(batch)
 }
 func (server *Server) deleteMessages(uid *[32]byte, messageList []*[32]byte) error {
 	batch := new(leveldb.Batch)
@@ -280,7 +369,7 @@ func (server *Server) deleteMessages(uid *[32]byte, messageList []*[32]byte) err
 		key := append(append([]byte{'m'}, uid[:]...), messageID[:]...)
 		batch.Delete(key)
 	}
-	return server.database.Write(batch, wO_sync)
+	return server.write(batch)
 }
 
 func (server *Server) getEnvelope(uid *[32]byte, messageID *[32]byte) ([]byte, error) {
@@ -294,9 +383,11 @@ func (server *Server) writeProtobuf(conn *transport.Conn, outBuf []byte, message
 	if err != nil {
 		return err
 	}
-	padMsg := proto.Pad(unpadMsg, proto.SERVER_MESSAGE_SIZE)
+	// clients from before the message size was raised negotiate a smaller
+	// frame size
+	padMsg := proto.Pad(unpadMsg, conn.MaxFrameSize())
 	copy(outBuf, padMsg)
-	conn.WriteFrame(outBuf[:proto.SERVER_MESSAGE_SIZE])
+	conn.WriteFrame(outBuf[:conn.MaxFrameSize()])
 	return nil
 }
 
@@ -340,7 +431,9 @@ func (server *Server) newMessage(uid *[32]byte, envelope []byte) (*[32]byte, err
 
 	messageHash := sha256.Sum256(envelope)
 	key := append(append(append([]byte{'m'}, uid[:]...), tstmp[:]...), messageHash[:24]...)
-	err := server.database.Put(key, (envelope)[:], wO_sync)
+	batch := new(leveldb.Batch)
+	batch.Put(key, envelope)
+	err := server.write(batch)
 	if err != nil {
 		return nil, err
 	}
@@ -353,5 +446,7 @@ func (server *Server) newMessage(uid *[32]byte, envelope []byte) (*[32]byte, err
 }
 
 func (server *Server) newUser(uid *[32]byte) error {
-	return server.database.Put(append([]byte{'u'}, uid[:]...), []byte(""), wO_sync)
+	batch := new(leveldb.Batch)
+	batch.Put(append([]byte{'u'}, uid[:]...), []byte(""))
+	return server.write(batch)
 }
@@ -1,34 +1,49 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/andres-erbsen/chatterbox/server"
 	"github.com/syndtr/goleveldb/leveldb"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 )
 
 func main() {
-	if len(os.Args) != 5 {
-		fmt.Fprintf(os.Stderr, "USAGE: %s <sk> <pk> <dbdir> <host:port>", os.Args[0])
+	backups := flag.String("backups", "", "comma-separated replication addresses of the backups of this server")
+	replicationAddr := flag.String("replication-listen", "", "run as a backup that accepts the connection from the primary at this address; to fail over, stop the primary and restart a backup with -backups instead")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s [-backups host:port,...|-replication-listen host:port] <sk> <pk> <dbdir> <host:port|unix:path>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 4 || *backups != "" && *replicationAddr != "" {
+		flag.Usage()
 		os.Exit(2)
 	}
-	db, err := leveldb.OpenFile(os.Args[3], nil)
+	db, err := leveldb.OpenFile(flag.Arg(2), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-	skBytes, err := ioutil.ReadFile(os.Args[1])
+	skBytes, err := ioutil.ReadFile(flag.Arg(0))
 	if err != nil {
 		log.Fatal(err)
 	}
-	pkBytes, err := ioutil.ReadFile(os.Args[2])
+	pkBytes, err := ioutil.ReadFile(flag.Arg(1))
 	if err != nil {
 		log.Fatal(err)
 	}
 	var sk, pk [32]byte
 	copy(sk[:], skBytes)
 	copy(pk[:], pkBytes)
-	server.StartServer(db, nil, &pk, &sk, os.Args[4])
+	replication := &server.ReplicationConfig{ListenAddr: *replicationAddr}
+	if *backups != "" {
+		replication.Backups = strings.Split(*backups, ",")
+	}
+	if _, err := server.StartReplicatedServer(db, make(chan struct{}), &pk, &sk, flag.Arg(3), replication); err != nil {
+		log.Fatal(err)
+	}
 	select {}
 }
@@ -92,6 +92,34 @@ func setUpServerTest(db *leveldb.DB, t *testing.T) (*Server, *transport.Conn, []
 	return server, conn, inBuf, outBuf, pkp
 }
 
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testdb")
+	handleError(err, t)
+	defer os.RemoveAll(dir)
+	db, err := leveldb.OpenFile(dir, nil)
+	handleError(err, t)
+	defer db.Close()
+
+	pks, sks, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	server, err := StartServer(db, make(chan struct{}), pks, sks, "unix:"+dir+"/server.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.StopServer()
+
+	oldConn, err := net.Dial("unix", dir+"/server.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := transport.Handshake(oldConn, nil, nil, pks, proto.SERVER_MESSAGE_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	createAccount(conn, make([]byte, proto.SERVER_MESSAGE_SIZE), make([]byte, proto.SERVER_MESSAGE_SIZE), t)
+}
+
 func createAccount(conn *transport.Conn, inBuf []byte, outBuf []byte, t *testing.T) {
 	command := &proto.ClientToServer{
 		CreateAccount: protobuf.Bool(true),
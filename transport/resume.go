@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// A Ticket lets a party resume a session with the party that issued it
+// without authenticating with long-term keys again. The ticket itself is
+// opaque: it is encrypted using a key only the issuer knows and contains the
+// long-term public key of the party it was issued to and a resumption secret
+// derived from the key of the connection it was issued on. The resumed
+// connection still uses new ephemeral keys, so it is as forward-secret as a
+// connection established using a full handshake. A ticket should only be used
+// once because it links the connections it is presented on.
+type Ticket struct {
+	peerPK [32]byte
+	secret [32]byte
+	blob   []byte
+}
+
+// PeerPK returns the long-term public key of the party that issued t.
+func (t *Ticket) PeerPK() *[32]byte { return &t.peerPK }
+
+// ticket contents: expiration (unix seconds, big-endian uint64), long-term
+// public key of the party the ticket was issued to, resumption secret
+const (
+	ticketContentsLength = 8 + 32 + 32
+	ticketLength         = 24 + secretbox.Overhead + ticketContentsLength
+)
+
+var (
+	resumptionSecretLabel = []byte("chatterbox transport resumption secret")
+	resumptionProofLabel  = []byte("chatterbox transport resumption proof")
+)
+
+// resumptionSecret derives the secret that a ticket issued on a connection
+// with the given key carries.
+func resumptionSecret(key *[32]byte) *[32]byte {
+	var ret [32]byte
+	h := hmac.New(sha256.New, key[:])
+	h.Write(resumptionSecretLabel)
+	h.Sum(ret[:0])
+	return &ret
+}
+
+// resumptionProof is sent instead of the long-term-key box in a resumed
+// handshake. It shows that the sender knows the resumption secret and covers
+// the same ephemeral keys and transcript as the box would.
+func resumptionProof(secret *[32]byte, senderEphemeral, receiverEphemeral *[32]byte, transcript []byte) []byte {
+	h := hmac.New(sha256.New, secret[:])
+	h.Write(resumptionProofLabel)
+	h.Write(senderEphemeral[:])
+	h.Write(receiverEphemeral[:])
+	h.Write(transcript)
+	return h.Sum(nil)
+}
+
+func sealTicket(ticketKey, peerPK, secret *[32]byte, lifetime time.Duration) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	var contents [ticketContentsLength]byte
+	binary.BigEndian.PutUint64(contents[:8], uint64(time.Now().Add(lifetime).Unix()))
+	copy(contents[8:40], peerPK[:])
+	copy(contents[40:], secret[:])
+	return secretbox.Seal(nonce[:], contents[:], &nonce, ticketKey), nil
+}
+
+// openTicket returns the public key of the party a ticket we issued was
+// issued to and the resumption secret in it.
+func openTicket(ticketKey *[32]byte, blob []byte) (*[32]byte, *[32]byte, error) {
+	if len(blob) != ticketLength {
+		return nil, nil, errors.New("malformed ticket")
+	}
+	var nonce [24]byte
+	copy(nonce[:], blob[:24])
+	contents, ok := secretbox.Open(nil, blob[24:], &nonce, ticketKey)
+	if !ok {
+		return nil, nil, errors.New("ticket not issued by us")
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(contents[:8])) {
+		return nil, nil, errors.New("ticket expired")
+	}
+	var peerPK, secret [32]byte
+	copy(peerPK[:], contents[8:40])
+	copy(secret[:], contents[40:])
+	return &peerPK, &secret, nil
+}
+
+// exchangeTickets sends the other party a ticket if we issue them and
+// receives a ticket from them if they do. A party that does not issue tickets
+// sends an empty frame.
+func (c *Conn) exchangeTickets(theirPK, secret *[32]byte, config *Config) error {
+	var blob []byte
+	if config.TicketKey != nil {
+		lifetime := config.TicketLifetime
+		if lifetime == 0 {
+			lifetime = DefaultTicketLifetime
+		}
+		var err error
+		if blob, err = sealTicket(config.TicketKey, theirPK, secret, lifetime); err != nil {
+			return err
+		}
+	}
+	writeErr := make(chan error, 1)
+	go func() { _, err := c.WriteFrame(blob); writeErr <- err }()
+	var theirs [ticketLength]byte
+	n, err := c.ReadFrame(theirs[:])
+	if err != nil {
+		return err
+	}
+	if err := <-writeErr; err != nil {
+		return err
+	}
+	if n == ticketLength {
+		c.ticket = &Ticket{peerPK: *theirPK, secret: *secret, blob: append([]byte{}, theirs[:]...)}
+	} else if n != 0 {
+		return errors.New("received malformed ticket")
+	}
+	return nil
+}
+
+// Ticket returns the ticket the other party issued on this connection, or nil
+// if it did not issue one.
+func (c *Conn) Ticket() *Ticket { return c.ticket }
+
+// Resumed returns whether the connection was established by resuming a
+// session using a ticket.
+func (c *Conn) Resumed() bool { return c.resumed }
@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"errors"
+	"io"
+)
+
+// A stream is a payload of any length that is sent as a sequence of frames.
+// Each frame of a stream starts with a byte that says whether more frames
+// follow, so that the receiver notices if the stream is cut short. Since
+// frames are authenticated and numbered, chunks can not be reordered or
+// replaced either.
+const (
+	streamMore byte = iota
+	streamEnd
+	streamAbort
+)
+
+// ErrStreamAborted is returned by ReadStream if the sender could not read the
+// whole payload.
+var ErrStreamAborted = errors.New("stream aborted by the sender")
+
+// WriteStream sends everything read from r as a stream that can be received
+// using ReadStream. The payload is sent one frame at a time, so it never has
+// to be in memory all at once. Other frames are not written on the connection
+// while the stream is being sent. If reading from r fails, the other party is
+// told that the stream was aborted and the error is returned.
+func (c *Conn) WriteStream(r io.Reader) (int64, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := make([]byte, c.maxFrameSize)
+	var written int64
+	for {
+		n, err := io.ReadFull(r, buf[1:])
+		switch err {
+		case nil:
+			buf[0] = streamMore
+		case io.EOF, io.ErrUnexpectedEOF:
+			buf[0] = streamEnd
+		default:
+			buf[0] = streamAbort
+			if _, err := c.writeFrame(buf[:1]); err != nil {
+				return written, err
+			}
+			return written, err
+		}
+		if _, err := c.writeFrame(buf[:1+n]); err != nil {
+			return written, err
+		}
+		written += int64(n)
+		if buf[0] == streamEnd {
+			return written, nil
+		}
+	}
+}
+
+// ReadStream receives a stream sent using WriteStream and writes it to w. It
+// returns the number of bytes written to w. If writing to w fails, the rest
+// of the stream is still read (and discarded) so that the connection can be
+// used afterwards.
+func (c *Conn) ReadStream(w io.Writer) (int64, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	buf := make([]byte, c.maxFrameSize)
+	var read int64
+	var writeErr error
+	for {
+		n, err := c.readFrame(buf)
+		if err != nil {
+			return read, err
+		}
+		if n == 0 || buf[0] > streamAbort {
+			return read, errors.New("invalid stream frame")
+		}
+		if buf[0] == streamAbort {
+			return read, ErrStreamAborted
+		}
+		if writeErr == nil {
+			var m int
+			m, writeErr = w.Write(buf[1:n])
+			read += int64(m)
+		}
+		if buf[0] == streamEnd {
+			return read, writeErr
+		}
+	}
+}
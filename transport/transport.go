@@ -4,31 +4,67 @@
 // nacl/box between one party's ephemeral key and the other's long-term key is
 // used for authentication (this provides deniability). Subsequent messages are
 // encrypted using nacl/box with the message counter as an implicit nonce.
+// If both parties support it, the keys are periodically ratcheted forward so
+// that a key compromised later does not decrypt the earlier frames.
+// The key exchange is preceded by a hello in which both parties announce the
+// protocol versions and features they support.
 package transport
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/mlkem"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/nacl/box"
 )
 
-// Conn is an encrypted and authenticated connection that is NOT concurrency-safe
+// Conn is an encrypted and authenticated connection. It is safe to read and
+// write frames from different goroutines at the same time: each frame (or
+// stream) is written and read as a whole. After an error other than
+// io.ErrShortBuffer, the connection should be closed.
 type Conn struct {
-	unencrypted           net.Conn
+	unencrypted net.Conn
+
+	// readMu protects the fields that start with read, writeMu protects the
+	// ones that start with write, rekeyTimer and closed.
+	readMu, writeMu       sync.Mutex
+	readKey, writeKey     [32]byte
 	readNonce, writeNonce uint64
-	key                   [32]byte
 	readBuf, writeBuf     []byte
-	maxFrameSize          int
+
+	// writeFrames is the number of frames sent using writeKey, writeRekeyed
+	// is when it was last changed.
+	writeFrames  uint64
+	writeRekeyed time.Time
+	rekeyTimer   *time.Timer
+	closed       bool
+
+	maxFrameSize  int
+	version       uint8
+	features      uint32
+	rekeyFrames   uint64
+	rekeyInterval time.Duration
+
+	ticket  *Ticket
+	resumed bool
 }
 
 var nullNonce = [24]byte{}
 
+// handshakeFrameSize is the size of the frame in which a party proves that it
+// holds its long-term key. Smaller frame sizes can not be negotiated.
+const handshakeFrameSize = 32 + (box.Overhead + 32 + 32 + sha256.Size)
+
 // Handshake establishes an encrypted and authenticated connection. unencrypted
 // is the underlying connection that will be used for the handshake and the
 // following calls to ReadFrame and WriteFrame. The connection should not be
@@ -36,9 +72,44 @@ var nullNonce = [24]byte{}
 // private keys of the caller. If expectedPK is not nil, pk will not be
 // revealed to the other party unless they prove that they hold the secret key
 // that corresponds to expectedPK.  Note that both sides of a connection using
-// this option will result in a deadlock. The public key of the other party is
-// returned along with the wrapped connection.
+// this option will result in a deadlock. maxFrameSize is the size of the
+// largest frame the caller is willing to handle; the connection uses the
+// smaller of the values of the two parties. The public key of the other party
+// is returned along with the wrapped connection. Handshake uses DefaultConfig.
 func Handshake(unencrypted net.Conn, pk, sk, expectedPK *[32]byte, maxFrameSize int) (*Conn, *[32]byte, error) {
+	return HandshakeConfig(unencrypted, pk, sk, expectedPK, maxFrameSize, &DefaultConfig)
+}
+
+// HandshakeConfig is like Handshake, but negotiates the protocol version and
+// features with the other party according to config.
+func HandshakeConfig(unencrypted net.Conn, pk, sk, expectedPK *[32]byte, maxFrameSize int, config *Config) (*Conn, *[32]byte, error) {
+	if err := config.check(); err != nil {
+		return nil, nil, err
+	}
+	if maxFrameSize < handshakeFrameSize || uint64(maxFrameSize) > math.MaxUint32 {
+		return nil, nil, fmt.Errorf("invalid maximum frame size %d", maxFrameSize)
+	}
+	return handshake(unencrypted, nil, pk, sk, expectedPK, maxFrameSize, config)
+}
+
+// ResumeHandshake is like HandshakeConfig, but offers the other party to
+// resume the session of ticket instead of authenticating using long-term
+// keys. If the other party does not accept the ticket, a full handshake is
+// done. Tickets are received using Conn.Ticket.
+func ResumeHandshake(unencrypted net.Conn, ticket *Ticket, pk, sk, expectedPK *[32]byte, maxFrameSize int, config *Config) (*Conn, *[32]byte, error) {
+	if err := config.check(); err != nil {
+		return nil, nil, err
+	}
+	if maxFrameSize < handshakeFrameSize || uint64(maxFrameSize) > math.MaxUint32 {
+		return nil, nil, fmt.Errorf("invalid maximum frame size %d", maxFrameSize)
+	}
+	if expectedPK != nil && ticket.peerPK != *expectedPK {
+		return nil, nil, errors.New("the ticket was issued by a different party")
+	}
+	return handshake(unencrypted, ticket, pk, sk, expectedPK, maxFrameSize, config)
+}
+
+func handshake(unencrypted net.Conn, ticket *Ticket, pk, sk, expectedPK *[32]byte, maxFrameSize int, config *Config) (*Conn, *[32]byte, error) {
 	if sk == nil && pk == nil {
 		var err error
 		pk, sk, err = box.GenerateKey(rand.Reader)
@@ -49,10 +120,24 @@ func Handshake(unencrypted net.Conn, pk, sk, expectedPK *[32]byte, maxFrameSize
 	// All single-letter symbols in this comment represent public DH keys.
 	// Capital letters represent long-term and others are per-connection
 	// ephemeral. [msg](PK1<>PK2) denotes nacl/box authenticated encryption.
-	//	--> a
-	//	<-- b
-	//	<-- [B,[b,a](B<>a)](a<>b)
-	//	--> [A,[a,b](A<>b)](a<>b)
+	// h and H are the hellos of the two parties, #(h,H) is SHA-256 of them.
+	//	--> h,a
+	//	<-- H,b
+	// If both hellos include FeatureHybridKEM, both parties then send an
+	// ML-KEM encapsulation key and encapsulate a secret to the other one's:
+	//	--> k        <-- K
+	//	--> c(K)     <-- C(k)
+	// and the key (a<>b) below also depends on both encapsulated secrets.
+	//	<-- [B,[b,a,#(H,h)](B<>a)](a<>b)
+	//	--> [A,[a,b,#(h,H)](A<>b)](a<>b)
+	// If h contains a ticket that the other party accepts, the boxes are
+	// replaced by HMACs keyed with the resumption secret s in the ticket:
+	//	<-- [HMAC_s(b,a,#(H,h))](a<>b)
+	//	--> [HMAC_s(a,b,#(h,H))](a<>b)
+	// If both hellos include FeatureResumption, each party then sends a
+	// ticket for the other one (or nothing):
+	//	<-- [ticket](a<>b)
+	//	--> [ticket](a<>b)
 	//	--> [data](a<>b)
 	//	<-- [data](a<>b)
 
@@ -61,40 +146,112 @@ func Handshake(unencrypted net.Conn, pk, sk, expectedPK *[32]byte, maxFrameSize
 		return nil, nil, err
 	}
 	var theirEphemeralPublic, theirPK [32]byte
+	ours, theirs := &hello{Config: *config, maxFrameSize: maxFrameSize}, (*hello)(nil)
+	if ticket != nil {
+		ours.ticket = ticket.blob
+	}
+	ourHello, theirHello := ours.marshal(), []byte(nil)
 	var readErr, writeErr error
 	writeDone, readDone := make(chan struct{}), make(chan struct{})
-	go func() { _, writeErr = unencrypted.Write(ourEphemeralPublic[:]); close(writeDone) }()
-	go func() { _, readErr = io.ReadFull(unencrypted, theirEphemeralPublic[:]); close(readDone) }()
+	go func() {
+		_, writeErr = unencrypted.Write(append(ourHello, ourEphemeralPublic[:]...))
+		close(writeDone)
+	}()
+	go func() {
+		defer close(readDone)
+		if theirHello, theirs, readErr = readHello(unencrypted); readErr != nil {
+			return
+		}
+		_, readErr = io.ReadFull(unencrypted, theirEphemeralPublic[:])
+	}()
 	if <-writeDone; writeErr != nil {
 		return nil, nil, writeErr
 	}
 	if <-readDone; readErr != nil {
 		return nil, nil, readErr
 	}
+	version, features, maxFrameSize, err := negotiate(ours, theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	ourTranscript := sha256.Sum256(append(append([]byte{}, ourHello...), theirHello...))
+	theirTranscript := sha256.Sum256(append(append([]byte{}, theirHello...), ourHello...))
 
-	ret := &Conn{unencrypted: unencrypted, maxFrameSize: maxFrameSize,
-		readBuf:  make([]byte, binary.MaxVarintLen64+box.Overhead+maxFrameSize),
-		writeBuf: make([]byte, binary.MaxVarintLen64+box.Overhead+maxFrameSize)}
+	ret := &Conn{unencrypted: unencrypted, maxFrameSize: maxFrameSize, version: version, features: features,
+		writeRekeyed: time.Now(), rekeyFrames: config.RekeyFrames, rekeyInterval: config.RekeyInterval}
+	if ret.rekeyFrames == 0 {
+		ret.rekeyFrames = DefaultRekeyFrames
+	}
+	if ret.rekeyInterval == 0 {
+		ret.rekeyInterval = DefaultRekeyInterval
+	}
 	if bytes.Compare(ourEphemeralPublic[:], theirEphemeralPublic[:]) < 0 {
 		ret.writeNonce = 1
 	} else {
 		ret.readNonce = 1
 	}
-	box.Precompute(&ret.key, &theirEphemeralPublic, ourEphemeralSecret)
+	box.Precompute(&ret.writeKey, &theirEphemeralPublic, ourEphemeralSecret)
+	if features&FeatureHybridKEM != 0 {
+		if err := ret.hybridKEM(ourEphemeralPublic, &theirEphemeralPublic); err != nil {
+			return nil, nil, err
+		}
+	}
+	secret := resumptionSecret(&ret.writeKey)
+	ret.readKey = ret.writeKey
+	if features&FeatureRekey != 0 {
+		ret.splitKeys(ret.writeNonce == 1)
+	}
+
+	// offered is whether the other party may accept our ticket, and
+	// theirSecret is set if we accepted theirs
+	offered := ticket != nil && features&FeatureResumption != 0
+	var theirSecret *[32]byte
+	if ticket == nil && theirs.ticket != nil && config.TicketKey != nil && features&FeatureResumption != 0 {
+		if peerPK, s, err := openTicket(config.TicketKey, theirs.ticket); err == nil {
+			theirPK, theirSecret, ret.resumed = *peerPK, s, true
+		}
+	}
 
 	writeDone, readDone = make(chan struct{}), make(chan struct{})
 	go func() {
 		defer close(readDone)
-		var theirHandshake [32 + (box.Overhead + 32 + 32)]byte // theirPK, box(theirEphPK, ourEphPK)
-		if _, readErr = ret.ReadFrame(theirHandshake[:]); readErr != nil {
+		var theirHandshake [handshakeFrameSize]byte // theirPK, box(theirEphPK, ourEphPK, transcript)
+		n, err := ret.ReadFrame(theirHandshake[:])
+		if readErr = err; readErr != nil {
+			return
+		}
+		if n == sha256.Size && (theirSecret != nil || offered) {
+			s := theirSecret
+			if offered {
+				s = &ticket.secret
+			}
+			if !hmac.Equal(theirHandshake[:n], resumptionProof(s, &theirEphemeralPublic, ourEphemeralPublic, theirTranscript[:])) {
+				readErr = errors.New("authentication failed (invalid resumption proof)")
+				return
+			}
+			if offered {
+				theirPK, ret.resumed = ticket.peerPK, true
+			}
+			return
+		}
+		if theirSecret != nil {
+			readErr = errors.New("authentication failed (expected a resumption proof)")
+			return
+		}
+		if n != len(theirHandshake) {
+			readErr = errors.New("authentication failed (malformed handshake)")
 			return
 		}
 		copy(theirPK[:], theirHandshake[:32])
 		hs, ok := box.Open(nil, theirHandshake[32:], &nullNonce, &theirPK, ourEphemeralSecret)
-		if !ok || !bytes.Equal(hs, append(theirEphemeralPublic[:], ourEphemeralPublic[:]...)) {
+		if !ok || !bytes.Equal(hs[:64], append(theirEphemeralPublic[:], ourEphemeralPublic[:]...)) {
 			readErr = errors.New("authentication failed (ephemeral pk mismatch)")
 			return
 		}
+		if !bytes.Equal(hs[64:], theirTranscript[:]) {
+			readErr = errors.New("authentication failed (hello mismatch, possible downgrade attack)")
+			return
+		}
 		if bytes.Equal(theirPK[:], pk[:]) {
 			readErr = errors.New("we are talking to a mirror")
 			return
@@ -106,13 +263,23 @@ func Handshake(unencrypted net.Conn, pk, sk, expectedPK *[32]byte, maxFrameSize
 	}()
 	go func() {
 		defer close(writeDone)
-		ourHandshake := box.Seal(pk[:], append(ourEphemeralPublic[:], theirEphemeralPublic[:]...),
+		if theirSecret != nil {
+			_, writeErr = ret.WriteFrame(resumptionProof(theirSecret, ourEphemeralPublic, &theirEphemeralPublic, ourTranscript[:]))
+			return
+		}
+		ourHandshake := box.Seal(pk[:], append(append(ourEphemeralPublic[:], theirEphemeralPublic[:]...), ourTranscript[:]...),
 			&nullNonce, &theirEphemeralPublic, sk)
-		if expectedPK != nil {
-			if <-readDone; readErr != nil { // only talk to the right server
+		// only talk to the right server, and only after learning whether
+		// it accepted our ticket
+		if expectedPK != nil || offered {
+			if <-readDone; readErr != nil {
 				return
 			}
 		}
+		if ret.resumed {
+			_, writeErr = ret.WriteFrame(resumptionProof(&ticket.secret, ourEphemeralPublic, &theirEphemeralPublic, ourTranscript[:]))
+			return
+		}
 		_, writeErr = ret.WriteFrame(ourHandshake)
 	}()
 	if <-readDone; readErr != nil {
@@ -124,24 +291,187 @@ func Handshake(unencrypted net.Conn, pk, sk, expectedPK *[32]byte, maxFrameSize
 	for i := range ourEphemeralSecret {
 		ourEphemeralSecret[i] = 0
 	}
+	if features&FeatureResumption != 0 {
+		if err := ret.exchangeTickets(&theirPK, secret, config); err != nil {
+			return nil, nil, err
+		}
+	}
+	if features&FeatureRekey != 0 {
+		ret.writeMu.Lock()
+		ret.rekeyTimer = time.AfterFunc(ret.rekeyInterval, ret.rekeyIfIdle)
+		ret.writeMu.Unlock()
+	}
 	return ret, &theirPK, nil
 }
 
+var hybridKEMLabel = []byte("chatterbox transport hybrid kem")
+
+// hybridKEM runs an ML-KEM-768 key exchange in each direction and mixes both
+// shared secrets into c.writeKey. The KEM messages are not authenticated by
+// themselves, but if they are tampered with, the two parties end up with
+// different keys and the rest of the handshake fails.
+func (c *Conn) hybridKEM(ourEphemeralPublic, theirEphemeralPublic *[32]byte) error {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return err
+	}
+	theirEncapsulationKey := make([]byte, mlkem.EncapsulationKeySize768)
+	if err := exchange(c.unencrypted, dk.EncapsulationKey().Bytes(), theirEncapsulationKey); err != nil {
+		return err
+	}
+	ek, err := mlkem.NewEncapsulationKey768(theirEncapsulationKey)
+	if err != nil {
+		return err
+	}
+	theirShared, ourCiphertext := ek.Encapsulate()
+	theirCiphertext := make([]byte, mlkem.CiphertextSize768)
+	if err := exchange(c.unencrypted, ourCiphertext, theirCiphertext); err != nil {
+		return err
+	}
+	ourShared, err := dk.Decapsulate(theirCiphertext)
+	if err != nil {
+		return err
+	}
+	// the secret encapsulated to the party with the smaller ephemeral key
+	// goes first so that both parties compute the same key
+	first, second := ourShared, theirShared
+	if bytes.Compare(ourEphemeralPublic[:], theirEphemeralPublic[:]) > 0 {
+		first, second = theirShared, ourShared
+	}
+	h := hmac.New(sha256.New, c.writeKey[:])
+	h.Write(hybridKEMLabel)
+	h.Write(first)
+	h.Write(second)
+	h.Sum(c.writeKey[:0])
+	return nil
+}
+
+// exchange writes out to conn while reading len(in) bytes from it.
+func exchange(conn net.Conn, out, in []byte) error {
+	writeErr := make(chan error, 1)
+	go func() { _, err := conn.Write(out); writeErr <- err }()
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return err
+	}
+	return <-writeErr
+}
+
 // WriteFrame(b) writes the frame to the connection in a length-value-encoded
 // for so it can be read using ReadFrame on the other side. Returns len(b).
+// Frames can not be larger than MaxFrameSize.
 func (c *Conn) WriteFrame(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrame(b)
+}
+
+func (c *Conn) writeFrame(b []byte) (int, error) {
 	if len(b) > c.maxFrameSize {
 		return 0, errors.New("write frame too large")
 	}
+	if c.features&FeatureRekey != 0 && c.writeFrames >= c.rekeyFrames {
+		if err := c.rekey(); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.seal(frameData, b); err != nil {
+		return 0, err
+	}
+	c.writeFrames++
+	return len(b), nil
+}
+
+// If FeatureRekey is negotiated, the length of each frame is shifted left by
+// one bit and the lowest bit tells whether the frame carries data or is a
+// rekey control frame. The kind is also included in the nonce, so frames
+// whose kind has been tampered with fail to authenticate.
+const (
+	frameData byte = iota
+	frameRekey
+)
+
+func (c *Conn) seal(kind byte, b []byte) error {
 	var nonce [24]byte
 	binary.LittleEndian.PutUint64(nonce[:], c.writeNonce)
+	nonce[8] = kind
 	c.writeNonce += 2
-	i := binary.PutUvarint(c.writeBuf, uint64(box.Overhead+len(b)))
-	buf := box.SealAfterPrecomputation(c.writeBuf[:i], b, &nonce, &c.key)
-	if _, err := c.unencrypted.Write(buf); err != nil {
-		return 0, err
+	if size := binary.MaxVarintLen64 + box.Overhead + len(b); cap(c.writeBuf) < size {
+		c.writeBuf = make([]byte, size)
+	}
+	c.writeBuf = c.writeBuf[:cap(c.writeBuf)]
+	header := uint64(box.Overhead + len(b))
+	if c.features&FeatureRekey != 0 {
+		header = header<<1 | uint64(kind)
+	}
+	i := binary.PutUvarint(c.writeBuf, header)
+	buf := box.SealAfterPrecomputation(c.writeBuf[:i], b, &nonce, &c.writeKey)
+	_, err := c.unencrypted.Write(buf)
+	return err
+}
+
+var rekeyLabel = []byte("chatterbox transport rekey")
+
+var (
+	lowerKeyLabel  = []byte("chatterbox transport lower")
+	higherKeyLabel = []byte("chatterbox transport higher")
+)
+
+// splitKeys replaces the key shared by both directions with one key for each
+// direction, derived with HMAC-SHA256 over lowerKeyLabel for the party whose
+// ephemeral key is smaller and over higherKeyLabel for the other one. Once a
+// party ratchets its sending key, no key it still has decrypts what it sent.
+func (c *Conn) splitKeys(lower bool) {
+	var lowerKey, higherKey [32]byte
+	h := hmac.New(sha256.New, c.writeKey[:])
+	h.Write(lowerKeyLabel)
+	h.Sum(lowerKey[:0])
+	h = hmac.New(sha256.New, c.writeKey[:])
+	h.Write(higherKeyLabel)
+	h.Sum(higherKey[:0])
+	if lower {
+		c.writeKey, c.readKey = lowerKey, higherKey
+	} else {
+		c.writeKey, c.readKey = higherKey, lowerKey
+	}
+}
+
+// ratchet replaces key with HMAC-SHA256 keyed with key over rekeyLabel. The
+// old key can not be computed from the new one.
+func ratchet(key *[32]byte) {
+	h := hmac.New(sha256.New, key[:])
+	h.Write(rekeyLabel)
+	h.Sum(key[:0])
+}
+
+// rekey tells the other party that we are switching to the next sending key
+// and switches to it. The other party ratchets its receiving key when it
+// reads the control frame. The caller must hold writeMu.
+func (c *Conn) rekey() error {
+	if err := c.seal(frameRekey, nil); err != nil {
+		return err
+	}
+	ratchet(&c.writeKey)
+	c.writeFrames = 0
+	c.writeRekeyed = time.Now()
+	return nil
+}
+
+// rekeyIfIdle runs every rekeyInterval so that the sending key is replaced
+// even if nothing is written for a long time.
+func (c *Conn) rekeyIfIdle() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return
+	}
+	if wait := c.rekeyInterval - time.Since(c.writeRekeyed); wait > 0 {
+		c.rekeyTimer.Reset(wait)
+		return
+	}
+	// if sending fails, so will the next call to WriteFrame
+	if c.rekey() == nil {
+		c.rekeyTimer.Reset(c.rekeyInterval)
 	}
-	return len(b), nil
 }
 
 type byteReader struct{ io.Reader }
@@ -153,34 +483,88 @@ func (r byteReader) ReadByte() (byte, error) {
 }
 
 // ReadFrame(b) reads a single frame into b and returns an integer n such that
-// b[:n] is the frame after possibly modifying b. If b does not have enough
-// space (maxFrameSize bytes), this function may panic.
+// b[:n] is the frame after possibly modifying b. If the frame does not fit in
+// b, it is skipped and io.ErrShortBuffer is returned. A buffer of MaxFrameSize
+// bytes is always large enough.
 func (c *Conn) ReadFrame(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.readFrame(b)
+}
+
+func (c *Conn) readFrame(b []byte) (int, error) {
+	for {
+		kind, n, err := c.open(b)
+		if err != nil || kind == frameData {
+			return n, err
+		}
+		if n != 0 {
+			return 0, errors.New("received malformed rekey frame")
+		}
+		ratchet(&c.readKey)
+	}
+}
+
+func (c *Conn) open(b []byte) (byte, int, error) {
 	var nonce [24]byte
 	binary.LittleEndian.PutUint64(nonce[:], c.readNonce)
 	c.readNonce += 2
 	size, err := binary.ReadUvarint(byteReader{c.unencrypted})
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	kind := frameData
+	if c.features&FeatureRekey != 0 {
+		kind, size = byte(size&1), size>>1
+	}
+	nonce[8] = kind
+	if size < box.Overhead || size > uint64(box.Overhead+c.maxFrameSize) {
+		return 0, 0, fmt.Errorf("received frame of invalid size %d", size)
+	}
+	if cap(c.readBuf) < int(size) {
+		c.readBuf = make([]byte, size)
 	}
 	if _, err := io.ReadFull(c.unencrypted, c.readBuf[:size]); err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	b2, ok := box.OpenAfterPrecomputation(b[:0], c.readBuf[:size], &nonce, &c.key)
-	if !ok {
-		return 0, errors.New("authentication failed")
+	n := int(size) - box.Overhead
+	if len(b) < n {
+		return 0, 0, io.ErrShortBuffer
 	}
-	if &b[0] != &b2[0] {
-		panic("ReadFrame buffer space accounting failed")
+	// b has enough space, so the frame is decrypted in place
+	if _, ok := box.OpenAfterPrecomputation(b[:0], c.readBuf[:size], &nonce, &c.readKey); !ok {
+		return 0, 0, errors.New("authentication failed")
 	}
-	return int(size - box.Overhead), nil
+	return kind, n, nil
 }
 
+// MaxFrameSize returns the size of the largest frame that can be sent or
+// received on the connection, as negotiated during the handshake.
+func (c *Conn) MaxFrameSize() int { return c.maxFrameSize }
+
+// Version returns the protocol version negotiated during the handshake.
+func (c *Conn) Version() uint8 { return c.version }
+
+// Features returns the optional features that both parties support.
+func (c *Conn) Features() uint32 { return c.features }
+
+// Close closes the underlying connection, which makes concurrent calls to
+// other methods return, and then erases the keys.
 func (c *Conn) Close() error {
-	for i := range c.key {
-		c.key[i] = 0
+	err := c.unencrypted.Close()
+	c.readMu.Lock()
+	c.writeMu.Lock()
+	c.closed = true
+	if c.rekeyTimer != nil {
+		c.rekeyTimer.Stop()
+	}
+	for i := range c.readKey {
+		c.readKey[i] = 0
+		c.writeKey[i] = 0
 	}
-	return c.unencrypted.Close()
+	c.writeMu.Unlock()
+	c.readMu.Unlock()
+	return err
 }
 
 func (c *Conn) SetDeadline(t time.Time) error      { return c.unencrypted.SetDeadline(t) }
@@ -3,8 +3,15 @@ package transport
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 )
@@ -79,3 +86,497 @@ func TestReadWriteFrame(t *testing.T) {
 		c1, c2 = c2, c1
 	}
 }
+
+func runConfigHandshake(config1, config2 *Config) (c1, c2 *Conn, err1, err2 error) {
+	p1, p2 := net.Pipe()
+	return runConfigHandshakeOver(p1, p2, config1, config2)
+}
+
+// runConfigHandshakeOver runs handshake directly so that the tests can
+// pretend to be a peer that implements a later version of the protocol.
+func runConfigHandshakeOver(p1, p2 net.Conn, config1, config2 *Config) (c1, c2 *Conn, err1, err2 error) {
+	ch1, ch2 := make(chan struct{}), make(chan struct{})
+	pk1, sk1, _ := box.GenerateKey(rand.Reader)
+	pk2, sk2, _ := box.GenerateKey(rand.Reader)
+	go func() { c1, _, err1 = handshake(p1, nil, pk1, sk1, nil, 1<<12, config1); close(ch1); p1.Close() }()
+	go func() { c2, _, err2 = handshake(p2, nil, pk2, sk2, nil, 1<<12, config2); close(ch2); p2.Close() }()
+	<-ch1
+	<-ch2
+	return
+}
+
+func TestNegotiateNewerPeer(t *testing.T) {
+	c1, c2, err1, err2 := runConfigHandshake(&Config{MinVersion: 1, MaxVersion: 1, Features: 3},
+		&Config{MinVersion: 1, MaxVersion: 7, Features: 6})
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	for _, c := range []*Conn{c1, c2} {
+		if c.Version() != 1 {
+			t.Errorf("negotiated version %d, want 1", c.Version())
+		}
+		if c.Features() != 2 {
+			t.Errorf("negotiated features %x, want 2", c.Features())
+		}
+	}
+}
+
+func TestNegotiateNoCommonVersion(t *testing.T) {
+	_, _, err1, err2 := runConfigHandshake(&Config{MinVersion: 1, MaxVersion: 1},
+		&Config{MinVersion: 2, MaxVersion: 3})
+	if err1 == nil || err2 == nil {
+		t.Fatal("handshake between incompatible versions succeeded")
+	}
+}
+
+func TestHandshakeConfigRejectsUnimplementedVersion(t *testing.T) {
+	p1, _ := net.Pipe()
+	if _, _, err := HandshakeConfig(p1, nil, nil, nil, 1<<12, &Config{MinVersion: 1, MaxVersion: Version + 1}); err == nil {
+		t.Error("HandshakeConfig accepted an unimplemented version")
+	}
+}
+
+func TestUnversionedPeer(t *testing.T) {
+	p1, p2 := net.Pipe()
+	go io.Copy(ioutil.Discard, p2)
+	go func() {
+		var ephemeral [32]byte
+		rand.Read(ephemeral[:])
+		p2.Write(ephemeral[:])
+	}()
+	if _, _, err := Handshake(p1, nil, nil, nil, 1<<12); err == nil {
+		t.Error("handshake with an unversioned peer succeeded")
+	}
+}
+
+// TestDowngrade checks that a man in the middle who removes a feature from
+// one of the hellos makes the handshake fail.
+func TestDowngrade(t *testing.T) {
+	// 1<<7 does not change the rest of the handshake, the others do
+	for _, feature := range []uint32{1 << 7, FeatureHybridKEM, FeatureRekey, FeatureResumption} {
+		p1, m1 := net.Pipe()
+		m2, p2 := net.Pipe()
+		go func() {
+			raw, _, err := readHello(m1)
+			if err != nil {
+				return
+			}
+			raw[len(helloMagic)+1+5] = 0 // clear the low byte of Features
+			m2.Write(raw)
+			io.Copy(m2, m1)
+			m2.Close()
+		}()
+		go func() { io.Copy(m1, m2); m1.Close() }()
+		// if the parties disagree on the features, they may also disagree on
+		// how much the other one is going to send
+		p1.SetDeadline(time.Now().Add(time.Second))
+		p2.SetDeadline(time.Now().Add(time.Second))
+		config := &Config{MinVersion: 1, MaxVersion: 1, Features: feature}
+		c1, c2, err1, err2 := runConfigHandshakeOver(p1, p2, config, config)
+		if err1 == nil && err2 == nil {
+			t.Fatalf("handshake succeeded with features %x and %x", c1.Features(), c2.Features())
+		}
+	}
+}
+
+func TestHybridKEM(t *testing.T) {
+	for _, tc := range []struct {
+		config1, config2 *Config
+		hybrid           bool
+	}{
+		{&HybridConfig, &HybridConfig, true},
+		{&HybridConfig, &DefaultConfig, false},
+		{&DefaultConfig, &HybridConfig, false},
+	} {
+		c1, c2, err1, err2 := runConfigHandshake(tc.config1, tc.config2)
+		if err1 != nil || err2 != nil {
+			t.Fatal(err1, err2)
+		}
+		if (c1.Features()&FeatureHybridKEM != 0) != tc.hybrid || c1.Features() != c2.Features() {
+			t.Errorf("negotiated features %x and %x, want hybrid=%v", c1.Features(), c2.Features(), tc.hybrid)
+		}
+		if c1.writeKey != c2.readKey {
+			t.Error("the parties derived different keys")
+		}
+	}
+}
+
+func TestNegotiateFrameSize(t *testing.T) {
+	ch1, ch2 := make(chan struct{}), make(chan struct{})
+	p1, p2 := net.Pipe()
+	var c1, c2 *Conn
+	var err1, err2 error
+	go func() { c1, _, err1 = Handshake(p1, nil, nil, nil, 1<<12); close(ch1) }()
+	go func() { c2, _, err2 = Handshake(p2, nil, nil, nil, 1<<10); close(ch2) }()
+	<-ch1
+	<-ch2
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	if c1.MaxFrameSize() != 1<<10 || c2.MaxFrameSize() != 1<<10 {
+		t.Errorf("negotiated frame sizes %d and %d, want %d", c1.MaxFrameSize(), c2.MaxFrameSize(), 1<<10)
+	}
+	if _, err := c1.WriteFrame(make([]byte, 1<<10+1)); err == nil {
+		t.Error("wrote a frame larger than the negotiated size")
+	}
+
+	// hellos from before frame-size negotiation do not announce one
+	ours := &hello{Config: DefaultConfig, maxFrameSize: 1 << 12}
+	if _, _, size, err := negotiate(ours, &hello{Config: DefaultConfig}); err != nil || size != 1<<12 {
+		t.Errorf("negotiated frame size %d with a peer that did not announce one (%v)", size, err)
+	}
+}
+
+// TestHelloFields checks that fields with unknown tags are skipped and that
+// the ticket is found next to them.
+func TestHelloFields(t *testing.T) {
+	ticket := []byte("ticket")
+	raw := (&hello{Config: DefaultConfig, maxFrameSize: 1 << 12, ticket: ticket}).marshal()
+	raw = append(raw, 0xff, 3, 'n', 'e', 'w')
+	raw[len(helloMagic)] += 5
+	_, h, err := readHello(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.ticket, ticket) || h.maxFrameSize != 1<<12 {
+		t.Errorf("read ticket %q and frame size %d", h.ticket, h.maxFrameSize)
+	}
+
+	raw = raw[:len(raw)-1]
+	raw[len(helloMagic)]--
+	if _, _, err := readHello(bytes.NewReader(raw)); err == nil {
+		t.Error("read a hello whose last field overruns it")
+	}
+}
+
+func TestReadFrameShortBuffer(t *testing.T) {
+	c1, c2 := runHandshake(t, false)
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		c1.WriteFrame([]byte("a long frame"))
+		c1.WriteFrame([]byte("short"))
+	}()
+	var buf [5]byte
+	if _, err := c2.ReadFrame(buf[:]); err != io.ErrShortBuffer {
+		t.Errorf("reading into a short buffer: %v", err)
+	}
+	if n, err := c2.ReadFrame(buf[:]); err != nil || string(buf[:n]) != "short" {
+		t.Errorf("read %q after a short buffer (%v)", buf[:n], err)
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	c1, c2 := runHandshake(t, false)
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		var size [binary.MaxVarintLen64]byte
+		c1.unencrypted.Write(size[:binary.PutUvarint(size[:], 1<<40)])
+	}()
+	buf := make([]byte, c2.MaxFrameSize())
+	if _, err := c2.ReadFrame(buf); err == nil {
+		t.Error("accepted a frame larger than the negotiated size")
+	}
+}
+
+func TestStream(t *testing.T) {
+	c1, c2 := runHandshake(t, false)
+	defer c1.Close()
+	defer c2.Close()
+	for _, size := range []int{0, 1, c1.MaxFrameSize() - 1, 10 * (c1.MaxFrameSize() - 1), 100000} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := c1.WriteStream(bytes.NewReader(payload))
+			writeErr <- err
+		}()
+		var received bytes.Buffer
+		n, err := c2.ReadStream(&received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-writeErr; err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(size) || !bytes.Equal(received.Bytes(), payload) {
+			t.Errorf("sent %d bytes, received %d", size, n)
+		}
+	}
+}
+
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("read failed")
+	}
+	if len(b) > r.n {
+		b = b[:r.n]
+	}
+	r.n -= len(b)
+	return len(b), nil
+}
+
+func TestStreamAborted(t *testing.T) {
+	c1, c2 := runHandshake(t, false)
+	defer c1.Close()
+	defer c2.Close()
+	go c1.WriteStream(&failingReader{3 * c1.MaxFrameSize()})
+	if _, err := c2.ReadStream(ioutil.Discard); err != ErrStreamAborted {
+		t.Errorf("reading an aborted stream: %v", err)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	c1, c2 := runHandshake(t, false)
+	defer c1.Close()
+	defer c2.Close()
+	const writers, frames = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < frames; j++ {
+				if _, err := c1.WriteFrame([]byte(fmt.Sprintf("%d %d", i, j))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	// c1 also receives while it is being written to
+	go func() {
+		for i := 0; i < frames; i++ {
+			c2.WriteFrame([]byte("reply"))
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, c1.MaxFrameSize())
+		for i := 0; i < frames; i++ {
+			if _, err := c1.ReadFrame(buf); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	seen := make(map[string]bool)
+	buf := make([]byte, c2.MaxFrameSize())
+	for i := 0; i < writers*frames; i++ {
+		n, err := c2.ReadFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[string(buf[:n])] {
+			t.Errorf("received %q twice", buf[:n])
+		}
+		seen[string(buf[:n])] = true
+	}
+	wg.Wait()
+}
+
+func TestCloseWhileReading(t *testing.T) {
+	c1, c2 := runHandshake(t, false)
+	defer c2.Close()
+	done := make(chan error)
+	go func() {
+		buf := make([]byte, c1.MaxFrameSize())
+		_, err := c1.ReadFrame(buf)
+		done <- err
+	}()
+	c1.Close()
+	if err := <-done; err == nil {
+		t.Error("ReadFrame on a closed connection succeeded")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	config := &Config{MinVersion: 1, MaxVersion: 1, Features: FeatureRekey, RekeyFrames: 3}
+	p1, p2 := net.Pipe()
+	c1, c2, err1, err2 := runRekeyHandshake(p1, p2, config)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	// after c1 rekeys, it must not keep its old sending key as its receiving key
+	if c1.readKey == c1.writeKey {
+		t.Error("both directions use the same key")
+	}
+	if c1.writeKey != c2.readKey || c1.readKey != c2.writeKey {
+		t.Error("the parties derived different keys")
+	}
+	initialKey := c1.writeKey
+	go func() {
+		for i := 0; i < 10; i++ {
+			c1.WriteFrame([]byte(fmt.Sprintf("frame %d", i)))
+		}
+	}()
+	buf := make([]byte, c2.MaxFrameSize())
+	for i := 0; i < 10; i++ {
+		n, err := c2.ReadFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("frame %d", i); string(buf[:n]) != want {
+			t.Errorf("read %q, want %q", buf[:n], want)
+		}
+	}
+	c1.writeMu.Lock()
+	defer c1.writeMu.Unlock()
+	if c1.writeKey == initialKey {
+		t.Error("the sending key was not replaced")
+	}
+	if c1.writeKey != c2.readKey {
+		t.Error("the parties ratcheted to different keys")
+	}
+}
+
+func TestRekeyIdle(t *testing.T) {
+	config := &Config{MinVersion: 1, MaxVersion: 1, Features: FeatureRekey, RekeyInterval: 10 * time.Millisecond}
+	p1, p2 := net.Pipe()
+	c1, c2, err1, err2 := runRekeyHandshake(p1, p2, config)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	initialKey := c2.readKey
+	done := make(chan error)
+	buf := make([]byte, c2.MaxFrameSize())
+	go func() {
+		_, err := c2.ReadFrame(buf)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c1.WriteFrame([]byte("fish"))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if c2.readKey == initialKey {
+		t.Error("the sending key of an idle connection was not replaced")
+	}
+}
+
+// runRekeyHandshake is like runConfigHandshakeOver, but leaves the
+// connections open.
+func runRekeyHandshake(p1, p2 net.Conn, config *Config) (c1, c2 *Conn, err1, err2 error) {
+	ch1, ch2 := make(chan struct{}), make(chan struct{})
+	go func() { c1, _, err1 = HandshakeConfig(p1, nil, nil, nil, 1<<12, config); close(ch1) }()
+	go func() { c2, _, err2 = HandshakeConfig(p2, nil, nil, nil, 1<<12, config); close(ch2) }()
+	<-ch1
+	<-ch2
+	return
+}
+
+// runResumeHandshake runs a handshake in which the client offers ticket (if
+// it is not nil) and returns the connections and the public keys each side
+// observed.
+func runResumeHandshake(t *testing.T, ticket *Ticket, clientPK, clientSK, serverPK, serverSK *[32]byte,
+	clientConfig, serverConfig *Config) (client, server *Conn, serverPK_c, clientPK_s *[32]byte) {
+	ch1, ch2 := make(chan struct{}), make(chan struct{})
+	p1, p2 := net.Pipe()
+	var err1, err2 error
+	go func() {
+		if ticket != nil {
+			client, serverPK_c, err1 = ResumeHandshake(p1, ticket, clientPK, clientSK, serverPK, 1<<12, clientConfig)
+		} else {
+			client, serverPK_c, err1 = HandshakeConfig(p1, clientPK, clientSK, serverPK, 1<<12, clientConfig)
+		}
+		close(ch1)
+	}()
+	go func() {
+		server, clientPK_s, err2 = HandshakeConfig(p2, serverPK, serverSK, nil, 1<<12, serverConfig)
+		close(ch2)
+	}()
+	<-ch1
+	<-ch2
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	return
+}
+
+func TestResume(t *testing.T) {
+	clientPK, clientSK, _ := box.GenerateKey(rand.Reader)
+	serverPK, serverSK, _ := box.GenerateKey(rand.Reader)
+	var ticketKey [32]byte
+	rand.Read(ticketKey[:])
+	serverConfig := DefaultConfig
+	serverConfig.TicketKey = &ticketKey
+
+	c1, c2, _, _ := runResumeHandshake(t, nil, clientPK, clientSK, serverPK, serverSK, &DefaultConfig, &serverConfig)
+	c1.Close()
+	c2.Close()
+	if c2.Ticket() != nil {
+		t.Error("the client issued a ticket")
+	}
+	ticket := c1.Ticket()
+	if ticket == nil || *ticket.PeerPK() != *serverPK {
+		t.Fatal("the server did not issue a ticket")
+	}
+
+	// the long-term keys are not used for resumption
+	c1, c2, serverPK_c, clientPK_s := runResumeHandshake(t, ticket, nil, nil, serverPK, nil, &DefaultConfig, &serverConfig)
+	defer c1.Close()
+	defer c2.Close()
+	if !c1.Resumed() || !c2.Resumed() {
+		t.Fatal("the session was not resumed")
+	}
+	if *serverPK_c != *serverPK || *clientPK_s != *clientPK {
+		t.Error("the resumed connection is not authenticated as the original one")
+	}
+	if c1.Ticket() == nil || bytes.Equal(c1.Ticket().blob, ticket.blob) {
+		t.Error("the server did not issue a new ticket")
+	}
+	go c1.WriteFrame([]byte("fish"))
+	var buf [8]byte
+	if n, err := c2.ReadFrame(buf[:]); err != nil || string(buf[:n]) != "fish" {
+		t.Errorf("read %q on a resumed connection (%v)", buf[:n], err)
+	}
+}
+
+func TestResumeRejected(t *testing.T) {
+	clientPK, clientSK, _ := box.GenerateKey(rand.Reader)
+	serverPK, serverSK, _ := box.GenerateKey(rand.Reader)
+	var ticketKey, otherTicketKey [32]byte
+	rand.Read(ticketKey[:])
+	rand.Read(otherTicketKey[:])
+	serverConfig := DefaultConfig
+	serverConfig.TicketKey = &ticketKey
+	expiredConfig := serverConfig
+	expiredConfig.TicketLifetime = -time.Hour
+	restartedConfig := serverConfig
+	restartedConfig.TicketKey = &otherTicketKey
+	oldConfig := restartedConfig
+	oldConfig.Features = 0
+
+	for _, tc := range []struct {
+		name                       string
+		issuerConfig, serverConfig *Config
+	}{
+		{"expired", &expiredConfig, &serverConfig},
+		{"different ticket key", &serverConfig, &restartedConfig},
+		{"no resumption support", &serverConfig, &oldConfig},
+	} {
+		c1, c2, _, _ := runResumeHandshake(t, nil, clientPK, clientSK, serverPK, serverSK, &DefaultConfig, tc.issuerConfig)
+		c1.Close()
+		c2.Close()
+		c1, c2, _, clientPK_s := runResumeHandshake(t, c1.Ticket(), clientPK, clientSK, serverPK, serverSK, &DefaultConfig, tc.serverConfig)
+		c1.Close()
+		c2.Close()
+		if c1.Resumed() || c2.Resumed() {
+			t.Errorf("%s: the session was resumed", tc.name)
+		}
+		if *clientPK_s != *clientPK {
+			t.Errorf("%s: the full handshake did not authenticate the client", tc.name)
+		}
+	}
+}
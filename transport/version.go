@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version is the latest transport protocol version implemented by this
+// package.
+const Version = 1
+
+// Config describes which protocol versions and optional features a party is
+// willing to use. The two sides of a connection pick the highest version that
+// both of them support and the features that both of them list.
+type Config struct {
+	MinVersion, MaxVersion uint8
+	Features               uint32
+
+	// RekeyFrames and RekeyInterval bound the number of frames and the time
+	// for which a key is used for sending if FeatureRekey is negotiated. They
+	// are not announced to the other party. Zero means DefaultRekeyFrames
+	// and DefaultRekeyInterval.
+	RekeyFrames   uint64
+	RekeyInterval time.Duration
+
+	// If TicketKey is set and FeatureResumption is negotiated, the party
+	// issues the other one a ticket encrypted using TicketKey, and accepts
+	// tickets encrypted using it to resume sessions (see ResumeHandshake).
+	// The tickets expire after TicketLifetime, which defaults to
+	// DefaultTicketLifetime.
+	TicketKey      *[32]byte
+	TicketLifetime time.Duration
+}
+
+// Optional features that can be negotiated in Config.Features.
+const (
+	// FeatureHybridKEM mixes the shared secrets of an ML-KEM-768 exchange in
+	// both directions into the connection key (see hybridKEM).
+	FeatureHybridKEM uint32 = 1 << iota
+	// FeatureRekey makes each party periodically replace its sending key
+	// with one derived from it (see rekey).
+	FeatureRekey
+	// FeatureResumption makes the parties exchange resumption tickets after
+	// the handshake (see Ticket).
+	FeatureResumption
+)
+
+const (
+	DefaultRekeyFrames    = 1 << 16
+	DefaultRekeyInterval  = time.Hour
+	DefaultTicketLifetime = 24 * time.Hour
+)
+
+// DefaultConfig is used by Handshake.
+var DefaultConfig = Config{MinVersion: 1, MaxVersion: Version, Features: FeatureRekey | FeatureResumption}
+
+// HybridConfig is like DefaultConfig, but also protects the connection
+// against an adversary who records it and later gets a quantum computer.
+var HybridConfig = Config{MinVersion: 1, MaxVersion: Version,
+	Features: FeatureHybridKEM | FeatureRekey | FeatureResumption}
+
+// Before anything else, both sides send a hello that describes their Config:
+// the magic "cbtp", a length byte, MinVersion, MaxVersion and Features (as a
+// big-endian uint32), followed by the largest frame the party is willing to
+// handle (also a big-endian uint32). Any further fields are covered by length
+// and tagged: each is a tag byte, a length byte and the value. A party that
+// resumes a session sends its ticket in a helloTicket field. Fields with
+// unknown tags are skipped, so future versions can add their own. The hellos
+// are not authenticated when they are received, instead a hash of both of
+// them is included in the boxes of the key exchange (see Handshake).
+var helloMagic = [4]byte{'c', 'b', 't', 'p'}
+
+const (
+	helloMinLength = 1 + 1 + 4
+	// hellos sent before frame-size negotiation was introduced end before
+	// the frame size
+	helloFrameSizeLength = helloMinLength + 4
+
+	helloTicket = 1
+)
+
+type hello struct {
+	Config
+	// maxFrameSize is 0 if the other party did not announce it
+	maxFrameSize int
+	ticket       []byte
+}
+
+func (h *hello) marshal() []byte {
+	length := helloFrameSizeLength
+	if h.ticket != nil {
+		length += 2 + len(h.ticket)
+	}
+	ret := make([]byte, len(helloMagic)+1+length)
+	copy(ret, helloMagic[:])
+	ret[len(helloMagic)] = byte(length)
+	ret[len(helloMagic)+1] = h.MinVersion
+	ret[len(helloMagic)+2] = h.MaxVersion
+	binary.BigEndian.PutUint32(ret[len(helloMagic)+3:], h.Features)
+	binary.BigEndian.PutUint32(ret[len(helloMagic)+7:], uint32(h.maxFrameSize))
+	if h.ticket != nil {
+		field := ret[len(helloMagic)+1+helloFrameSizeLength:]
+		field[0], field[1] = helloTicket, byte(len(h.ticket))
+		copy(field[2:], h.ticket)
+	}
+	return ret
+}
+
+func (config *Config) check() error {
+	if config.MinVersion == 0 || config.MinVersion > config.MaxVersion {
+		return fmt.Errorf("invalid transport version range %d-%d", config.MinVersion, config.MaxVersion)
+	}
+	if config.MaxVersion > Version {
+		return fmt.Errorf("transport version %d is not implemented", config.MaxVersion)
+	}
+	return nil
+}
+
+// readHello reads the hello of the other party and returns both the raw
+// bytes (for the transcript) and their contents.
+func readHello(r io.Reader) ([]byte, *hello, error) {
+	var header [len(helloMagic) + 1]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:len(helloMagic)], helloMagic[:]) {
+		return nil, nil, errors.New("the other party does not speak a versioned transport protocol")
+	}
+	length := int(header[len(helloMagic)])
+	if length < helloMinLength {
+		return nil, nil, errors.New("hello too short")
+	}
+	raw := make([]byte, len(header)+length)
+	copy(raw, header[:])
+	if _, err := io.ReadFull(r, raw[len(header):]); err != nil {
+		return nil, nil, err
+	}
+	body := raw[len(header):]
+	ret := &hello{Config: Config{
+		MinVersion: body[0],
+		MaxVersion: body[1],
+		Features:   binary.BigEndian.Uint32(body[2:6]),
+	}}
+	if length >= helloFrameSizeLength {
+		ret.maxFrameSize = int(binary.BigEndian.Uint32(body[6:10]))
+		if ret.maxFrameSize == 0 {
+			return nil, nil, errors.New("the other party announced a zero frame size")
+		}
+		for fields := body[helloFrameSizeLength:]; len(fields) != 0; {
+			if len(fields) < 2 || len(fields) < 2+int(fields[1]) {
+				return nil, nil, errors.New("hello field too long")
+			}
+			tag, value := fields[0], fields[2:2+int(fields[1])]
+			fields = fields[2+len(value):]
+			if tag == helloTicket {
+				ret.ticket = value
+			}
+		}
+	}
+	return raw, ret, nil
+}
+
+// negotiate returns the version, the features and the largest frame size
+// that two parties with the given hellos will use. A party that did not
+// announce a frame size is assumed to use the same one as we do.
+func negotiate(ours, theirs *hello) (uint8, uint32, int, error) {
+	version := ours.MaxVersion
+	if theirs.MaxVersion < version {
+		version = theirs.MaxVersion
+	}
+	if version < ours.MinVersion || version < theirs.MinVersion {
+		return 0, 0, 0, fmt.Errorf("no common transport version (we support %d-%d, they support %d-%d)",
+			ours.MinVersion, ours.MaxVersion, theirs.MinVersion, theirs.MaxVersion)
+	}
+	maxFrameSize := ours.maxFrameSize
+	if theirs.maxFrameSize != 0 && theirs.maxFrameSize < maxFrameSize {
+		maxFrameSize = theirs.maxFrameSize
+	}
+	if maxFrameSize < handshakeFrameSize {
+		return 0, 0, 0, fmt.Errorf("frame size %d is too small for the handshake", maxFrameSize)
+	}
+	return version, ours.Features & theirs.Features, maxFrameSize, nil
+}